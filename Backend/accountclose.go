@@ -0,0 +1,140 @@
+// accountclose.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A closed account keeps its transactions and shows up in history, but
+// takes no transactions dated after its close and is left out of account
+// listings unless ?include_closed=true. From the close on it no longer
+// counts towards net worth; net worth snapshots already taken for later
+// days are corrected, so the history is accurate whenever the close is
+// dated.
+
+// --- MODELS ---
+
+// AccountClosure is the optional body of the close route; closed_on
+// (YYYY-MM-DD) defaults to today.
+type AccountClosure struct {
+	ClosedOn string `json:"closed_on"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// shiftNetWorthSnapshots adds the base-currency balance of a to its owner's
+// snapshots dated after day, or takes it off when sign is -1. An account
+// with no exchange rate was never counted.
+func shiftNetWorthSnapshots(q queryer, a Account, day time.Time, sign float64) error {
+	if a.BaseBalance == nil {
+		return nil
+	}
+	column := "assets"
+	amount := sign * *a.BaseBalance
+	if isLiability(a.Type) {
+		column, amount = "liabilities", -amount
+	}
+	_, err := q.Exec("UPDATE net_worth_snapshots SET "+column+" = "+column+" + $1 WHERE user_id = $2 AND date > $3", amount, a.UserID, day)
+	return err
+}
+
+// --- ACCOUNT CLOSE HANDLERS ---
+
+// CloseAccount closes an account as of closed_on. It must have no
+// transactions dated later.
+func CloseAccount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	var c AccountClosure
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	now := time.Now()
+	closedOn := dateOnly(now, now.Location())
+	if c.ClosedOn != "" {
+		if closedOn, err = time.Parse("2006-01-02", c.ClosedOn); err != nil || closedOn.After(now) {
+			respondWithError(w, http.StatusBadRequest, "'closed_on' must be a date no later than today")
+			return
+		}
+	}
+	a, err := loadAccount(dbFor(r), accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return
+	}
+	if a.ClosedAt != nil {
+		respondWithError(w, http.StatusConflict, "Account is already closed")
+		return
+	}
+	var later bool
+	err = dbFor(r).QueryRow("SELECT EXISTS (SELECT 1 FROM transactions WHERE account_id=$1 AND deleted_at IS NULL AND date >= $2)",
+		accountID, closedOn.AddDate(0, 0, 1)).Scan(&later)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check account transactions")
+		return
+	}
+	if later {
+		respondWithError(w, http.StatusConflict, "The account has transactions after "+closedOn.Format("2006-01-02"))
+		return
+	}
+	err = withTx(r, func(q queryer) error {
+		if _, err := q.Exec("UPDATE accounts SET closed_at = $1 WHERE id = $2", closedOn, accountID); err != nil {
+			return err
+		}
+		return shiftNetWorthSnapshots(q, a, closedOn, -1)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to close account")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Account closed successfully"})
+}
+
+// ReopenAccount reopens a closed account and restores it to the net worth
+// snapshots taken since it closed.
+func ReopenAccount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	a, err := loadAccount(dbFor(r), accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return
+	}
+	if a.ClosedAt == nil {
+		respondWithError(w, http.StatusConflict, "Account is not closed")
+		return
+	}
+	err = withTx(r, func(q queryer) error {
+		if _, err := q.Exec("UPDATE accounts SET closed_at = NULL WHERE id = $1", accountID); err != nil {
+			return err
+		}
+		return shiftNetWorthSnapshots(q, a, *a.ClosedAt, 1)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reopen account")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Account reopened successfully"})
+}
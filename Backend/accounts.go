@@ -0,0 +1,359 @@
+// accounts.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Accounts are where a user's money is held, or owed: bank accounts, credit
+// cards, cash, investments and loans. A transaction can name the account it moved through, and an
+// account's balance is its opening balance less the transactions on it, so
+// an expense (positive amount) lowers it and income raises it. Credit card
+// balances go negative as the card is used.
+
+// Account types.
+const (
+	accountChecking   = "checking"
+	accountSavings    = "savings"
+	accountCreditCard = "credit_card"
+	accountCash       = "cash"
+	// Assets and liabilities such as a house, a car or a private loan are
+	// tracked at a manually entered value instead of by transactions.
+	accountAsset     = "asset"
+	accountLiability = "liability"
+	// Investment accounts hold cash like a bank account plus the securities
+	// in their holdings.
+	accountInvestment = "investment"
+	// Loan accounts start at the amount borrowed, owed as a negative opening
+	// balance, and are paid down on a fixed schedule.
+	accountLoan = "loan"
+)
+
+// liabilityTypesSQL lists the account types whose balance is owed.
+const liabilityTypesSQL = `('credit_card', 'liability', 'loan')`
+
+// accountAmountSQL is what the transaction aliased t takes off the balance
+// of the account aliased a, in the account's currency: the amount charged
+// where the transaction was made in it, otherwise the base-currency amount
+// converted at the account currency's rate (unconverted if it has none).
+const accountAmountSQL = `CASE WHEN t.currency = a.currency THEN COALESCE(t.original_amount, t.amount)
+                ELSE t.amount / COALESCE(` + exchangeRateSQL + `, 1) END`
+
+// accountSelectSQL selects accounts aliased a with their balances, for
+// scanAccount; callers add the WHERE clause and "GROUP BY a.id". The cleared
+// balance leaves out pending transactions, so it should match the bank's own
+// figure. A manual-value account's balance is its value, negative for a
+// liability, and an investment account's includes its holdings. Balances
+// are in the account's currency; exchange_rate converts them to the owner's
+// base currency.
+const accountSelectSQL = `SELECT a.id, a.user_id, a.name, a.type, a.institution, a.currency, a.opening_balance, a.statement_day, a.payment_due_days,
+            a.manual_value, a.interest_rate, a.term_months, a.first_payment_date, a.closed_at, (SELECT u.base_currency FROM users u WHERE u.id = a.user_id) AS base_currency,
+            ` + exchangeRateSQL + ` AS exchange_rate, ` + holdingsValueSQL + ` AS holdings_value,
+            CASE a.type WHEN 'asset' THEN a.manual_value WHEN 'liability' THEN -a.manual_value
+                ELSE a.opening_balance - COALESCE(SUM(` + accountAmountSQL + `), 0) + ` + holdingsValueSQL + ` END AS balance,
+            CASE a.type WHEN 'asset' THEN a.manual_value WHEN 'liability' THEN -a.manual_value
+                ELSE a.opening_balance - COALESCE(SUM(` + accountAmountSQL + `) FILTER (WHERE t.status <> 'pending'), 0) + ` + holdingsValueSQL + `
+            END AS cleared_balance
+        FROM accounts a
+        LEFT JOIN transactions t ON t.account_id = a.id AND t.deleted_at IS NULL`
+
+// accountLedgerSQL stands in for the transactions table in listings
+// filtered by account: it selects every transaction on the account in
+// parameter $%d, deleted ones included, with the account's balance after
+// each live one in date order.
+const accountLedgerSQL = `(SELECT t.*, CASE WHEN t.deleted_at IS NULL THEN
+                a.opening_balance - SUM(` + accountAmountSQL + `) FILTER (WHERE t.deleted_at IS NULL) OVER (ORDER BY t.date, t.id)
+            END AS running_balance
+        FROM transactions t JOIN accounts a ON a.id = t.account_id
+        WHERE t.account_id = $%d) transactions`
+
+// --- MODELS ---
+type Account struct {
+	ID             int     `json:"id"`
+	UserID         int     `json:"user_id"`
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	Institution    string  `json:"institution"`
+	Currency       string  `json:"currency"`
+	OpeningBalance float64 `json:"opening_balance"`
+	// StatementDay (1-31, clamped to short months) and PaymentDueDays set up
+	// a credit card's statement cycle: each statement closes on that day and
+	// is due that many days later.
+	StatementDay   *int `json:"statement_day,omitempty"`
+	PaymentDueDays *int `json:"payment_due_days,omitempty"`
+	// ManualValue is what an asset is worth or a liability owes, both
+	// positive. Only those two types have one, and they have no transactions.
+	ManualValue *float64 `json:"manual_value,omitempty"`
+	// InterestRate (annual, in percent), TermMonths and FirstPaymentDate are
+	// a loan's terms; it is repaid in TermMonths equal monthly payments,
+	// the first on FirstPaymentDate.
+	InterestRate     *float64   `json:"interest_rate,omitempty"`
+	TermMonths       *int       `json:"term_months,omitempty"`
+	FirstPaymentDate *time.Time `json:"first_payment_date,omitempty"`
+	// ClosedAt is the last day of a closed account.
+	ClosedAt *time.Time `json:"closed_at,omitempty"`
+	// Balance and ClearedBalance are calculated on reads, in the account's
+	// currency, and include HoldingsValue, the market value of an investment
+	// account's holdings. BaseBalance is Balance in the owner's base currency
+	// at ExchangeRate, and is missing when no rate is known.
+	HoldingsValue  float64  `json:"holdings_value,omitempty"`
+	Balance        float64  `json:"balance"`
+	ClearedBalance float64  `json:"cleared_balance"`
+	BaseCurrency   string   `json:"base_currency"`
+	ExchangeRate   *float64 `json:"exchange_rate,omitempty"`
+	BaseBalance    *float64 `json:"base_balance,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// isLiability reports whether accounts of type t hold what is owed.
+func isLiability(t string) bool {
+	return t == accountCreditCard || t == accountLiability || t == accountLoan
+}
+
+func validateAccount(w http.ResponseWriter, a *Account) bool {
+	a.Name = strings.TrimSpace(a.Name)
+	isLoan := a.Type == accountLoan
+	switch {
+	case a.Name == "":
+		respondWithError(w, http.StatusBadRequest, "Account name is required")
+	case a.Type != accountChecking && a.Type != accountSavings && a.Type != accountCreditCard && a.Type != accountCash &&
+		a.Type != accountAsset && a.Type != accountLiability && a.Type != accountInvestment && !isLoan:
+		respondWithError(w, http.StatusBadRequest, "Type must be 'checking', 'savings', 'credit_card', 'cash', 'asset', 'liability', 'investment' or 'loan'")
+	case (a.Type == accountAsset || a.Type == accountLiability) != (a.ManualValue != nil):
+		respondWithError(w, http.StatusBadRequest, "manual_value is required for, and only allowed on, 'asset' and 'liability' accounts")
+	case a.ManualValue != nil && *a.ManualValue < 0:
+		respondWithError(w, http.StatusBadRequest, "manual_value cannot be negative")
+	case (a.StatementDay != nil || a.PaymentDueDays != nil) && a.Type != accountCreditCard:
+		respondWithError(w, http.StatusBadRequest, "Only credit cards have a statement cycle")
+	case (a.StatementDay == nil) != (a.PaymentDueDays == nil):
+		respondWithError(w, http.StatusBadRequest, "statement_day and payment_due_days must be provided together")
+	case a.StatementDay != nil && (*a.StatementDay < 1 || *a.StatementDay > 31):
+		respondWithError(w, http.StatusBadRequest, "statement_day must be between 1 and 31")
+	case a.PaymentDueDays != nil && (*a.PaymentDueDays < 0 || *a.PaymentDueDays > 90):
+		respondWithError(w, http.StatusBadRequest, "payment_due_days must be between 0 and 90")
+	case isLoan != (a.InterestRate != nil) || isLoan != (a.TermMonths != nil) || isLoan != (a.FirstPaymentDate != nil):
+		respondWithError(w, http.StatusBadRequest, "interest_rate, term_months and first_payment_date are required for, and only allowed on, 'loan' accounts")
+	case isLoan && a.OpeningBalance >= 0:
+		respondWithError(w, http.StatusBadRequest, "A loan's opening_balance is the amount borrowed, as a negative number")
+	case isLoan && (*a.InterestRate < 0 || *a.InterestRate > 100):
+		respondWithError(w, http.StatusBadRequest, "interest_rate must be between 0 and 100")
+	case isLoan && (*a.TermMonths < 1 || *a.TermMonths > 600):
+		respondWithError(w, http.StatusBadRequest, "term_months must be between 1 and 600")
+	default:
+		return true
+	}
+	return false
+}
+
+func scanAccount(row interface{ Scan(...interface{}) error }, a *Account) error {
+	err := row.Scan(&a.ID, &a.UserID, &a.Name, &a.Type, &a.Institution, &a.Currency, &a.OpeningBalance, &a.StatementDay, &a.PaymentDueDays,
+		&a.ManualValue, &a.InterestRate, &a.TermMonths, &a.FirstPaymentDate, &a.ClosedAt, &a.BaseCurrency, &a.ExchangeRate, &a.HoldingsValue, &a.Balance, &a.ClearedBalance)
+	if err == nil && a.ExchangeRate != nil {
+		base := math.Round(a.Balance**a.ExchangeRate*100) / 100
+		a.BaseBalance = &base
+	}
+	return err
+}
+
+func loadAccount(q queryer, id int) (Account, error) {
+	var a Account
+	err := scanAccount(q.QueryRow(accountSelectSQL+" WHERE a.id = $1 GROUP BY a.id", id), &a)
+	return a, err
+}
+
+// transactionSource returns the select list and source of a transaction
+// listing, and the arguments to go with them. A listing filtered by
+// account_id reads the account's ledger, which adds running_balance after
+// the transaction columns; running is then true.
+func transactionSource(query url.Values, args []interface{}) (columns, source string, sourceArgs []interface{}, running bool) {
+	accountID, err := strconv.Atoi(query.Get("account_id"))
+	if err != nil {
+		return transactionColumns, "transactions", args, false
+	}
+	args = append(args, accountID)
+	return transactionColumns + ", running_balance", fmt.Sprintf(accountLedgerSQL, len(args)), args, true
+}
+
+// authorizeAccount rejects accounts outside the given user's ledger,
+// manual-value accounts, which take no transactions, and closed accounts
+// for transactions dated after they closed. A nil accountID is not checked.
+func authorizeAccount(w http.ResponseWriter, accountID *int, ownerID int, date time.Time) bool {
+	if accountID == nil {
+		return true
+	}
+	var owner int
+	var manual bool
+	var closedAt *time.Time
+	err := db.QueryRow("SELECT user_id, manual_value IS NOT NULL, closed_at FROM accounts WHERE id=$1", *accountID).Scan(&owner, &manual, &closedAt)
+	if err == sql.ErrNoRows || (err == nil && owner != ownerID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid account")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify account")
+		return false
+	}
+	if manual {
+		respondWithError(w, http.StatusBadRequest, "Manual-value accounts cannot have transactions")
+		return false
+	}
+	if closedAt != nil && dateOnly(date, closedAt.Location()).After(*closedAt) {
+		respondWithError(w, http.StatusBadRequest, "The account was closed on "+closedAt.Format("2006-01-02")+" and takes no later transactions")
+		return false
+	}
+	return true
+}
+
+// --- ACCOUNT HANDLERS ---
+
+// CreateAccount adds an account. The currency defaults to the owner's base
+// currency.
+func CreateAccount(w http.ResponseWriter, r *http.Request) {
+	var a Account
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &a.UserID) || !validateAccount(w, &a) {
+		return
+	}
+	a.Currency = strings.ToUpper(strings.TrimSpace(a.Currency))
+	if a.Currency == "" {
+		base, err := baseCurrency(dbFor(r), a.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up base currency")
+			return
+		}
+		a.Currency = base
+	} else if !currencyCodePattern.MatchString(a.Currency) {
+		respondWithError(w, http.StatusBadRequest, "Currency must be a three-letter ISO 4217 code")
+		return
+	}
+	err := dbFor(r).QueryRow(`INSERT INTO accounts (user_id, name, type, institution, currency, opening_balance, statement_day, payment_due_days,
+            manual_value, interest_rate, term_months, first_payment_date)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`,
+		a.UserID, a.Name, a.Type, a.Institution, a.Currency, a.OpeningBalance, a.StatementDay, a.PaymentDueDays, a.ManualValue,
+		a.InterestRate, a.TermMonths, a.FirstPaymentDate).Scan(&a.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create account. An account with this name may already exist.")
+		return
+	}
+	if a, err = loadAccount(dbFor(r), a.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, a)
+}
+
+// GetAccounts lists a user's accounts with their current balances. Closed
+// accounts are left out unless ?include_closed=true.
+func GetAccounts(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	query := accountSelectSQL + " WHERE a.user_id = $1"
+	if r.URL.Query().Get("include_closed") != "true" {
+		query += " AND a.closed_at IS NULL"
+	}
+	rows, err := dbFor(r).Query(query+" GROUP BY a.id ORDER BY a.name, a.id", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve accounts")
+		return
+	}
+	defer rows.Close()
+	accounts := []Account{}
+	for rows.Next() {
+		var a Account
+		if err := scanAccount(rows, &a); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan account")
+			return
+		}
+		accounts = append(accounts, a)
+	}
+	respondWithJSON(w, http.StatusOK, accounts)
+}
+
+// GetAccountBalance returns one account with its current and cleared
+// balances.
+func GetAccountBalance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	a, err := loadAccount(dbFor(r), accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, a)
+}
+
+// UpdateAccount changes an account's details. Its currency is fixed once
+// created, since its transactions are recorded against it.
+func UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	var a Account
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !validateAccount(w, &a) {
+		return
+	}
+	_, err = dbFor(r).Exec(`UPDATE accounts SET name=$1, type=$2, institution=$3, opening_balance=$4, statement_day=$5, payment_due_days=$6,
+            manual_value=$7, interest_rate=$8, term_months=$9, first_payment_date=$10
+        WHERE id=$11`, a.Name, a.Type, a.Institution, a.OpeningBalance, a.StatementDay, a.PaymentDueDays, a.ManualValue,
+		a.InterestRate, a.TermMonths, a.FirstPaymentDate, accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update account. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Account updated successfully"})
+}
+
+// DeleteAccount removes an account. Its transactions are kept without one.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	if _, err := dbFor(r).Exec("DELETE FROM accounts WHERE id=$1", accountID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete account")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Account deleted successfully"})
+}
@@ -0,0 +1,127 @@
+// activity.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A budget's activity is read from the audit log: changes to the budget
+// itself, members joining and leaving, and changes to the transactions that
+// count towards it. Share recipients only see transactions if their share
+// includes them, and then only those the shared budget's views show them:
+// live transactions that count towards it.
+
+// activityTypes names each audited resource and action as an activity.
+var activityTypes = map[string]map[string]string{
+	"budget":        {auditCreate: "budget_created", auditUpdate: "budget_updated", auditDelete: "budget_deleted"},
+	"transaction":   {auditCreate: "transaction_added", auditUpdate: "transaction_updated", auditDelete: "transaction_deleted"},
+	"budget_member": {auditCreate: "member_joined", auditUpdate: "member_role_changed", auditDelete: "member_left"},
+}
+
+// --- MODELS ---
+type ActivityEvent struct {
+	ID         int             `json:"id"`
+	Type       string          `json:"type"`
+	Resource   string          `json:"resource"`
+	ResourceID int             `json:"resource_id"`
+	ActorID    *int            `json:"actor_id"`
+	Actor      *string         `json:"actor,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// --- ACTIVITY HANDLERS ---
+
+// GetBudgetActivity returns a budget's activity since it was created, newest
+// first, paginated with ?page and ?per_page.
+func GetBudgetActivity(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	page, perPage, err := parsePagination(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	u, _ := currentUser(r)
+	ref, err := loadResource("budget", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+
+	// Transactions count towards an organization budget if they are the
+	// organization's, and towards a personal one if they belong to its
+	// owner or members.
+	ledger := `a.organization_id IS NULL AND (a.owner_id = $1 OR a.owner_id IN (
+            SELECT user_id FROM budget_members WHERE budget_id = $2 AND accepted_at IS NOT NULL))`
+	ledgerOwner := ref.OwnerID
+	showTransactions := true
+	if ref.OrgID.Valid {
+		ledger, ledgerOwner = "a.organization_id = $1", int(ref.OrgID.Int64)
+	} else if !canAccess(u, ref.OwnerID) {
+		member, err := isBudgetMember(budgetID, u.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to verify budget membership")
+			return
+		}
+		if !member {
+			err = db.QueryRow("SELECT COALESCE(BOOL_OR(show_transactions), FALSE) FROM shared_budgets WHERE budget_id=$1 AND to_user_id=$2",
+				budgetID, u.ID).Scan(&showTransactions)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to verify share")
+				return
+			}
+			ledger = `a.resource_id IN (SELECT transaction_id FROM transaction_lines
+                WHERE ` + budgetLedgerSQL("$2") + ` AND NOT excluded)`
+		}
+	}
+	where := `((a.resource = 'budget' AND a.resource_id = $2)
+            OR (a.resource = 'budget_member' AND (COALESCE(a.after, a.before)->>'budget_id')::integer = $2)
+            OR ($3 AND a.resource = 'transaction' AND ` + ledger + `))
+        AND a.created_at >= COALESCE((SELECT MIN(created_at) FROM audit_log WHERE resource = 'budget' AND resource_id = $2), '-infinity')`
+	args := []interface{}{ledgerOwner, budgetID, showTransactions}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_log a WHERE "+where, args...).Scan(&total); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve activity")
+		return
+	}
+	rows, err := db.Query(`SELECT a.id, a.resource, a.resource_id, a.action, a.actor_id, u.username, a.before, a.after, a.created_at
+        FROM audit_log a LEFT JOIN users u ON u.id = a.actor_id
+        WHERE `+where+`
+        ORDER BY a.created_at DESC, a.id DESC
+        LIMIT $4 OFFSET $5`, append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve activity")
+		return
+	}
+	defer rows.Close()
+	events := []ActivityEvent{}
+	for rows.Next() {
+		var e ActivityEvent
+		var action string
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.Resource, &e.ResourceID, &action, &e.ActorID, &e.Actor, &before, &after, &e.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan activity")
+			return
+		}
+		e.Type = activityTypes[e.Resource][action]
+		e.Before, e.After = before, after
+		events = append(events, e)
+	}
+	setPaginationHeaders(w, total, page, perPage)
+	respondWithJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,398 @@
+// allocations.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Zero-based budgeting: every unit of income is assigned to a category for a
+// month. Income is personal money coming in, i.e. negative amounts that are
+// not refunds. The pool still to be budgeted is cumulative, so income left
+// unassigned in one month is available in the next.
+
+// --- MODELS ---
+type CategoryAllocation struct {
+	CategoryID int     `json:"category_id"`
+	Category   string  `json:"category"`
+	Amount     float64 `json:"amount"`
+	Spent      float64 `json:"spent"`
+}
+
+type AllocationSummary struct {
+	Month        string               `json:"month"` // YYYY-MM
+	Income       float64              `json:"income"`
+	Available    float64              `json:"available"` // all income up to the end of the month
+	Allocated    float64              `json:"allocated"` // all allocations up to and including the month
+	ToBeBudgeted float64              `json:"to_be_budgeted"`
+	Allocations  []CategoryAllocation `json:"allocations"`
+	Warnings     []string             `json:"warnings"`
+}
+
+// AllocationRequest sets a category's allocation for a month. With Force, an
+// allocation larger than the funds left to budget is accepted and reported
+// as a warning instead of rejected.
+type AllocationRequest struct {
+	Month      string  `json:"month"`
+	CategoryID int     `json:"category_id"`
+	Amount     float64 `json:"amount"`
+	Force      bool    `json:"force"`
+}
+
+// ReallocationRequest moves Amount of a month's allocation from one category
+// to another. Month defaults to the current month.
+type ReallocationRequest struct {
+	Month          string  `json:"month"`
+	FromCategoryID int     `json:"from_category_id"`
+	ToCategoryID   int     `json:"to_category_id"`
+	Amount         float64 `json:"amount"`
+}
+
+type AllocationMovement struct {
+	ID             int       `json:"id"`
+	UserID         int       `json:"user_id"`
+	BudgetID       *int      `json:"budget_id"`
+	Month          string    `json:"month"`
+	FromCategoryID *int      `json:"from_category_id"`
+	ToCategoryID   *int      `json:"to_category_id"`
+	Amount         float64   `json:"amount"`
+	MovedBy        *int      `json:"moved_by"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// parseMonth parses YYYY-MM, defaulting to the current month when empty.
+func parseMonth(v string) (time.Time, error) {
+	if v == "" {
+		return monthStart(time.Now()), nil
+	}
+	return time.Parse("2006-01", v)
+}
+
+// allocationSummary builds the zero-based budget of userID for month.
+func allocationSummary(userID int, month time.Time) (AllocationSummary, error) {
+	next := month.AddDate(0, 1, 0)
+	s := AllocationSummary{Month: month.Format("2006-01"), Allocations: []CategoryAllocation{}, Warnings: []string{}}
+	err := db.QueryRow(`
+        SELECT COALESCE(-SUM(amount) FILTER (WHERE date >= $2), 0), COALESCE(-SUM(amount), 0)
+        FROM transactions
+        WHERE user_id = $1 AND organization_id IS NULL AND deleted_at IS NULL
+          AND amount < 0 AND linked_transaction_id IS NULL AND date < $3`,
+		userID, month, next).Scan(&s.Income, &s.Available)
+	if err != nil {
+		return s, err
+	}
+	err = db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM category_allocations WHERE user_id=$1 AND month <= $2",
+		userID, month).Scan(&s.Allocated)
+	if err != nil {
+		return s, err
+	}
+	s.ToBeBudgeted = math.Round((s.Available-s.Allocated)*100) / 100
+
+	rows, err := db.Query(`
+        SELECT a.category_id, c.name, a.amount,
+            COALESCE((SELECT SUM(l.amount) FROM transaction_lines l
+                WHERE l.category_id = a.category_id AND l.user_id = a.user_id AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3), 0)
+        FROM category_allocations a
+        JOIN categories c ON c.id = a.category_id
+        WHERE a.user_id = $1 AND a.month = $2
+        ORDER BY c.name`, userID, month, next)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a CategoryAllocation
+		if err := rows.Scan(&a.CategoryID, &a.Category, &a.Amount, &a.Spent); err != nil {
+			return s, err
+		}
+		if a.Spent > a.Amount {
+			s.Warnings = append(s.Warnings, fmt.Sprintf("%s is overspent by %.2f", a.Category, a.Spent-a.Amount))
+		}
+		s.Allocations = append(s.Allocations, a)
+	}
+	if s.ToBeBudgeted < 0 {
+		s.Warnings = append(s.Warnings, fmt.Sprintf("Allocations exceed available funds by %.2f", -s.ToBeBudgeted))
+	}
+	return s, rows.Err()
+}
+
+// setAllocation stores a category's allocation for a month, removing it when
+// amount is zero, and responds with the updated summary. Unless force is
+// set, it refuses to assign more than is left to budget.
+func setAllocation(w http.ResponseWriter, userID int, month time.Time, categoryID int, amount float64, force bool) {
+	var current float64
+	err := db.QueryRow("SELECT COALESCE((SELECT amount FROM category_allocations WHERE user_id=$1 AND category_id=$2 AND month=$3), 0)",
+		userID, categoryID, month).Scan(&current)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve allocation")
+		return
+	}
+	before, err := allocationSummary(userID, month)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate funds to budget")
+		return
+	}
+	// Compared in cents so assigning exactly what is left never trips this.
+	if increase := math.Round((amount - current) * 100); increase > 0 && increase > math.Round(before.ToBeBudgeted*100) && !force {
+		respondWithError(w, http.StatusConflict,
+			fmt.Sprintf("Only %.2f is left to budget; send \"force\": true to allocate anyway", math.Max(before.ToBeBudgeted, 0)))
+		return
+	}
+	if amount == 0 {
+		_, err = db.Exec("DELETE FROM category_allocations WHERE user_id=$1 AND category_id=$2 AND month=$3", userID, categoryID, month)
+	} else {
+		_, err = db.Exec(`INSERT INTO category_allocations (user_id, category_id, month, amount) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (user_id, category_id, month) DO UPDATE SET amount = EXCLUDED.amount`, userID, categoryID, month, amount)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save allocation")
+		return
+	}
+	summary, err := allocationSummary(userID, month)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate funds to budget")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, summary)
+}
+
+// decodeAllocation reads an AllocationRequest for the user in the path and
+// checks its month and category.
+func decodeAllocation(w http.ResponseWriter, r *http.Request) (int, time.Time, AllocationRequest, bool) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return 0, time.Time{}, AllocationRequest{}, false
+	}
+	if !authorizeOwner(w, r, userID) {
+		return 0, time.Time{}, AllocationRequest{}, false
+	}
+	var req AllocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CategoryID == 0 || req.Amount < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return 0, time.Time{}, AllocationRequest{}, false
+	}
+	month, err := parseMonth(req.Month)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'month'; use YYYY-MM")
+		return 0, time.Time{}, AllocationRequest{}, false
+	}
+	if !authorizeCategory(w, req.CategoryID, resourceRef{OwnerID: userID}) || !authorizeAllocationUnlocked(w, r, userID, month) {
+		return 0, time.Time{}, AllocationRequest{}, false
+	}
+	return userID, month, req, true
+}
+
+// --- ALLOCATION HANDLERS ---
+
+// GetAllocations returns the zero-based budget for ?month= (YYYY-MM,
+// default: the current month).
+func GetAllocations(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	month, err := parseMonth(r.URL.Query().Get("month"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'month'; use YYYY-MM")
+		return
+	}
+	summary, err := allocationSummary(userID, month)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate funds to budget")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, summary)
+}
+
+// SetAllocation sets how much of a month's funds go to a category.
+func SetAllocation(w http.ResponseWriter, r *http.Request) {
+	userID, month, req, ok := decodeAllocation(w, r)
+	if !ok {
+		return
+	}
+	setAllocation(w, userID, month, req.CategoryID, req.Amount, req.Force)
+}
+
+// AssignRemaining adds everything left to budget to a category's
+// allocation for the month. The amount in the body is ignored.
+func AssignRemaining(w http.ResponseWriter, r *http.Request) {
+	userID, month, req, ok := decodeAllocation(w, r)
+	if !ok {
+		return
+	}
+	summary, err := allocationSummary(userID, month)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate funds to budget")
+		return
+	}
+	if summary.ToBeBudgeted <= 0 {
+		respondWithError(w, http.StatusConflict, "Nothing is left to budget")
+		return
+	}
+	var current float64
+	for _, a := range summary.Allocations {
+		if a.CategoryID == req.CategoryID {
+			current = a.Amount
+		}
+	}
+	setAllocation(w, userID, month, req.CategoryID, current+summary.ToBeBudgeted, false)
+}
+
+// Reallocate moves money between two of the budget owner's category
+// allocations for a month within the budget's current period. Both
+// allocations change together or not at all, and the movement is kept,
+// and audited, as an allocation_movement.
+func Reallocate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetEdit(w, r, budgetID) {
+		return
+	}
+	var b Budget
+	err = scanBudget(db.QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &b)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if b.OrganizationID != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Category allocations are only kept for personal budgets")
+		return
+	}
+	var req ReallocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FromCategoryID == 0 || req.ToCategoryID == 0 || req.Amount <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.FromCategoryID == req.ToCategoryID {
+		respondWithError(w, http.StatusBadRequest, "Cannot move money to the same category")
+		return
+	}
+	month, err := parseMonth(req.Month)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'month'; use YYYY-MM")
+		return
+	}
+	now := time.Now()
+	start, end, err := budgetPeriod(b, now)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, now.Location())
+	if !month.Before(end) || !month.AddDate(0, 1, 0).After(start) {
+		respondWithError(w, http.StatusBadRequest, "'month' is outside the budget's current period")
+		return
+	}
+	owner := resourceRef{OwnerID: b.UserID}
+	if !authorizeCategory(w, req.FromCategoryID, owner) || !authorizeCategory(w, req.ToCategoryID, owner) ||
+		!authorizeAllocationUnlocked(w, r, b.UserID, month) {
+		return
+	}
+
+	u, _ := currentUser(r)
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to move allocation")
+		return
+	}
+	defer tx.Rollback()
+	var available float64
+	err = tx.QueryRow("SELECT amount FROM category_allocations WHERE user_id=$1 AND category_id=$2 AND month=$3 FOR UPDATE",
+		b.UserID, req.FromCategoryID, month).Scan(&available)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve allocation")
+		return
+	}
+	if math.Round(req.Amount*100) > math.Round(available*100) {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("Only %.2f is allocated to the source category", available))
+		return
+	}
+	if math.Round(req.Amount*100) == math.Round(available*100) {
+		_, err = tx.Exec("DELETE FROM category_allocations WHERE user_id=$1 AND category_id=$2 AND month=$3", b.UserID, req.FromCategoryID, month)
+	} else {
+		_, err = tx.Exec("UPDATE category_allocations SET amount = amount - $1 WHERE user_id=$2 AND category_id=$3 AND month=$4",
+			req.Amount, b.UserID, req.FromCategoryID, month)
+	}
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO category_allocations (user_id, category_id, month, amount) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (user_id, category_id, month) DO UPDATE SET amount = category_allocations.amount + EXCLUDED.amount`,
+			b.UserID, req.ToCategoryID, month, req.Amount)
+	}
+	var movementID int
+	if err == nil {
+		err = tx.QueryRow(`INSERT INTO allocation_movements (user_id, budget_id, month, from_category_id, to_category_id, amount, moved_by)
+            VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			b.UserID, budgetID, month, req.FromCategoryID, req.ToCategoryID, req.Amount, u.ID).Scan(&movementID)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to move allocation")
+		return
+	}
+	writeAudit(tx, u.ID, "allocation_movement", movementID, auditCreate, nil)
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to move allocation")
+		return
+	}
+	summary, err := allocationSummary(b.UserID, month)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate funds to budget")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, summary)
+}
+
+// GetReallocations lists the money moved between allocations through a
+// budget, newest first.
+func GetReallocations(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	rows, err := db.Query(`SELECT id, user_id, budget_id, month, from_category_id, to_category_id, amount, moved_by, created_at
+        FROM allocation_movements WHERE budget_id=$1 ORDER BY created_at DESC, id DESC`, budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reallocations")
+		return
+	}
+	defer rows.Close()
+	movements := []AllocationMovement{}
+	for rows.Next() {
+		var m AllocationMovement
+		var month time.Time
+		if err := rows.Scan(&m.ID, &m.UserID, &m.BudgetID, &month, &m.FromCategoryID, &m.ToCategoryID, &m.Amount, &m.MovedBy, &m.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan reallocation")
+			return
+		}
+		m.Month = month.Format("2006-01")
+		movements = append(movements, m)
+	}
+	respondWithJSON(w, http.StatusOK, movements)
+}
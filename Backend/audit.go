@@ -0,0 +1,250 @@
+// audit.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+// auditTables maps each audited resource to its table.
+var auditTables = map[string]string{
+	"category":    "categories",
+	"transaction": "transactions",
+	"budget":      "budgets",
+	// Allocation movements are only ever created, by Reallocate.
+	"allocation_movement": "allocation_movements",
+	// Memberships are audited when they take effect and when they end.
+	"budget_member": "budget_members",
+}
+
+// --- MODELS ---
+type AuditEntry struct {
+	ID             int             `json:"id"`
+	Resource       string          `json:"resource"`
+	ResourceID     int             `json:"resource_id"`
+	Action         string          `json:"action"`
+	ActorID        *int            `json:"actor_id"`
+	OwnerID        *int            `json:"owner_id,omitempty"`
+	OrganizationID *int            `json:"organization_id,omitempty"`
+	Before         json.RawMessage `json:"before,omitempty"`
+	After          json.RawMessage `json:"after,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// snapshotResource returns the row as JSON, or nil if it cannot be read.
+func snapshotResource(q queryer, resource string, id int) []byte {
+	var snapshot []byte
+	err := q.QueryRow("SELECT row_to_json(x) FROM "+auditTables[resource]+" x WHERE id=$1", id).Scan(&snapshot)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to snapshot %s %d for audit: %v", resource, id, err)
+	}
+	return snapshot
+}
+
+// diffSnapshots reduces before/after rows to the fields that changed.
+func diffSnapshots(before, after []byte) ([]byte, []byte) {
+	var b, a map[string]interface{}
+	if json.Unmarshal(before, &b) != nil || json.Unmarshal(after, &a) != nil {
+		return before, after
+	}
+	changedBefore := map[string]interface{}{}
+	changedAfter := map[string]interface{}{}
+	for k, v := range a {
+		if !reflect.DeepEqual(b[k], v) {
+			changedBefore[k] = b[k]
+			changedAfter[k] = v
+		}
+	}
+	before, _ = json.Marshal(changedBefore)
+	after, _ = json.Marshal(changedAfter)
+	return before, after
+}
+
+// writeAudit records a change made by actorID. For creates and updates the
+// current row is read back as the "after" state. Failures are logged rather
+// than failing the change itself: inside a transaction the entry is written
+// under a savepoint, so a failed write is rolled back on its own instead of
+// aborting the transaction.
+func writeAudit(q queryer, actorID int, resource string, id int, action string, before []byte) {
+	tx, inTx := q.(*sql.Tx)
+	if inTx {
+		if _, err := tx.Exec("SAVEPOINT audit_entry"); err != nil {
+			log.Printf("Failed to write audit entry for %s %d: %v", resource, id, err)
+			return
+		}
+	}
+	if err := insertAuditEntry(q, actorID, resource, id, action, before); err != nil {
+		log.Printf("Failed to write audit entry for %s %d: %v", resource, id, err)
+		if inTx {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT audit_entry"); err != nil {
+				log.Printf("Failed to roll back audit entry for %s %d: %v", resource, id, err)
+			}
+		}
+		return
+	}
+	if inTx {
+		if _, err := tx.Exec("RELEASE SAVEPOINT audit_entry"); err != nil {
+			log.Printf("Failed to release audit savepoint for %s %d: %v", resource, id, err)
+		}
+	}
+}
+
+// insertAuditEntry does the work of writeAudit.
+func insertAuditEntry(q queryer, actorID int, resource string, id int, action string, before []byte) error {
+	var after []byte
+	if action != auditDelete {
+		after = snapshotResource(q, resource, id)
+	}
+	// Owner and organization come from whichever snapshot exists, so the
+	// trail stays readable after the resource is deleted.
+	var owner struct {
+		UserID         *int `json:"user_id"`
+		OrganizationID *int `json:"organization_id"`
+	}
+	if after != nil {
+		json.Unmarshal(after, &owner)
+	} else if before != nil {
+		json.Unmarshal(before, &owner)
+	}
+	if action == auditUpdate && before != nil && after != nil {
+		before, after = diffSnapshots(before, after)
+	}
+	var actor sql.NullInt64
+	if actorID != 0 {
+		actor = sql.NullInt64{Int64: int64(actorID), Valid: true}
+	}
+	_, err := q.Exec(`INSERT INTO audit_log (resource, resource_id, action, actor_id, owner_id, organization_id, before, after)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		resource, id, action, actor, owner.UserID, owner.OrganizationID, nullJSON(before), nullJSON(after))
+	return err
+}
+
+// recordAudit is writeAudit for the caller of r, within the request's
+// database handle.
+func recordAudit(r *http.Request, resource string, id int, action string, before []byte) {
+	actorID := 0
+	if u, ok := currentUser(r); ok {
+		actorID = u.ID
+	}
+	writeAudit(dbFor(r), actorID, resource, id, action, before)
+}
+
+// upsertAction names the audit action for an INSERT ... ON CONFLICT DO UPDATE,
+// given whether Postgres reported the row as freshly inserted (xmax = 0).
+func upsertAction(inserted bool) string {
+	if inserted {
+		return auditCreate
+	}
+	return auditUpdate
+}
+
+func nullJSON(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+// canReadAudit reports whether u may see the history of a resource: its
+// owner (or their parent), admins, members of the owning organization, and
+// users the owner shares budgets with.
+func canReadAudit(u *AuthUser, resource string, id int, ownerID, orgID sql.NullInt64) (bool, error) {
+	if u.Role == "admin" {
+		return true, nil
+	}
+	if orgID.Valid {
+		role, err := orgMemberRole(int(orgID.Int64), u.ID)
+		return role != "", err
+	}
+	if !ownerID.Valid {
+		return false, nil
+	}
+	if int(ownerID.Int64) == u.ID {
+		return true, nil
+	}
+	if parent, err := isParentOf(u.ID, int(ownerID.Int64)); err != nil || parent {
+		return parent, err
+	}
+	var shared bool
+	var err error
+	if resource == "budget" {
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM shared_budgets WHERE budget_id=$1 AND to_user_id=$2)", id, u.ID).Scan(&shared)
+	} else {
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM shared_budgets WHERE from_user_id=$1 AND to_user_id=$2)", ownerID.Int64, u.ID).Scan(&shared)
+	}
+	return shared, err
+}
+
+// --- AUDIT HANDLERS ---
+
+// GetAuditLog returns the change history of one resource:
+// GET /audit?resource=transaction&id=42
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	resource := r.URL.Query().Get("resource")
+	if _, ok := auditTables[resource]; !ok {
+		respondWithError(w, http.StatusBadRequest, "resource must be 'category', 'transaction', 'budget', 'allocation_movement' or 'budget_member'")
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid resource ID")
+		return
+	}
+
+	var ownerID, orgID sql.NullInt64
+	err = db.QueryRow(`SELECT owner_id, organization_id FROM audit_log
+        WHERE resource=$1 AND resource_id=$2 ORDER BY created_at DESC, id DESC LIMIT 1`, resource, id).Scan(&ownerID, &orgID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "No audit history for this resource")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve audit history")
+		return
+	}
+	allowed, err := canReadAudit(u, resource, id, ownerID, orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify access")
+		return
+	}
+	if !allowed {
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, resource, resource_id, action, actor_id, owner_id, organization_id, before, after, created_at
+        FROM audit_log WHERE resource=$1 AND resource_id=$2 ORDER BY created_at, id`, resource, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve audit history")
+		return
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.ID, &e.Resource, &e.ResourceID, &e.Action, &e.ActorID, &e.OwnerID, &e.OrganizationID, &before, &after, &e.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan audit entry")
+			return
+		}
+		e.Before, e.After = before, after
+		entries = append(entries, e)
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,319 @@
+// auth.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// AuthUser is the authenticated identity injected into the request context,
+// regardless of whether it came from a JWT or a session cookie.
+type AuthUser struct {
+	ID        int
+	Role      string
+	TokenID   string
+	Scope     string
+	ExpiresAt time.Time
+	// Generation is the user's token generation the JWT was issued in; see
+	// revocationStore.
+	Generation int64
+}
+
+type tokenClaims struct {
+	Role       string `json:"role"`
+	Generation int64  `json:"gen,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type contextKey string
+
+const (
+	userContextKey    contextKey = "authUser"
+	sessionCookieName            = "budgello_session"
+	authModeJWT                  = "jwt"
+	authModeSession              = "session"
+)
+
+var (
+	authMode  string
+	jwtSecret []byte
+)
+
+// initAuth reads the authentication configuration from the environment.
+// AUTH_MODE selects between bearer JWTs (default) and server-side cookie sessions.
+func initAuth() {
+	authMode = authModeJWT
+	if os.Getenv("AUTH_MODE") == authModeSession {
+		authMode = authModeSession
+	}
+
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtSecret) == 0 {
+		jwtSecret = []byte(randomToken())
+		log.Println("JWT_SECRET not set; generated an ephemeral secret. Tokens will not survive restarts.")
+	}
+	log.Printf("Authentication mode: %s", authMode)
+}
+
+func authTTL() time.Duration {
+	return time.Duration(getEnvInt("AUTH_TTL_HOURS", 24*30)) * time.Hour
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal("Failed to read random bytes:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// currentUser returns the authenticated user for the request, if any.
+func currentUser(r *http.Request) (*AuthUser, bool) {
+	u, ok := r.Context().Value(userContextKey).(*AuthUser)
+	return u, ok
+}
+
+// --- JWT ---
+
+func issueToken(userID int, role string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(authTTL())
+	gen, err := revocations.UserGeneration(userID, authTTL())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims := tokenClaims{
+		Role:       role,
+		Generation: gen,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomToken(),
+			Subject:   jwtSubject(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	return signed, expiresAt, err
+}
+
+func parseToken(tokenString string) (*AuthUser, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	userID, err := parseJWTSubject(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthUser{ID: userID, Role: claims.Role, TokenID: claims.ID, ExpiresAt: claims.ExpiresAt.Time, Generation: claims.Generation}, nil
+}
+
+func jwtSubject(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func parseJWTSubject(sub string) (int, error) {
+	id, ok := strings.CutPrefix(sub, "user:")
+	if !ok {
+		return 0, errors.New("invalid subject")
+	}
+	return strconv.Atoi(id)
+}
+
+// --- SESSIONS ---
+
+func createSession(w http.ResponseWriter, userID int) (time.Time, error) {
+	token := randomToken()
+	expiresAt := time.Now().Add(authTTL())
+	_, err := db.Exec("INSERT INTO sessions (id, user_id, expires_at) VALUES ($1, $2, $3)", hashToken(token), userID, expiresAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   os.Getenv("COOKIE_SECURE") == "true",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return expiresAt, nil
+}
+
+func lookupSession(token string) (*AuthUser, error) {
+	u := AuthUser{TokenID: hashToken(token)}
+	err := db.QueryRow(`
+        SELECT s.user_id, u.role, s.expires_at
+        FROM sessions s
+        JOIN users u ON u.id = s.user_id
+        WHERE s.id = $1 AND s.expires_at > NOW()`, u.TokenID).Scan(&u.ID, &u.Role, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   os.Getenv("COOKIE_SECURE") == "true",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func purgeExpiredSessions() error {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= NOW()")
+	return err
+}
+
+// --- MIDDLEWARE ---
+
+// authMiddleware resolves the caller's identity from a service account API
+// key or the configured credential and stores it in the request context. Requests without
+// credentials pass through anonymously; invalid credentials are rejected.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *AuthUser
+		var err error
+
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			user, err = lookupAPIKey(apiKey)
+			if err != nil && err != sql.ErrNoRows {
+				respondWithError(w, http.StatusInternalServerError, "Failed to verify API key")
+				return
+			}
+		} else if authMode == authModeSession {
+			cookie, cookieErr := r.Cookie(sessionCookieName)
+			if cookieErr != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			user, err = lookupSession(cookie.Value)
+			if err != nil && err != sql.ErrNoRows {
+				respondWithError(w, http.StatusInternalServerError, "Failed to load session")
+				return
+			}
+		} else {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			tokenString, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				respondWithError(w, http.StatusUnauthorized, "Invalid authorization header")
+				return
+			}
+			user, err = parseToken(tokenString)
+			if err == nil {
+				revoked, revErr := isTokenRevoked(user)
+				if revErr != nil {
+					respondWithError(w, http.StatusInternalServerError, "Failed to check token revocation")
+					return
+				}
+				if revoked {
+					respondWithError(w, http.StatusUnauthorized, "Token has been revoked")
+					return
+				}
+			}
+		}
+
+		if user == nil || err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid or expired credentials")
+			return
+		}
+		// Accounts awaiting erasure are frozen, whatever credential they
+		// present.
+		if pending, err := isPendingDeletion(user.ID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to verify account")
+			return
+		} else if pending {
+			respondWithError(w, http.StatusForbidden, "Account is scheduled for deletion")
+			return
+		}
+		if !scopeAllows(user.Scope, r) {
+			respondWithError(w, http.StatusForbidden, "This token is read-only")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// --- AUTH HANDLERS ---
+
+// issueCredentials establishes an authenticated session for the user using
+// the configured auth mode and returns the fields to merge into the login response.
+func issueCredentials(w http.ResponseWriter, userID int, role string) (map[string]interface{}, error) {
+	if authMode == authModeSession {
+		expiresAt, err := createSession(w, userID)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"expires_at": expiresAt}, nil
+	}
+	token, expiresAt, err := issueToken(userID, role)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"token": token, "expires_at": expiresAt}, nil
+}
+
+func LogoutUser(w http.ResponseWriter, r *http.Request) {
+	if authMode == authModeSession {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			if _, err := db.Exec("DELETE FROM sessions WHERE id=$1", hashToken(cookie.Value)); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to end session")
+				return
+			}
+		}
+		clearSessionCookie(w)
+	} else if u, ok := currentUser(r); ok {
+		if err := revocations.Revoke(u.TokenID, time.Until(u.ExpiresAt)); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Logout successful"})
+}
+
+// ForceLogoutUser lets an admin invalidate every outstanding credential for a user.
+func ForceLogoutUser(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if err := revokeAllUserCredentials(userID); err != nil {
+		log.Printf("Error revoking credentials for user %d: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to log out user")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "User logged out everywhere"})
+}
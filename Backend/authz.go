@@ -0,0 +1,307 @@
+// authz.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+const (
+	permissionView = "view"
+	permissionEdit = "edit"
+)
+
+// ownerQueries maps each protected resource to the query that loads its
+// owner and, for organization ledgers, the owning organization.
+var ownerQueries = map[string]string{
+	"category":               "SELECT COALESCE(user_id, 0), organization_id FROM categories WHERE id=$1",
+	"transaction":            "SELECT user_id, organization_id FROM transactions WHERE id=$1",
+	"budget":                 "SELECT user_id, organization_id FROM budgets WHERE id=$1",
+	"tag":                    "SELECT user_id, NULL::INTEGER FROM tags WHERE id=$1",
+	"payee":                  "SELECT user_id, NULL::INTEGER FROM payees WHERE id=$1",
+	"saved_view":             "SELECT user_id, NULL::INTEGER FROM saved_views WHERE id=$1",
+	"template":               "SELECT user_id, NULL::INTEGER FROM transaction_templates WHERE id=$1",
+	"subscription":           "SELECT user_id, NULL::INTEGER FROM subscriptions WHERE id=$1",
+	"budget_template":        "SELECT user_id, NULL::INTEGER FROM budget_templates WHERE id=$1",
+	"sinking_fund":           "SELECT user_id, NULL::INTEGER FROM sinking_funds WHERE id=$1",
+	"account":                "SELECT user_id, NULL::INTEGER FROM accounts WHERE id=$1",
+	"reconciliation_session": "SELECT user_id, NULL::INTEGER FROM reconciliation_sessions WHERE id=$1",
+	"holding":                "SELECT a.user_id, NULL::INTEGER FROM holdings h JOIN accounts a ON a.id = h.account_id WHERE h.id=$1",
+}
+
+// orgWriteRoles is the organization role needed to modify each resource.
+// Any member may record transactions; only org admins shape the ledger.
+var orgWriteRoles = map[string]string{
+	"category":    orgRoleAdmin,
+	"transaction": orgRoleMember,
+	"budget":      orgRoleAdmin,
+}
+
+// resourceRef identifies who a record belongs to. OrgID is set for records
+// in an organization ledger, in which case OwnerID is the member who created it,
+// and OwnerID is 0 for global categories.
+type resourceRef struct {
+	OwnerID int
+	OrgID   sql.NullInt64
+}
+
+// requireUser responds with 401 and returns false if the request is anonymous.
+func requireUser(w http.ResponseWriter, r *http.Request) (*AuthUser, bool) {
+	u, ok := currentUser(r)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return nil, false
+	}
+	return u, true
+}
+
+// adminOnly wraps a handler so that only admins can reach it.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		if u.Role != "admin" {
+			respondWithError(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// canAccess reports whether the caller may act on data owned by ownerID.
+func canAccess(u *AuthUser, ownerID int) bool {
+	return u.Role == "admin" || u.ID == ownerID
+}
+
+// authorizeOwner checks that the caller is ownerID, an admin, or ownerID's
+// parent, responding with 401/403 and returning false otherwise.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, ownerID int) bool {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return false
+	}
+	if canAccess(u, ownerID) {
+		return true
+	}
+	parent, err := isParentOf(u.ID, ownerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify resource ownership")
+		return false
+	}
+	if !parent {
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+		return false
+	}
+	return true
+}
+
+func loadResource(resource string, id int) (resourceRef, error) {
+	var ref resourceRef
+	err := db.QueryRow(ownerQueries[resource], id).Scan(&ref.OwnerID, &ref.OrgID)
+	return ref, err
+}
+
+func resourceOwner(resource string, id int) (int, error) {
+	ref, err := loadResource(resource, id)
+	return ref.OwnerID, err
+}
+
+// authorizeResource loads the owner of the given resource and checks it
+// against the caller, responding with 404/403 and returning false on failure.
+func authorizeResource(w http.ResponseWriter, r *http.Request, resource string, id int) bool {
+	if _, ok := requireUser(w, r); !ok {
+		return false
+	}
+	ref, err := loadResource(resource, id)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Resource not found")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify resource ownership")
+		return false
+	}
+	if ref.OrgID.Valid {
+		return authorizeOrgRole(w, r, int(ref.OrgID.Int64), orgWriteRoles[resource])
+	}
+	return authorizeOwner(w, r, ref.OwnerID)
+}
+
+// authorizeBodyOwner defaults a missing user_id in a request body to the
+// caller and then checks the caller may act as that user.
+func authorizeBodyOwner(w http.ResponseWriter, r *http.Request, userID *int) bool {
+	if *userID == 0 {
+		if u, ok := currentUser(r); ok {
+			*userID = u.ID
+		}
+	}
+	return authorizeOwner(w, r, *userID)
+}
+
+// authorizeCategory rejects references to categories outside the ledger of
+// the record using them: another user's categories, or for organization
+// records another organization's. Global categories, which have no owner,
+// fit any personal ledger. A zero categoryID is not checked.
+func authorizeCategory(w http.ResponseWriter, categoryID int, owner resourceRef) bool {
+	if categoryID == 0 {
+		return true
+	}
+	category, err := loadResource("category", categoryID)
+	sameLedger := category.OrgID == owner.OrgID && (owner.OrgID.Valid || category.OwnerID == owner.OwnerID || category.OwnerID == 0)
+	if err == sql.ErrNoRows || (err == nil && !sameLedger) {
+		respondWithError(w, http.StatusBadRequest, "Invalid category")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify category")
+		return false
+	}
+	return true
+}
+
+// budgetSharePermission returns the permission the user holds on a budget via
+// a share, or "" if it is not shared with them.
+func budgetSharePermission(budgetID, userID int) (string, error) {
+	var permission string
+	err := db.QueryRow("SELECT permission FROM shared_budgets WHERE budget_id=$1 AND to_user_id=$2", budgetID, userID).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return permission, err
+}
+
+// authorizeBudgetEdit allows the budget owner, admins and the budget's
+// member admins to modify a budget. A share, even an edit share, only lets
+// its recipient add transactions to the budget, so share recipients get 403
+// like strangers.
+func authorizeBudgetEdit(w http.ResponseWriter, r *http.Request, budgetID int) bool {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return false
+	}
+	ref, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Resource not found")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify resource ownership")
+		return false
+	}
+	if ref.OrgID.Valid {
+		return authorizeOrgRole(w, r, int(ref.OrgID.Int64), orgRoleAdmin)
+	}
+	if canAccess(u, ref.OwnerID) {
+		return true
+	}
+	role, err := budgetMemberRole(budgetID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget membership")
+		return false
+	} else if role == memberRoleAdmin {
+		return true
+	}
+	permission, err := budgetSharePermission(budgetID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify share permission")
+		return false
+	}
+	switch permission {
+	case permissionEdit:
+		respondWithError(w, http.StatusForbidden, "Your share only lets you add transactions to this budget")
+	case permissionView:
+		respondWithError(w, http.StatusForbidden, "You only have view access to this budget")
+	default:
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+	}
+	return false
+}
+
+// authorizeBudgetView allows the budget owner, admins, anyone it is shared
+// with, its members, and for organization budgets any member of the
+// organization, to read a budget.
+func authorizeBudgetView(w http.ResponseWriter, r *http.Request, budgetID int) bool {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return false
+	}
+	ref, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Resource not found")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify resource ownership")
+		return false
+	}
+	if ref.OrgID.Valid {
+		return authorizeOrgRole(w, r, int(ref.OrgID.Int64), orgRoleMember)
+	}
+	if canAccess(u, ref.OwnerID) {
+		return true
+	}
+	permission, err := budgetSharePermission(budgetID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify share permission")
+		return false
+	}
+	member, err := isBudgetMember(budgetID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget membership")
+		return false
+	} else if permission == "" && !member {
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+		return false
+	}
+	return true
+}
+
+// authorizeTransactionWrite allows creating t in its owner's ledger for the
+// owner and admins. Anyone the owner has shared an active budget with as
+// editor may add transactions too, but only ones that count towards the
+// budget: not in an organization ledger and not excluded from budgets,
+// themselves or through their category. A zero t.UserID defaults to the
+// caller.
+func authorizeTransactionWrite(w http.ResponseWriter, r *http.Request, t *Transaction) bool {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return false
+	}
+	if t.UserID == 0 {
+		t.UserID = u.ID
+	}
+	if canAccess(u, t.UserID) {
+		return true
+	}
+	var permission string
+	var excludedCategory bool
+	err := db.QueryRow(`
+        SELECT CASE
+                   WHEN BOOL_OR(sb.permission = 'edit') THEN 'edit'
+                   WHEN COUNT(*) > 0 THEN 'view'
+                   ELSE ''
+               END,
+            EXISTS(SELECT 1 FROM categories WHERE id = $3 AND exclude_from_budget)
+        FROM shared_budgets sb
+        JOIN budgets b ON b.id = sb.budget_id AND b.organization_id IS NULL AND b.archived_at IS NULL
+        WHERE sb.from_user_id = $1 AND sb.to_user_id = $2`, t.UserID, u.ID, t.CategoryID).Scan(&permission, &excludedCategory)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify share permission")
+		return false
+	}
+	if permission == permissionEdit && (t.ExcludeFromBudget || excludedCategory) {
+		respondWithError(w, http.StatusForbidden, "Only transactions that count towards the shared budget can be added")
+		return false
+	}
+	return checkSharePermission(w, permission)
+}
+
+func checkSharePermission(w http.ResponseWriter, permission string) bool {
+	switch permission {
+	case permissionEdit:
+		return true
+	case permissionView:
+		respondWithError(w, http.StatusForbidden, "You only have view access to this budget")
+	default:
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+	}
+	return false
+}
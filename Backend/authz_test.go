@@ -0,0 +1,148 @@
+// authz_test.go
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The ledger the authorization tests run against: user 1 owns budget 10,
+// shared with user 2 as editor and user 3 as viewer, and user 4 administers
+// it as a member. Budget 11 belongs to organization 5, which user 6
+// administers and user 7 is a member of. Category 21 is excluded from
+// budgets.
+const (
+	testOwner       = 1
+	testShareEditor = 2
+	testShareViewer = 3
+	testMemberAdmin = 4
+	testOrgAdmin    = 6
+	testOrgMember   = 7
+	testStranger    = 8
+	testAdmin       = 9
+)
+
+func useFakeLedger(t *testing.T) {
+	shares := map[int]string{testShareEditor: permissionEdit, testShareViewer: permissionView}
+	orgRoles := map[int]string{testOrgAdmin: orgRoleAdmin, testOrgMember: orgRoleMember}
+	useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		id := func(i int) int { return int(args[i].(int64)) }
+		switch {
+		case strings.HasPrefix(query, "SELECT user_id, organization_id FROM budgets"):
+			columns := []string{"user_id", "organization_id"}
+			switch id(0) {
+			case 10:
+				return fakeRow(columns, int64(testOwner), nil), nil
+			case 11:
+				return fakeRow(columns, int64(testOrgAdmin), int64(5)), nil
+			}
+			return fakeResult{columns: columns}, nil
+		case strings.HasPrefix(query, "SELECT role FROM budget_members"):
+			if id(0) == 10 && id(1) == testMemberAdmin {
+				return fakeRow([]string{"role"}, memberRoleAdmin), nil
+			}
+			return fakeResult{columns: []string{"role"}}, nil
+		case strings.HasPrefix(query, "SELECT permission FROM shared_budgets"):
+			if permission, ok := shares[id(1)]; ok && id(0) == 10 {
+				return fakeRow([]string{"permission"}, permission), nil
+			}
+			return fakeResult{columns: []string{"permission"}}, nil
+		case strings.Contains(query, "FROM shared_budgets sb"):
+			permission := ""
+			if id(0) == testOwner {
+				permission = shares[id(1)]
+			}
+			return fakeRow([]string{"permission", "excluded"}, permission, id(2) == 21), nil
+		case strings.HasPrefix(query, "SELECT role FROM organization_members"):
+			if role, ok := orgRoles[id(1)]; ok && id(0) == 5 {
+				return fakeRow([]string{"role"}, role), nil
+			}
+			return fakeResult{columns: []string{"role"}}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeResult{}, nil
+	})
+}
+
+// requestAs is a request from the given user, or an anonymous one for 0.
+func requestAs(userID int) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "/", nil)
+	if userID == 0 {
+		return r
+	}
+	role := "user"
+	if userID == testAdmin {
+		role = "admin"
+	}
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, &AuthUser{ID: userID, Role: role}))
+}
+
+func TestAuthorizeBudgetEdit(t *testing.T) {
+	useFakeLedger(t)
+	tests := []struct {
+		name     string
+		userID   int
+		budgetID int
+		want     int // 0 when allowed
+	}{
+		{"owner", testOwner, 10, 0},
+		{"admin", testAdmin, 10, 0},
+		{"member admin", testMemberAdmin, 10, 0},
+		{"share editor", testShareEditor, 10, http.StatusForbidden},
+		{"share viewer", testShareViewer, 10, http.StatusForbidden},
+		{"stranger", testStranger, 10, http.StatusForbidden},
+		{"anonymous", 0, 10, http.StatusUnauthorized},
+		{"missing budget", testOwner, 99, http.StatusNotFound},
+		{"organization admin", testOrgAdmin, 11, 0},
+		{"organization member", testOrgMember, 11, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ok := authorizeBudgetEdit(w, requestAs(tt.userID), tt.budgetID)
+			if ok != (tt.want == 0) || (!ok && w.Code != tt.want) {
+				t.Errorf("authorizeBudgetEdit = %v with %d, want status %d", ok, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeTransactionWrite(t *testing.T) {
+	useFakeLedger(t)
+	tests := []struct {
+		name   string
+		userID int
+		t      Transaction
+		want   int // 0 when allowed
+	}{
+		{"owner", testOwner, Transaction{UserID: testOwner, CategoryID: 20}, 0},
+		{"admin", testAdmin, Transaction{UserID: testOwner, CategoryID: 20}, 0},
+		{"share editor", testShareEditor, Transaction{UserID: testOwner, CategoryID: 20}, 0},
+		{"share editor, excluded transaction", testShareEditor,
+			Transaction{UserID: testOwner, CategoryID: 20, ExcludeFromBudget: true}, http.StatusForbidden},
+		{"share editor, excluded category", testShareEditor, Transaction{UserID: testOwner, CategoryID: 21}, http.StatusForbidden},
+		{"share editor in another ledger", testShareEditor, Transaction{UserID: testStranger, CategoryID: 20}, http.StatusForbidden},
+		{"share viewer", testShareViewer, Transaction{UserID: testOwner, CategoryID: 20}, http.StatusForbidden},
+		{"stranger", testStranger, Transaction{UserID: testOwner, CategoryID: 20}, http.StatusForbidden},
+		{"anonymous", 0, Transaction{UserID: testOwner, CategoryID: 20}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ok := authorizeTransactionWrite(w, requestAs(tt.userID), &tt.t)
+			if ok != (tt.want == 0) || (!ok && w.Code != tt.want) {
+				t.Errorf("authorizeTransactionWrite = %v with %d, want status %d", ok, w.Code, tt.want)
+			}
+		})
+	}
+
+	// A transaction without an owner goes in the caller's ledger.
+	tx := Transaction{CategoryID: 20}
+	if !authorizeTransactionWrite(httptest.NewRecorder(), requestAs(testShareEditor), &tx) || tx.UserID != testShareEditor {
+		t.Errorf("transaction without an owner went to user %d, want %d", tx.UserID, testShareEditor)
+	}
+}
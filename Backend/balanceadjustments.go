@@ -0,0 +1,108 @@
+// balanceadjustments.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A balance adjustment trues up an account, typically a cash wallet, to
+// the balance the user says it has without tracking down every missing
+// transaction. It is stored as a cleared transaction for the difference,
+// marked as an adjustment and excluded from budgets and spending reports.
+
+const balanceAdjustmentDescription = "Balance adjustment"
+
+// --- MODELS ---
+
+// BalanceAdjustment is the body of the adjust route. For an investment
+// account, balance is its cash, leaving out holdings. Date defaults to
+// today. An adjustment to an account kept in a currency other than the
+// owner's base is recorded at exchange_rate (base units per unit), by
+// default the account's current rate.
+type BalanceAdjustment struct {
+	Balance      *float64 `json:"balance"`
+	Reason       string   `json:"reason"`
+	Date         string   `json:"date"`
+	ExchangeRate *float64 `json:"exchange_rate"`
+}
+
+// --- BALANCE ADJUSTMENT HANDLERS ---
+
+// AdjustAccountBalance records the transaction that brings the account in
+// {id} to the stated balance and returns it.
+func AdjustAccountBalance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	var adj BalanceAdjustment
+	if err := json.NewDecoder(r.Body).Decode(&adj); err != nil || adj.Balance == nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if strings.TrimSpace(adj.Reason) == "" {
+		respondWithError(w, http.StatusBadRequest, "A reason is required")
+		return
+	}
+	a, err := loadAccount(dbFor(r), accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return
+	}
+	date := time.Now()
+	if adj.Date != "" {
+		if date, err = time.Parse("2006-01-02", adj.Date); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+			return
+		}
+	}
+	difference := toCents(a.Balance-a.HoldingsValue) - toCents(*adj.Balance)
+	if difference == 0 {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("The account balance is already %.2f", a.Balance))
+		return
+	}
+	amount := float64(difference) / 100
+	t := Transaction{
+		UserID:            a.UserID,
+		Description:       balanceAdjustmentDescription,
+		Amount:            amount,
+		Date:              date,
+		AccountID:         &a.ID,
+		IsAdjustment:      true,
+		Status:            statusCleared,
+		Notes:             strings.TrimSpace(adj.Reason),
+		Currency:          a.Currency,
+		OriginalAmount:    &amount,
+		ExchangeRate:      adj.ExchangeRate,
+		ExcludeFromBudget: true,
+	}
+	if t.ExchangeRate == nil {
+		t.ExchangeRate = a.ExchangeRate
+	}
+	if !authorizeAccount(w, t.AccountID, t.UserID, t.Date) || !authorizeUnlockedDates(w, r, resourceRef{OwnerID: t.UserID}, t.Date) ||
+		!applyCurrency(w, dbFor(r), &t) {
+		return
+	}
+	err = dbFor(r).QueryRow(`INSERT INTO transactions (user_id, description, amount, date, category_id, status, notes,
+            currency, original_amount, exchange_rate, exclude_from_budget, account_id, is_adjustment)
+        VALUES ($1, $2, $3, $4, NULL, $5, $6, $7, $8, $9, TRUE, $10, TRUE) RETURNING id`,
+		t.UserID, t.Description, t.Amount, t.Date, t.Status, t.Notes, t.Currency, t.OriginalAmount, t.ExchangeRate, t.AccountID).Scan(&t.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record balance adjustment")
+		return
+	}
+	recordAudit(r, "transaction", t.ID, auditCreate, nil)
+	respondWithJSON(w, http.StatusCreated, t)
+}
@@ -0,0 +1,246 @@
+// budgetapprovals.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The owner of a group budget can require approval of what members spend.
+// While it is required, each transaction a member adds waits for the
+// owner's approval before it counts towards the budget; a rejected one never
+// does. The transaction itself stays in the member's ledger either way, and
+// counts towards their other budgets as usual. Turning approval off lets
+// whatever is still waiting count.
+
+// Approval statuses.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+// --- MODELS ---
+type BudgetTransactionApproval struct {
+	BudgetID      int        `json:"budget_id"`
+	TransactionID int        `json:"transaction_id"`
+	UserID        int        `json:"user_id"`
+	Username      string     `json:"username"`
+	Description   string     `json:"description"`
+	Amount        float64    `json:"amount"`
+	Date          time.Time  `json:"date"`
+	Status        string     `json:"status"`
+	RequestedAt   time.Time  `json:"requested_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// budgetApprovedSQL leaves out of the budget whose id is budgetParam the
+// transaction lines still waiting for, or refused, its owner's approval.
+func budgetApprovedSQL(budgetParam string) string {
+	return `transaction_id NOT IN (SELECT transaction_id FROM budget_transaction_approvals
+            WHERE budget_id = ` + budgetParam + ` AND status <> '` + approvalApproved + `')`
+}
+
+// approvalRequest is a budget holding a transaction back until its owner
+// approves it.
+type approvalRequest struct{ budgetID, ownerID int }
+
+// requestBudgetApprovals holds t back from each budget requiring approval
+// that t's owner is a member of. It runs through q, the transaction t is
+// written in, so t is never counted before approval; the caller announces
+// the returned requests with notifyApprovalsRequested once committed.
+func requestBudgetApprovals(q queryer, t Transaction) ([]approvalRequest, error) {
+	rows, err := q.Query(`INSERT INTO budget_transaction_approvals (budget_id, transaction_id)
+        SELECT b.id, $2 FROM budgets b
+        JOIN budget_members m ON m.budget_id = b.id AND m.user_id = $1 AND m.accepted_at IS NOT NULL
+        WHERE b.require_approval AND b.organization_id IS NULL AND b.archived_at IS NULL
+        RETURNING budget_id, (SELECT user_id FROM budgets WHERE id = budget_id)`, t.UserID, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var requests []approvalRequest
+	for rows.Next() {
+		var req approvalRequest
+		if err := rows.Scan(&req.budgetID, &req.ownerID); err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// notifyApprovalsRequested asks the owners of the budgets holding t back to
+// approve it.
+func notifyApprovalsRequested(t Transaction, requests []approvalRequest) {
+	for _, req := range requests {
+		notifyBudgetEvent(t.UserID, req.ownerID, notifyApprovalRequested, req.budgetID, t.Description, t.Amount)
+	}
+}
+
+// setBudgetApproval turns a budget's approval requirement on or off. Only
+// the owner of a personal budget can change it.
+func setBudgetApproval(w http.ResponseWriter, r *http.Request, required bool) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	budget, err := loadResource("budget", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if budget.OrgID.Valid {
+		respondWithError(w, http.StatusUnprocessableEntity, "Only group budgets can require approval")
+		return
+	}
+	u, _ := currentUser(r)
+	before := snapshotResource(db, "budget", budgetID)
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update budget")
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE budgets SET require_approval=$1 WHERE id=$2", required, budgetID)
+	if err == nil && !required {
+		_, err = tx.Exec("UPDATE budget_transaction_approvals SET status=$1, decided_at=NOW(), decided_by=$2 WHERE budget_id=$3 AND status=$4",
+			approvalApproved, u.ID, budgetID, approvalPending)
+	}
+	if err == nil {
+		writeAudit(tx, u.ID, "budget", budgetID, auditUpdate, before)
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update budget")
+		return
+	}
+	if required {
+		respondWithJSON(w, http.StatusOK, map[string]string{"message": "Approval required successfully"})
+	} else {
+		respondWithJSON(w, http.StatusOK, map[string]string{"message": "Approval no longer required"})
+	}
+}
+
+// --- BUDGET APPROVAL HANDLERS ---
+
+func RequireBudgetApproval(w http.ResponseWriter, r *http.Request) {
+	setBudgetApproval(w, r, true)
+}
+
+func UnrequireBudgetApproval(w http.ResponseWriter, r *http.Request) {
+	setBudgetApproval(w, r, false)
+}
+
+// GetBudgetApprovals lists a budget's approval requests, by default those
+// still pending; ?status= picks another status. The owner sees everyone's,
+// members only their own.
+func GetBudgetApprovals(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = approvalPending
+	}
+	if status != approvalPending && status != approvalApproved && status != approvalRejected {
+		respondWithError(w, http.StatusBadRequest, "'status' must be 'pending', 'approved' or 'rejected'")
+		return
+	}
+	u, _ := currentUser(r)
+	ref, err := loadResource("budget", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	// Members' transactions are hidden by row-level security, so this reads
+	// through db once access has been checked.
+	rows, err := db.Query(`SELECT a.budget_id, a.transaction_id, t.user_id, u.username, t.description, t.amount, t.date,
+            a.status, a.requested_at, a.decided_at
+        FROM budget_transaction_approvals a
+        JOIN transactions t ON t.id = a.transaction_id AND t.deleted_at IS NULL
+        JOIN users u ON u.id = t.user_id
+        WHERE a.budget_id = $1 AND a.status = $2 AND ($3 OR t.user_id = $4)
+        ORDER BY a.requested_at, a.transaction_id`, budgetID, status, canAccess(u, ref.OwnerID), u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve approvals")
+		return
+	}
+	defer rows.Close()
+	approvals := []BudgetTransactionApproval{}
+	for rows.Next() {
+		var a BudgetTransactionApproval
+		if err := rows.Scan(&a.BudgetID, &a.TransactionID, &a.UserID, &a.Username, &a.Description, &a.Amount, &a.Date,
+			&a.Status, &a.RequestedAt, &a.DecidedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan approval")
+			return
+		}
+		approvals = append(approvals, a)
+	}
+	respondWithJSON(w, http.StatusOK, approvals)
+}
+
+func ApproveBudgetTransaction(w http.ResponseWriter, r *http.Request) {
+	decideBudgetTransaction(w, r, true)
+}
+
+func RejectBudgetTransaction(w http.ResponseWriter, r *http.Request) {
+	decideBudgetTransaction(w, r, false)
+}
+
+// decideBudgetTransaction records the budget owner's decision on a pending
+// transaction and tells the member who added it.
+func decideBudgetTransaction(w http.ResponseWriter, r *http.Request, approve bool) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	transactionID, err := strconv.Atoi(params["transaction_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	u, _ := currentUser(r)
+	status, kind := approvalRejected, notifyTransactionRejected
+	if approve {
+		status, kind = approvalApproved, notifyTransactionApproved
+	}
+	var memberID int
+	var description string
+	err = db.QueryRow(`UPDATE budget_transaction_approvals a SET status=$1, decided_at=NOW(), decided_by=$2
+        FROM transactions t
+        WHERE a.budget_id=$3 AND a.transaction_id=$4 AND a.status=$5 AND t.id = a.transaction_id
+        RETURNING t.user_id, t.description`,
+		status, u.ID, budgetID, transactionID, approvalPending).Scan(&memberID, &description)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Pending transaction not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update approval")
+		return
+	}
+	notifyBudgetEvent(u.ID, memberID, kind, budgetID, description)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction " + status})
+}
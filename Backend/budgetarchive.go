@@ -0,0 +1,78 @@
+// budgetarchive.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// An archived budget keeps its history but is paused: it is left out of
+// budget listings unless ?include_archived=true, and the period-close job
+// neither snapshots nor renews it. Restoring it resumes tracking from its
+// current period, so the time it spent archived leaves no history or
+// carryover behind.
+
+// --- HELPER FUNCTIONS ---
+
+// archivedBudgetFilter returns the condition that hides archived budgets
+// from a listing, or nothing when the request asks to include them. col is
+// the archived_at column as the query names it.
+func archivedBudgetFilter(r *http.Request, col string) string {
+	if r.URL.Query().Get("include_archived") == "true" {
+		return ""
+	}
+	return " AND " + col + " IS NULL"
+}
+
+// --- BUDGET ARCHIVE HANDLERS ---
+
+func ArchiveBudget(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "budget", budgetID)
+	res, err := dbFor(r).Exec("UPDATE budgets SET archived_at = NOW() WHERE id=$1 AND archived_at IS NULL", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to archive budget")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusConflict, "Budget is already archived")
+		return
+	}
+	recordAudit(r, "budget", budgetID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Budget archived successfully"})
+}
+
+func RestoreBudget(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "budget", budgetID)
+	res, err := dbFor(r).Exec(`UPDATE budgets SET archived_at = NULL, closed_through = NULL, carryover = 0
+        WHERE id=$1 AND archived_at IS NOT NULL`, budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to restore budget")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusConflict, "Budget is not archived")
+		return
+	}
+	recordAudit(r, "budget", budgetID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Budget restored successfully"})
+}
@@ -0,0 +1,160 @@
+// budgetcategorymappings.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Members of a group budget spend in categories of their own, which rarely
+// match the owner's by name. A budget's category mappings fold a member's
+// category into one of the owner's, or a global category, so reports on the
+// budget count the member's spending there. Mappings belong to the budget:
+// the same member category can map differently in another budget.
+
+// --- MODELS ---
+type BudgetCategoryMapping struct {
+	BudgetID         int    `json:"budget_id"`
+	CategoryID       int    `json:"category_id"`
+	Category         string `json:"category,omitempty"`
+	UserID           int    `json:"user_id"` // the member the category belongs to
+	MappedCategoryID int    `json:"mapped_category_id"`
+	MappedCategory   string `json:"mapped_category,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// budgetCategorySQL is the category a transaction line l counts under in
+// the budget whose id is budgetParam: its own, unless the budget maps it.
+func budgetCategorySQL(l, budgetParam string) string {
+	return `COALESCE((SELECT mapped_category_id FROM budget_category_mappings
+            WHERE budget_id = ` + budgetParam + ` AND category_id = ` + l + `.category_id), ` + l + `.category_id)`
+}
+
+// --- CATEGORY MAPPING HANDLERS ---
+
+// GetBudgetCategoryMappings lists a budget's category mappings to anyone who
+// can view the budget.
+func GetBudgetCategoryMappings(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	// Members' categories are hidden by row-level security, so this reads
+	// through db once access has been checked.
+	rows, err := db.Query(`SELECT m.budget_id, m.category_id, c.name, c.user_id, m.mapped_category_id, t.name
+        FROM budget_category_mappings m
+        JOIN categories c ON c.id = m.category_id
+        JOIN categories t ON t.id = m.mapped_category_id
+        WHERE m.budget_id = $1
+        ORDER BY c.name, m.category_id`, budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve category mappings")
+		return
+	}
+	defer rows.Close()
+	mappings := []BudgetCategoryMapping{}
+	for rows.Next() {
+		var m BudgetCategoryMapping
+		if err := rows.Scan(&m.BudgetID, &m.CategoryID, &m.Category, &m.UserID, &m.MappedCategoryID, &m.MappedCategory); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category mapping")
+			return
+		}
+		mappings = append(mappings, m)
+	}
+	respondWithJSON(w, http.StatusOK, mappings)
+}
+
+// SetBudgetCategoryMapping maps a member's category onto one of the budget
+// owner's categories or a global one, replacing any earlier mapping of it.
+// Whoever can edit the budget can map its categories.
+func SetBudgetCategoryMapping(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetEdit(w, r, budgetID) {
+		return
+	}
+	var m BudgetCategoryMapping
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	m.BudgetID = budgetID
+	budget, err := loadResource("budget", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if budget.OrgID.Valid {
+		respondWithError(w, http.StatusUnprocessableEntity, "Organization budgets share one set of categories")
+		return
+	}
+	if m.MappedCategoryID == 0 {
+		respondWithError(w, http.StatusBadRequest, "mapped_category_id is required")
+		return
+	}
+	if !authorizeCategory(w, m.MappedCategoryID, resourceRef{OwnerID: budget.OwnerID}) {
+		return
+	}
+	// Only a member's own categories need mapping; the owner's and global
+	// ones already mean the same to everyone in the budget.
+	err = db.QueryRow(`SELECT c.user_id, c.name, (SELECT name FROM categories WHERE id = $3) FROM categories c
+        JOIN budget_members bm ON bm.user_id = c.user_id AND bm.budget_id = $1 AND bm.accepted_at IS NOT NULL
+        WHERE c.id = $2 AND c.organization_id IS NULL`,
+		budgetID, m.CategoryID, m.MappedCategoryID).Scan(&m.UserID, &m.Category, &m.MappedCategory)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusBadRequest, "Category must be one of a budget member's own categories")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify category")
+		return
+	}
+	_, err = db.Exec(`INSERT INTO budget_category_mappings (budget_id, category_id, mapped_category_id) VALUES ($1, $2, $3)
+        ON CONFLICT (budget_id, category_id) DO UPDATE SET mapped_category_id = EXCLUDED.mapped_category_id`,
+		budgetID, m.CategoryID, m.MappedCategoryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save category mapping")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+func DeleteBudgetCategoryMapping(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	categoryID, err := strconv.Atoi(params["category_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	if !authorizeBudgetEdit(w, r, budgetID) {
+		return
+	}
+	res, err := db.Exec("DELETE FROM budget_category_mappings WHERE budget_id=$1 AND category_id=$2", budgetID, categoryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete category mapping")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Category mapping not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category mapping deleted successfully"})
+}
@@ -0,0 +1,291 @@
+// budgetcomments.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Each budget has a discussion thread open to everyone who can view it.
+// Mentioning a participant by @username notifies them; mentions of anyone
+// else are left as plain text.
+
+const maxCommentLength = 2000
+
+// mentionPattern matches an @username, leaving off trailing punctuation.
+var mentionPattern = regexp.MustCompile(`@([\w.-]*\w)`)
+
+// --- MODELS ---
+type BudgetComment struct {
+	ID       int     `json:"id"`
+	BudgetID int     `json:"budget_id"`
+	UserID   *int    `json:"user_id"` // nil once the author's account is deleted
+	Username *string `json:"username,omitempty"`
+	Body     string  `json:"body"`
+	// Mentioned lists the participants a write notified.
+	Mentioned []int      `json:"mentioned,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// commentMentions returns the budget's participants that body mentions,
+// other than its author.
+func commentMentions(budgetID, authorID int, body string) ([]int, error) {
+	var names []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		names = append(names, strings.ToLower(m[1]))
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	participants, err := budgetParticipants(budgetID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, p := range participants {
+		if p.UserID != authorID {
+			ids = append(ids, int64(p.UserID))
+		}
+	}
+	rows, err := db.Query("SELECT id FROM users WHERE id = ANY($1) AND LOWER(username) = ANY($2) ORDER BY id", pq.Array(ids), pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var mentioned []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		mentioned = append(mentioned, id)
+	}
+	return mentioned, rows.Err()
+}
+
+// notifyMentions notifies the participants body mentions, skipping those in
+// already, and returns who it notified.
+func notifyMentions(c BudgetComment, already []int) []int {
+	mentioned, err := commentMentions(c.BudgetID, *c.UserID, c.Body)
+	if err != nil {
+		log.Printf("Failed to resolve mentions in comment %d: %v", c.ID, err)
+		return nil
+	}
+	var notified []int
+	for _, id := range mentioned {
+		if containsInt(already, id) {
+			continue
+		}
+		notifyBudgetEvent(*c.UserID, id, notifyMentioned, c.BudgetID, commentExcerpt(c.Body))
+		notified = append(notified, id)
+	}
+	return notified
+}
+
+// commentExcerpt shortens a comment for a notification.
+func commentExcerpt(body string) string {
+	runes := []rune(strings.Join(strings.Fields(body), " "))
+	if len(runes) > 80 {
+		return string(runes[:77]) + "..."
+	}
+	return string(runes)
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeCommentBody reads and validates the body of a comment request.
+func decodeCommentBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return "", false
+	}
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" || len([]rune(req.Body)) > maxCommentLength {
+		respondWithError(w, http.StatusBadRequest, "Comment must be between 1 and "+strconv.Itoa(maxCommentLength)+" characters")
+		return "", false
+	}
+	return req.Body, true
+}
+
+// --- BUDGET COMMENT HANDLERS ---
+
+// GetBudgetComments returns a budget's thread, oldest first, paginated with
+// ?page and ?per_page.
+func GetBudgetComments(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	page, perPage, err := parsePagination(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM budget_comments WHERE budget_id=$1", budgetID).Scan(&total); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve comments")
+		return
+	}
+	// Other participants' usernames are hidden by row-level security, so
+	// this reads through db once access has been checked.
+	rows, err := db.Query(`SELECT c.id, c.budget_id, c.user_id, u.username, c.body, c.created_at, c.edited_at
+        FROM budget_comments c LEFT JOIN users u ON u.id = c.user_id
+        WHERE c.budget_id = $1
+        ORDER BY c.created_at, c.id
+        LIMIT $2 OFFSET $3`, budgetID, perPage, (page-1)*perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve comments")
+		return
+	}
+	defer rows.Close()
+	comments := []BudgetComment{}
+	for rows.Next() {
+		var c BudgetComment
+		if err := rows.Scan(&c.ID, &c.BudgetID, &c.UserID, &c.Username, &c.Body, &c.CreatedAt, &c.EditedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan comment")
+			return
+		}
+		comments = append(comments, c)
+	}
+	setPaginationHeaders(w, total, page, perPage)
+	respondWithJSON(w, http.StatusOK, comments)
+}
+
+// CreateBudgetComment adds the caller's comment to a budget they can view
+// and notifies the participants it mentions.
+func CreateBudgetComment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	body, ok := decodeCommentBody(w, r)
+	if !ok {
+		return
+	}
+	u, _ := currentUser(r)
+	c := BudgetComment{BudgetID: budgetID, UserID: &u.ID, Body: body}
+	err = db.QueryRow(`INSERT INTO budget_comments (budget_id, user_id, body) VALUES ($1, $2, $3)
+        RETURNING id, created_at, (SELECT username FROM users WHERE id=$2)`,
+		budgetID, u.ID, body).Scan(&c.ID, &c.CreatedAt, &c.Username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create comment")
+		return
+	}
+	c.Mentioned = notifyMentions(c, nil)
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+// UpdateBudgetComment lets the author edit their comment. Only participants
+// the edit newly mentions are notified.
+func UpdateBudgetComment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	commentID, err := strconv.Atoi(params["comment_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid comment ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	body, ok := decodeCommentBody(w, r)
+	if !ok {
+		return
+	}
+	u, _ := currentUser(r)
+	var previous string
+	err = db.QueryRow("SELECT body FROM budget_comments WHERE id=$1 AND budget_id=$2 AND user_id=$3", commentID, budgetID, u.ID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Comment not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update comment")
+		return
+	}
+	c := BudgetComment{ID: commentID, BudgetID: budgetID, UserID: &u.ID, Body: body}
+	err = db.QueryRow(`UPDATE budget_comments SET body=$1, edited_at=NOW() WHERE id=$2
+        RETURNING created_at, edited_at, (SELECT username FROM users WHERE id=$3)`,
+		body, commentID, u.ID).Scan(&c.CreatedAt, &c.EditedAt, &c.Username)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update comment")
+		return
+	}
+	already, err := commentMentions(budgetID, u.ID, previous)
+	if err != nil {
+		log.Printf("Failed to resolve mentions in comment %d: %v", commentID, err)
+	}
+	c.Mentioned = notifyMentions(c, already)
+	respondWithJSON(w, http.StatusOK, c)
+}
+
+// DeleteBudgetComment lets the author, or the budget's owner, delete a
+// comment.
+func DeleteBudgetComment(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	commentID, err := strconv.Atoi(params["comment_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid comment ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	u, _ := currentUser(r)
+	budget, err := loadResource("budget", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	moderator := !budget.OrgID.Valid && canAccess(u, budget.OwnerID)
+	res, err := db.Exec("DELETE FROM budget_comments WHERE id=$1 AND budget_id=$2 AND ($3 OR user_id=$4)", commentID, budgetID, moderator, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete comment")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Comment not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Comment deleted successfully"})
+}
@@ -0,0 +1,277 @@
+// budgetdigests.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A budget digest mails a weekly summary of a budget's progress to someone
+// who has no account, such as a relative. The budget's owner adds their
+// address, but nothing is sent until its holder confirms it through the link
+// in a confirmation email; every digest carries a link to unsubscribe. The
+// links are the only credential: the confirmation link holds a random token,
+// of which only the hash is stored, and the unsubscribe link that hash.
+
+const digestInterval = 7 * 24 * time.Hour
+
+// --- MODELS ---
+type BudgetDigest struct {
+	ID          int        `json:"id"`
+	BudgetID    int        `json:"budget_id"`
+	Email       string     `json:"email"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	LastSentAt  *time.Time `json:"last_sent_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// digestText renders a budget's progress as the body of a digest email.
+func digestText(b Budget, p BudgetProgress) string {
+	currency := ""
+	if b.Currency != nil {
+		currency = " " + *b.Currency
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s, %s to %s\n\n", b.Name, p.PeriodStart.Format("Jan 2"), p.PeriodEnd.Format("Jan 2, 2006"))
+	fmt.Fprintf(&sb, "Spent: %.2f of %.2f%s (%.0f%%)\n", p.Spent, p.Available, currency, p.PercentUsed)
+	fmt.Fprintf(&sb, "Remaining: %.2f%s with %d days left\n", p.Remaining, currency, p.DaysLeft)
+	switch p.Pace {
+	case "ahead":
+		sb.WriteString("Spending is ahead of pace.\n")
+	case "behind":
+		sb.WriteString("Spending is behind pace.\n")
+	default:
+		sb.WriteString("Spending is on track.\n")
+	}
+	return sb.String()
+}
+
+// sendBudgetDigests mails the summary of each confirmed digest not sent in
+// the last week.
+func sendBudgetDigests() error {
+	if mailer == nil {
+		return nil
+	}
+	rows, err := db.Query(`SELECT id, budget_id, email, token_hash, base_url FROM budget_digests
+        WHERE confirmed_at IS NOT NULL AND (last_sent_at IS NULL OR last_sent_at <= $1)`, time.Now().Add(-digestInterval))
+	if err != nil {
+		return err
+	}
+	type due struct {
+		id, budgetID          int
+		email, token, baseURL string
+	}
+	var digests []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.budgetID, &d.email, &d.token, &d.baseURL); err != nil {
+			rows.Close()
+			return err
+		}
+		digests = append(digests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range digests {
+		b, progress, err := computeBudgetProgress(d.budgetID)
+		if err != nil {
+			log.Printf("Failed to compute progress for digest %d: %v", d.id, err)
+			continue
+		}
+		if b.ArchivedAt != nil {
+			continue
+		}
+		body := digestText(b, progress) + "\nTo stop these emails: " + d.baseURL + "/digests/" + strconv.Itoa(d.id) + "/" + d.token + "/unsubscribe\n"
+		if err := mailer.Send(d.email, "Budgello: weekly summary of "+b.Name, body); err != nil {
+			log.Printf("Failed to send digest %d: %v", d.id, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE budget_digests SET last_sent_at = NOW() WHERE id=$1", d.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- BUDGET DIGEST HANDLERS ---
+
+// CreateBudgetDigest adds an email address to receive a budget's weekly
+// digest and mails it a link to confirm. Only the owner of a personal
+// budget can add one.
+func CreateBudgetDigest(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid email address")
+		return
+	}
+	budget, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget ownership")
+		return
+	}
+	if budget.OrgID.Valid || !canAccess(u, budget.OwnerID) {
+		respondWithError(w, http.StatusForbidden, "You can only share your own budgets")
+		return
+	}
+	if mailer == nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Email delivery is not configured")
+		return
+	}
+
+	token := randomToken()
+	baseURL := requestBaseURL(r)
+	d := BudgetDigest{BudgetID: budgetID, Email: addr.Address}
+	var owner, name string
+	err = db.QueryRow(`INSERT INTO budget_digests (budget_id, email, token_hash, base_url, created_by) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT DO NOTHING
+        RETURNING id, created_at, (SELECT username FROM users WHERE id=$5), (SELECT name FROM budgets WHERE id=$1)`,
+		budgetID, d.Email, hashToken(token), baseURL, u.ID).Scan(&d.ID, &d.CreatedAt, &owner, &name)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusConflict, "This address already receives or has been asked to confirm this budget's digest")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create digest")
+		return
+	}
+	body := fmt.Sprintf("%s would like to email you a weekly summary of the budget %q.\n\nTo start receiving it: %s/digests/%d/%s/confirm\n\nIf you don't want it, ignore this email and you won't hear from us again.\n",
+		owner, name, baseURL, d.ID, token)
+	go func() {
+		if err := mailer.Send(d.Email, "Budgello: confirm your weekly budget summary", body); err != nil {
+			log.Printf("Failed to send confirmation for digest %d: %v", d.ID, err)
+		}
+	}()
+	respondWithJSON(w, http.StatusCreated, d)
+}
+
+// GetBudgetDigests lists the addresses a budget's digest goes to or awaits
+// confirmation from.
+func GetBudgetDigests(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	rows, err := db.Query("SELECT id, budget_id, email, confirmed_at, last_sent_at, created_at FROM budget_digests WHERE budget_id=$1 ORDER BY email", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve digests")
+		return
+	}
+	defer rows.Close()
+	digests := []BudgetDigest{}
+	for rows.Next() {
+		var d BudgetDigest
+		if err := rows.Scan(&d.ID, &d.BudgetID, &d.Email, &d.ConfirmedAt, &d.LastSentAt, &d.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan digest")
+			return
+		}
+		digests = append(digests, d)
+	}
+	respondWithJSON(w, http.StatusOK, digests)
+}
+
+func DeleteBudgetDigest(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	digestID, err := strconv.Atoi(params["digest_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid digest ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	res, err := db.Exec("DELETE FROM budget_digests WHERE id=$1 AND budget_id=$2", digestID, budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete digest")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Digest not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Digest deleted successfully"})
+}
+
+// ConfirmBudgetDigest and UnsubscribeBudgetDigest are opened from links in
+// emails, so they need no account and answer GET.
+
+func ConfirmBudgetDigest(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	digestID, err := strconv.Atoi(params["digest_id"])
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Digest not found")
+		return
+	}
+	res, err := db.Exec("UPDATE budget_digests SET confirmed_at = COALESCE(confirmed_at, NOW()) WHERE id=$1 AND token_hash=$2",
+		digestID, hashToken(params["token"]))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to confirm digest")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Digest not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "You will receive a weekly summary of this budget"})
+}
+
+func UnsubscribeBudgetDigest(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	digestID, err := strconv.Atoi(params["digest_id"])
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Digest not found")
+		return
+	}
+	res, err := db.Exec("DELETE FROM budget_digests WHERE id=$1 AND token_hash=$2", digestID, params["token"])
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to unsubscribe")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Digest not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "You will no longer receive this budget's summary"})
+}
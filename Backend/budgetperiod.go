@@ -0,0 +1,105 @@
+// budgetperiod.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Budget frequencies. A custom budget covers a single fixed date range,
+// from its period to its end_date; every other frequency repeats.
+const (
+	frequencyWeekly      = "weekly"
+	frequencyBiweekly    = "biweekly"
+	frequencySemimonthly = "semimonthly"
+	frequencyMonthly     = "monthly"
+	frequencyYearly      = "yearly"
+	frequencyCustom      = "custom"
+)
+
+var budgetFrequencies = map[string]bool{
+	frequencyWeekly: true, frequencyBiweekly: true, frequencySemimonthly: true,
+	frequencyMonthly: true, frequencyYearly: true, frequencyCustom: true,
+}
+
+const budgetFrequencyError = "Frequency must be 'weekly', 'biweekly', 'semimonthly', 'monthly', 'yearly' or 'custom'"
+
+// dateOnly returns midnight of t's calendar date in loc.
+func dateOnly(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// addMonthsClamped moves t by months, keeping its day of the month but
+// clamping it to the last day of shorter months: Jan 31 + 1 is Feb 28 (or
+// 29), not Mar 3 as time.AddDate would give.
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, 0, 0, 0, 0, t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, t.Location())
+}
+
+// budgetPeriod returns the bounds [start, end) of b's period that contains
+// now. Recurring periods repeat from the day of b.Period, with each boundary
+// computed from it directly so month-end anchors don't drift; semimonthly
+// periods always run 1st-15th and 16th-end of month. A custom budget has a
+// single period whatever now is.
+func budgetPeriod(b Budget, now time.Time) (time.Time, time.Time, error) {
+	loc := now.Location()
+	anchor := dateOnly(b.Period, loc)
+	var boundary func(n int) time.Time
+	switch b.Frequency {
+	case frequencyWeekly:
+		boundary = func(n int) time.Time { return anchor.AddDate(0, 0, 7*n) }
+	case frequencyBiweekly:
+		boundary = func(n int) time.Time { return anchor.AddDate(0, 0, 14*n) }
+	case frequencyMonthly:
+		boundary = func(n int) time.Time { return addMonthsClamped(anchor, n) }
+	case frequencyYearly:
+		boundary = func(n int) time.Time { return addMonthsClamped(anchor, 12*n) }
+	case frequencySemimonthly:
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		mid := month.AddDate(0, 0, 15)
+		if now.Before(mid) {
+			return month, mid, nil
+		}
+		return mid, month.AddDate(0, 1, 0), nil
+	case frequencyCustom:
+		if b.EndDate == nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("custom budget has no end date")
+		}
+		return anchor, dateOnly(*b.EndDate, loc).AddDate(0, 0, 1), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown budget frequency %q", b.Frequency)
+	}
+	n := 0
+	for !boundary(n + 1).After(now) {
+		n++
+	}
+	for boundary(n).After(now) {
+		n--
+	}
+	return boundary(n), boundary(n + 1), nil
+}
+
+// validateBudgetPeriod checks a budget's frequency, and that end_date is set
+// exactly when the budget is custom and doesn't precede its period.
+func validateBudgetPeriod(w http.ResponseWriter, b Budget) bool {
+	switch {
+	case !budgetFrequencies[b.Frequency]:
+		respondWithError(w, http.StatusBadRequest, budgetFrequencyError)
+	case b.Frequency == frequencyCustom && b.EndDate == nil:
+		respondWithError(w, http.StatusBadRequest, "Custom budgets require an end_date")
+	case b.Frequency != frequencyCustom && b.EndDate != nil:
+		respondWithError(w, http.StatusBadRequest, "Only custom budgets have an end_date")
+	case b.EndDate != nil && b.EndDate.Before(b.Period):
+		respondWithError(w, http.StatusBadRequest, "end_date cannot be before period")
+	default:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+// budgetperiod_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestAddMonthsClamped(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   time.Time
+		months int
+		want   time.Time
+	}{
+		{"same day next month", date(2025, 3, 14), 1, date(2025, 4, 14)},
+		{"month end into February", date(2025, 1, 31), 1, date(2025, 2, 28)},
+		{"month end into leap February", date(2024, 1, 31), 1, date(2024, 2, 29)},
+		{"31st into 30-day month", date(2025, 3, 31), 1, date(2025, 4, 30)},
+		{"across the year end", date(2025, 11, 30), 3, date(2026, 2, 28)},
+		{"backwards", date(2025, 3, 31), -1, date(2025, 2, 28)},
+		{"leap day a year on", date(2024, 2, 29), 12, date(2025, 2, 28)},
+		{"leap day four years on", date(2024, 2, 29), 48, date(2028, 2, 29)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addMonthsClamped(tt.from, tt.months); !got.Equal(tt.want) {
+				t.Errorf("addMonthsClamped(%s, %d) = %s, want %s", tt.from.Format("2006-01-02"), tt.months,
+					got.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+func TestBudgetPeriod(t *testing.T) {
+	end := func(y int, m time.Month, d int) *time.Time {
+		e := date(y, m, d)
+		return &e
+	}
+	tests := []struct {
+		name      string
+		budget    Budget
+		now       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		// Weekly
+		{"weekly on its anchor", Budget{Frequency: frequencyWeekly, Period: date(2025, 1, 6)},
+			date(2025, 1, 6), date(2025, 1, 6), date(2025, 1, 13)},
+		{"weekly last day of a period", Budget{Frequency: frequencyWeekly, Period: date(2025, 1, 6)},
+			date(2025, 1, 12).Add(23 * time.Hour), date(2025, 1, 6), date(2025, 1, 13)},
+		{"weekly across the year end", Budget{Frequency: frequencyWeekly, Period: date(2024, 12, 30)},
+			date(2025, 1, 8), date(2025, 1, 6), date(2025, 1, 13)},
+		{"weekly before its anchor", Budget{Frequency: frequencyWeekly, Period: date(2025, 1, 6)},
+			date(2025, 1, 1), date(2024, 12, 30), date(2025, 1, 6)},
+		{"weekly across leap day", Budget{Frequency: frequencyWeekly, Period: date(2024, 2, 26)},
+			date(2024, 3, 3), date(2024, 2, 26), date(2024, 3, 4)},
+
+		// Biweekly
+		{"biweekly second week", Budget{Frequency: frequencyBiweekly, Period: date(2025, 1, 3)},
+			date(2025, 1, 12), date(2025, 1, 3), date(2025, 1, 17)},
+		{"biweekly next period", Budget{Frequency: frequencyBiweekly, Period: date(2025, 1, 3)},
+			date(2025, 1, 17), date(2025, 1, 17), date(2025, 1, 31)},
+		{"biweekly across leap February", Budget{Frequency: frequencyBiweekly, Period: date(2024, 2, 16)},
+			date(2024, 2, 29), date(2024, 2, 16), date(2024, 3, 1)},
+		{"biweekly across non-leap February", Budget{Frequency: frequencyBiweekly, Period: date(2025, 2, 14)},
+			date(2025, 3, 1), date(2025, 2, 28), date(2025, 3, 14)},
+
+		// Semimonthly
+		{"semimonthly first half", Budget{Frequency: frequencySemimonthly, Period: date(2025, 1, 1)},
+			date(2025, 4, 15), date(2025, 4, 1), date(2025, 4, 16)},
+		{"semimonthly second half", Budget{Frequency: frequencySemimonthly, Period: date(2025, 1, 1)},
+			date(2025, 4, 16), date(2025, 4, 16), date(2025, 5, 1)},
+		{"semimonthly 31-day month end", Budget{Frequency: frequencySemimonthly, Period: date(2025, 1, 1)},
+			date(2025, 1, 31), date(2025, 1, 16), date(2025, 2, 1)},
+		{"semimonthly February", Budget{Frequency: frequencySemimonthly, Period: date(2025, 1, 1)},
+			date(2025, 2, 28), date(2025, 2, 16), date(2025, 3, 1)},
+		{"semimonthly leap February", Budget{Frequency: frequencySemimonthly, Period: date(2024, 1, 1)},
+			date(2024, 2, 29), date(2024, 2, 16), date(2024, 3, 1)},
+		{"semimonthly December", Budget{Frequency: frequencySemimonthly, Period: date(2025, 1, 1)},
+			date(2025, 12, 20), date(2025, 12, 16), date(2026, 1, 1)},
+
+		// Monthly, anchored at month end
+		{"monthly from the 31st in February", Budget{Frequency: frequencyMonthly, Period: date(2025, 1, 31)},
+			date(2025, 3, 10), date(2025, 2, 28), date(2025, 3, 31)},
+		{"monthly from the 31st in leap February", Budget{Frequency: frequencyMonthly, Period: date(2024, 1, 31)},
+			date(2024, 3, 10), date(2024, 2, 29), date(2024, 3, 31)},
+		{"monthly from the 31st doesn't drift", Budget{Frequency: frequencyMonthly, Period: date(2025, 1, 31)},
+			date(2025, 5, 31), date(2025, 5, 31), date(2025, 6, 30)},
+
+		// Yearly from leap day
+		{"yearly from leap day", Budget{Frequency: frequencyYearly, Period: date(2024, 2, 29)},
+			date(2025, 6, 1), date(2025, 2, 28), date(2026, 2, 28)},
+		{"yearly back on leap day", Budget{Frequency: frequencyYearly, Period: date(2024, 2, 29)},
+			date(2028, 3, 1), date(2028, 2, 29), date(2029, 2, 28)},
+
+		// Custom
+		{"custom single day", Budget{Frequency: frequencyCustom, Period: date(2025, 6, 1), EndDate: end(2025, 6, 1)},
+			date(2025, 6, 1), date(2025, 6, 1), date(2025, 6, 2)},
+		{"custom ending at month end", Budget{Frequency: frequencyCustom, Period: date(2025, 1, 15), EndDate: end(2025, 2, 28)},
+			date(2025, 2, 1), date(2025, 1, 15), date(2025, 3, 1)},
+		{"custom ending on leap day", Budget{Frequency: frequencyCustom, Period: date(2024, 2, 1), EndDate: end(2024, 2, 29)},
+			date(2024, 2, 10), date(2024, 2, 1), date(2024, 3, 1)},
+		{"custom is the same whatever now is", Budget{Frequency: frequencyCustom, Period: date(2025, 1, 1), EndDate: end(2025, 12, 31)},
+			date(2030, 1, 1), date(2025, 1, 1), date(2026, 1, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := budgetPeriod(tt.budget, tt.now)
+			if err != nil {
+				t.Fatalf("budgetPeriod: %v", err)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("budgetPeriod(%s from %s, %s) = [%s, %s), want [%s, %s)", tt.budget.Frequency,
+					tt.budget.Period.Format("2006-01-02"), tt.now.Format("2006-01-02"), start.Format("2006-01-02"),
+					end.Format("2006-01-02"), tt.wantStart.Format("2006-01-02"), tt.wantEnd.Format("2006-01-02"))
+			}
+		})
+	}
+}
+
+func TestBudgetPeriodErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		budget Budget
+	}{
+		{"custom without an end date", Budget{Frequency: frequencyCustom, Period: date(2025, 1, 1)}},
+		{"unknown frequency", Budget{Frequency: "fortnightly", Period: date(2025, 1, 1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := budgetPeriod(tt.budget, date(2025, 1, 1)); err == nil {
+				t.Error("budgetPeriod succeeded, want an error")
+			}
+		})
+	}
+}
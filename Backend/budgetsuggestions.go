@@ -0,0 +1,269 @@
+// budgetsuggestions.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	minSuggestionMonths     = 3
+	maxSuggestionMonths     = 6
+	defaultSuggestionMonths = 6
+)
+
+// --- MODELS ---
+type CategoryBudgetSuggestion struct {
+	CategoryID *int      `json:"category_id"` // null for uncategorized spending
+	Category   string    `json:"category"`
+	Monthly    []float64 `json:"monthly"` // spending per month, oldest first
+	Suggested  float64   `json:"suggested"`
+}
+
+// BudgetSuggestion proposes a monthly budget from the complete months before
+// the current one. Each category's amount is the median (or trimmed mean) of
+// its monthly spending, rounded up to a whole unit.
+type BudgetSuggestion struct {
+	UserID     int                        `json:"user_id"`
+	Method     string                     `json:"method"`
+	From       time.Time                  `json:"from"`
+	To         time.Time                  `json:"to"` // exclusive
+	Total      float64                    `json:"total"`
+	Categories []CategoryBudgetSuggestion `json:"categories"`
+}
+
+// AcceptBudgetSuggestion picks the suggestion to accept. CategoryIDs limits
+// it to some categories; by default all are taken.
+type AcceptBudgetSuggestion struct {
+	Months      int    `json:"months"`
+	Method      string `json:"method"`
+	CategoryIDs []int  `json:"category_ids"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// trimmedMean averages values after dropping the highest and lowest, once
+// there are enough of them for that to leave something.
+func trimmedMean(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if len(sorted) >= 3 {
+		sorted = sorted[1 : len(sorted)-1]
+	}
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return sum / float64(len(sorted))
+}
+
+// suggestBudget analyzes userID's personal spending over the months
+// complete months before now.
+func suggestBudget(userID, months int, method string, now time.Time) (BudgetSuggestion, error) {
+	to := monthStart(now)
+	from := to.AddDate(0, -months, 0)
+	s := BudgetSuggestion{UserID: userID, Method: method, From: from, To: to, Categories: []CategoryBudgetSuggestion{}}
+	rows, err := db.Query(`
+        SELECT l.category_id, COALESCE(c.name, 'Uncategorized'), date_trunc('month', l.date), SUM(l.amount)
+        FROM transaction_lines l
+        LEFT JOIN categories c ON c.id = l.category_id
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3
+        GROUP BY l.category_id, c.name, date_trunc('month', l.date)
+        ORDER BY c.name NULLS LAST`, userID, from, to)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	index := map[string]int{}
+	for rows.Next() {
+		var categoryID *int
+		var name string
+		var month time.Time
+		var spent float64
+		if err := rows.Scan(&categoryID, &name, &month, &spent); err != nil {
+			return s, err
+		}
+		key := "uncategorized"
+		if categoryID != nil {
+			key = strconv.Itoa(*categoryID)
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(s.Categories)
+			index[key] = i
+			// Months without spending count as zero.
+			s.Categories = append(s.Categories, CategoryBudgetSuggestion{CategoryID: categoryID, Category: name, Monthly: make([]float64, months)})
+		}
+		m := (month.Year()-from.Year())*12 + int(month.Month()-from.Month())
+		if m >= 0 && m < months {
+			s.Categories[i].Monthly[m] = spent
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	suggested := s.Categories[:0]
+	for _, c := range s.Categories {
+		if method == "trimmed_mean" {
+			c.Suggested = trimmedMean(c.Monthly)
+		} else {
+			c.Suggested = median(c.Monthly)
+		}
+		c.Suggested = math.Ceil(c.Suggested)
+		if c.Suggested <= 0 {
+			continue
+		}
+		s.Total += c.Suggested
+		suggested = append(suggested, c)
+	}
+	s.Categories = suggested
+	return s, nil
+}
+
+// suggestionParams validates the analysis window and method, applying the
+// defaults.
+func suggestionParams(w http.ResponseWriter, months int, method string) (int, string, bool) {
+	if months == 0 {
+		months = defaultSuggestionMonths
+	}
+	if method == "" {
+		method = "median"
+	}
+	if months < minSuggestionMonths || months > maxSuggestionMonths {
+		respondWithError(w, http.StatusBadRequest, "'months' must be between 3 and 6")
+		return 0, "", false
+	}
+	if method != "median" && method != "trimmed_mean" {
+		respondWithError(w, http.StatusBadRequest, "'method' must be 'median' or 'trimmed_mean'")
+		return 0, "", false
+	}
+	return months, method, true
+}
+
+// --- BUDGET SUGGESTION HANDLERS ---
+
+// GetBudgetSuggestions proposes per-category monthly budget amounts from the
+// last ?months= (3-6, default 6) complete months, using ?method=median (the
+// default) or trimmed_mean.
+func GetBudgetSuggestions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	months := 0
+	if v := r.URL.Query().Get("months"); v != "" {
+		if months, err = strconv.Atoi(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'months'")
+			return
+		}
+	}
+	months, method, ok := suggestionParams(w, months, r.URL.Query().Get("method"))
+	if !ok {
+		return
+	}
+	s, err := suggestBudget(userID, months, method, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to analyze spending")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// AcceptBudgetSuggestions creates (or replaces) the user's monthly budget
+// from a suggestion: its amount is the suggested total, and each suggested
+// category's amount becomes its allocation for the current month.
+// Uncategorized spending counts toward the total only.
+func AcceptBudgetSuggestions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	var req AcceptBudgetSuggestion
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	months, method, ok := suggestionParams(w, req.Months, req.Method)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if !authorizeAllocationUnlocked(w, r, userID, monthStart(now)) {
+		return
+	}
+	s, err := suggestBudget(userID, months, method, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to analyze spending")
+		return
+	}
+	if len(req.CategoryIDs) > 0 {
+		wanted := map[int]bool{}
+		for _, id := range req.CategoryIDs {
+			wanted[id] = true
+		}
+		kept := s.Categories[:0]
+		s.Total = 0
+		for _, c := range s.Categories {
+			if c.CategoryID != nil && wanted[*c.CategoryID] {
+				kept = append(kept, c)
+				s.Total += c.Suggested
+			}
+		}
+		s.Categories = kept
+	}
+	if s.Total == 0 {
+		respondWithError(w, http.StatusUnprocessableEntity, "There is no spending to base a budget on")
+		return
+	}
+
+	b := Budget{UserID: userID, Period: monthStart(now), Frequency: frequencyMonthly, Amount: s.Total, Kind: budgetKindExpense,
+		Name: "Suggested budget"}
+	var inserted bool
+	err = withTx(r, func(q queryer) error {
+		err := q.QueryRow(`
+            INSERT INTO budgets (user_id, period, frequency, amount, name, kind)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (user_id, kind, frequency) WHERE organization_id IS NULL AND frequency <> 'custom'
+            DO UPDATE SET amount = EXCLUDED.amount, period = EXCLUDED.period, currency = NULL, exchange_rate = NULL,
+                closed_through = CASE WHEN budgets.archived_at IS NULL THEN budgets.closed_through END, archived_at = NULL
+            RETURNING id, xmax = 0, name`, b.UserID, b.Period, b.Frequency, b.Amount, b.Name, b.Kind).Scan(&b.ID, &inserted, &b.Name)
+		if err != nil {
+			return err
+		}
+		for _, c := range s.Categories {
+			if c.CategoryID == nil {
+				continue
+			}
+			_, err := q.Exec(`INSERT INTO category_allocations (user_id, category_id, month, amount) VALUES ($1, $2, $3, $4)
+                ON CONFLICT (user_id, category_id, month) DO UPDATE SET amount = EXCLUDED.amount`, userID, *c.CategoryID, b.Period, c.Suggested)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create budget from suggestions")
+		return
+	}
+	recordAudit(r, "budget", b.ID, upsertAction(inserted), nil)
+	respondWithJSON(w, http.StatusCreated, map[string]interface{}{"budget": b, "suggestion": s})
+}
@@ -0,0 +1,265 @@
+// budgettemplates.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type BudgetTemplate struct {
+	ID        int     `json:"id"`
+	UserID    int     `json:"user_id"`
+	Name      string  `json:"name"`
+	Frequency string  `json:"frequency"`
+	Amount    float64 `json:"amount"`
+	Rollover  bool    `json:"rollover"`
+}
+
+// BudgetCopy describes the budget to create from an existing one or a
+// template. Missing fields take the source's values; the period defaults to
+// the start of the current one.
+type BudgetCopy struct {
+	Frequency string     `json:"frequency"`
+	Period    time.Time  `json:"period"`
+	EndDate   *time.Time `json:"end_date"`
+	Amount    *float64   `json:"amount"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func validateBudgetTemplate(w http.ResponseWriter, t BudgetTemplate) bool {
+	if strings.TrimSpace(t.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Template name is required")
+		return false
+	}
+	if !budgetFrequencies[t.Frequency] || t.Frequency == frequencyCustom {
+		respondWithError(w, http.StatusBadRequest, "Templates need a recurring frequency: 'weekly', 'biweekly', 'semimonthly', 'monthly' or 'yearly'")
+		return false
+	}
+	return true
+}
+
+// decodeBudgetCopy reads an optional BudgetCopy body and fills its gaps from
+// src.
+func decodeBudgetCopy(w http.ResponseWriter, r *http.Request, src Budget) (Budget, bool) {
+	var c BudgetCopy
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return Budget{}, false
+		}
+	}
+	b := src
+	b.ID = 0
+	b.ArchivedAt, b.SinkingFundID = nil, nil
+	if c.Frequency != "" {
+		b.Frequency = c.Frequency
+	}
+	if b.Frequency != frequencyCustom {
+		b.EndDate = nil
+	}
+	if c.EndDate != nil {
+		b.EndDate = c.EndDate
+	}
+	if c.Amount != nil {
+		b.Amount = *c.Amount
+	}
+	b.Period = c.Period
+	if b.Period.IsZero() && b.Frequency != frequencyCustom {
+		b.Period, _, _ = budgetPeriod(Budget{Period: src.Period, Frequency: b.Frequency}, time.Now())
+	} else if b.Period.IsZero() {
+		b.Period = src.Period
+	}
+	if !validateBudgetPeriod(w, b) {
+		return Budget{}, false
+	}
+	return b, true
+}
+
+// --- BUDGET TEMPLATE HANDLERS ---
+
+func CreateBudgetTemplate(w http.ResponseWriter, r *http.Request) {
+	var t BudgetTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &t.UserID) || !validateBudgetTemplate(w, t) {
+		return
+	}
+	err := db.QueryRow(`INSERT INTO budget_templates (user_id, name, frequency, amount, rollover)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id`, t.UserID, t.Name, t.Frequency, t.Amount, t.Rollover).Scan(&t.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create template. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, t)
+}
+
+func GetBudgetTemplates(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	rows, err := db.Query("SELECT id, user_id, name, frequency, amount, rollover FROM budget_templates WHERE user_id=$1 ORDER BY name", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve templates")
+		return
+	}
+	defer rows.Close()
+	templates := []BudgetTemplate{}
+	for rows.Next() {
+		var t BudgetTemplate
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Frequency, &t.Amount, &t.Rollover); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan template")
+			return
+		}
+		templates = append(templates, t)
+	}
+	respondWithJSON(w, http.StatusOK, templates)
+}
+
+func UpdateBudgetTemplate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	templateID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget_template", templateID) {
+		return
+	}
+	var t BudgetTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !validateBudgetTemplate(w, t) {
+		return
+	}
+	_, err = db.Exec("UPDATE budget_templates SET name=$1, frequency=$2, amount=$3, rollover=$4 WHERE id=$5",
+		t.Name, t.Frequency, t.Amount, t.Rollover, templateID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update template. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Template updated successfully"})
+}
+
+func DeleteBudgetTemplate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	templateID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget_template", templateID) {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM budget_templates WHERE id=$1", templateID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete template")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Template deleted successfully"})
+}
+
+// CreateBudgetFromTemplate sets up the template owner's personal budget
+// from a template. Like POST /budgets, it replaces an existing budget of the
+// same frequency.
+func CreateBudgetFromTemplate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	templateID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget_template", templateID) {
+		return
+	}
+	var src Budget
+	err = db.QueryRow("SELECT user_id, frequency, amount, rollover, name FROM budget_templates WHERE id=$1", templateID).
+		Scan(&src.UserID, &src.Frequency, &src.Amount, &src.Rollover, &src.Name)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Template not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve template")
+		return
+	}
+	src.Period = time.Now()
+	src.Kind = budgetKindExpense
+	b, ok := decodeBudgetCopy(w, r, src)
+	if !ok {
+		return
+	}
+	var inserted bool
+	err = dbFor(r).QueryRow(`
+        INSERT INTO budgets (user_id, period, end_date, frequency, amount, rollover, name)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (user_id, kind, frequency) WHERE organization_id IS NULL AND frequency <> 'custom'
+        DO UPDATE SET amount = EXCLUDED.amount, period = EXCLUDED.period, rollover = EXCLUDED.rollover, name = EXCLUDED.name,
+            currency = NULL, exchange_rate = NULL,
+            closed_through = CASE WHEN budgets.archived_at IS NULL THEN budgets.closed_through END, archived_at = NULL
+        RETURNING id, xmax = 0`, b.UserID, b.Period, b.EndDate, b.Frequency, b.Amount, b.Rollover, b.Name).Scan(&b.ID, &inserted)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create or update budget")
+		return
+	}
+	recordAudit(r, "budget", b.ID, upsertAction(inserted), nil)
+	respondWithJSON(w, http.StatusCreated, b)
+}
+
+// CopyBudget creates a budget in the same ledger from an existing one, for
+// example a yearly budget from a monthly one, or a custom budget for the
+// next date range. A ledger holds one budget per recurring frequency, so
+// copying onto one that is already taken is a 409 rather than an overwrite.
+func CopyBudget(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	var src Budget
+	err = scanBudget(dbFor(r).QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &src)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	b, ok := decodeBudgetCopy(w, r, src)
+	if !ok {
+		return
+	}
+	err = dbFor(r).QueryRow(`INSERT INTO budgets (user_id, organization_id, period, end_date, frequency, amount, rollover, name, description, notes, kind,
+            currency, exchange_rate)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT DO NOTHING RETURNING id`,
+		b.UserID, b.OrganizationID, b.Period, b.EndDate, b.Frequency, b.Amount, b.Rollover, b.Name, b.Description, b.Notes, b.Kind,
+		b.Currency, b.ExchangeRate).Scan(&b.ID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusConflict, "A "+b.Frequency+" "+b.Kind+" budget already exists; update it instead")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to copy budget")
+		return
+	}
+	recordAudit(r, "budget", b.ID, auditCreate, nil)
+	respondWithJSON(w, http.StatusCreated, b)
+}
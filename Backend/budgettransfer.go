@@ -0,0 +1,206 @@
+// budgettransfer.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Transferring a budget hands it to another user as if they had created it.
+// Its history, shares, members and share links stay with the budget; what
+// belongs to the previous owner rather than the budget, such as a linked
+// sinking fund, is left behind. Category allocations are personal, so they
+// only follow the budget when asked to, and only into categories the new
+// owner has.
+
+// --- MODELS ---
+
+// BudgetTransferRequest names the new owner. IncludeAllocations moves the
+// previous owner's allocations from the current month on; KeepAccess shares
+// the budget back with the previous owner as an editor.
+type BudgetTransferRequest struct {
+	ToUserID           int  `json:"to_user_id"`
+	IncludeAllocations bool `json:"include_allocations"`
+	KeepAccess         bool `json:"keep_access"`
+}
+
+type BudgetTransfer struct {
+	BudgetID         int `json:"budget_id"`
+	FromUserID       int `json:"from_user_id"`
+	ToUserID         int `json:"to_user_id"`
+	AllocationsMoved int `json:"allocations_moved"`
+	// SkippedCategories names categories whose allocations stayed behind
+	// because the new owner has no category of that name.
+	SkippedCategories []string `json:"skipped_categories"`
+}
+
+// --- BUDGET TRANSFER HANDLERS ---
+
+// TransferBudget moves a personal budget to another user. Only its owner can
+// transfer it.
+func TransferBudget(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req BudgetTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// The new owner's rows are hidden by row-level security, so this reads
+	// and writes through db once access has been checked.
+	var b Budget
+	err = scanBudget(db.QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &b)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if b.OrganizationID != nil || !canAccess(u, b.UserID) {
+		respondWithError(w, http.StatusForbidden, "You can only transfer your own budgets")
+		return
+	}
+	if req.ToUserID == b.UserID {
+		respondWithError(w, http.StatusBadRequest, "The budget already belongs to this user")
+		return
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", req.ToUserID).Scan(&exists); err != nil || !exists {
+		respondWithError(w, http.StatusBadRequest, "User to transfer to does not exist.")
+		return
+	}
+	var taken bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM budgets WHERE user_id=$1 AND organization_id IS NULL AND kind=$2 AND frequency=$3
+        AND frequency <> 'custom' AND id <> $4)`, req.ToUserID, b.Kind, b.Frequency, b.ID).Scan(&taken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check the new owner's budgets")
+		return
+	}
+	if taken {
+		respondWithError(w, http.StatusConflict, "The new owner already has a "+b.Frequency+" "+b.Kind+" budget")
+		return
+	}
+	// The budget's amount stays in the currency it was in, which becomes a
+	// foreign currency if the new owner's base currency differs.
+	if b.Currency == nil {
+		base, err := baseCurrency(db, b.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up base currency")
+			return
+		}
+		b.Currency = &base
+	}
+	b.ExchangeRate = nil
+	if !validateBudgetCurrency(w, db, req.ToUserID, &b) {
+		return
+	}
+
+	transfer := BudgetTransfer{BudgetID: b.ID, FromUserID: b.UserID, ToUserID: req.ToUserID, SkippedCategories: []string{}}
+	before := snapshotResource(db, "budget", b.ID)
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to transfer budget")
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE budgets SET user_id=$1, currency=$2, exchange_rate=$3, sinking_fund_id=NULL WHERE id=$4",
+		req.ToUserID, b.Currency, b.ExchangeRate, b.ID)
+	if err == nil {
+		// The new owner no longer needs a share or membership of their own
+		// budget.
+		_, err = tx.Exec("DELETE FROM shared_budgets WHERE budget_id=$1 AND to_user_id=$2", b.ID, req.ToUserID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE shared_budgets SET from_user_id=$1 WHERE budget_id=$2", req.ToUserID, b.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM budget_members WHERE budget_id=$1 AND user_id=$2", b.ID, req.ToUserID)
+	}
+	if err == nil {
+		// The owner's transactions always count, so none of theirs await
+		// approval.
+		_, err = tx.Exec(`DELETE FROM budget_transaction_approvals
+            WHERE budget_id=$1 AND transaction_id IN (SELECT id FROM transactions WHERE user_id=$2)`, b.ID, req.ToUserID)
+	}
+	if err == nil && req.KeepAccess {
+		_, err = tx.Exec(`INSERT INTO shared_budgets (budget_id, from_user_id, to_user_id, permission) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (budget_id, to_user_id) DO UPDATE SET permission = EXCLUDED.permission`,
+			b.ID, req.ToUserID, b.UserID, permissionEdit)
+	}
+	if err == nil && req.IncludeAllocations {
+		err = moveAllocations(tx, b.UserID, req.ToUserID, monthStart(time.Now()), &transfer)
+	}
+	if err == nil {
+		writeAudit(tx, u.ID, "budget", b.ID, auditUpdate, before)
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to transfer budget")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, transfer)
+}
+
+// moveAllocations moves fromUserID's allocations from month on to toUserID,
+// each into toUserID's category of the same name or the global category it
+// already is, adding to any allocation toUserID already has there.
+func moveAllocations(tx *sql.Tx, fromUserID, toUserID int, month time.Time, transfer *BudgetTransfer) error {
+	rows, err := tx.Query(`SELECT c.name, t.id IS NULL FROM category_allocations a
+        JOIN categories c ON c.id = a.category_id
+        LEFT JOIN categories t ON t.id = CASE WHEN c.is_global THEN c.id ELSE
+            (SELECT id FROM categories WHERE user_id = $2 AND organization_id IS NULL AND name = c.name) END
+        WHERE a.user_id = $1 AND a.month >= $3
+        GROUP BY c.name, t.id IS NULL
+        ORDER BY c.name`, fromUserID, toUserID, month)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var skipped bool
+		if err := rows.Scan(&name, &skipped); err != nil {
+			return err
+		}
+		if skipped {
+			transfer.SkippedCategories = append(transfer.SkippedCategories, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`WITH moved AS (
+            DELETE FROM category_allocations a
+            USING categories c, categories t
+            WHERE a.user_id = $1 AND a.month >= $3 AND c.id = a.category_id
+              AND t.id = CASE WHEN c.is_global THEN c.id ELSE
+                  (SELECT id FROM categories WHERE user_id = $2 AND organization_id IS NULL AND name = c.name) END
+            RETURNING t.id AS category_id, a.month, a.amount
+        )
+        INSERT INTO category_allocations (user_id, category_id, month, amount)
+        SELECT $2, category_id, month, amount FROM moved
+        ON CONFLICT (user_id, category_id, month) DO UPDATE SET amount = category_allocations.amount + EXCLUDED.amount`,
+		fromUserID, toUserID, month)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	transfer.AllocationsMoved = int(n)
+	return nil
+}
@@ -0,0 +1,476 @@
+// bulk.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const maxBulkTransactions = 1000
+
+// bulkFilterKeys are the filters transactionFilters understands; anything
+// else is rejected so a typo cannot silently select every transaction.
+var bulkFilterKeys = map[string]bool{
+	"from": true, "to": true, "category_id": true, "payee_id": true, "account_id": true, "min_amount": true, "max_amount": true, "q": true,
+	"description": true, "tags": true, "status": true,
+}
+
+// --- MODELS ---
+type BulkRowError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// captureError runs an authorization or validation helper against a
+// throwaway writer and returns the error message it would have sent, so the
+// same checks can produce per-row errors in bulk requests.
+func captureError(check func(w http.ResponseWriter) bool) (string, bool) {
+	buf := &bufferedResponse{header: http.Header{}}
+	if check(buf) {
+		return "", true
+	}
+	var resp struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(buf.body.Bytes(), &resp)
+	return resp.Error, false
+}
+
+// validateBulkTransaction applies the same rules as CreateTransaction to one
+// row, returning an error message or "".
+func validateBulkTransaction(r *http.Request, t *Transaction) string {
+	if t.CategoryID == 0 {
+		return "category_id is required"
+	}
+	if msg, ok := captureError(func(w http.ResponseWriter) bool {
+		return validateTransactionStatus(w, t) && validateLocation(w, *t)
+	}); !ok {
+		return msg
+	}
+	if msg, ok := captureError(func(w http.ResponseWriter) bool {
+		return authorizeTransactionWrite(w, r, t) && authorizeCategory(w, t.CategoryID, resourceRef{OwnerID: t.UserID}) &&
+			authorizeUnlockedDates(w, r, resourceRef{OwnerID: t.UserID}, t.Date) &&
+			authorizePayee(w, t.PayeeID, t.UserID) && authorizeAccount(w, t.AccountID, t.UserID, t.Date) && applyCurrency(w, dbFor(r), t)
+	}); !ok {
+		return msg
+	}
+	needsApproval := false
+	if msg, ok := captureError(func(w http.ResponseWriter) bool {
+		var ok bool
+		needsApproval, ok = enforceChildLimits(w, r, *t, 0)
+		return ok
+	}); !ok {
+		return msg
+	}
+	if needsApproval {
+		return "Amount exceeds the approval threshold; submit this transaction individually for approval"
+	}
+	return ""
+}
+
+// --- BULK HANDLERS ---
+
+// CreateTransactionsBulk inserts an array of transactions atomically. Every
+// row is validated first; if any fail, nothing is written and the response
+// lists the errors by index.
+func CreateTransactionsBulk(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var transactions []Transaction
+	if err := json.NewDecoder(r.Body).Decode(&transactions); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(transactions) == 0 || len(transactions) > maxBulkTransactions {
+		respondWithError(w, http.StatusBadRequest, "Provide between 1 and 1000 transactions")
+		return
+	}
+
+	rowErrors := []BulkRowError{}
+	for i := range transactions {
+		t := &transactions[i]
+		if t.Date.IsZero() {
+			t.Date = time.Now()
+		}
+		if msg := validateBulkTransaction(r, t); msg != "" {
+			rowErrors = append(rowErrors, BulkRowError{Index: i, Error: msg})
+		}
+	}
+	if len(rowErrors) > 0 {
+		respondWithJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":  "No transactions were created",
+			"errors": rowErrors,
+		})
+		return
+	}
+
+	err := withTx(r, func(q queryer) error {
+		for i := range transactions {
+			t := &transactions[i]
+			if t.PayeeID == nil {
+				payeeID, err := resolvePayee(q, t.UserID, t.Description)
+				if err != nil {
+					return err
+				}
+				t.PayeeID = payeeID
+			}
+			err := q.QueryRow(`INSERT INTO transactions (user_id, description, amount, date, category_id, payee_id, status, notes, latitude, longitude,
+                    currency, original_amount, exchange_rate, exclude_from_budget, account_id)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id`,
+				t.UserID, t.Description, t.Amount, t.Date, t.CategoryID, t.PayeeID, t.Status, t.Notes, t.Latitude, t.Longitude,
+				t.Currency, t.OriginalAmount, t.ExchangeRate, t.ExcludeFromBudget, t.AccountID).Scan(&t.ID)
+			if err != nil {
+				return err
+			}
+			writeAudit(q, u.ID, "transaction", t.ID, auditCreate, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create transactions")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, transactions)
+}
+
+// BulkSelection picks transactions in one user's personal ledger, either by
+// ID or by the same filters GET /transactions/{user_id} accepts. When both
+// are given a transaction must match both.
+type BulkSelection struct {
+	UserID int               `json:"user_id"`
+	IDs    []int             `json:"ids"`
+	Filter map[string]string `json:"filter"`
+	DryRun bool              `json:"dry_run"`
+}
+
+type BulkUpdateRequest struct {
+	BulkSelection
+	CategoryID   int   `json:"category_id"`
+	AddTagIDs    []int `json:"add_tag_ids"`
+	RemoveTagIDs []int `json:"remove_tag_ids"`
+}
+
+type BulkResult struct {
+	Matched  int  `json:"matched"`
+	Affected int  `json:"affected"`
+	DryRun   bool `json:"dry_run"`
+}
+
+// authorizeBulkSelection checks the caller may bulk-edit the selected ledger.
+// Child accounts must go through their parent, since bulk edits would bypass
+// category limits.
+func authorizeBulkSelection(w http.ResponseWriter, r *http.Request, sel *BulkSelection) bool {
+	if !authorizeBodyOwner(w, r, &sel.UserID) {
+		return false
+	}
+	if len(sel.IDs) == 0 && len(sel.Filter) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Select transactions with 'ids' or 'filter'")
+		return false
+	}
+	for key := range sel.Filter {
+		if !bulkFilterKeys[key] {
+			respondWithError(w, http.StatusBadRequest, "Unknown filter '"+key+"'")
+			return false
+		}
+	}
+	if _, _, err := transactionFilters(sel.filterValues(), sel.UserID); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return requireParentForChild(w, r, sel.UserID, "Bulk edits of a child account must be made by the parent")
+}
+
+// requireParentForChild rejects writes to a child account's ledger by anyone
+// but its parent or an admin, for operations that bypass category limits.
+func requireParentForChild(w http.ResponseWriter, r *http.Request, userID int, message string) bool {
+	u, _ := currentUser(r)
+	parentID, err := childParentID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify child account")
+		return false
+	}
+	if parentID.Valid && int(parentID.Int64) != u.ID && u.Role != "admin" {
+		respondWithError(w, http.StatusForbidden, message)
+		return false
+	}
+	return true
+}
+
+func (sel BulkSelection) filterValues() url.Values {
+	filter := url.Values{}
+	for k, v := range sel.Filter {
+		filter.Set(k, v)
+	}
+	return filter
+}
+
+// selectTransactionIDs resolves a selection to IDs, locking the rows.
+func selectTransactionIDs(q queryer, sel BulkSelection) ([]int64, error) {
+	where, args, err := transactionFilters(sel.filterValues(), sel.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sel.IDs) > 0 {
+		args = append(args, pq.Array(sel.IDs))
+		where += fmt.Sprintf(" AND id = ANY($%d)", len(args))
+	}
+	rows, err := q.Query("SELECT id FROM transactions WHERE "+where+" FOR UPDATE", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdateTransactionsBulk recategorizes and/or retags the selected
+// transactions. With dry_run it only reports how many would be affected.
+func UpdateTransactionsBulk(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req BulkUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBulkSelection(w, r, &req.BulkSelection) {
+		return
+	}
+	if req.CategoryID == 0 && len(req.AddTagIDs) == 0 && len(req.RemoveTagIDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Nothing to update: set category_id, add_tag_ids or remove_tag_ids")
+		return
+	}
+	if !authorizeCategory(w, req.CategoryID, resourceRef{OwnerID: req.UserID}) {
+		return
+	}
+	for _, tagID := range req.AddTagIDs {
+		if owner, err := resourceOwner("tag", tagID); err != nil || owner != req.UserID {
+			respondWithError(w, http.StatusBadRequest, "Invalid tag")
+			return
+		}
+	}
+
+	result := BulkResult{DryRun: req.DryRun}
+	var lockedOn *time.Time
+	err := withTx(r, func(q queryer) error {
+		ids, err := selectTransactionIDs(q, req.BulkSelection)
+		if err != nil {
+			return err
+		}
+		result.Matched = len(ids)
+		if req.DryRun || len(ids) == 0 {
+			return nil
+		}
+		if req.CategoryID != 0 {
+			if err := checkBulkUnlocked(r, q, ids, &lockedOn); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				before := snapshotResource(q, "transaction", int(id))
+				if err := saveTransactionVersion(q, int(id), u.ID); err != nil {
+					return err
+				}
+				if _, err := q.Exec("UPDATE transactions SET category_id=$1 WHERE id=$2", req.CategoryID, id); err != nil {
+					return err
+				}
+				writeAudit(q, u.ID, "transaction", int(id), auditUpdate, before)
+			}
+		}
+		if len(req.AddTagIDs) > 0 {
+			_, err := q.Exec(`INSERT INTO transaction_tags (transaction_id, tag_id)
+                SELECT t, g FROM unnest($1::INTEGER[]) t CROSS JOIN unnest($2::INTEGER[]) g
+                ON CONFLICT DO NOTHING`, pq.Array(ids), pq.Array(req.AddTagIDs))
+			if err != nil {
+				return err
+			}
+		}
+		if len(req.RemoveTagIDs) > 0 {
+			_, err := q.Exec("DELETE FROM transaction_tags WHERE transaction_id = ANY($1) AND tag_id = ANY($2)", pq.Array(ids), pq.Array(req.RemoveTagIDs))
+			if err != nil {
+				return err
+			}
+		}
+		result.Affected = len(ids)
+		return nil
+	})
+	if lockedOn != nil {
+		respondPeriodLocked(w, *lockedOn)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Bulk operation failed")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// DeleteTransactionsBulk deletes the selected transactions. With dry_run it
+// only reports how many would be deleted.
+func DeleteTransactionsBulk(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var sel BulkSelection
+	if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBulkSelection(w, r, &sel) {
+		return
+	}
+
+	result := BulkResult{DryRun: sel.DryRun}
+	var lockedOn *time.Time
+	err := withTx(r, func(q queryer) error {
+		ids, err := selectTransactionIDs(q, sel)
+		if err != nil {
+			return err
+		}
+		result.Matched = len(ids)
+		if sel.DryRun {
+			return nil
+		}
+		if err := checkBulkUnlocked(r, q, ids, &lockedOn); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			before := snapshotResource(q, "transaction", int(id))
+			if _, err := q.Exec("UPDATE transactions SET deleted_at = NOW() WHERE id=$1", id); err != nil {
+				return err
+			}
+			writeAudit(q, u.ID, "transaction", int(id), auditDelete, before)
+		}
+		result.Affected = len(ids)
+		return nil
+	})
+	if lockedOn != nil {
+		respondPeriodLocked(w, *lockedOn)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Bulk operation failed")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+type RecategorizeRequest struct {
+	BulkSelection
+	CategoryID int `json:"category_id"`
+}
+
+// RecategorizeGroup counts the selected transactions coming from one
+// category.
+type RecategorizeGroup struct {
+	CategoryID *int   `json:"category_id"`
+	Category   string `json:"category"`
+	Count      int    `json:"count"`
+}
+
+type RecategorizeResult struct {
+	BulkResult
+	From []RecategorizeGroup `json:"from"`
+}
+
+// RecategorizeTransactions moves every selected transaction into
+// category_id in one statement, e.g. all "Uber" rides filed under Dining
+// into Transport after a rule change. Transactions already in the category
+// are left alone. With dry_run it only previews how many would move and
+// from which categories.
+func RecategorizeTransactions(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req RecategorizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBulkSelection(w, r, &req.BulkSelection) {
+		return
+	}
+	if req.CategoryID == 0 {
+		respondWithError(w, http.StatusBadRequest, "category_id is required")
+		return
+	}
+	if !authorizeCategory(w, req.CategoryID, resourceRef{OwnerID: req.UserID}) {
+		return
+	}
+
+	result := RecategorizeResult{BulkResult: BulkResult{DryRun: req.DryRun}, From: []RecategorizeGroup{}}
+	var lockedOn *time.Time
+	err := withTx(r, func(q queryer) error {
+		selected, err := selectTransactionIDs(q, req.BulkSelection)
+		if err != nil {
+			return err
+		}
+		result.Matched = len(selected)
+		rows, err := q.Query(`SELECT t.category_id, COALESCE(c.name, 'Uncategorized'), COUNT(*), array_agg(t.id)
+            FROM transactions t LEFT JOIN categories c ON c.id = t.category_id
+            WHERE t.id = ANY($1) AND t.category_id IS DISTINCT FROM $2
+            GROUP BY t.category_id, c.name
+            ORDER BY COUNT(*) DESC, c.name`, pq.Array(selected), req.CategoryID)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		for rows.Next() {
+			var g RecategorizeGroup
+			var groupIDs []int64
+			if err := rows.Scan(&g.CategoryID, &g.Category, &g.Count, pq.Array(&groupIDs)); err != nil {
+				rows.Close()
+				return err
+			}
+			result.From = append(result.From, g)
+			ids = append(ids, groupIDs...)
+		}
+		rows.Close()
+		if req.DryRun || len(ids) == 0 {
+			return nil
+		}
+		if err := checkBulkUnlocked(r, q, ids, &lockedOn); err != nil {
+			return err
+		}
+		before := make(map[int64][]byte, len(ids))
+		for _, id := range ids {
+			before[id] = snapshotResource(q, "transaction", int(id))
+			if err := saveTransactionVersion(q, int(id), u.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := q.Exec("UPDATE transactions SET category_id=$1 WHERE id = ANY($2)", req.CategoryID, pq.Array(ids)); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			writeAudit(q, u.ID, "transaction", int(id), auditUpdate, before[id])
+		}
+		result.Affected = len(ids)
+		return nil
+	})
+	if lockedOn != nil {
+		respondPeriodLocked(w, *lockedOn)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Bulk operation failed")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,113 @@
+// cashflow.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The cash flow report is a time series of income against spending, split
+// into weeks (starting Monday) or calendar months. Income and spending are
+// as in the monthly summary. Postgres does the bucketing, and fills in the
+// buckets nothing happened in so the series has no gaps.
+
+// --- MODELS ---
+type CashFlowPoint struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"` // last day of the period, inclusive
+	IncomeExpenseTotals
+}
+
+type CashFlowReport struct {
+	Interval string              `json:"interval"`
+	From     time.Time           `json:"from"`
+	To       time.Time           `json:"to"`
+	Total    IncomeExpenseTotals `json:"total"`
+	Series   []CashFlowPoint     `json:"series"`
+}
+
+// --- CASH FLOW HANDLERS ---
+
+// GetCashFlow returns a user's personal income, spending and net per
+// ?interval= ('week' or 'month', default month) over a date range, by
+// default the last twelve months. Periods at either end are cut to the
+// range.
+func GetCashFlow(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "month"
+	}
+	if interval != "week" && interval != "month" {
+		respondWithError(w, http.StatusBadRequest, "'interval' must be 'week' or 'month'")
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now).AddDate(0, -11, 0))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	if to.Before(from) {
+		respondWithError(w, http.StatusBadRequest, "'to' cannot be before 'from'")
+		return
+	}
+	rows, err := dbFor(r).Query(`
+        WITH buckets AS (
+            SELECT generate_series(date_trunc($4, $2::date::timestamp), $3::date::timestamp, ('1 ' || $4)::interval) AS start
+        )
+        SELECT b.start::date, COALESCE(-SUM(l.amount) FILTER (WHERE `+incomeLineSQL("l")+`), 0),
+            COALESCE(SUM(l.amount) FILTER (WHERE NOT (`+incomeLineSQL("l")+`)), 0)
+        FROM buckets b
+        LEFT JOIN transaction_lines l ON date_trunc($4, l.date::timestamp) = b.start
+            AND l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3::date + 1
+        GROUP BY b.start
+        ORDER BY b.start`, userID, from, to, interval)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build cash flow report")
+		return
+	}
+	defer rows.Close()
+	report := CashFlowReport{Interval: interval, From: from, To: to, Series: []CashFlowPoint{}}
+	var income, expenses float64
+	for rows.Next() {
+		var p CashFlowPoint
+		var in, out float64
+		if err := rows.Scan(&p.PeriodStart, &in, &out); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan cash flow report")
+			return
+		}
+		if interval == "week" {
+			p.PeriodEnd = p.PeriodStart.AddDate(0, 0, 6)
+		} else {
+			p.PeriodEnd = p.PeriodStart.AddDate(0, 1, -1)
+		}
+		if p.PeriodStart.Before(from) {
+			p.PeriodStart = from
+		}
+		if p.PeriodEnd.After(to) {
+			p.PeriodEnd = to
+		}
+		p.IncomeExpenseTotals = newIncomeExpenseTotals(in, out)
+		income, expenses = income+in, expenses+out
+		report.Series = append(report.Series, p)
+	}
+	report.Total = newIncomeExpenseTotals(income, expenses)
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,118 @@
+// categorybreakdown.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The category breakdown is the category report shaped for a pie or donut
+// chart: each slice carries its share of the total, so the client only has
+// to draw it. Income is left out, and so are categories whose refunds
+// outweigh their spending, since a slice can't be negative.
+
+// --- MODELS ---
+type CategoryBreakdownSlice struct {
+	CategoryID *int    `json:"category_id"`
+	Category   string  `json:"category"`
+	Total      float64 `json:"total"`
+	Percent    float64 `json:"percent"` // of the breakdown's total
+	Count      int     `json:"count"`   // expenses, not counting refunds
+}
+
+type CategoryBreakdown struct {
+	From       time.Time                `json:"from"`
+	To         time.Time                `json:"to"`
+	Total      float64                  `json:"total"`
+	Categories []CategoryBreakdownSlice `json:"categories"`
+}
+
+// --- CATEGORY BREAKDOWN HANDLERS ---
+
+// GetCategoryBreakdown totals a user's personal spending per category for a
+// date range (default: the current month) with each category's percentage of
+// the total and its number of transactions. Refunds and ?level=parent work
+// as in the category report.
+func GetCategoryBreakdown(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	if to.Before(from) {
+		respondWithError(w, http.StatusBadRequest, "'to' cannot be before 'from'")
+		return
+	}
+	mode, ok := refundReportMode(w, r)
+	if !ok {
+		return
+	}
+	level, ok := categoryReportLevel(w, r)
+	if !ok {
+		return
+	}
+	categoryID := "CASE WHEN o.id IS NULL THEN l.category_id ELSE o.category_id END"
+	query := `
+        SELECT c.id, COALESCE(c.name, 'Uncategorized'), SUM(l.amount),
+            COUNT(DISTINCT l.transaction_id) FILTER (WHERE l.linked_transaction_id IS NULL)
+        FROM transaction_lines l
+        LEFT JOIN transactions o ON o.id = l.linked_transaction_id`
+	if level == "parent" {
+		query = categoryRootsCTE + query + `
+        LEFT JOIN category_roots cr ON cr.id = ` + categoryID + `
+        LEFT JOIN categories c ON c.id = cr.root_id`
+	} else {
+		query += `
+        LEFT JOIN categories c ON c.id = ` + categoryID
+	}
+	query += `
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3::date + 1
+          AND NOT (` + incomeLineSQL("l") + `)`
+	if mode == "gross" {
+		query += " AND l.linked_transaction_id IS NULL"
+	}
+	query += `
+        GROUP BY c.id, c.name
+        HAVING SUM(l.amount) > 0
+        ORDER BY SUM(l.amount) DESC, 2`
+	rows, err := dbFor(r).Query(query, userID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build report")
+		return
+	}
+	defer rows.Close()
+	report := CategoryBreakdown{From: from, To: to, Categories: []CategoryBreakdownSlice{}}
+	for rows.Next() {
+		var c CategoryBreakdownSlice
+		if err := rows.Scan(&c.CategoryID, &c.Category, &c.Total, &c.Count); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan report row")
+			return
+		}
+		report.Total += c.Total
+		report.Categories = append(report.Categories, c)
+	}
+	report.Total = math.Round(report.Total*100) / 100
+	for i := range report.Categories {
+		report.Categories[i].Percent = math.Round(report.Categories[i].Total/report.Total*10000) / 100
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
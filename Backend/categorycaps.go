@@ -0,0 +1,153 @@
+// categorycaps.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A category cap is a monthly ceiling on a user's spending in one category,
+// separate from any budget. New transactions that take the month over the
+// cap get a warning, or are rejected when the cap is strict.
+
+const categoryCapWarningHeader = "X-Category-Cap-Warning"
+
+// --- MODELS ---
+type CategoryCap struct {
+	UserID     int     `json:"user_id"`
+	CategoryID int     `json:"category_id"`
+	MonthlyCap float64 `json:"monthly_cap"`
+	Strict     bool    `json:"strict"`
+	// Spent is the month-to-date spending in the category, on reads.
+	Spent float64 `json:"spent"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// enforceCategoryCap checks a new personal transaction against its
+// category's cap. Over a strict cap it responds with 422 and returns false;
+// over a soft cap it adds a warning to t and the response headers.
+func enforceCategoryCap(w http.ResponseWriter, r *http.Request, t *Transaction) bool {
+	if t.CategoryID == 0 || t.ExcludeFromBudget {
+		return true
+	}
+	var c CategoryCap
+	from := monthStart(t.Date)
+	err := dbFor(r).QueryRow(`SELECT monthly_cap, strict,
+            (SELECT COALESCE(SUM(l.amount), 0) FROM transaction_lines l
+             WHERE l.user_id = $1 AND l.organization_id IS NULL AND l.category_id = $2 AND NOT l.excluded AND l.date >= $3 AND l.date < $4)
+        FROM category_caps WHERE user_id=$1 AND category_id=$2`, t.UserID, t.CategoryID, from, from.AddDate(0, 1, 0)).
+		Scan(&c.MonthlyCap, &c.Strict, &c.Spent)
+	if err == sql.ErrNoRows {
+		return true
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check category cap")
+		return false
+	}
+	if t.Amount <= 0 || c.Spent+t.Amount <= c.MonthlyCap {
+		return true
+	}
+	msg := fmt.Sprintf("This takes %s spending in the category to %.2f, over its monthly cap of %.2f",
+		from.Format("January"), c.Spent+t.Amount, c.MonthlyCap)
+	if c.Strict {
+		respondWithError(w, http.StatusUnprocessableEntity, msg)
+		return false
+	}
+	t.Warnings = append(t.Warnings, msg)
+	w.Header().Add(categoryCapWarningHeader, msg)
+	return true
+}
+
+// capOwnerFromPath reads {user_id} and checks the caller may manage that
+// user's caps.
+func capOwnerFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return 0, false
+	}
+	return userID, authorizeOwner(w, r, userID)
+}
+
+// --- CATEGORY CAP HANDLERS ---
+
+// GetCategoryCaps lists a user's caps with what they have spent against
+// each so far this month.
+func GetCategoryCaps(w http.ResponseWriter, r *http.Request) {
+	userID, ok := capOwnerFromPath(w, r)
+	if !ok {
+		return
+	}
+	from := monthStart(time.Now())
+	rows, err := dbFor(r).Query(`SELECT k.user_id, k.category_id, k.monthly_cap, k.strict,
+            (SELECT COALESCE(SUM(l.amount), 0) FROM transaction_lines l
+             WHERE l.user_id = k.user_id AND l.organization_id IS NULL AND l.category_id = k.category_id AND NOT l.excluded
+               AND l.date >= $2 AND l.date < $3)
+        FROM category_caps k WHERE k.user_id=$1 ORDER BY k.category_id`, userID, from, from.AddDate(0, 1, 0))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve category caps")
+		return
+	}
+	defer rows.Close()
+	caps := []CategoryCap{}
+	for rows.Next() {
+		var c CategoryCap
+		if err := rows.Scan(&c.UserID, &c.CategoryID, &c.MonthlyCap, &c.Strict, &c.Spent); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category cap")
+			return
+		}
+		caps = append(caps, c)
+	}
+	respondWithJSON(w, http.StatusOK, caps)
+}
+
+func SetCategoryCap(w http.ResponseWriter, r *http.Request) {
+	userID, ok := capOwnerFromPath(w, r)
+	if !ok {
+		return
+	}
+	var c CategoryCap
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.CategoryID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if c.MonthlyCap <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Monthly cap must be positive")
+		return
+	}
+	if !authorizeCategory(w, c.CategoryID, resourceRef{OwnerID: userID}) {
+		return
+	}
+	c.UserID, c.Spent = userID, 0
+	_, err := dbFor(r).Exec(`INSERT INTO category_caps (user_id, category_id, monthly_cap, strict) VALUES ($1, $2, $3, $4)
+        ON CONFLICT (user_id, category_id) DO UPDATE SET monthly_cap = EXCLUDED.monthly_cap, strict = EXCLUDED.strict`,
+		c.UserID, c.CategoryID, c.MonthlyCap, c.Strict)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to set category cap")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, c)
+}
+
+func DeleteCategoryCap(w http.ResponseWriter, r *http.Request) {
+	userID, ok := capOwnerFromPath(w, r)
+	if !ok {
+		return
+	}
+	categoryID, err := strconv.Atoi(mux.Vars(r)["category_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	if _, err := dbFor(r).Exec("DELETE FROM category_caps WHERE user_id=$1 AND category_id=$2", userID, categoryID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete category cap")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category cap deleted successfully"})
+}
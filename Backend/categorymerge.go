@@ -0,0 +1,224 @@
+// categorymerge.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+
+// CategoryMerge is the body of POST /categories/{id}/merge and its response:
+// everything filed under the source category moves to TargetID and the
+// source is deleted.
+type CategoryMerge struct {
+	TargetID      int `json:"target_id"`
+	Transactions  int `json:"transactions"`
+	Splits        int `json:"splits"`
+	Allocations   int `json:"allocations"`
+	Subcategories int `json:"subcategories"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// validateMergeTarget checks that targetID is another category in the
+// source's ledger and not one of its subcategories, which would be left
+// without a place in the tree once the source is gone.
+func validateMergeTarget(w http.ResponseWriter, sourceID, targetID int, owner resourceRef) bool {
+	if targetID == 0 || targetID == sourceID {
+		respondWithError(w, http.StatusBadRequest, "target_id must be a different category")
+		return false
+	}
+	if !authorizeCategory(w, targetID, owner) {
+		return false
+	}
+	var descendant bool
+	err := db.QueryRow(`WITH RECURSIVE ancestors (id, parent_id) AS (
+            SELECT id, parent_id FROM categories WHERE id = $1
+            UNION
+            SELECT c.id, c.parent_id FROM categories c JOIN ancestors a ON c.id = a.parent_id
+        )
+        SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)`, targetID, sourceID).Scan(&descendant)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify target category")
+		return false
+	}
+	if descendant {
+		respondWithError(w, http.StatusBadRequest, "A category cannot be merged into one of its subcategories")
+		return false
+	}
+	return true
+}
+
+// authorizeMergeUnlocked refuses to merge away a category whose allocations
+// fall in a locked period. Transactions are checked inside the merge.
+func authorizeMergeUnlocked(w http.ResponseWriter, r *http.Request, categoryID int) bool {
+	rows, err := db.Query("SELECT DISTINCT user_id, month FROM category_allocations WHERE category_id=$1", categoryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check for closed periods")
+		return false
+	}
+	defer rows.Close()
+	type allocationMonth struct {
+		userID int
+		month  time.Time
+	}
+	var months []allocationMonth
+	for rows.Next() {
+		var m allocationMonth
+		if err := rows.Scan(&m.userID, &m.month); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check for closed periods")
+			return false
+		}
+		months = append(months, m)
+	}
+	for _, m := range months {
+		if !authorizeAllocationUnlocked(w, r, m.userID, m.month) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeCategory moves everything filed under sourceID to targetID and
+// deletes the source. Allocations for a month both categories have are
+// added together; a child's spending limit or a user's cap on the source is
+// kept only when the target has none.
+func mergeCategory(r *http.Request, q queryer, editorID, sourceID, targetID int, m *CategoryMerge, lockedOn **time.Time) error {
+	// Transactions filed under the source, plus those with a split on it,
+	// which must also be outside locked periods.
+	rows, err := q.Query(`SELECT t.id, COALESCE(t.category_id = $1, FALSE) FROM transactions t
+        WHERE t.category_id = $1 OR EXISTS (SELECT 1 FROM transaction_splits s WHERE s.transaction_id = t.id AND s.category_id = $1)`, sourceID)
+	if err != nil {
+		return err
+	}
+	var ids, filed []int64
+	for rows.Next() {
+		var id int64
+		var direct bool
+		if err := rows.Scan(&id, &direct); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		if direct {
+			filed = append(filed, id)
+		}
+	}
+	rows.Close()
+	if err := checkBulkUnlocked(r, q, ids, lockedOn); err != nil {
+		return err
+	}
+
+	for _, id := range filed {
+		before := snapshotResource(q, "transaction", int(id))
+		if err := saveTransactionVersion(q, int(id), editorID); err != nil {
+			return err
+		}
+		if _, err := q.Exec("UPDATE transactions SET category_id=$1 WHERE id=$2", targetID, id); err != nil {
+			return err
+		}
+		writeAudit(q, editorID, "transaction", int(id), auditUpdate, before)
+	}
+	m.Transactions = len(filed)
+
+	res, err := q.Exec("UPDATE transaction_splits SET category_id=$1 WHERE category_id=$2", targetID, sourceID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	m.Splits = int(n)
+
+	res, err = q.Exec(`INSERT INTO category_allocations (user_id, category_id, month, amount)
+        SELECT user_id, $1, month, amount FROM category_allocations WHERE category_id = $2
+        ON CONFLICT (user_id, category_id, month) DO UPDATE SET amount = category_allocations.amount + EXCLUDED.amount`, targetID, sourceID)
+	if err != nil {
+		return err
+	}
+	n, _ = res.RowsAffected()
+	m.Allocations = int(n)
+
+	res, err = q.Exec("UPDATE categories SET parent_id=$1 WHERE parent_id=$2", targetID, sourceID)
+	if err != nil {
+		return err
+	}
+	n, _ = res.RowsAffected()
+	m.Subcategories = int(n)
+
+	statements := []string{
+		`INSERT INTO child_category_limits (child_id, category_id, monthly_limit)
+            SELECT child_id, $1, monthly_limit FROM child_category_limits WHERE category_id = $2
+            ON CONFLICT DO NOTHING`,
+		`INSERT INTO category_caps (user_id, category_id, monthly_cap, strict)
+            SELECT user_id, $1, monthly_cap, strict FROM category_caps WHERE category_id = $2
+            ON CONFLICT DO NOTHING`,
+		"UPDATE pending_transactions SET category_id=$1 WHERE category_id=$2",
+		"UPDATE transaction_templates SET category_id=$1 WHERE category_id=$2",
+		"UPDATE transaction_versions SET category_id=$1 WHERE category_id=$2",
+		"UPDATE allocation_movements SET from_category_id=$1 WHERE from_category_id=$2",
+		"UPDATE allocation_movements SET to_category_id=$1 WHERE to_category_id=$2",
+	}
+	for _, stmt := range statements {
+		if _, err := q.Exec(stmt, targetID, sourceID); err != nil {
+			return err
+		}
+	}
+
+	before := snapshotResource(q, "category", sourceID)
+	if _, err := q.Exec("DELETE FROM categories WHERE id=$1", sourceID); err != nil {
+		return err
+	}
+	writeAudit(q, editorID, "category", sourceID, auditDelete, before)
+	return nil
+}
+
+// --- CATEGORY MERGE HANDLERS ---
+
+// MergeCategory folds a category into another in the same ledger, e.g. a
+// stray "Food" into "Groceries": its transactions, splits, allocations and
+// subcategories move to the target and the source is deleted, all in one
+// transaction.
+func MergeCategory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	sourceID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	if !authorizeResource(w, r, "category", sourceID) {
+		return
+	}
+	var m CategoryMerge
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	source, err := loadResource("category", sourceID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve category")
+		return
+	}
+	if !validateMergeTarget(w, sourceID, m.TargetID, source) {
+		return
+	}
+	if !authorizeMergeUnlocked(w, r, sourceID) {
+		return
+	}
+	u, _ := currentUser(r)
+	var lockedOn *time.Time
+	err = withTx(r, func(q queryer) error {
+		return mergeCategory(r, q, u.ID, sourceID, m.TargetID, &m, &lockedOn)
+	})
+	if lockedOn != nil {
+		respondPeriodLocked(w, *lockedOn)
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to merge categories")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, m)
+}
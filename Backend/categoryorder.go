@@ -0,0 +1,67 @@
+// categoryorder.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Users can arrange their categories, global ones included, in their own
+// order. Positions live in category_order per user; categories left out of
+// the arrangement list after the arranged ones.
+
+// --- MODELS ---
+type CategoryOrder struct {
+	CategoryIDs []int `json:"category_ids"`
+}
+
+// --- CATEGORY ORDER HANDLERS ---
+
+// ReorderCategories replaces the user's arrangement with the order of
+// category_ids. An empty list clears it.
+func ReorderCategories(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	var o CategoryOrder
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	seen := map[int]bool{}
+	for _, id := range o.CategoryIDs {
+		if id == 0 || seen[id] {
+			respondWithError(w, http.StatusBadRequest, "category_ids must list each category once")
+			return
+		}
+		seen[id] = true
+		if !authorizeCategory(w, id, resourceRef{OwnerID: userID}) {
+			return
+		}
+	}
+	err = withTx(r, func(q queryer) error {
+		if _, err := q.Exec("DELETE FROM category_order WHERE user_id=$1", userID); err != nil {
+			return err
+		}
+		for i, id := range o.CategoryIDs {
+			if _, err := q.Exec("INSERT INTO category_order (user_id, category_id, sort_order) VALUES ($1, $2, $3)", userID, id, i+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save category order")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Categories reordered successfully"})
+}
@@ -0,0 +1,123 @@
+// categorysummary.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+
+// CategorySummary is one category's spending in a period next to the
+// period before it. ChangePercent is null when nothing was spent before.
+type CategorySummary struct {
+	CategoryID    *int     `json:"category_id"`
+	Category      string   `json:"category"`
+	Total         float64  `json:"total"`
+	Count         int      `json:"count"`
+	PreviousTotal float64  `json:"previous_total"`
+	PreviousCount int      `json:"previous_count"`
+	Change        float64  `json:"change"`
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+type CategorySummaryReport struct {
+	Period              string            `json:"period"`
+	PeriodStart         time.Time         `json:"period_start"`
+	PeriodEnd           time.Time         `json:"period_end"`
+	PreviousPeriodStart time.Time         `json:"previous_period_start"`
+	Categories          []CategorySummary `json:"categories"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// summaryPeriod returns the calendar week (from Monday), month or year
+// containing date, and the start of the one before it.
+func summaryPeriod(period string, date time.Time) (prev, start, end time.Time, ok bool) {
+	day := dateOnly(date, date.Location())
+	switch period {
+	case frequencyWeekly:
+		start = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start.AddDate(0, 0, -7), start, start.AddDate(0, 0, 7), true
+	case frequencyMonthly:
+		start = monthStart(day)
+		return start.AddDate(0, -1, 0), start, start.AddDate(0, 1, 0), true
+	case frequencyYearly:
+		start = time.Date(day.Year(), 1, 1, 0, 0, 0, 0, day.Location())
+		return start.AddDate(-1, 0, 0), start, start.AddDate(1, 0, 0), true
+	}
+	return time.Time{}, time.Time{}, time.Time{}, false
+}
+
+// percentChange is the change from previous to current as a percentage of
+// previous, or nil when previous is zero.
+func percentChange(previous, current float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	p := math.Round((current-previous)/math.Abs(previous)*10000) / 100
+	return &p
+}
+
+// --- CATEGORY SUMMARY HANDLERS ---
+
+// GetCategorySummary totals a user's personal spending per category for the
+// ?period= ('weekly', 'monthly' or 'yearly'; default monthly) containing
+// ?date= (default today), with transaction counts and the change from the
+// previous period.
+func GetCategorySummary(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	date, err := parseDateParam(r, "date", time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = frequencyMonthly
+	}
+	prev, start, end, ok := summaryPeriod(period, date)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "'period' must be 'weekly', 'monthly' or 'yearly'")
+		return
+	}
+	rows, err := dbFor(r).Query(`
+        SELECT l.category_id, COALESCE(c.name, 'Uncategorized'),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.date >= $2), 0), COUNT(DISTINCT l.transaction_id) FILTER (WHERE l.date >= $2),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.date < $2), 0), COUNT(DISTINCT l.transaction_id) FILTER (WHERE l.date < $2)
+        FROM transaction_lines l
+        LEFT JOIN categories c ON c.id = l.category_id
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $3 AND l.date < $4
+        GROUP BY l.category_id, c.name
+        ORDER BY 3 DESC, 2`, userID, start, prev, end)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build category summary")
+		return
+	}
+	defer rows.Close()
+	report := CategorySummaryReport{Period: period, PeriodStart: start, PeriodEnd: end.AddDate(0, 0, -1), PreviousPeriodStart: prev,
+		Categories: []CategorySummary{}}
+	for rows.Next() {
+		var c CategorySummary
+		if err := rows.Scan(&c.CategoryID, &c.Category, &c.Total, &c.Count, &c.PreviousTotal, &c.PreviousCount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category summary")
+			return
+		}
+		c.Change = math.Round((c.Total-c.PreviousTotal)*100) / 100
+		c.ChangePercent = percentChange(c.PreviousTotal, c.Total)
+		report.Categories = append(report.Categories, c)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,208 @@
+// categorytemplates.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// New accounts start with a set of categories from a template so they
+// aren't empty. Templates come from the JSON file named by
+// CATEGORY_TEMPLATES_FILE, or the built-in set below; DEFAULT_CATEGORY_TEMPLATE
+// picks the one applied on registration ("none" turns seeding off).
+
+// --- MODELS ---
+type CategoryTemplate struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Categories  []CategoryTemplateItem `json:"categories"`
+}
+
+type CategoryTemplateItem struct {
+	Name              string   `json:"name"`
+	Subcategories     []string `json:"subcategories,omitempty"`
+	ExcludeFromBudget bool     `json:"exclude_from_budget,omitempty"`
+}
+
+// CategoryTemplateApplication is the body of POST
+// /category-templates/{name}/apply and its response.
+type CategoryTemplateApplication struct {
+	UserID  int `json:"user_id"`
+	Created int `json:"created"`
+}
+
+var builtinCategoryTemplates = []CategoryTemplate{
+	{
+		Name:        "standard",
+		Description: "Everyday household spending",
+		Categories: []CategoryTemplateItem{
+			{Name: "Housing", Subcategories: []string{"Rent", "Utilities"}},
+			{Name: "Food", Subcategories: []string{"Groceries", "Dining Out"}},
+			{Name: "Transport", Subcategories: []string{"Fuel", "Public Transit"}},
+			{Name: "Health"},
+			{Name: "Entertainment"},
+			{Name: "Shopping"},
+			{Name: "Savings"},
+		},
+	},
+	{
+		Name:        "student",
+		Description: "A lean set for students",
+		Categories: []CategoryTemplateItem{
+			{Name: "Rent"},
+			{Name: "Groceries"},
+			{Name: "Tuition", Subcategories: []string{"Books", "Fees"}},
+			{Name: "Transport"},
+			{Name: "Entertainment"},
+		},
+	},
+	{
+		Name:        "freelancer",
+		Description: "Personal spending plus reimbursable business costs",
+		Categories: []CategoryTemplateItem{
+			{Name: "Housing", Subcategories: []string{"Rent", "Utilities"}},
+			{Name: "Food", Subcategories: []string{"Groceries", "Dining Out"}},
+			{Name: "Taxes"},
+			{Name: "Business Expenses", Subcategories: []string{"Software", "Equipment"}, ExcludeFromBudget: true},
+		},
+	},
+}
+
+// categoryTemplates is the configured template set; defaultCategoryTemplate
+// names the one applied to new accounts, or is empty when seeding is off.
+var (
+	categoryTemplates       = builtinCategoryTemplates
+	defaultCategoryTemplate = "standard"
+)
+
+func initCategoryTemplates() error {
+	if path := os.Getenv("CATEGORY_TEMPLATES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var templates []CategoryTemplate
+		if err := json.Unmarshal(data, &templates); err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if len(templates) == 0 {
+			return fmt.Errorf("%s defines no templates", path)
+		}
+		categoryTemplates = templates
+		defaultCategoryTemplate = templates[0].Name
+	}
+	switch name := os.Getenv("DEFAULT_CATEGORY_TEMPLATE"); name {
+	case "":
+	case "none":
+		defaultCategoryTemplate = ""
+	default:
+		defaultCategoryTemplate = name
+	}
+	if defaultCategoryTemplate == "" {
+		log.Println("DEFAULT_CATEGORY_TEMPLATE is 'none'; new accounts start without categories.")
+	} else if findCategoryTemplate(defaultCategoryTemplate) == nil {
+		return fmt.Errorf("default category template %q is not defined", defaultCategoryTemplate)
+	}
+	return nil
+}
+
+// --- HELPER FUNCTIONS ---
+
+func findCategoryTemplate(name string) *CategoryTemplate {
+	for i := range categoryTemplates {
+		if strings.EqualFold(categoryTemplates[i].Name, name) {
+			return &categoryTemplates[i]
+		}
+	}
+	return nil
+}
+
+// applyCategoryTemplate adds the template's categories to the user's
+// personal ledger and returns how many it created. Categories the user
+// already has by name, or that exist as global categories, are kept as they
+// are, so a template can be re-applied safely; missing subcategories are
+// nested under the existing parent.
+func applyCategoryTemplate(q queryer, actorID, userID int, t *CategoryTemplate) (int, error) {
+	created := 0
+	ensure := func(name string, parentID *int, exclude bool) (int, error) {
+		var id int
+		err := q.QueryRow("SELECT id FROM categories WHERE is_global AND name=$1", name).Scan(&id)
+		if err != sql.ErrNoRows {
+			return id, err
+		}
+		err = q.QueryRow(`INSERT INTO categories (user_id, name, parent_id, exclude_from_budget) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (user_id, name) WHERE organization_id IS NULL DO NOTHING RETURNING id`,
+			userID, name, parentID, exclude).Scan(&id)
+		if err != sql.ErrNoRows {
+			if err == nil {
+				created++
+				writeAudit(q, actorID, "category", id, auditCreate, nil)
+			}
+			return id, err
+		}
+		err = q.QueryRow("SELECT id FROM categories WHERE user_id=$1 AND organization_id IS NULL AND name=$2", userID, name).Scan(&id)
+		return id, err
+	}
+	for _, item := range t.Categories {
+		parentID, err := ensure(item.Name, nil, item.ExcludeFromBudget)
+		if err != nil {
+			return 0, err
+		}
+		for _, sub := range item.Subcategories {
+			if _, err := ensure(sub, &parentID, item.ExcludeFromBudget); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return created, nil
+}
+
+// --- CATEGORY TEMPLATE HANDLERS ---
+
+func GetCategoryTemplates(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireUser(w, r); !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"default":   defaultCategoryTemplate,
+		"templates": categoryTemplates,
+	})
+}
+
+// ApplyCategoryTemplate adds a template's categories to an existing
+// account, skipping any it already has.
+func ApplyCategoryTemplate(w http.ResponseWriter, r *http.Request) {
+	t := findCategoryTemplate(mux.Vars(r)["name"])
+	if t == nil {
+		respondWithError(w, http.StatusNotFound, "Category template not found")
+		return
+	}
+	var a CategoryTemplateApplication
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	if !authorizeBodyOwner(w, r, &a.UserID) {
+		return
+	}
+	u, _ := currentUser(r)
+	err := withTx(r, func(q queryer) error {
+		var err error
+		a.Created, err = applyCategoryTemplate(q, u.ID, a.UserID, t)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to apply category template")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, a)
+}
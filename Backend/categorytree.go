@@ -0,0 +1,71 @@
+// categorytree.go
+package main
+
+import (
+	"net/http"
+)
+
+// Categories can be nested under a parent in the same ledger, e.g. Food >
+// Groceries. Transactions keep pointing at whichever category they were
+// filed under; reports roll children up into their top-level category on
+// request.
+
+// categoryRootsCTE maps every category to its top-level ancestor. Prefix a
+// query with it and join category_roots on id.
+const categoryRootsCTE = `WITH RECURSIVE category_roots (id, root_id) AS (
+        SELECT id, id FROM categories WHERE parent_id IS NULL
+        UNION ALL
+        SELECT c.id, r.root_id FROM categories c JOIN category_roots r ON c.parent_id = r.id
+    )`
+
+// --- HELPER FUNCTIONS ---
+
+// validateCategoryParent checks that parentID may become the parent of
+// categoryID (0 for a new category): it must be in the same ledger and must
+// not be the category itself or one of its descendants.
+func validateCategoryParent(w http.ResponseWriter, categoryID int, parentID *int, owner resourceRef) bool {
+	if parentID == nil {
+		return true
+	}
+	if *parentID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid parent category")
+		return false
+	}
+	if !authorizeCategory(w, *parentID, owner) {
+		return false
+	}
+	if categoryID == 0 {
+		return true
+	}
+	var cycle bool
+	err := db.QueryRow(`WITH RECURSIVE ancestors (id, parent_id) AS (
+            SELECT id, parent_id FROM categories WHERE id = $1
+            UNION
+            SELECT c.id, c.parent_id FROM categories c JOIN ancestors a ON c.id = a.parent_id
+        )
+        SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2)`, *parentID, categoryID).Scan(&cycle)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify parent category")
+		return false
+	}
+	if cycle {
+		respondWithError(w, http.StatusBadRequest, "A category cannot be nested under itself or one of its subcategories")
+		return false
+	}
+	return true
+}
+
+// categoryReportLevel reads ?level=: "category" (the default) reports each
+// category on its own, "parent" rolls subcategories into their top-level
+// category.
+func categoryReportLevel(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch level := r.URL.Query().Get("level"); level {
+	case "", "category":
+		return "category", true
+	case "parent":
+		return "parent", true
+	default:
+		respondWithError(w, http.StatusBadRequest, "'level' must be 'category' or 'parent'")
+		return "", false
+	}
+}
@@ -0,0 +1,513 @@
+// childaccounts.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- MODELS ---
+type ChildAccount struct {
+	ID                int      `json:"id"`
+	Username          string   `json:"username"`
+	Password          string   `json:"password,omitempty"`
+	ParentID          int      `json:"parent_id"`
+	Allowance         float64  `json:"allowance"`
+	ApprovalThreshold *float64 `json:"approval_threshold"`
+}
+
+type CategoryLimit struct {
+	ChildID      int     `json:"child_id"`
+	CategoryID   int     `json:"category_id"`
+	MonthlyLimit float64 `json:"monthly_limit"`
+}
+
+type PendingTransaction struct {
+	ID            int        `json:"id"`
+	ChildID       int        `json:"child_id"`
+	Description   string     `json:"description"`
+	Amount        float64    `json:"amount"`
+	Date          time.Time  `json:"date"`
+	CategoryID    int        `json:"category_id"`
+	Status        string     `json:"status"`
+	TransactionID *int       `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+}
+
+type AllowanceCredit struct {
+	ID        int       `json:"id"`
+	ChildID   int       `json:"child_id"`
+	Amount    float64   `json:"amount"`
+	Period    time.Time `json:"period"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AllowanceSummary struct {
+	ChildID  int               `json:"child_id"`
+	Credited float64           `json:"credited"`
+	Spent    float64           `json:"spent"`
+	Balance  float64           `json:"balance"`
+	Credits  []AllowanceCredit `json:"credits"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// childParentID returns the parent of a child account; it is not Valid for
+// ordinary accounts.
+func childParentID(userID int) (sql.NullInt64, error) {
+	var parentID sql.NullInt64
+	err := db.QueryRow("SELECT parent_id FROM users WHERE id=$1", userID).Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return parentID, nil
+	}
+	return parentID, err
+}
+
+func isParentOf(parentID, childID int) (bool, error) {
+	p, err := childParentID(childID)
+	return p.Valid && int(p.Int64) == parentID, err
+}
+
+// authorizeParent checks the caller is the parent of the child in the path
+// (or a site admin) and returns the child's ID.
+func authorizeParent(w http.ResponseWriter, r *http.Request) (int, bool) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return 0, false
+	}
+	childID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return 0, false
+	}
+	parentID, err := childParentID(childID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify child account")
+		return 0, false
+	}
+	if !parentID.Valid || (int(parentID.Int64) != u.ID && u.Role != "admin") {
+		respondWithError(w, http.StatusNotFound, "Child account not found")
+		return 0, false
+	}
+	return childID, true
+}
+
+// enforceChildLimits applies a parent's rules to a transaction in a child's
+// ledger: category caps are rejected outright, and amounts above the approval
+// threshold are reported as needing approval. Parents and admins are exempt.
+// excludeID is the transaction being edited, if any.
+func enforceChildLimits(w http.ResponseWriter, r *http.Request, t Transaction, excludeID int) (needsApproval bool, ok bool) {
+	u, _ := currentUser(r)
+	parentID, err := childParentID(t.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify child account")
+		return false, false
+	}
+	if !parentID.Valid || int(parentID.Int64) == u.ID || u.Role == "admin" {
+		return false, true
+	}
+
+	if t.CategoryID != 0 {
+		var limit float64
+		err := db.QueryRow("SELECT monthly_limit FROM child_category_limits WHERE child_id=$1 AND category_id=$2", t.UserID, t.CategoryID).Scan(&limit)
+		if err != nil && err != sql.ErrNoRows {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check spending limit")
+			return false, false
+		}
+		if err == nil {
+			date := t.Date
+			if date.IsZero() {
+				date = time.Now()
+			}
+			from := monthStart(date)
+			var spent float64
+			err := db.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM transactions
+                WHERE user_id=$1 AND category_id=$2 AND date >= $3 AND date < $4 AND id <> $5 AND deleted_at IS NULL`,
+				t.UserID, t.CategoryID, from, from.AddDate(0, 1, 0), excludeID).Scan(&spent)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to check spending limit")
+				return false, false
+			}
+			if spent+t.Amount > limit {
+				respondWithError(w, http.StatusForbidden, "Spending limit for this category exceeded")
+				return false, false
+			}
+		}
+	}
+
+	var threshold sql.NullFloat64
+	err = db.QueryRow("SELECT approval_threshold FROM child_settings WHERE child_id=$1", t.UserID).Scan(&threshold)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check approval threshold")
+		return false, false
+	}
+	return threshold.Valid && t.Amount > threshold.Float64, true
+}
+
+// submitForApproval queues a child's transaction for their parent instead of
+// recording it.
+func submitForApproval(w http.ResponseWriter, t Transaction) {
+	p := PendingTransaction{ChildID: t.UserID, Description: t.Description, Amount: t.Amount, Date: t.Date, CategoryID: t.CategoryID}
+	var categoryID sql.NullInt64
+	if t.CategoryID != 0 {
+		categoryID = sql.NullInt64{Int64: int64(t.CategoryID), Valid: true}
+	}
+	err := db.QueryRow(`INSERT INTO pending_transactions (child_id, description, amount, date, category_id)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id, status, created_at`,
+		p.ChildID, p.Description, p.Amount, p.Date, categoryID).Scan(&p.ID, &p.Status, &p.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to submit transaction for approval")
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, p)
+}
+
+// creditAllowances adds this month's allowance for every child that has one.
+// The unique (child_id, period) constraint makes it safe to run repeatedly.
+func creditAllowances() error {
+	res, err := db.Exec(`
+        INSERT INTO allowance_credits (child_id, amount, period)
+        SELECT child_id, allowance, date_trunc('month', NOW())::date
+        FROM child_settings
+        WHERE allowance > 0
+        ON CONFLICT (child_id, period) DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Credited monthly allowance to %d child accounts.", n)
+	}
+	return nil
+}
+
+// --- CHILD ACCOUNT HANDLERS ---
+
+func CreateChildAccount(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	if parentID, err := childParentID(u.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	} else if parentID.Valid {
+		respondWithError(w, http.StatusForbidden, "Child accounts cannot create child accounts")
+		return
+	}
+	var c ChildAccount
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || strings.TrimSpace(c.Username) == "" || c.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if c.Allowance < 0 || (c.ApprovalThreshold != nil && *c.ApprovalThreshold < 0) {
+		respondWithError(w, http.StatusBadRequest, "Allowance and approval threshold cannot be negative")
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(c.Password), 8)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to hash password")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create child account")
+		return
+	}
+	defer tx.Rollback()
+	c.ParentID = u.ID
+	err = tx.QueryRow("INSERT INTO users (username, password, parent_id) VALUES ($1, $2, $3) RETURNING id",
+		c.Username, string(hashedPassword), c.ParentID).Scan(&c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create child account. The username may be taken.")
+		return
+	}
+	_, err = tx.Exec("INSERT INTO child_settings (child_id, allowance, approval_threshold) VALUES ($1, $2, $3)",
+		c.ID, c.Allowance, c.ApprovalThreshold)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create child account")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create child account")
+		return
+	}
+	c.Password = ""
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+func GetChildAccounts(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT u.id, u.username, u.parent_id, COALESCE(s.allowance, 0), s.approval_threshold
+        FROM users u
+        LEFT JOIN child_settings s ON s.child_id = u.id
+        WHERE u.parent_id = $1
+        ORDER BY u.username`
+	rows, err := db.Query(query, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve child accounts")
+		return
+	}
+	defer rows.Close()
+	var children []ChildAccount
+	for rows.Next() {
+		var c ChildAccount
+		if err := rows.Scan(&c.ID, &c.Username, &c.ParentID, &c.Allowance, &c.ApprovalThreshold); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan child account")
+			return
+		}
+		children = append(children, c)
+	}
+	respondWithJSON(w, http.StatusOK, children)
+}
+
+func UpdateChildSettings(w http.ResponseWriter, r *http.Request) {
+	childID, ok := authorizeParent(w, r)
+	if !ok {
+		return
+	}
+	var c ChildAccount
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if c.Allowance < 0 || (c.ApprovalThreshold != nil && *c.ApprovalThreshold < 0) {
+		respondWithError(w, http.StatusBadRequest, "Allowance and approval threshold cannot be negative")
+		return
+	}
+	_, err := db.Exec(`INSERT INTO child_settings (child_id, allowance, approval_threshold) VALUES ($1, $2, $3)
+        ON CONFLICT (child_id) DO UPDATE SET allowance = EXCLUDED.allowance, approval_threshold = EXCLUDED.approval_threshold`,
+		childID, c.Allowance, c.ApprovalThreshold)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update child settings")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Child settings updated successfully"})
+}
+
+// --- SPENDING LIMIT HANDLERS ---
+
+func GetCategoryLimits(w http.ResponseWriter, r *http.Request) {
+	childID, ok := authorizeParent(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT child_id, category_id, monthly_limit FROM child_category_limits WHERE child_id=$1 ORDER BY category_id", childID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve spending limits")
+		return
+	}
+	defer rows.Close()
+	var limits []CategoryLimit
+	for rows.Next() {
+		var l CategoryLimit
+		if err := rows.Scan(&l.ChildID, &l.CategoryID, &l.MonthlyLimit); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan spending limit")
+			return
+		}
+		limits = append(limits, l)
+	}
+	respondWithJSON(w, http.StatusOK, limits)
+}
+
+func SetCategoryLimit(w http.ResponseWriter, r *http.Request) {
+	childID, ok := authorizeParent(w, r)
+	if !ok {
+		return
+	}
+	var l CategoryLimit
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil || l.CategoryID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if l.MonthlyLimit < 0 {
+		respondWithError(w, http.StatusBadRequest, "Monthly limit cannot be negative")
+		return
+	}
+	if !authorizeCategory(w, l.CategoryID, resourceRef{OwnerID: childID}) {
+		return
+	}
+	l.ChildID = childID
+	_, err := db.Exec(`INSERT INTO child_category_limits (child_id, category_id, monthly_limit) VALUES ($1, $2, $3)
+        ON CONFLICT (child_id, category_id) DO UPDATE SET monthly_limit = EXCLUDED.monthly_limit`,
+		l.ChildID, l.CategoryID, l.MonthlyLimit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to set spending limit")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, l)
+}
+
+func DeleteCategoryLimit(w http.ResponseWriter, r *http.Request) {
+	childID, ok := authorizeParent(w, r)
+	if !ok {
+		return
+	}
+	categoryID, err := strconv.Atoi(mux.Vars(r)["category_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	_, err = db.Exec("DELETE FROM child_category_limits WHERE child_id=$1 AND category_id=$2", childID, categoryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete spending limit")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Spending limit deleted successfully"})
+}
+
+// --- ALLOWANCE HANDLERS ---
+
+// GetAllowance returns a child's allowance credits and what is left after
+// their spending. Visible to the child and their parent.
+func GetAllowance(w http.ResponseWriter, r *http.Request) {
+	childID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, childID) {
+		return
+	}
+	summary := AllowanceSummary{ChildID: childID, Credits: []AllowanceCredit{}}
+	rows, err := db.Query("SELECT id, child_id, amount, period, created_at FROM allowance_credits WHERE child_id=$1 ORDER BY period DESC", childID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve allowance")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c AllowanceCredit
+		if err := rows.Scan(&c.ID, &c.ChildID, &c.Amount, &c.Period, &c.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan allowance credit")
+			return
+		}
+		summary.Credited += c.Amount
+		summary.Credits = append(summary.Credits, c)
+	}
+	err = db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE user_id=$1 AND organization_id IS NULL AND deleted_at IS NULL", childID).Scan(&summary.Spent)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve allowance")
+		return
+	}
+	summary.Balance = summary.Credited - summary.Spent
+	respondWithJSON(w, http.StatusOK, summary)
+}
+
+// --- APPROVAL HANDLERS ---
+
+// GetPendingApprovals lists pending transactions the caller can act on (their
+// children's) or is waiting on (their own).
+func GetPendingApprovals(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT p.id, p.child_id, COALESCE(p.description, ''), p.amount, p.date, COALESCE(p.category_id, 0), p.status, p.created_at
+        FROM pending_transactions p
+        JOIN users c ON c.id = p.child_id
+        WHERE p.status = 'pending' AND (c.parent_id = $1 OR p.child_id = $1)
+        ORDER BY p.created_at`
+	rows, err := db.Query(query, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve pending approvals")
+		return
+	}
+	defer rows.Close()
+	var pending []PendingTransaction
+	for rows.Next() {
+		var p PendingTransaction
+		if err := rows.Scan(&p.ID, &p.ChildID, &p.Description, &p.Amount, &p.Date, &p.CategoryID, &p.Status, &p.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan pending transaction")
+			return
+		}
+		pending = append(pending, p)
+	}
+	respondWithJSON(w, http.StatusOK, pending)
+}
+
+func ApproveTransaction(w http.ResponseWriter, r *http.Request) {
+	decidePendingTransaction(w, r, true)
+}
+
+func RejectTransaction(w http.ResponseWriter, r *http.Request) {
+	decidePendingTransaction(w, r, false)
+}
+
+// decidePendingTransaction records the parent's decision; approval copies the
+// queued transaction into the child's ledger.
+func decidePendingTransaction(w http.ResponseWriter, r *http.Request, approve bool) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	pendingID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid approval ID")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update approval")
+		return
+	}
+	defer tx.Rollback()
+
+	var p PendingTransaction
+	var categoryID sql.NullInt64
+	var parentID sql.NullInt64
+	err = tx.QueryRow(`
+        SELECT p.id, p.child_id, COALESCE(p.description, ''), p.amount, p.date, p.category_id, c.parent_id
+        FROM pending_transactions p
+        JOIN users c ON c.id = p.child_id
+        WHERE p.id = $1 AND p.status = 'pending'
+        FOR UPDATE OF p`, pendingID).Scan(&p.ID, &p.ChildID, &p.Description, &p.Amount, &p.Date, &categoryID, &parentID)
+	if err == nil && !(parentID.Valid && int(parentID.Int64) == u.ID) && u.Role != "admin" {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Pending transaction not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update approval")
+		return
+	}
+
+	p.Status = "rejected"
+	if approve {
+		p.Status = "approved"
+		var transactionID int
+		err = tx.QueryRow("INSERT INTO transactions (user_id, description, amount, date, category_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			p.ChildID, p.Description, p.Amount, p.Date, categoryID).Scan(&transactionID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to record transaction")
+			return
+		}
+		p.TransactionID = &transactionID
+		writeAudit(tx, u.ID, "transaction", transactionID, auditCreate, nil)
+	}
+	_, err = tx.Exec("UPDATE pending_transactions SET status=$1, transaction_id=$2, decided_at=NOW() WHERE id=$3",
+		p.Status, p.TransactionID, p.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update approval")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update approval")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction " + p.Status})
+}
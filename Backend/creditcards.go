@@ -0,0 +1,235 @@
+// creditcards.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Credit card accounts with a statement cycle close a statement on the same
+// day each month. Its balance is what the card owed at the close, due
+// payment_due_days later. Payments are credits on the card, linked to the
+// statement they pay off; by default that is the last one to close before
+// the payment.
+
+// --- MODELS ---
+
+// CreditCardStatement reports one statement. Balances are what the card
+// owes, so they are positive while it is in debt.
+type CreditCardStatement struct {
+	AccountID        int                `json:"account_id"`
+	PeriodStart      time.Time          `json:"period_start"`
+	StatementDate    time.Time          `json:"statement_date"`
+	DueDate          time.Time          `json:"due_date"`
+	StatementBalance float64            `json:"statement_balance"`
+	Paid             float64            `json:"paid"`
+	RemainingDue     float64            `json:"remaining_due"`
+	Overdue          bool               `json:"overdue"`
+	CurrentBalance   float64            `json:"current_balance"`
+	Payments         []StatementPayment `json:"payments"`
+}
+
+type StatementPayment struct {
+	TransactionID int       `json:"transaction_id"`
+	StatementDate time.Time `json:"statement_date"`
+	Date          time.Time `json:"date"`
+	Amount        float64   `json:"amount"`
+}
+
+// StatementPaymentLink is the body of the link route; statement_date
+// (YYYY-MM-DD) defaults to the statement the payment follows.
+type StatementPaymentLink struct {
+	TransactionID int    `json:"transaction_id"`
+	StatementDate string `json:"statement_date"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// statementClose returns the day a card that closes on day closes in the
+// month of m, clamped to the month's last day.
+func statementClose(day int, m time.Time) time.Time {
+	first := monthStart(m)
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// statementCycle returns the latest statement close on or before date and
+// the close before it.
+func statementCycle(day int, date time.Time) (prevClosing, closing time.Time) {
+	date = dateOnly(date, date.Location())
+	closing = statementClose(day, date)
+	if closing.After(date) {
+		closing = statementClose(day, monthStart(date).AddDate(0, -1, 0))
+	}
+	return statementClose(day, monthStart(closing).AddDate(0, -1, 0)), closing
+}
+
+// creditCardFromPath reads {id}, checks the caller owns the account, and
+// loads it, requiring a credit card with a statement cycle.
+func creditCardFromPath(w http.ResponseWriter, r *http.Request) (Account, bool) {
+	var a Account
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return a, false
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return a, false
+	}
+	if a, err = loadAccount(dbFor(r), accountID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return a, false
+	}
+	if a.Type != accountCreditCard || a.StatementDay == nil {
+		respondWithError(w, http.StatusBadRequest, "Account is not a credit card with a statement cycle")
+		return a, false
+	}
+	return a, true
+}
+
+// creditCardStatement builds the statement of a that closed on closing.
+func creditCardStatement(q queryer, a Account, prevClosing, closing time.Time, now time.Time) (CreditCardStatement, error) {
+	s := CreditCardStatement{
+		AccountID:     a.ID,
+		PeriodStart:   prevClosing.AddDate(0, 0, 1),
+		StatementDate: closing,
+		DueDate:       closing.AddDate(0, 0, *a.PaymentDueDays),
+		Payments:      []StatementPayment{},
+	}
+	err := q.QueryRow(`SELECT COALESCE(SUM(`+accountAmountSQL+`) FILTER (WHERE t.date < $2), 0) - a.opening_balance
+        FROM accounts a
+        LEFT JOIN transactions t ON t.account_id = a.id AND t.deleted_at IS NULL
+        WHERE a.id = $1 GROUP BY a.id`, a.ID, closing.AddDate(0, 0, 1)).Scan(&s.StatementBalance)
+	if err != nil {
+		return s, err
+	}
+	rows, err := q.Query(`SELECT t.id, p.statement_date, t.date, -(`+accountAmountSQL+`)
+        FROM statement_payments p
+        JOIN transactions t ON t.id = p.transaction_id
+        JOIN accounts a ON a.id = p.account_id
+        WHERE p.account_id = $1 AND p.statement_date = $2 AND t.deleted_at IS NULL
+        ORDER BY t.date, t.id`, a.ID, closing)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+	var paid int64
+	for rows.Next() {
+		var p StatementPayment
+		if err := rows.Scan(&p.TransactionID, &p.StatementDate, &p.Date, &p.Amount); err != nil {
+			return s, err
+		}
+		paid += toCents(p.Amount)
+		s.Payments = append(s.Payments, p)
+	}
+	if err := rows.Err(); err != nil {
+		return s, err
+	}
+	s.Paid = float64(paid) / 100
+	s.RemainingDue = math.Max(float64(toCents(s.StatementBalance)-paid)/100, 0)
+	s.Overdue = s.RemainingDue > 0 && dateOnly(now, now.Location()).After(s.DueDate)
+	s.CurrentBalance = -a.Balance
+	return s, nil
+}
+
+// --- CREDIT CARD HANDLERS ---
+
+// GetCreditCardStatement returns the statement that closed on or before
+// ?date= (default today), with what is due, by when, and the payments
+// linked to it.
+func GetCreditCardStatement(w http.ResponseWriter, r *http.Request) {
+	a, ok := creditCardFromPath(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	date, err := parseDateParam(r, "date", now)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+		return
+	}
+	prevClosing, closing := statementCycle(*a.StatementDay, date)
+	s, err := creditCardStatement(dbFor(r), a, prevClosing, closing, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build statement")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// LinkStatementPayment records which statement a payment on the card pays
+// off. Linking an already linked payment moves it.
+func LinkStatementPayment(w http.ResponseWriter, r *http.Request) {
+	a, ok := creditCardFromPath(w, r)
+	if !ok {
+		return
+	}
+	var link StatementPaymentLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil || link.TransactionID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	var date time.Time
+	var amount float64
+	err := dbFor(r).QueryRow("SELECT date, amount FROM transactions WHERE id=$1 AND account_id=$2 AND deleted_at IS NULL",
+		link.TransactionID, a.ID).Scan(&date, &amount)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusBadRequest, "Transaction is not on this account")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify transaction")
+		return
+	}
+	if amount >= 0 {
+		respondWithError(w, http.StatusBadRequest, "Only payments (credits to the card) can be linked to a statement")
+		return
+	}
+	p := StatementPayment{TransactionID: link.TransactionID, Date: date, Amount: -amount}
+	if link.StatementDate == "" {
+		_, p.StatementDate = statementCycle(*a.StatementDay, date.AddDate(0, 0, -1))
+	} else {
+		p.StatementDate, err = time.Parse("2006-01-02", link.StatementDate)
+		if err != nil || !statementClose(*a.StatementDay, p.StatementDate).Equal(p.StatementDate) {
+			respondWithError(w, http.StatusBadRequest, "'statement_date' must be a day this card's statement closes")
+			return
+		}
+	}
+	_, err = dbFor(r).Exec(`INSERT INTO statement_payments (transaction_id, account_id, statement_date) VALUES ($1, $2, $3)
+        ON CONFLICT (transaction_id) DO UPDATE SET account_id = EXCLUDED.account_id, statement_date = EXCLUDED.statement_date`,
+		p.TransactionID, a.ID, p.StatementDate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to link payment")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func UnlinkStatementPayment(w http.ResponseWriter, r *http.Request) {
+	a, ok := creditCardFromPath(w, r)
+	if !ok {
+		return
+	}
+	transactionID, err := strconv.Atoi(mux.Vars(r)["transaction_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	res, err := dbFor(r).Exec("DELETE FROM statement_payments WHERE transaction_id=$1 AND account_id=$2", transactionID, a.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to unlink payment")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Payment is not linked to a statement")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Payment unlinked successfully"})
+}
@@ -0,0 +1,119 @@
+// currency.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// baseCurrency returns the currency a user's budgets and reports are kept in.
+func baseCurrency(q queryer, userID int) (string, error) {
+	var currency string
+	err := q.QueryRow("SELECT base_currency FROM users WHERE id=$1", userID).Scan(&currency)
+	return currency, err
+}
+
+// applyCurrency fills in a transaction's currency fields before it is
+// stored. Amount is always in the owner's base currency, since budgets and
+// reports sum it directly. A transaction in another currency must carry
+// original_amount and exchange_rate (base units per unit of currency), and
+// Amount is derived from them; otherwise the currency defaults to the base
+// and original_amount mirrors Amount.
+func applyCurrency(w http.ResponseWriter, q queryer, t *Transaction) bool {
+	base, err := baseCurrency(q, t.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up base currency")
+		return false
+	}
+	t.Currency = strings.ToUpper(strings.TrimSpace(t.Currency))
+	if t.Currency == "" || t.Currency == base {
+		rate, amount := 1.0, t.Amount
+		t.Currency, t.ExchangeRate, t.OriginalAmount = base, &rate, &amount
+		return true
+	}
+	if !currencyCodePattern.MatchString(t.Currency) {
+		respondWithError(w, http.StatusBadRequest, "Currency must be a three-letter ISO 4217 code")
+		return false
+	}
+	if t.OriginalAmount == nil || t.ExchangeRate == nil || *t.ExchangeRate <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Foreign-currency transactions need original_amount and a positive exchange_rate")
+		return false
+	}
+	t.Amount = math.Round(*t.OriginalAmount**t.ExchangeRate*100) / 100
+	return true
+}
+
+// validateBudgetCurrency normalizes a budget's currency against its owner's
+// base currency. A budget in the base currency stores neither currency nor
+// rate. One in another currency needs the rate (base units per unit of the
+// budget's currency) to convert spending in other currencies; when none is
+// given it takes the owner's current rate for that currency.
+func validateBudgetCurrency(w http.ResponseWriter, q queryer, ownerID int, b *Budget) bool {
+	base, err := baseCurrency(q, ownerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up base currency")
+		return false
+	}
+	if b.Currency != nil {
+		currency := strings.ToUpper(strings.TrimSpace(*b.Currency))
+		b.Currency = &currency
+	}
+	if b.Currency == nil || *b.Currency == "" || *b.Currency == base {
+		b.Currency, b.ExchangeRate = nil, nil
+		return true
+	}
+	if !currencyCodePattern.MatchString(*b.Currency) {
+		respondWithError(w, http.StatusBadRequest, "Currency must be a three-letter ISO 4217 code")
+		return false
+	}
+	if b.ExchangeRate != nil {
+		if *b.ExchangeRate <= 0 {
+			respondWithError(w, http.StatusBadRequest, "exchange_rate must be positive")
+			return false
+		}
+		return true
+	}
+	rate, err := lookupExchangeRate(q, ownerID, *b.Currency)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up exchange rate")
+		return false
+	}
+	if rate == nil {
+		respondWithError(w, http.StatusBadRequest, "No "+*b.Currency+" exchange rate is known; provide exchange_rate")
+		return false
+	}
+	b.ExchangeRate = rate
+	return true
+}
+
+// budgetAmountSQL converts the amount of the transaction_lines row aliased
+// as l into a budget's currency, whose code and rate are bound to the
+// placeholders currencyParam and rateParam (see budgetCurrencyArgs). Lines
+// charged in that currency convert back at their own rate, so they count at
+// what was actually charged; the rest use the budget's rate.
+func budgetAmountSQL(l, currencyParam, rateParam string) string {
+	return "CASE WHEN " + l + ".currency = " + currencyParam + "::text AND " + l + ".exchange_rate > 0 THEN " + l + ".amount / " + l + ".exchange_rate ELSE " +
+		l + ".amount / " + rateParam + "::numeric END"
+}
+
+// budgetCurrencyArgs are the arguments for budgetAmountSQL's placeholders:
+// b's currency and rate, or NULL and 1 for a budget in the base currency.
+func budgetCurrencyArgs(b Budget) []interface{} {
+	if b.Currency == nil || b.ExchangeRate == nil {
+		return []interface{}{nil, 1.0}
+	}
+	return []interface{}{*b.Currency, *b.ExchangeRate}
+}
+
+// budgetRate is the base units per unit of b's currency, 1 for budgets in
+// the base currency.
+func budgetRate(b Budget) float64 {
+	if b.ExchangeRate == nil {
+		return 1
+	}
+	return *b.ExchangeRate
+}
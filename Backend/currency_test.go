@@ -0,0 +1,42 @@
+// currency_test.go
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBudgetAmountSQL(t *testing.T) {
+	got := budgetAmountSQL("l", "$5", "$6")
+	want := "CASE WHEN l.currency = $5::text AND l.exchange_rate > 0 THEN l.amount / l.exchange_rate ELSE l.amount / $6::numeric END"
+	if got != want {
+		t.Errorf("budgetAmountSQL = %q, want %q", got, want)
+	}
+}
+
+func TestBudgetCurrencyArgs(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name   string
+		budget Budget
+		want   []interface{}
+	}{
+		{"base currency", Budget{}, []interface{}{nil, 1.0}},
+		{"currency without a rate", Budget{Currency: str("EUR")}, []interface{}{nil, 1.0}},
+		{"foreign currency", Budget{Currency: str("EUR"), ExchangeRate: num(1.08)}, []interface{}{"EUR", 1.08}},
+		// Whatever a writer stored, it is bound, never spliced into the SQL.
+		{"unvalidated currency", Budget{Currency: str("EUR' OR '1'='1"), ExchangeRate: num(2)}, []interface{}{"EUR' OR '1'='1", 2.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := budgetCurrencyArgs(tt.budget); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("budgetCurrencyArgs = %#v, want %#v", got, tt.want)
+			}
+			if sql := budgetAmountSQL("l", "$1", "$2"); tt.budget.Currency != nil && strings.Contains(sql, *tt.budget.Currency) {
+				t.Errorf("budgetAmountSQL contains the currency: %q", sql)
+			}
+		})
+	}
+}
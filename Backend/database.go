@@ -79,5 +79,1436 @@ func createTables() error {
 	}
 	log.Println("Table 'shared_budgets' created or already exists.")
 
+	// Share permission levels: viewers can only read, editors can also modify
+	_, err = db.Exec(`ALTER TABLE shared_budgets ADD COLUMN IF NOT EXISTS permission TEXT NOT NULL DEFAULT 'view' CHECK (permission IN ('view', 'edit'))`)
+	if err != nil {
+		return err
+	}
+
+	// Account_Deletions table (pending right-to-erasure requests)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS account_deletions (
+            user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+            requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            scheduled_for TIMESTAMP NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'account_deletions' created or already exists.")
+
+	// User_Tombstones table (anonymized record of erased accounts)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS user_tombstones (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER NOT NULL,
+            role TEXT NOT NULL,
+            requested_at TIMESTAMP NOT NULL,
+            deleted_at TIMESTAMP NOT NULL DEFAULT NOW()
+        );
+        ALTER TABLE user_tombstones DROP COLUMN IF EXISTS username_hash;
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'user_tombstones' created or already exists.")
+
+	// Sessions table (used when AUTH_MODE=session)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS sessions (
+            id TEXT PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            expires_at TIMESTAMP NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'sessions' created or already exists.")
+
+	// Service accounts are users flagged as non-interactive
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_service BOOLEAN NOT NULL DEFAULT FALSE`)
+	if err != nil {
+		return err
+	}
+
+	// API_Keys table (credentials for service accounts)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS api_keys (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            prefix TEXT NOT NULL,
+            key_hash TEXT NOT NULL UNIQUE,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            last_used_at TIMESTAMP,
+            revoked_at TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'api_keys' created or already exists.")
+
+	// Scope limits what an API key may do ('full' or read-only 'read')
+	_, err = db.Exec(`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS scope TEXT NOT NULL DEFAULT 'full' CHECK (scope IN ('full', 'read'))`)
+	if err != nil {
+		return err
+	}
+
+	// Inbound_Webhook_Events table (verified payloads from integrations)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS inbound_webhook_events (
+            id SERIAL PRIMARY KEY,
+            source TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            received_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            processed_at TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'inbound_webhook_events' created or already exists.")
+
+	// Idempotency_Keys table (stored responses for retried POSTs)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS idempotency_keys (
+            scope TEXT NOT NULL,
+            key TEXT NOT NULL,
+            request_hash TEXT NOT NULL,
+            status_code INTEGER,
+            response_body TEXT,
+            response_headers JSONB,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (scope, key)
+        );
+        ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS response_headers JSONB;
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'idempotency_keys' created or already exists.")
+
+	// Organizations table (separate ledgers for businesses and clubs)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS organizations (
+            id SERIAL PRIMARY KEY,
+            name TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'organizations' created or already exists.")
+
+	// Organization_Members table
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS organization_members (
+            organization_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member')),
+            joined_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (organization_id, user_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'organization_members' created or already exists.")
+
+	// Organization_Invitations table
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS organization_invitations (
+            id SERIAL PRIMARY KEY,
+            organization_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member')),
+            invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined')),
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'organization_invitations' created or already exists.")
+
+	// Organization-scoped ledgers: records with an organization_id belong to
+	// the organization rather than the member who created them.
+	for _, table := range []string{"categories", "transactions", "budgets"} {
+		_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN IF NOT EXISTS organization_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`
+        ALTER TABLE categories DROP CONSTRAINT IF EXISTS categories_user_id_name_key;
+        CREATE UNIQUE INDEX IF NOT EXISTS categories_personal_name_key ON categories (user_id, name) WHERE organization_id IS NULL;
+        CREATE UNIQUE INDEX IF NOT EXISTS categories_org_name_key ON categories (organization_id, name) WHERE organization_id IS NOT NULL;
+        ALTER TABLE budgets DROP CONSTRAINT IF EXISTS budgets_user_id_frequency_key;
+        DROP INDEX IF EXISTS budgets_personal_frequency_key;
+        DROP INDEX IF EXISTS budgets_org_frequency_key;
+        ALTER TABLE budgets ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'expense' CHECK (kind IN ('expense', 'income'));
+        DROP INDEX IF EXISTS budgets_personal_recurring_key;
+        DROP INDEX IF EXISTS budgets_org_recurring_key;
+        CREATE UNIQUE INDEX IF NOT EXISTS budgets_personal_recurring_kind_key ON budgets (user_id, kind, frequency) WHERE organization_id IS NULL AND frequency <> 'custom';
+        CREATE UNIQUE INDEX IF NOT EXISTS budgets_org_recurring_kind_key ON budgets (organization_id, kind, frequency) WHERE organization_id IS NOT NULL AND frequency <> 'custom'
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Organization ledger columns created or already exist.")
+
+	// Households table (families combining their personal spending)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS households (
+            id SERIAL PRIMARY KEY,
+            name TEXT NOT NULL,
+            created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'households' created or already exists.")
+
+	// Household_Members table
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS household_members (
+            household_id INTEGER REFERENCES households(id) ON DELETE CASCADE,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            joined_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (household_id, user_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'household_members' created or already exists.")
+
+	// Household_Invitations table
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS household_invitations (
+            id SERIAL PRIMARY KEY,
+            household_id INTEGER REFERENCES households(id) ON DELETE CASCADE,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined')),
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'household_invitations' created or already exists.")
+
+	// Household_Categories table (shared category names members roll up into)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS household_categories (
+            id SERIAL PRIMARY KEY,
+            household_id INTEGER REFERENCES households(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            UNIQUE(household_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'household_categories' created or already exists.")
+
+	// Child accounts: a parent_id links a restricted account to its parent
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES users(id) ON DELETE CASCADE`)
+	if err != nil {
+		return err
+	}
+
+	// Child_Settings table (allowance and approval threshold set by the parent)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS child_settings (
+            child_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+            allowance NUMERIC(10, 2) NOT NULL DEFAULT 0,
+            approval_threshold NUMERIC(10, 2)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'child_settings' created or already exists.")
+
+	// Child_Category_Limits table (monthly spending caps per category)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS child_category_limits (
+            child_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+            monthly_limit NUMERIC(10, 2) NOT NULL,
+            PRIMARY KEY (child_id, category_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'child_category_limits' created or already exists.")
+
+	// Pending_Transactions table (child purchases awaiting parent approval)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS pending_transactions (
+            id SERIAL PRIMARY KEY,
+            child_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            description TEXT,
+            amount NUMERIC(10, 2) NOT NULL,
+            date TIMESTAMP NOT NULL,
+            category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+            transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            decided_at TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'pending_transactions' created or already exists.")
+
+	// Allowance_Credits table (one credit per child per month)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS allowance_credits (
+            id SERIAL PRIMARY KEY,
+            child_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            amount NUMERIC(10, 2) NOT NULL,
+            period DATE NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE(child_id, period)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'allowance_credits' created or already exists.")
+
+	// Delegations table (time-boxed read-only access to a user's data)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS delegations (
+            id SERIAL PRIMARY KEY,
+            owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            delegate_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            expires_at TIMESTAMP NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            revoked_at TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'delegations' created or already exists.")
+
+	// Delegation_Access_Log table (every request made under a delegation)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS delegation_access_log (
+            id SERIAL PRIMARY KEY,
+            delegation_id INTEGER REFERENCES delegations(id) ON DELETE CASCADE,
+            delegate_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            method TEXT NOT NULL,
+            path TEXT NOT NULL,
+            accessed_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'delegation_access_log' created or already exists.")
+
+	// Audit_Log table (who changed which transaction, budget or category)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS audit_log (
+            id SERIAL PRIMARY KEY,
+            resource TEXT NOT NULL CHECK (resource IN ('category', 'transaction', 'budget')),
+            resource_id INTEGER NOT NULL,
+            action TEXT NOT NULL CHECK (action IN ('create', 'update', 'delete')),
+            actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            owner_id INTEGER,
+            organization_id INTEGER,
+            before JSONB,
+            after JSONB,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource, resource_id)`)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'audit_log' created or already exists.")
+
+	// Tags table (free-form labels that cut across categories)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS tags (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            UNIQUE(user_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'tags' created or already exists.")
+
+	// Transaction_Tags table (many-to-many between transactions and tags)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS transaction_tags (
+            transaction_id INTEGER REFERENCES transactions(id) ON DELETE CASCADE,
+            tag_id INTEGER REFERENCES tags(id) ON DELETE CASCADE,
+            PRIMARY KEY (transaction_id, tag_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'transaction_tags' created or already exists.")
+
+	// Transaction_Splits table (one transaction divided across categories)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS transaction_splits (
+            id SERIAL PRIMARY KEY,
+            transaction_id INTEGER REFERENCES transactions(id) ON DELETE CASCADE,
+            category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            amount NUMERIC(10, 2) NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'transaction_splits' created or already exists.")
+
+	_, err = db.Exec(`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS linked_transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL`)
+	if err != nil {
+		return err
+	}
+
+	// Categories and transactions flagged exclude_from_budget are left out
+	// of budget math and spending reports.
+	_, err = db.Exec(`
+        ALTER TABLE categories ADD COLUMN IF NOT EXISTS exclude_from_budget BOOLEAN NOT NULL DEFAULT FALSE;
+        ALTER TABLE transactions ADD COLUMN IF NOT EXISTS exclude_from_budget BOOLEAN NOT NULL DEFAULT FALSE;
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Transaction_Lines view: one row per live split, or the transaction
+	// itself when it has no splits. Reports aggregate over this. A line is
+	// excluded when its transaction or category is, or, for a linked
+	// refund, when the expense it refunds is.
+	_, err = db.Exec(`
+        CREATE OR REPLACE VIEW transaction_lines AS
+        SELECT t.id AS transaction_id, t.user_id, t.organization_id, t.date,
+               COALESCE(s.category_id, CASE WHEN s.id IS NULL THEN t.category_id END) AS category_id,
+               COALESCE(s.amount, t.amount) AS amount, t.linked_transaction_id,
+               t.exclude_from_budget OR COALESCE(c.exclude_from_budget, FALSE)
+                   OR COALESCE(o.exclude_from_budget OR oc.exclude_from_budget, FALSE) AS excluded,
+               t.currency, t.exchange_rate
+        FROM transactions t
+        LEFT JOIN transaction_splits s ON s.transaction_id = t.id
+        LEFT JOIN categories c ON c.id = COALESCE(s.category_id, CASE WHEN s.id IS NULL THEN t.category_id END)
+        LEFT JOIN transactions o ON o.id = t.linked_transaction_id
+        LEFT JOIN categories oc ON oc.id = o.category_id
+        WHERE t.deleted_at IS NULL
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("View 'transaction_lines' created or updated.")
+
+	// Receipts table (uploaded images queued for OCR)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS receipts (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            image BYTEA NOT NULL,
+            content_type TEXT NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'processing', 'done', 'failed')),
+            raw_text TEXT,
+            merchant TEXT,
+            receipt_date DATE,
+            total NUMERIC(10, 2),
+            error TEXT,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            claimed_at TIMESTAMP,
+            processed_at TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'receipts' created or already exists.")
+
+	// Payees table (canonical merchants)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS payees (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            UNIQUE(user_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'payees' created or already exists.")
+
+	// Payee_Aliases table (normalized bank descriptors mapped to payees)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS payee_aliases (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            descriptor TEXT NOT NULL,
+            payee_id INTEGER REFERENCES payees(id) ON DELETE CASCADE,
+            PRIMARY KEY (user_id, descriptor)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'payee_aliases' created or already exists.")
+
+	_, err = db.Exec(`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS payee_id INTEGER REFERENCES payees(id) ON DELETE SET NULL`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'cleared', 'reconciled'))`)
+	if err != nil {
+		return err
+	}
+
+	// Reconciliations table (completed statement reconciliations)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS reconciliations (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            period_start DATE NOT NULL,
+            period_end DATE NOT NULL,
+            opening_balance NUMERIC(10, 2) NOT NULL,
+            statement_balance NUMERIC(10, 2) NOT NULL,
+            cleared_total NUMERIC(10, 2) NOT NULL,
+            transaction_count INTEGER NOT NULL,
+            created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'reconciliations' created or already exists.")
+
+	_, err = db.Exec(`
+        ALTER TABLE transactions
+            ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT '',
+            ADD COLUMN IF NOT EXISTS latitude DOUBLE PRECISION,
+            ADD COLUMN IF NOT EXISTS longitude DOUBLE PRECISION
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Transaction_Versions table (prior values of edited transactions)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS transaction_versions (
+            transaction_id INTEGER REFERENCES transactions(id) ON DELETE CASCADE,
+            version INTEGER NOT NULL,
+            description TEXT,
+            amount NUMERIC(10, 2) NOT NULL,
+            date TIMESTAMP NOT NULL,
+            category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            edited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            edited_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (transaction_id, version)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'transaction_versions' created or already exists.")
+
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS base_currency CHAR(3) NOT NULL DEFAULT 'USD'`)
+	if err != nil {
+		return err
+	}
+
+	// Amount stays in the owner's base currency; these record what was
+	// actually charged and the rate used to convert it.
+	_, err = db.Exec(`
+        ALTER TABLE transactions
+            ADD COLUMN IF NOT EXISTS currency CHAR(3),
+            ADD COLUMN IF NOT EXISTS original_amount NUMERIC(12, 2),
+            ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(18, 8)
+    `)
+	if err != nil {
+		return err
+	}
+
+	// updated_at is maintained by trigger so every write path, including
+	// soft deletes, is visible to incremental sync.
+	_, err = db.Exec(`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW()`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+        CREATE OR REPLACE FUNCTION touch_updated_at() RETURNS TRIGGER AS $$
+        BEGIN
+            NEW.updated_at = NOW();
+            RETURN NEW;
+        END
+        $$ LANGUAGE plpgsql
+    `)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+        DROP TRIGGER IF EXISTS transactions_touch_updated_at ON transactions;
+        CREATE TRIGGER transactions_touch_updated_at BEFORE UPDATE ON transactions
+            FOR EACH ROW EXECUTE FUNCTION touch_updated_at()
+    `)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS transactions_user_updated_idx ON transactions (user_id, updated_at)`)
+	if err != nil {
+		return err
+	}
+
+	// Saved_Views table (named transaction filters)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS saved_views (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            filters JSONB NOT NULL DEFAULT '{}',
+            UNIQUE(user_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'saved_views' created or already exists.")
+
+	// CSV_Imports table (uploaded statements queued for import)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS csv_imports (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            created_by INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            file BYTEA NOT NULL,
+            mapping JSONB NOT NULL,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'processing', 'done', 'failed')),
+            imported INTEGER NOT NULL DEFAULT 0,
+            duplicates INTEGER NOT NULL DEFAULT 0,
+            errors JSONB,
+            error TEXT,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            claimed_at TIMESTAMP,
+            processed_at TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'csv_imports' created or already exists.")
+
+	// Transaction_Templates table (reusable manual entries)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS transaction_templates (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            amount NUMERIC(10, 2) NOT NULL,
+            category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            tag_ids INTEGER[] NOT NULL DEFAULT '{}',
+            favorite BOOLEAN NOT NULL DEFAULT FALSE,
+            UNIQUE(user_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'transaction_templates' created or already exists.")
+
+	// Subscriptions table (recurring charges found by the analyzer)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS subscriptions (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            payee_id INTEGER REFERENCES payees(id) ON DELETE CASCADE,
+            average_amount NUMERIC(10, 2) NOT NULL,
+            interval_days INTEGER NOT NULL CHECK (interval_days > 0),
+            last_charged TIMESTAMP NOT NULL,
+            next_expected TIMESTAMP NOT NULL,
+            status TEXT NOT NULL DEFAULT 'detected' CHECK (status IN ('detected', 'confirmed', 'dismissed')),
+            detected_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE(user_id, payee_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'subscriptions' created or already exists.")
+
+	// Budget rollover: carryover is the unspent money brought into the period
+	// that starts on closed_through.
+	_, err = db.Exec(`
+        ALTER TABLE budgets
+            ADD COLUMN IF NOT EXISTS rollover BOOLEAN NOT NULL DEFAULT FALSE,
+            ADD COLUMN IF NOT EXISTS carryover NUMERIC(10, 2) NOT NULL DEFAULT 0,
+            ADD COLUMN IF NOT EXISTS closed_through DATE
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Budget_Templates table (reusable budget settings)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS budget_templates (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            frequency TEXT NOT NULL CHECK (frequency IN ('weekly', 'biweekly', 'semimonthly', 'monthly', 'yearly')),
+            amount NUMERIC(10, 2) NOT NULL,
+            rollover BOOLEAN NOT NULL DEFAULT FALSE,
+            UNIQUE(user_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_templates' created or already exists.")
+
+	// Budget_Periods table (final budgeted vs actual of each ended period)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS budget_periods (
+            budget_id INTEGER REFERENCES budgets(id) ON DELETE CASCADE,
+            period_start DATE NOT NULL,
+            period_end DATE NOT NULL,
+            frequency TEXT NOT NULL,
+            budgeted NUMERIC(10, 2) NOT NULL,
+            carryover NUMERIC(10, 2) NOT NULL DEFAULT 0,
+            spent NUMERIC(10, 2) NOT NULL,
+            closed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (budget_id, period_start)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_periods' created or already exists.")
+
+	// Custom budget periods: more recurring frequencies, and custom budgets
+	// covering a fixed range from period to end_date.
+	_, err = db.Exec(`
+        ALTER TABLE budgets ADD COLUMN IF NOT EXISTS end_date DATE;
+        ALTER TABLE budgets DROP CONSTRAINT IF EXISTS budgets_frequency_check;
+        ALTER TABLE budgets ADD CONSTRAINT budgets_frequency_check
+            CHECK (frequency IN ('weekly', 'biweekly', 'semimonthly', 'monthly', 'yearly', 'custom'));
+        ALTER TABLE budgets DROP CONSTRAINT IF EXISTS budgets_end_date_check;
+        ALTER TABLE budgets ADD CONSTRAINT budgets_end_date_check
+            CHECK ((frequency = 'custom') = (end_date IS NOT NULL) AND (end_date IS NULL OR end_date >= period));
+        ALTER TABLE budget_templates DROP CONSTRAINT IF EXISTS budget_templates_frequency_check;
+        ALTER TABLE budget_templates ADD CONSTRAINT budget_templates_frequency_check
+            CHECK (frequency IN ('weekly', 'biweekly', 'semimonthly', 'monthly', 'yearly'))
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Category_Allocations table (zero-based budget assignments per month)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS category_allocations (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+            month DATE NOT NULL,
+            amount NUMERIC(10, 2) NOT NULL CHECK (amount > 0),
+            PRIMARY KEY (category_id, month)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'category_allocations' created or already exists.")
+
+	_, err = db.Exec(`
+        ALTER TABLE budgets
+            ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '',
+            ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+            ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT ''
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE budgets ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	// Sinking_Funds table (savings toward a target amount by a target date)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS sinking_funds (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            target_amount NUMERIC(10, 2) NOT NULL CHECK (target_amount > 0),
+            target_date DATE NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'sinking_funds' created or already exists.")
+
+	// Sinking_Fund_Contributions table (money moved into or out of a fund)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS sinking_fund_contributions (
+            id SERIAL PRIMARY KEY,
+            fund_id INTEGER NOT NULL REFERENCES sinking_funds(id) ON DELETE CASCADE,
+            amount NUMERIC(10, 2) NOT NULL CHECK (amount <> 0),
+            date DATE NOT NULL,
+            note TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'sinking_fund_contributions' created or already exists.")
+
+	// Allocation_Movements table (money moved between category allocations)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS allocation_movements (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            budget_id INTEGER REFERENCES budgets(id) ON DELETE SET NULL,
+            month DATE NOT NULL,
+            from_category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            to_category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            amount NUMERIC(10, 2) NOT NULL CHECK (amount > 0),
+            moved_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'allocation_movements' created or already exists.")
+
+	// Allocation movements are audited, which the original check on
+	// audit_log does not allow.
+	_, err = db.Exec(`
+        ALTER TABLE audit_log DROP CONSTRAINT IF EXISTS audit_log_resource_check;
+        ALTER TABLE audit_log ADD CONSTRAINT audit_log_resource_check
+            CHECK (resource IN ('category', 'transaction', 'budget', 'allocation_movement'));
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Budgets kept in a currency other than the owner's base currency, with
+	// the base units per unit used to convert spending in other currencies.
+	_, err = db.Exec(`
+        ALTER TABLE budgets
+            ADD COLUMN IF NOT EXISTS currency CHAR(3),
+            ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(18, 8)
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Budgets can feed a savings goal with what they leave unspent.
+	_, err = db.Exec(`
+        ALTER TABLE budgets ADD COLUMN IF NOT EXISTS sinking_fund_id INTEGER REFERENCES sinking_funds(id) ON DELETE SET NULL;
+        ALTER TABLE sinking_fund_contributions ADD COLUMN IF NOT EXISTS budget_id INTEGER REFERENCES budgets(id) ON DELETE SET NULL;
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Closed periods are locked against edits to their transactions.
+	_, err = db.Exec(`
+        ALTER TABLE budget_periods
+            ADD COLUMN IF NOT EXISTS locked_at TIMESTAMP,
+            ADD COLUMN IF NOT EXISTS locked_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Subcategories nest under a parent category in the same ledger.
+	_, err = db.Exec("ALTER TABLE categories ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES categories(id) ON DELETE SET NULL")
+	if err != nil {
+		return err
+	}
+
+	// System-wide categories managed by admins have no owner and show up in
+	// every personal ledger unless the user hides them. Allocations are keyed
+	// by user as well, since a global category is shared across users.
+	_, err = db.Exec(`
+        ALTER TABLE categories ADD COLUMN IF NOT EXISTS is_global BOOLEAN NOT NULL DEFAULT FALSE;
+        CREATE UNIQUE INDEX IF NOT EXISTS categories_global_name_key ON categories (name) WHERE is_global;
+        ALTER TABLE category_allocations DROP CONSTRAINT IF EXISTS category_allocations_pkey;
+        CREATE UNIQUE INDEX IF NOT EXISTS category_allocations_user_month_key ON category_allocations (user_id, category_id, month);
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Hidden_Categories table (global categories a user has opted out of)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS hidden_categories (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+            PRIMARY KEY (user_id, category_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'hidden_categories' created or already exists.")
+
+	// Category_Order table (each user's own arrangement of their categories)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS category_order (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+            sort_order INTEGER NOT NULL,
+            PRIMARY KEY (user_id, category_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'category_order' created or already exists.")
+
+	// Category_Caps table (monthly spending ceilings kept apart from budgets)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS category_caps (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            category_id INTEGER REFERENCES categories(id) ON DELETE CASCADE,
+            monthly_cap NUMERIC(10, 2) NOT NULL CHECK (monthly_cap > 0),
+            strict BOOLEAN NOT NULL DEFAULT FALSE,
+            PRIMARY KEY (user_id, category_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'category_caps' created or already exists.")
+
+	// Accounts table (checking, savings, credit card and cash accounts money
+	// is held in)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS accounts (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            name TEXT NOT NULL,
+            type TEXT NOT NULL CHECK (type IN ('checking', 'savings', 'credit_card', 'cash')),
+            institution TEXT NOT NULL DEFAULT '',
+            currency CHAR(3) NOT NULL,
+            opening_balance NUMERIC(10, 2) NOT NULL DEFAULT 0,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE (user_id, name)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'accounts' created or already exists.")
+
+	// Transactions record the account the money moved through.
+	_, err = db.Exec("ALTER TABLE transactions ADD COLUMN IF NOT EXISTS account_id INTEGER REFERENCES accounts(id) ON DELETE SET NULL")
+	if err != nil {
+		return err
+	}
+
+	// Reconciliation_Sessions table (an account statement being checked off
+	// transaction by transaction). Each account has at most one open session.
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS reconciliation_sessions (
+            id SERIAL PRIMARY KEY,
+            account_id INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            statement_date DATE NOT NULL,
+            statement_balance NUMERIC(10, 2) NOT NULL,
+            status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'finished')),
+            reconciliation_id INTEGER REFERENCES reconciliations(id) ON DELETE SET NULL,
+            created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            finished_at TIMESTAMP
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS reconciliation_sessions_open_key ON reconciliation_sessions (account_id) WHERE status = 'open';
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'reconciliation_sessions' created or already exists.")
+
+	// Reconciliation_Session_Items table (transactions checked off in a session)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS reconciliation_session_items (
+            session_id INTEGER REFERENCES reconciliation_sessions(id) ON DELETE CASCADE,
+            transaction_id INTEGER REFERENCES transactions(id) ON DELETE CASCADE,
+            PRIMARY KEY (session_id, transaction_id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'reconciliation_session_items' created or already exists.")
+
+	// Reconciliations finished through a session record their account.
+	_, err = db.Exec("ALTER TABLE reconciliations ADD COLUMN IF NOT EXISTS account_id INTEGER REFERENCES accounts(id) ON DELETE SET NULL")
+	if err != nil {
+		return err
+	}
+
+	// Credit cards close a statement on the same day each month, due a set
+	// number of days later.
+	_, err = db.Exec(`
+        ALTER TABLE accounts
+            ADD COLUMN IF NOT EXISTS statement_day SMALLINT CHECK (statement_day BETWEEN 1 AND 31),
+            ADD COLUMN IF NOT EXISTS payment_due_days SMALLINT CHECK (payment_due_days >= 0)
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Statement_Payments table (payments linked to the credit card statement
+	// they pay off)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS statement_payments (
+            transaction_id INTEGER PRIMARY KEY REFERENCES transactions(id) ON DELETE CASCADE,
+            account_id INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            statement_date DATE NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'statement_payments' created or already exists.")
+
+	// Assets and liabilities like a house or a car loan are valued by hand.
+	_, err = db.Exec(`
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS manual_value NUMERIC(12, 2) CHECK (manual_value >= 0);
+        ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_type_check;
+        ALTER TABLE accounts ADD CONSTRAINT accounts_type_check
+            CHECK (type IN ('checking', 'savings', 'credit_card', 'cash', 'asset', 'liability'));
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Net_Worth_Snapshots table (each user's assets and liabilities per day)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS net_worth_snapshots (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            date DATE NOT NULL,
+            assets NUMERIC(14, 2) NOT NULL,
+            liabilities NUMERIC(14, 2) NOT NULL,
+            PRIMARY KEY (user_id, date)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'net_worth_snapshots' created or already exists.")
+
+	// Closed accounts keep their history but take no new transactions.
+	_, err = db.Exec("ALTER TABLE accounts ADD COLUMN IF NOT EXISTS closed_at DATE")
+	if err != nil {
+		return err
+	}
+
+	// Balance adjustments true up an account and stay out of reports.
+	_, err = db.Exec("ALTER TABLE transactions ADD COLUMN IF NOT EXISTS is_adjustment BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+
+	// Exchange_Rates table (rates a user has recorded, in base units per unit
+	// of currency, for converting account balances)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS exchange_rates (
+            user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+            base_currency CHAR(3) NOT NULL,
+            currency CHAR(3) NOT NULL,
+            date DATE NOT NULL,
+            rate NUMERIC(18, 8) NOT NULL CHECK (rate > 0),
+            PRIMARY KEY (user_id, base_currency, currency, date)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'exchange_rates' created or already exists.")
+
+	// Investment accounts hold securities on top of their cash.
+	_, err = db.Exec(`
+        ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_type_check;
+        ALTER TABLE accounts ADD CONSTRAINT accounts_type_check
+            CHECK (type IN ('checking', 'savings', 'credit_card', 'cash', 'asset', 'liability', 'investment'));
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Holdings table (securities held in an investment account; cost_basis is
+	// the total paid, in the account's currency)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS holdings (
+            id SERIAL PRIMARY KEY,
+            account_id INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            ticker VARCHAR(20) NOT NULL,
+            quantity NUMERIC(18, 6) NOT NULL CHECK (quantity >= 0),
+            cost_basis NUMERIC(14, 2) NOT NULL DEFAULT 0,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE (account_id, ticker)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'holdings' created or already exists.")
+
+	// Security_Prices table (closing quotes per ticker, shared by all users)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS security_prices (
+            ticker VARCHAR(20) NOT NULL,
+            date DATE NOT NULL,
+            price NUMERIC(18, 6) NOT NULL CHECK (price >= 0),
+            PRIMARY KEY (ticker, date)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'security_prices' created or already exists.")
+
+	// Investment_Valuations table (each investment account's holdings value
+	// per day)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS investment_valuations (
+            account_id INTEGER REFERENCES accounts(id) ON DELETE CASCADE,
+            date DATE NOT NULL,
+            market_value NUMERIC(14, 2) NOT NULL,
+            cost_basis NUMERIC(14, 2) NOT NULL,
+            PRIMARY KEY (account_id, date)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'investment_valuations' created or already exists.")
+
+	// Loan accounts carry their repayment terms.
+	_, err = db.Exec(`
+        ALTER TABLE accounts
+            ADD COLUMN IF NOT EXISTS interest_rate NUMERIC(7, 4) CHECK (interest_rate >= 0),
+            ADD COLUMN IF NOT EXISTS term_months INTEGER CHECK (term_months > 0),
+            ADD COLUMN IF NOT EXISTS first_payment_date DATE;
+        ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_type_check;
+        ALTER TABLE accounts ADD CONSTRAINT accounts_type_check
+            CHECK (type IN ('checking', 'savings', 'credit_card', 'cash', 'asset', 'liability', 'investment', 'loan'));
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Loan_Payments table (each loan payment and its split between principal
+	// and interest, with the transactions that record it)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS loan_payments (
+            id SERIAL PRIMARY KEY,
+            account_id INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+            date DATE NOT NULL,
+            amount NUMERIC(12, 2) NOT NULL,
+            principal NUMERIC(12, 2) NOT NULL,
+            interest NUMERIC(12, 2) NOT NULL,
+            from_account_id INTEGER REFERENCES accounts(id) ON DELETE SET NULL,
+            loan_transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+            transfer_transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+            interest_transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'loan_payments' created or already exists.")
+
+	// Shares can also expose the transactions behind the budget.
+	_, err = db.Exec("ALTER TABLE shared_budgets ADD COLUMN IF NOT EXISTS show_transactions BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+
+	// Owed_Entries table (the ledger of what users owe one another: debtor
+	// owes creditor for an expense, and a settlement pays that back)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS owed_entries (
+            id SERIAL PRIMARY KEY,
+            creditor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            debtor_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            kind TEXT NOT NULL CHECK (kind IN ('expense', 'settlement')),
+            amount NUMERIC(12, 2) NOT NULL CHECK (amount > 0),
+            date DATE NOT NULL,
+            note TEXT NOT NULL DEFAULT '',
+            creditor_transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+            debtor_transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+            created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            CHECK (creditor_id <> debtor_id)
+        );
+        CREATE INDEX IF NOT EXISTS owed_entries_creditor_idx ON owed_entries (creditor_id);
+        CREATE INDEX IF NOT EXISTS owed_entries_debtor_idx ON owed_entries (debtor_id);
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'owed_entries' created or already exists.")
+
+	// Budget_Members table (users whose spending counts towards another
+	// user's budget once they accept the owner's invitation)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS budget_members (
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            invited_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            accepted_at TIMESTAMP,
+            PRIMARY KEY (budget_id, user_id)
+        );
+        CREATE INDEX IF NOT EXISTS budget_members_user_idx ON budget_members (user_id);
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_members' created or already exists.")
+
+	// Share_Links table (expiring links that show a budget's progress to
+	// anyone holding them; id is the signed token's ID)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS share_links (
+            id TEXT PRIMARY KEY,
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            expires_at TIMESTAMP NOT NULL,
+            revoked_at TIMESTAMP,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS share_links_budget_idx ON share_links (budget_id);
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'share_links' created or already exists.")
+
+	// Notifications table (in-app notices, e.g. of shares and invitations);
+	// users may also give an email address to receive them by mail
+	_, err = db.Exec(`
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+        CREATE TABLE IF NOT EXISTS notifications (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            kind TEXT NOT NULL,
+            message TEXT NOT NULL,
+            budget_id INTEGER REFERENCES budgets(id) ON DELETE SET NULL,
+            actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            read_at TIMESTAMP,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, created_at);
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'notifications' created or already exists.")
+
+	// Budget memberships are audited so they show in a budget's activity,
+	// which needs them to have an id, and the check on audit_log to allow
+	// them.
+	_, err = db.Exec(`
+        ALTER TABLE budget_members ADD COLUMN IF NOT EXISTS id SERIAL UNIQUE;
+        ALTER TABLE audit_log DROP CONSTRAINT IF EXISTS audit_log_resource_check;
+        ALTER TABLE audit_log ADD CONSTRAINT audit_log_resource_check
+            CHECK (resource IN ('category', 'transaction', 'budget', 'allocation_movement', 'budget_member'));
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Budgets and transactions carry a version, bumped by trigger on every
+	// write, so edits made from a stale copy can be refused.
+	_, err = db.Exec(`
+        ALTER TABLE budgets ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+        ALTER TABLE budgets ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+        ALTER TABLE transactions ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+        CREATE OR REPLACE FUNCTION bump_version() RETURNS TRIGGER AS $$
+        BEGIN
+            NEW.version = OLD.version + 1;
+            RETURN NEW;
+        END
+        $$ LANGUAGE plpgsql;
+        DROP TRIGGER IF EXISTS budgets_bump_version ON budgets;
+        CREATE TRIGGER budgets_bump_version BEFORE UPDATE ON budgets
+            FOR EACH ROW EXECUTE FUNCTION bump_version();
+        DROP TRIGGER IF EXISTS budgets_touch_updated_at ON budgets;
+        CREATE TRIGGER budgets_touch_updated_at BEFORE UPDATE ON budgets
+            FOR EACH ROW EXECUTE FUNCTION touch_updated_at();
+        DROP TRIGGER IF EXISTS transactions_bump_version ON transactions;
+        CREATE TRIGGER transactions_bump_version BEFORE UPDATE ON transactions
+            FOR EACH ROW EXECUTE FUNCTION bump_version();
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Notification preferences of a budget's participants
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS notification_preferences (
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            transactions_above NUMERIC(10, 2) CHECK (transactions_above >= 0),
+            threshold_alerts BOOLEAN NOT NULL DEFAULT TRUE,
+            member_changes BOOLEAN NOT NULL DEFAULT TRUE,
+            PRIMARY KEY (budget_id, user_id)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'notification_preferences' created or already exists.")
+
+	// Roles of a budget's members
+	_, err = db.Exec(`ALTER TABLE budget_members ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('admin', 'member'))`)
+	if err != nil {
+		return err
+	}
+
+	// Budget_Digests table (weekly progress emails to addresses without an
+	// account, sent once the address confirms)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS budget_digests (
+            id SERIAL PRIMARY KEY,
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            email TEXT NOT NULL,
+            token_hash TEXT NOT NULL UNIQUE,
+            base_url TEXT NOT NULL,
+            created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            confirmed_at TIMESTAMP,
+            last_sent_at TIMESTAMP,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE (budget_id, email)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_digests' created or already exists.")
+
+	// Budget_Category_Mappings table (a group budget member's categories
+	// counted under the owner's in the budget's reports)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS budget_category_mappings (
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+            mapped_category_id INTEGER NOT NULL REFERENCES categories(id) ON DELETE CASCADE,
+            PRIMARY KEY (budget_id, category_id)
+        );
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_category_mappings' created or already exists.")
+
+	// Budget_Comments table (each budget's discussion thread)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS budget_comments (
+            id SERIAL PRIMARY KEY,
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            body TEXT NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            edited_at TIMESTAMP
+        );
+        CREATE INDEX IF NOT EXISTS budget_comments_budget_idx ON budget_comments (budget_id, created_at);
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_comments' created or already exists.")
+
+	// Budget_Transaction_Approvals table (members' transactions held back
+	// from a group budget until its owner approves them)
+	_, err = db.Exec(`
+        ALTER TABLE budgets ADD COLUMN IF NOT EXISTS require_approval BOOLEAN NOT NULL DEFAULT FALSE;
+        CREATE TABLE IF NOT EXISTS budget_transaction_approvals (
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            transaction_id INTEGER NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,
+            status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+            requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            decided_at TIMESTAMP,
+            decided_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+            PRIMARY KEY (budget_id, transaction_id)
+        );
+        CREATE INDEX IF NOT EXISTS budget_transaction_approvals_transaction_idx ON budget_transaction_approvals (transaction_id);
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'budget_transaction_approvals' created or already exists.")
+
+	// Recurring_Splits and Recurring_Split_Participants tables (an expense
+	// one user pays every period, such as rent, with shares owed by others)
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS recurring_splits (
+            id SERIAL PRIMARY KEY,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            description TEXT NOT NULL,
+            amount NUMERIC(12, 2) NOT NULL CHECK (amount > 0),
+            category_id INTEGER REFERENCES categories(id) ON DELETE SET NULL,
+            account_id INTEGER REFERENCES accounts(id) ON DELETE SET NULL,
+            frequency TEXT NOT NULL CHECK (frequency IN ('weekly', 'biweekly', 'monthly', 'yearly')),
+            start_date DATE NOT NULL,
+            occurrences INTEGER NOT NULL DEFAULT 0,
+            next_date DATE NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS recurring_splits_next_date_idx ON recurring_splits (next_date);
+        CREATE TABLE IF NOT EXISTS recurring_split_participants (
+            recurring_split_id INTEGER NOT NULL REFERENCES recurring_splits(id) ON DELETE CASCADE,
+            user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            amount NUMERIC(12, 2) NOT NULL CHECK (amount > 0),
+            accepted_at TIMESTAMP,
+            PRIMARY KEY (recurring_split_id, user_id)
+        );
+        CREATE INDEX IF NOT EXISTS recurring_split_participants_user_idx ON recurring_split_participants (user_id);
+        ALTER TABLE owed_entries ADD COLUMN IF NOT EXISTS recurring_split_id INTEGER REFERENCES recurring_splits(id) ON DELETE SET NULL;
+    `)
+	if err != nil {
+		return err
+	}
+	log.Println("Table 'recurring_splits' created or already exists.")
+
 	return nil
 }
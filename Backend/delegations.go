@@ -0,0 +1,252 @@
+// delegations.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type Delegation struct {
+	ID         int        `json:"id"`
+	OwnerID    int        `json:"owner_id"`
+	DelegateID int        `json:"delegate_id"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type DelegationAccess struct {
+	ID           int       `json:"id"`
+	DelegationID int       `json:"delegation_id"`
+	DelegateID   int       `json:"delegate_id"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	AccessedAt   time.Time `json:"accessed_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// delegated wraps a read handler for /delegations/{user_id}/... routes. The
+// caller must hold an active, unexpired delegation from user_id; every access
+// is recorded before the handler runs.
+func delegated(next func(w http.ResponseWriter, r *http.Request, ownerID int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ownerID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		var delegationID int
+		err = db.QueryRow(`SELECT id FROM delegations
+            WHERE owner_id=$1 AND delegate_id=$2 AND revoked_at IS NULL AND expires_at > NOW()
+            ORDER BY expires_at DESC LIMIT 1`, ownerID, u.ID).Scan(&delegationID)
+		if err == sql.ErrNoRows {
+			respondWithError(w, http.StatusForbidden, "No active delegation from this user")
+			return
+		} else if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to verify delegation")
+			return
+		}
+		_, err = db.Exec("INSERT INTO delegation_access_log (delegation_id, delegate_id, method, path) VALUES ($1, $2, $3, $4)",
+			delegationID, u.ID, r.Method, r.URL.Path)
+		if err != nil {
+			log.Printf("Failed to record delegated access for delegation %d: %v", delegationID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to record access")
+			return
+		}
+		next(w, r, ownerID)
+	}
+}
+
+// --- DELEGATION HANDLERS ---
+
+func CreateDelegation(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var d Delegation
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if d.DelegateID == 0 || d.DelegateID == u.ID {
+		respondWithError(w, http.StatusBadRequest, "Invalid delegate")
+		return
+	}
+	if !d.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=$1 AND NOT is_service)", d.DelegateID).Scan(&exists)
+	if err != nil || !exists {
+		respondWithError(w, http.StatusBadRequest, "Delegate user does not exist.")
+		return
+	}
+	d.OwnerID = u.ID
+	err = db.QueryRow("INSERT INTO delegations (owner_id, delegate_id, expires_at) VALUES ($1, $2, $3) RETURNING id, created_at",
+		d.OwnerID, d.DelegateID, d.ExpiresAt).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create delegation")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, d)
+}
+
+// GetDelegations lists delegations the caller has granted or received.
+func GetDelegations(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.Query(`SELECT id, owner_id, delegate_id, expires_at, created_at, revoked_at FROM delegations
+        WHERE owner_id=$1 OR delegate_id=$1 ORDER BY created_at DESC`, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve delegations")
+		return
+	}
+	defer rows.Close()
+	var delegations []Delegation
+	for rows.Next() {
+		var d Delegation
+		if err := rows.Scan(&d.ID, &d.OwnerID, &d.DelegateID, &d.ExpiresAt, &d.CreatedAt, &d.RevokedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan delegation")
+			return
+		}
+		delegations = append(delegations, d)
+	}
+	respondWithJSON(w, http.StatusOK, delegations)
+}
+
+// RevokeDelegation ends a delegation early. Either side may revoke it.
+func RevokeDelegation(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	delegationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delegation ID")
+		return
+	}
+	res, err := db.Exec(`UPDATE delegations SET revoked_at = NOW()
+        WHERE id=$1 AND (owner_id=$2 OR delegate_id=$2) AND revoked_at IS NULL`, delegationID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke delegation")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Delegation not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Delegation revoked successfully"})
+}
+
+// GetDelegationAccessLog shows the owner every request made under a delegation.
+func GetDelegationAccessLog(w http.ResponseWriter, r *http.Request) {
+	delegationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delegation ID")
+		return
+	}
+	var ownerID int
+	err = db.QueryRow("SELECT owner_id FROM delegations WHERE id=$1", delegationID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Delegation not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve delegation")
+		return
+	}
+	if !authorizeOwner(w, r, ownerID) {
+		return
+	}
+	rows, err := db.Query(`SELECT id, delegation_id, delegate_id, method, path, accessed_at FROM delegation_access_log
+        WHERE delegation_id=$1 ORDER BY accessed_at DESC`, delegationID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve access log")
+		return
+	}
+	defer rows.Close()
+	var entries []DelegationAccess
+	for rows.Next() {
+		var a DelegationAccess
+		if err := rows.Scan(&a.ID, &a.DelegationID, &a.DelegateID, &a.Method, &a.Path, &a.AccessedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan access log entry")
+			return
+		}
+		entries = append(entries, a)
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+// --- DELEGATED READ HANDLERS ---
+
+func GetDelegatedCategories(w http.ResponseWriter, r *http.Request, ownerID int) {
+	rows, err := db.Query(visibleCategoriesSQL+" AND h.user_id IS NULL ORDER BY name", ownerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve categories")
+		return
+	}
+	defer rows.Close()
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.ParentID, &c.ExcludeFromBudget, &c.IsGlobal, &c.Hidden, &c.SortOrder); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category")
+			return
+		}
+		categories = append(categories, c)
+	}
+	respondWithJSON(w, http.StatusOK, categories)
+}
+
+func GetDelegatedTransactions(w http.ResponseWriter, r *http.Request, ownerID int) {
+	rows, err := db.Query("SELECT "+transactionColumns+" FROM transactions WHERE user_id=$1 AND organization_id IS NULL AND deleted_at IS NULL ORDER BY date DESC", ownerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
+		return
+	}
+	defer rows.Close()
+	var transactions []Transaction
+	for rows.Next() {
+		var t Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	respondWithJSON(w, http.StatusOK, transactions)
+}
+
+func GetDelegatedBudgets(w http.ResponseWriter, r *http.Request, ownerID int) {
+	rows, err := db.Query("SELECT "+budgetColumns+" FROM budgets WHERE user_id=$1 AND organization_id IS NULL"+archivedBudgetFilter(r, "archived_at"), ownerID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budgets")
+		return
+	}
+	defer rows.Close()
+	var budgets []Budget
+	for rows.Next() {
+		var b Budget
+		if err := scanBudget(rows, &b); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan budget")
+			return
+		}
+		budgets = append(budgets, b)
+	}
+	respondWithJSON(w, http.StatusOK, budgets)
+}
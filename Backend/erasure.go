@@ -0,0 +1,229 @@
+// erasure.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// --- MODELS ---
+type AccountDeletion struct {
+	UserID       int       `json:"user_id"`
+	RequestedAt  time.Time `json:"requested_at"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+}
+
+type deletionConfirmation struct {
+	Password string `json:"password"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func deletionGracePeriod() time.Duration {
+	return time.Duration(getEnvInt("ACCOUNT_DELETION_GRACE_DAYS", 30)) * 24 * time.Hour
+}
+
+// isPendingDeletion reports whether the user has an outstanding erasure
+// request, in which case the account is frozen.
+func isPendingDeletion(userID int) (bool, error) {
+	var pending bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM account_deletions WHERE user_id=$1)", userID).Scan(&pending)
+	return pending, err
+}
+
+// verifyUserPassword checks the password for the given user, responding with
+// an error and returning false if it does not match.
+func verifyUserPassword(w http.ResponseWriter, r *http.Request, userID int) bool {
+	var conf deletionConfirmation
+	if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return false
+	}
+	var hashed string
+	err := db.QueryRow("SELECT password FROM users WHERE id=$1", userID).Scan(&hashed)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Database error")
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(conf.Password)); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid password")
+		return false
+	}
+	return true
+}
+
+// --- ACCOUNT DELETION HANDLERS ---
+
+func RequestAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !verifyUserPassword(w, r, userID) {
+		return
+	}
+	d := AccountDeletion{UserID: userID}
+	query := `
+        INSERT INTO account_deletions (user_id, scheduled_for)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+        RETURNING requested_at, scheduled_for
+    `
+	err = db.QueryRow(query, userID, time.Now().Add(deletionGracePeriod())).Scan(&d.RequestedAt, &d.ScheduledFor)
+	if err != nil {
+		log.Printf("Error requesting deletion for user %d: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to request account deletion")
+		return
+	}
+	// The account is frozen from now on: sign it out everywhere. API keys
+	// are refused by authMiddleware while the request stands.
+	if err := revokeAllUserCredentials(userID); err != nil {
+		log.Printf("Error revoking credentials for user %d: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke credentials")
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, d)
+}
+
+// GetAccountDeletion shows a user's pending deletion to admins and the
+// user's parent. The user's own account is frozen while deletion is pending,
+// so they ask with their password through CheckAccountDeletion instead.
+func GetAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	respondWithAccountDeletion(w, userID)
+}
+
+// CheckAccountDeletion shows the owner of an account its pending deletion,
+// given their password, just as cancelling it takes only the password.
+func CheckAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !verifyUserPassword(w, r, userID) {
+		return
+	}
+	respondWithAccountDeletion(w, userID)
+}
+
+func respondWithAccountDeletion(w http.ResponseWriter, userID int) {
+	d := AccountDeletion{UserID: userID}
+	err := db.QueryRow("SELECT requested_at, scheduled_for FROM account_deletions WHERE user_id=$1", userID).Scan(&d.RequestedAt, &d.ScheduledFor)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "No pending deletion for this user")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve deletion request")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, d)
+}
+
+func CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !verifyUserPassword(w, r, userID) {
+		return
+	}
+	res, err := db.Exec("DELETE FROM account_deletions WHERE user_id=$1", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel account deletion")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "No pending deletion for this user")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Account deletion cancelled"})
+}
+
+// --- BACKGROUND JOB ---
+
+// processAccountDeletions erases every account whose grace period has
+// elapsed, leaving an anonymized tombstone behind for auditing.
+func processAccountDeletions() error {
+	rows, err := db.Query("SELECT user_id FROM account_deletions WHERE scheduled_for <= NOW()")
+	if err != nil {
+		return err
+	}
+	var due []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, userID := range due {
+		if err := eraseUser(userID); err != nil {
+			log.Printf("Failed to erase user %d: %v", userID, err)
+			continue
+		}
+		log.Printf("Erased user %d after grace period.", userID)
+	}
+	return nil
+}
+
+func eraseUser(userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var role string
+	var requestedAt time.Time
+	err = tx.QueryRow(`
+        SELECT u.role, d.requested_at
+        FROM users u
+        JOIN account_deletions d ON d.user_id = u.id
+        WHERE u.id = $1
+        FOR UPDATE`, userID).Scan(&role, &requestedAt)
+	if err != nil {
+		return err
+	}
+
+	// The tombstone keeps no trace of the username: a hash of it would be
+	// easily reversed by hashing candidate names.
+	_, err = tx.Exec("INSERT INTO user_tombstones (user_id, role, requested_at) VALUES ($1, $2, $3)",
+		userID, role, requestedAt)
+	if err != nil {
+		return err
+	}
+
+	// Categories, transactions, budgets, shares and the deletion request
+	// itself all cascade from the user row.
+	if _, err := tx.Exec("DELETE FROM users WHERE id=$1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,135 @@
+// erasure_test.go
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// useFakeAccounts backs users, sessions and account_deletions for user 1,
+// "alice", whose password is "secret", and user 9, an admin.
+func useFakeAccounts(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	deletions := map[int64][2]time.Time{}
+	useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT password FROM users"):
+			if args[0].(int64) != 1 {
+				return fakeResult{columns: []string{"password"}}, nil
+			}
+			return fakeRow([]string{"password"}, hashed), nil
+		case strings.HasPrefix(query, "SELECT id, password, role, is_service FROM users"):
+			columns := []string{"id", "password", "role", "is_service"}
+			if args[0].(string) != "alice" {
+				return fakeResult{columns: columns}, nil
+			}
+			return fakeRow(columns, int64(1), hashed, "user", false), nil
+		case strings.Contains(query, "INSERT INTO account_deletions"):
+			d, ok := deletions[args[0].(int64)]
+			if !ok {
+				d = [2]time.Time{time.Now(), args[1].(time.Time)}
+				deletions[args[0].(int64)] = d
+			}
+			return fakeRow([]string{"requested_at", "scheduled_for"}, d[0], d[1]), nil
+		case strings.HasPrefix(query, "SELECT requested_at, scheduled_for FROM account_deletions"):
+			d, ok := deletions[args[0].(int64)]
+			if !ok {
+				return fakeResult{columns: []string{"requested_at", "scheduled_for"}}, nil
+			}
+			return fakeRow([]string{"requested_at", "scheduled_for"}, d[0], d[1]), nil
+		case strings.HasPrefix(query, "SELECT EXISTS(SELECT 1 FROM account_deletions"):
+			_, ok := deletions[args[0].(int64)]
+			return fakeRow([]string{"exists"}, ok), nil
+		case strings.HasPrefix(query, "DELETE FROM account_deletions"):
+			if _, ok := deletions[args[0].(int64)]; !ok {
+				return fakeResult{}, nil
+			}
+			delete(deletions, args[0].(int64))
+			return fakeResult{affected: 1}, nil
+		case strings.HasPrefix(query, "DELETE FROM sessions"):
+			return fakeResult{}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeResult{}, nil
+	})
+}
+
+func TestAccountDeletionFlow(t *testing.T) {
+	jwtSecret = []byte("test secret")
+	revocations = newMemoryRevocationStore()
+	useFakeAccounts(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/login", LoginUser).Methods("POST")
+	r.HandleFunc("/users/{id}/deletion", RequestAccountDeletion).Methods("POST")
+	r.HandleFunc("/users/{id}/deletion", GetAccountDeletion).Methods("GET")
+	r.HandleFunc("/users/{id}/deletion/status", CheckAccountDeletion).Methods("POST")
+	r.HandleFunc("/users/{id}/deletion/cancel", CancelAccountDeletion).Methods("POST")
+	r.Use(authMiddleware)
+	send := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(step string, w *httptest.ResponseRecorder, want int) {
+		t.Helper()
+		if w.Code != want {
+			t.Fatalf("%s = %d %s, want %d", step, w.Code, w.Body.String(), want)
+		}
+	}
+	loginAlice := func() string {
+		t.Helper()
+		w := send("POST", "/login", "", `{"username": "alice", "password": "secret"}`)
+		expect("login", w, http.StatusOK)
+		var resp struct{ Token string }
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding login response: %v", err)
+		}
+		return resp.Token
+	}
+	admin, _, err := issueToken(testAdmin, "admin")
+	if err != nil {
+		t.Fatalf("issueToken: %v", err)
+	}
+
+	token := loginAlice()
+	expect("status before requesting", send("GET", "/users/1/deletion", token, ""), http.StatusNotFound)
+	expect("request with the wrong password", send("POST", "/users/1/deletion", token, `{"password": "wrong"}`), http.StatusUnauthorized)
+	expect("request", send("POST", "/users/1/deletion", token, `{"password": "secret"}`), http.StatusAccepted)
+
+	// The account is frozen: its tokens are revoked and it cannot log in.
+	expect("old token", send("GET", "/users/1/deletion", token, ""), http.StatusUnauthorized)
+	expect("login while pending", send("POST", "/login", "", `{"username": "alice", "password": "secret"}`), http.StatusForbidden)
+
+	// The owner can still see the request with their password, as can an admin.
+	expect("status with the wrong password", send("POST", "/users/1/deletion/status", "", `{"password": "wrong"}`), http.StatusUnauthorized)
+	w := send("POST", "/users/1/deletion/status", "", `{"password": "secret"}`)
+	expect("status", w, http.StatusOK)
+	var d AccountDeletion
+	if err := json.NewDecoder(w.Body).Decode(&d); err != nil || d.UserID != 1 || d.ScheduledFor.Before(time.Now()) {
+		t.Errorf("status = %+v (%v), want user 1 scheduled in the future", d, err)
+	}
+	expect("status as admin", send("GET", "/users/1/deletion", admin, ""), http.StatusOK)
+
+	expect("cancel with the wrong password", send("POST", "/users/1/deletion/cancel", "", `{"password": "wrong"}`), http.StatusUnauthorized)
+	expect("cancel", send("POST", "/users/1/deletion/cancel", "", `{"password": "secret"}`), http.StatusOK)
+	expect("status after cancelling", send("POST", "/users/1/deletion/status", "", `{"password": "secret"}`), http.StatusNotFound)
+
+	// Cancelling thaws the account.
+	expect("status with a new token", send("GET", "/users/1/deletion", loginAlice(), ""), http.StatusNotFound)
+}
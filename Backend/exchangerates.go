@@ -0,0 +1,138 @@
+// exchangerates.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Exchange rates convert amounts in other currencies into a user's base
+// currency, in base units per unit of the other currency. A user records
+// rates as they see fit; where none has been recorded for a currency, the
+// rate of their latest transaction in it stands in.
+
+// exchangeRateSQL is the rate into the owner's current base currency for
+// the currency of the row aliased a (with user_id and currency columns): 1
+// for the base currency itself, otherwise the latest recorded rate, falling
+// back to the latest transaction rate. It is NULL when neither exists.
+const exchangeRateSQL = `CASE WHEN a.currency = (SELECT u.base_currency FROM users u WHERE u.id = a.user_id) THEN 1 ELSE COALESCE(
+                (SELECT x.rate FROM exchange_rates x JOIN users u ON u.id = x.user_id AND u.base_currency = x.base_currency
+                    WHERE x.user_id = a.user_id AND x.currency = a.currency ORDER BY x.date DESC LIMIT 1),
+                (SELECT x.exchange_rate FROM transactions x
+                    WHERE x.user_id = a.user_id AND x.currency = a.currency AND x.exchange_rate > 0 AND x.deleted_at IS NULL
+                    ORDER BY x.date DESC, x.id DESC LIMIT 1)) END`
+
+// --- MODELS ---
+type ExchangeRate struct {
+	UserID       int       `json:"user_id"`
+	BaseCurrency string    `json:"base_currency"`
+	Currency     string    `json:"currency"`
+	Date         time.Time `json:"date"`
+	Rate         float64   `json:"rate"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// lookupExchangeRate returns the rate exchangeRateSQL gives for currency,
+// or nil if there is none.
+func lookupExchangeRate(q queryer, userID int, currency string) (*float64, error) {
+	var rate *float64
+	err := q.QueryRow("SELECT "+exchangeRateSQL+" FROM (SELECT $1::integer AS user_id, $2::char(3) AS currency) a", userID, currency).Scan(&rate)
+	return rate, err
+}
+
+// --- EXCHANGE RATE HANDLERS ---
+
+// SetExchangeRate records the rate of a currency against the owner's base
+// currency on a date (default today), replacing one already recorded for
+// that day.
+func SetExchangeRate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UserID   int     `json:"user_id"`
+		Currency string  `json:"currency"`
+		Date     string  `json:"date"`
+		Rate     float64 `json:"rate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &body.UserID) {
+		return
+	}
+	e := ExchangeRate{UserID: body.UserID, Currency: strings.ToUpper(strings.TrimSpace(body.Currency)), Rate: body.Rate}
+	if !currencyCodePattern.MatchString(e.Currency) {
+		respondWithError(w, http.StatusBadRequest, "Currency must be a three-letter ISO 4217 code")
+		return
+	}
+	if e.Rate <= 0 {
+		respondWithError(w, http.StatusBadRequest, "rate must be positive")
+		return
+	}
+	now := time.Now()
+	e.Date = dateOnly(now, now.Location())
+	if body.Date != "" {
+		var err error
+		if e.Date, err = time.Parse("2006-01-02", body.Date); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+			return
+		}
+	}
+	base, err := baseCurrency(dbFor(r), e.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up base currency")
+		return
+	}
+	if e.Currency == base {
+		respondWithError(w, http.StatusBadRequest, "No rate is needed for the base currency")
+		return
+	}
+	e.BaseCurrency = base
+	_, err = dbFor(r).Exec(`INSERT INTO exchange_rates (user_id, base_currency, currency, date, rate) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (user_id, base_currency, currency, date) DO UPDATE SET rate = EXCLUDED.rate`,
+		e.UserID, e.BaseCurrency, e.Currency, e.Date, e.Rate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record exchange rate")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, e)
+}
+
+// GetExchangeRates lists the rates a user has recorded against their
+// current base currency, latest first, optionally for one ?currency=.
+func GetExchangeRates(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	currency := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+	rows, err := dbFor(r).Query(`SELECT x.user_id, x.base_currency, x.currency, x.date, x.rate
+        FROM exchange_rates x JOIN users u ON u.id = x.user_id AND u.base_currency = x.base_currency
+        WHERE x.user_id = $1 AND ($2 OR x.currency = $3)
+        ORDER BY x.currency, x.date DESC`, userID, currency == "", currency)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve exchange rates")
+		return
+	}
+	defer rows.Close()
+	rates := []ExchangeRate{}
+	for rows.Next() {
+		var e ExchangeRate
+		if err := rows.Scan(&e.UserID, &e.BaseCurrency, &e.Currency, &e.Date, &e.Rate); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan exchange rate")
+			return
+		}
+		rates = append(rates, e)
+	}
+	respondWithJSON(w, http.StatusOK, rates)
+}
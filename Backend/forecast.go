@@ -0,0 +1,160 @@
+// forecast.go
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type CategoryForecast struct {
+	CategoryID      *int     `json:"category_id"`
+	Category        string   `json:"category"`
+	Spent           float64  `json:"spent"`
+	Projected       float64  `json:"projected"`
+	Allocated       *float64 `json:"allocated,omitempty"`
+	LikelyToOverrun bool     `json:"likely_to_overrun"`
+}
+
+type BudgetForecast struct {
+	BudgetID        int                `json:"budget_id"`
+	PeriodStart     time.Time          `json:"period_start"`
+	PeriodEnd       time.Time          `json:"period_end"` // last day of the period, inclusive
+	Available       float64            `json:"available"`
+	Spent           float64            `json:"spent"`
+	Projected       float64            `json:"projected"`
+	ProjectedOver   float64            `json:"projected_over"`
+	LikelyToOverrun bool               `json:"likely_to_overrun"`
+	Categories      []CategoryForecast `json:"categories"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// projectSpending estimates total spending for a period from what has been
+// spent so far. The run-rate estimate extends the spending so far evenly
+// over the remaining time; when there is spending for the same window a
+// year earlier, it is averaged with a seasonal estimate that assumes the
+// rest of the period relates to its start as it did last year.
+func projectSpending(spent float64, elapsed, remaining time.Duration, lastYearElapsed, lastYearRemaining float64) float64 {
+	if remaining <= 0 {
+		return spent
+	}
+	if elapsed <= 0 {
+		return spent + lastYearRemaining
+	}
+	runRate := spent * remaining.Hours() / elapsed.Hours()
+	if lastYearElapsed > 0 {
+		seasonal := spent * lastYearRemaining / lastYearElapsed
+		return spent + (runRate+seasonal)/2
+	}
+	return spent + runRate
+}
+
+// --- FORECAST HANDLERS ---
+
+// GetBudgetForecast projects spending to the end of the budget's current
+// period, overall and per category. A category is flagged as likely to
+// overrun when its projection exceeds what was allocated to it for the
+// months starting in the period. Amounts are in the budget's currency.
+func GetBudgetForecast(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	var b Budget
+	var carryover float64
+	var closedThrough sql.NullTime
+	err = scanBudget(db.QueryRow("SELECT "+budgetColumns+", carryover, closed_through FROM budgets WHERE id=$1", budgetID),
+		&b, &carryover, &closedThrough)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if b.Kind == budgetKindIncome {
+		respondWithError(w, http.StatusUnprocessableEntity, "Income budgets are tracked by the income report")
+		return
+	}
+	now := time.Now()
+	start, end, err := budgetPeriod(b, now)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	cutoff := now
+	if cutoff.After(end) {
+		cutoff = end
+	} else if cutoff.Before(start) {
+		cutoff = start
+	}
+
+	forecast := BudgetForecast{BudgetID: b.ID, PeriodStart: start, PeriodEnd: end.AddDate(0, 0, -1), Available: b.Amount, Categories: []CategoryForecast{}}
+	if b.Rollover && closedThrough.Valid && closedThrough.Time.Format("2006-01-02") == start.Format("2006-01-02") {
+		forecast.Available += carryover
+	}
+
+	ledger, owner := "l.user_id = $1 AND l.organization_id IS NULL", b.UserID
+	if b.OrganizationID != nil {
+		ledger, owner = "l.organization_id = $1", *b.OrganizationID
+	}
+	amount := budgetAmountSQL("l", "$8", "$9")
+	rows, err := db.Query(`
+        SELECT l.category_id, COALESCE(c.name, 'Uncategorized'),
+            COALESCE(SUM(`+amount+`) FILTER (WHERE l.date >= $2 AND l.date < $3), 0),
+            COALESCE(SUM(`+amount+`) FILTER (WHERE l.date >= $4 AND l.date < $5), 0),
+            COALESCE(SUM(`+amount+`) FILTER (WHERE l.date >= $5 AND l.date < $6), 0),
+            (SELECT SUM(a.amount) FROM category_allocations a
+                WHERE a.category_id = l.category_id AND a.user_id = l.user_id AND a.month >= $2 AND a.month < $7)
+        FROM transaction_lines l
+        LEFT JOIN categories c ON c.id = l.category_id
+        WHERE `+ledger+` AND NOT l.excluded AND ((l.date >= $2 AND l.date < $3) OR (l.date >= $4 AND l.date < $6))
+        GROUP BY l.category_id, c.name
+        ORDER BY c.name`,
+		append([]interface{}{owner, start, cutoff, start.AddDate(-1, 0, 0), cutoff.AddDate(-1, 0, 0), end.AddDate(-1, 0, 0), end},
+			budgetCurrencyArgs(b)...)...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build forecast")
+		return
+	}
+	defer rows.Close()
+	elapsed, remaining := cutoff.Sub(start), end.Sub(cutoff)
+	for rows.Next() {
+		var c CategoryForecast
+		var lastYearElapsed, lastYearRemaining float64
+		var allocated sql.NullFloat64
+		if err := rows.Scan(&c.CategoryID, &c.Category, &c.Spent, &lastYearElapsed, &lastYearRemaining, &allocated); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan forecast row")
+			return
+		}
+		c.Spent = math.Round(c.Spent*100) / 100
+		c.Projected = math.Round(projectSpending(c.Spent, elapsed, remaining, lastYearElapsed, lastYearRemaining)*100) / 100
+		if allocated.Valid {
+			// Allocations are kept in the base currency.
+			converted := math.Round(allocated.Float64/budgetRate(b)*100) / 100
+			c.Allocated = &converted
+			c.LikelyToOverrun = c.Projected > converted
+		}
+		forecast.Spent += c.Spent
+		forecast.Projected += c.Projected
+		forecast.Categories = append(forecast.Categories, c)
+	}
+	forecast.Spent = math.Round(forecast.Spent*100) / 100
+	forecast.Projected = math.Round(forecast.Projected*100) / 100
+	if over := forecast.Projected - forecast.Available; over > 0 {
+		forecast.ProjectedOver = math.Round(over*100) / 100
+		forecast.LikelyToOverrun = true
+	}
+	respondWithJSON(w, http.StatusOK, forecast)
+}
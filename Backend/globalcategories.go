@@ -0,0 +1,192 @@
+// globalcategories.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Global categories are created by admins and appear in every personal
+// ledger next to the user's own, so common names like "Groceries" aren't
+// duplicated per user and admins can compare spending across users. They
+// have no owner (user_id is NULL); admins edit and delete them through the
+// regular category routes, and users can hide the ones they don't use.
+
+// visibleCategoriesSQL selects the personal categories of the user in $1
+// plus every global category, with whether the user has hidden it and where
+// they placed it. Append " AND h.user_id IS NULL" to leave hidden ones out.
+const visibleCategoriesSQL = `SELECT c.id, COALESCE(c.user_id, 0), c.name, c.parent_id, c.exclude_from_budget, c.is_global, h.user_id IS NOT NULL,
+            o.sort_order
+        FROM categories c
+        LEFT JOIN hidden_categories h ON h.category_id = c.id AND h.user_id = $1
+        LEFT JOIN category_order o ON o.category_id = c.id AND o.user_id = $1
+        WHERE ((c.user_id = $1 AND c.organization_id IS NULL) OR c.is_global)`
+
+// --- MODELS ---
+
+// GlobalCategorySpending is one row of the admin report on global
+// categories across all users.
+type GlobalCategorySpending struct {
+	CategoryID int     `json:"category_id"`
+	Category   string  `json:"category"`
+	Users      int     `json:"users"`
+	HiddenBy   int     `json:"hidden_by"`
+	Total      float64 `json:"total"`
+}
+
+// CategoryVisibility is the optional body of the hide and unhide routes;
+// user_id defaults to the caller.
+type CategoryVisibility struct {
+	UserID int `json:"user_id"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// globalCategoryFromPath reads {id} and checks it names a global category.
+func globalCategoryFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	categoryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return 0, false
+	}
+	var global bool
+	err = db.QueryRow("SELECT is_global FROM categories WHERE id=$1", categoryID).Scan(&global)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Category not found")
+		return 0, false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve category")
+		return 0, false
+	}
+	if !global {
+		respondWithError(w, http.StatusBadRequest, "Only global categories can be hidden")
+		return 0, false
+	}
+	return categoryID, true
+}
+
+// decodeCategoryVisibility reads the optional CategoryVisibility body and
+// checks the caller may act for its user.
+func decodeCategoryVisibility(w http.ResponseWriter, r *http.Request) (int, bool) {
+	var v CategoryVisibility
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return 0, false
+		}
+	}
+	if !authorizeBodyOwner(w, r, &v.UserID) {
+		return 0, false
+	}
+	return v.UserID, true
+}
+
+// --- GLOBAL CATEGORY HANDLERS ---
+
+// CreateGlobalCategory adds an admin-managed category that every user sees.
+// A global category can only be nested under another global one.
+func CreateGlobalCategory(w http.ResponseWriter, r *http.Request) {
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Category name is required")
+		return
+	}
+	c.UserID, c.OrganizationID, c.IsGlobal = 0, nil, true
+	if !validateCategoryParent(w, 0, c.ParentID, resourceRef{}) {
+		return
+	}
+	err := dbFor(r).QueryRow("INSERT INTO categories (name, parent_id, exclude_from_budget, is_global) VALUES ($1, $2, $3, TRUE) RETURNING id",
+		c.Name, c.ParentID, c.ExcludeFromBudget).Scan(&c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create category. A global category with this name may already exist.")
+		return
+	}
+	recordAudit(r, "category", c.ID, auditCreate, nil)
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+// HideCategory hides a global category from a user's category list. Its
+// existing transactions keep it.
+func HideCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := globalCategoryFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := decodeCategoryVisibility(w, r)
+	if !ok {
+		return
+	}
+	_, err := db.Exec("INSERT INTO hidden_categories (user_id, category_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, categoryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to hide category")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category hidden"})
+}
+
+func UnhideCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := globalCategoryFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := decodeCategoryVisibility(w, r)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM hidden_categories WHERE user_id=$1 AND category_id=$2", userID, categoryID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to unhide category")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category unhidden"})
+}
+
+// GetGlobalCategoryReport totals personal spending in each global category
+// across all users between ?from= and ?to= (default: the current month),
+// with how many users spent in it and how many have hidden it.
+func GetGlobalCategoryReport(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	rows, err := db.Query(`
+        SELECT c.id, c.name, COUNT(DISTINCT l.user_id), (SELECT COUNT(*) FROM hidden_categories h WHERE h.category_id = c.id),
+            COALESCE(SUM(l.amount), 0)
+        FROM categories c
+        LEFT JOIN transaction_lines l ON l.category_id = c.id AND l.organization_id IS NULL AND NOT l.excluded
+            AND l.date >= $1 AND l.date < $2::date + 1
+        WHERE c.is_global
+        GROUP BY c.id, c.name
+        ORDER BY COALESCE(SUM(l.amount), 0) DESC, c.name`, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build report")
+		return
+	}
+	defer rows.Close()
+	report := []GlobalCategorySpending{}
+	for rows.Next() {
+		var s GlobalCategorySpending
+		if err := rows.Scan(&s.CategoryID, &s.Category, &s.Users, &s.HiddenBy, &s.Total); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan report row")
+			return
+		}
+		report = append(report, s)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,427 @@
+// groupbudgets.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A personal budget can have members besides its owner. The owner invites a
+// user, and once they accept, their personal transactions count towards the
+// budget just like the owner's, so the budget tracks what the group spends
+// together. Members can see the budget and its progress, and can always
+// leave. What else they can do depends on their role: the owner can do
+// anything, admins can invite and remove members and change the budget and
+// its allocations, and plain members only contribute their transactions.
+// Only the owner can make members admins or remove admins.
+
+// Member statuses as listed.
+const (
+	memberOwner   = "owner"
+	memberInvited = "invited"
+	memberActive  = "active"
+)
+
+// Member roles. The owner's role is memberOwner; the others are stored on
+// the membership.
+const (
+	memberRoleAdmin  = "admin"
+	memberRoleMember = "member"
+)
+
+// --- MODELS ---
+type BudgetMember struct {
+	UserID     int        `json:"user_id"`
+	Username   string     `json:"username"`
+	Status     string     `json:"status"`
+	Role       string     `json:"role"`
+	InvitedAt  *time.Time `json:"invited_at,omitempty"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+// BudgetContribution is what one member of a group budget spent in a
+// period, and their percentage of the group's total.
+type BudgetContribution struct {
+	UserID   int     `json:"user_id"`
+	Username string  `json:"username"`
+	Spent    float64 `json:"spent"`
+	Percent  float64 `json:"percent"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// budgetLedgerSQL matches the personal transaction lines that count towards
+// the personal budget whose owner is $1 and whose id is budgetParam: the
+// owner's and those of every member who has accepted, unless they await or
+// were refused the owner's approval.
+func budgetLedgerSQL(budgetParam string) string {
+	return `organization_id IS NULL AND (user_id = $1 OR user_id IN (
+            SELECT user_id FROM budget_members WHERE budget_id = ` + budgetParam + ` AND accepted_at IS NOT NULL))
+        AND ` + budgetApprovedSQL(budgetParam)
+}
+
+// isBudgetMember reports whether the user has accepted membership of the
+// budget.
+func isBudgetMember(budgetID, userID int) (bool, error) {
+	var member bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM budget_members WHERE budget_id=$1 AND user_id=$2 AND accepted_at IS NOT NULL)",
+		budgetID, userID).Scan(&member)
+	return member, err
+}
+
+// budgetMemberRole returns the role of an accepted member of the budget, or
+// "" if the user is not one.
+func budgetMemberRole(budgetID, userID int) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM budget_members WHERE budget_id=$1 AND user_id=$2 AND accepted_at IS NOT NULL",
+		budgetID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// budgetContributions splits what budgetSpent sums for a personal budget
+// between its owner and members, each of whom is listed even if they spent
+// nothing.
+func budgetContributions(q queryer, b Budget, from, to time.Time) ([]BudgetContribution, error) {
+	sum, filter := "SUM("+budgetAmountSQL("l", "$5", "$6")+")", ""
+	if b.Kind == budgetKindIncome {
+		sum, filter = "-"+sum, " AND amount < 0 AND linked_transaction_id IS NULL"
+	}
+	rows, err := q.Query(`SELECT m.user_id, u.username, COALESCE(s.spent, 0)
+        FROM (SELECT $1::integer AS user_id
+              UNION SELECT user_id FROM budget_members WHERE budget_id = $4 AND accepted_at IS NOT NULL) m
+        JOIN users u ON u.id = m.user_id
+        LEFT JOIN (SELECT user_id, ROUND(`+sum+`, 2) AS spent FROM transaction_lines l
+              WHERE `+budgetLedgerSQL("$4")+` AND NOT excluded AND date >= $2 AND date < $3`+filter+`
+              GROUP BY user_id) s ON s.user_id = m.user_id
+        ORDER BY u.username`, append([]interface{}{b.UserID, from, to, b.ID}, budgetCurrencyArgs(b)...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	contributions := []BudgetContribution{}
+	var total float64
+	for rows.Next() {
+		var c BudgetContribution
+		if err := rows.Scan(&c.UserID, &c.Username, &c.Spent); err != nil {
+			return nil, err
+		}
+		total += c.Spent
+		contributions = append(contributions, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if total != 0 {
+		for i := range contributions {
+			contributions[i].Percent = math.Round(contributions[i].Spent/total*10000) / 100
+		}
+	}
+	return contributions, nil
+}
+
+// --- BUDGET MEMBER HANDLERS ---
+
+// InviteBudgetMember invites the user in the body to the budget as a member,
+// or with role "admin" as an admin. The owner of a personal budget and its
+// admins can invite, but only the owner can invite admins.
+func InviteBudgetMember(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID int    `json:"user_id"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	budget, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget ownership")
+		return
+	}
+	if budget.OrgID.Valid {
+		respondWithError(w, http.StatusForbidden, "You can only invite members to your own budgets")
+		return
+	}
+	if req.Role == "" {
+		req.Role = memberRoleMember
+	} else if req.Role != memberRoleAdmin && req.Role != memberRoleMember {
+		respondWithError(w, http.StatusBadRequest, "Role must be 'admin' or 'member'")
+		return
+	}
+	if budget.OwnerID != u.ID {
+		role, err := budgetMemberRole(budgetID, u.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to verify budget membership")
+			return
+		}
+		if role != memberRoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only the budget owner and its admins can invite members")
+			return
+		}
+		if req.Role == memberRoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only the budget owner can invite admins")
+			return
+		}
+	}
+	if req.UserID == budget.OwnerID {
+		respondWithError(w, http.StatusBadRequest, "User already owns this budget")
+		return
+	}
+	m := BudgetMember{UserID: req.UserID, Status: memberInvited, Role: req.Role}
+	if err := db.QueryRow("SELECT username FROM users WHERE id=$1", req.UserID).Scan(&m.Username); err != nil {
+		respondWithError(w, http.StatusBadRequest, "User to invite does not exist.")
+		return
+	}
+	err = db.QueryRow(`INSERT INTO budget_members (budget_id, user_id, role) VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING RETURNING invited_at`, budgetID, req.UserID, req.Role).Scan(&m.InvitedAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusConflict, "User is already invited to this budget")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to invite member")
+		return
+	}
+	notifyBudgetEvent(u.ID, req.UserID, notifyMemberInvited, budgetID)
+	respondWithJSON(w, http.StatusCreated, m)
+}
+
+// AcceptBudgetMembership accepts the caller's invitation to the budget, from
+// which point their transactions count towards it.
+func AcceptBudgetMembership(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	m := BudgetMember{UserID: u.ID, Status: memberActive}
+	var memberID int
+	var alreadyAccepted bool
+	err = db.QueryRow(`UPDATE budget_members m SET accepted_at = COALESCE(accepted_at, CURRENT_TIMESTAMP)
+        FROM (SELECT accepted_at IS NOT NULL AS accepted FROM budget_members WHERE budget_id=$1 AND user_id=$2) old
+        WHERE m.budget_id=$1 AND m.user_id=$2
+        RETURNING m.id, (SELECT username FROM users WHERE id=$2), m.role, m.invited_at, m.accepted_at, old.accepted`,
+		budgetID, u.ID).Scan(&memberID, &m.Username, &m.Role, &m.InvitedAt, &m.AcceptedAt, &alreadyAccepted)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "You have not been invited to this budget")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+	if !alreadyAccepted {
+		writeAudit(db, u.ID, "budget_member", memberID, auditCreate, nil)
+		notifyMemberChange(u.ID, notifyMemberJoined, budgetID)
+	}
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+// GetBudgetMembers lists the budget's owner followed by its members and
+// pending invitations.
+func GetBudgetMembers(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	// Other users' usernames are hidden by row-level security, so this
+	// reads through db once access has been checked.
+	rows, err := db.Query(`SELECT u.id, u.username, m.role, m.invited_at, m.accepted_at FROM (
+            SELECT user_id, '`+memberOwner+`' AS role, NULL::timestamptz AS invited_at, NULL::timestamptz AS accepted_at, 0 AS rank
+            FROM budgets WHERE id = $1 AND organization_id IS NULL
+            UNION ALL
+            SELECT user_id, role, invited_at, accepted_at, CASE WHEN accepted_at IS NULL THEN 2 ELSE 1 END
+            FROM budget_members WHERE budget_id = $1
+        ) m JOIN users u ON u.id = m.user_id
+        ORDER BY m.rank, u.username`, budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve members")
+		return
+	}
+	defer rows.Close()
+	members := []BudgetMember{}
+	for rows.Next() {
+		var m BudgetMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.InvitedAt, &m.AcceptedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan member")
+			return
+		}
+		switch {
+		case m.InvitedAt == nil:
+			m.Status = memberOwner
+		case m.AcceptedAt == nil:
+			m.Status = memberInvited
+		default:
+			m.Status = memberActive
+		}
+		members = append(members, m)
+	}
+	respondWithJSON(w, http.StatusOK, members)
+}
+
+// RemoveBudgetMember removes a member or withdraws an invitation. The owner
+// can remove anyone, admins anyone but other admins, and members can remove
+// themselves.
+func RemoveBudgetMember(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	budget, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget ownership")
+		return
+	}
+	if !canAccess(u, budget.OwnerID) && u.ID != userID {
+		var callerRole, role string
+		err := db.QueryRow(`SELECT COALESCE((SELECT role FROM budget_members WHERE budget_id=$1 AND user_id=$2 AND accepted_at IS NOT NULL), ''),
+                COALESCE((SELECT role FROM budget_members WHERE budget_id=$1 AND user_id=$3), '')`,
+			budgetID, u.ID, userID).Scan(&callerRole, &role)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to verify budget membership")
+			return
+		}
+		if callerRole != memberRoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only the budget owner and its admins can remove other members")
+			return
+		}
+		if role == memberRoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only the budget owner can remove admins")
+			return
+		}
+	}
+	var memberID int
+	var before []byte
+	var accepted bool
+	err = db.QueryRow("DELETE FROM budget_members m WHERE budget_id=$1 AND user_id=$2 RETURNING id, row_to_json(m), accepted_at IS NOT NULL",
+		budgetID, userID).Scan(&memberID, &before, &accepted)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	// Withdrawn invitations never took effect, so only memberships are
+	// audited.
+	if accepted {
+		writeAudit(db, u.ID, "budget_member", memberID, auditDelete, before)
+	}
+	if u.ID == userID {
+		notifyMemberChange(u.ID, notifyMemberLeft, budgetID)
+	} else {
+		notifyBudgetEvent(u.ID, userID, notifyMemberRemoved, budgetID)
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Member removed successfully"})
+}
+
+// SetBudgetMemberRole changes the role of a member or invitee. Only the
+// budget's owner can change roles.
+func SetBudgetMemberRole(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.Role != memberRoleAdmin && req.Role != memberRoleMember {
+		respondWithError(w, http.StatusBadRequest, "Role must be 'admin' or 'member'")
+		return
+	}
+	budget, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget ownership")
+		return
+	}
+	if budget.OrgID.Valid || !canAccess(u, budget.OwnerID) {
+		respondWithError(w, http.StatusForbidden, "Only the budget owner can change member roles")
+		return
+	}
+	var memberID int
+	if err := db.QueryRow("SELECT id FROM budget_members WHERE budget_id=$1 AND user_id=$2", budgetID, userID).Scan(&memberID); err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update member")
+		return
+	}
+	before := snapshotResource(db, "budget_member", memberID)
+	m := BudgetMember{UserID: userID, Role: req.Role, Status: memberActive}
+	err = db.QueryRow(`UPDATE budget_members SET role=$2 WHERE id=$1
+        RETURNING (SELECT username FROM users WHERE id=user_id), invited_at, accepted_at`,
+		memberID, req.Role).Scan(&m.Username, &m.InvitedAt, &m.AcceptedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update member")
+		return
+	}
+	// Invitations are not audited until accepted.
+	if m.AcceptedAt == nil {
+		m.Status = memberInvited
+	} else {
+		writeAudit(db, u.ID, "budget_member", memberID, auditUpdate, before)
+	}
+	respondWithJSON(w, http.StatusOK, m)
+}
@@ -4,51 +4,172 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // --- MODELS ---
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password,omitempty"`
-	Role     string `json:"role,omitempty"`
+	ID           int    `json:"id"`
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	Role         string `json:"role,omitempty"`
+	IsService    bool   `json:"is_service,omitempty"`
+	BaseCurrency string `json:"base_currency,omitempty"`
+	// Email is where notifications are mailed, if set.
+	Email *string `json:"email,omitempty"`
 }
 
 type Category struct {
-	ID     int    `json:"id"`
-	UserID int    `json:"user_id"`
-	Name   string `json:"name"`
+	ID             int    `json:"id"`
+	UserID         int    `json:"user_id"`
+	OrganizationID *int   `json:"organization_id,omitempty"`
+	Name           string `json:"name"`
+	ParentID       *int   `json:"parent_id,omitempty"`
+	// ExcludeFromBudget keeps the category's spending, e.g. reimbursable
+	// work expenses, out of budgets and spending reports.
+	ExcludeFromBudget bool `json:"exclude_from_budget"`
+	// IsGlobal marks an admin-managed category every user sees; Hidden is
+	// set on one the requesting user has hidden.
+	IsGlobal bool `json:"is_global"`
+	Hidden   bool `json:"hidden,omitempty"`
+	// SortOrder is the requesting user's position for the category, unset
+	// until they arrange their categories.
+	SortOrder *int `json:"sort_order,omitempty"`
 }
 
 type Transaction struct {
-	ID          int       `json:"id"`
-	UserID      int       `json:"user_id"`
-	Description string    `json:"description"`
-	Amount      float64   `json:"amount"`
-	Date        time.Time `json:"date"`
-	CategoryID  int       `json:"category_id"`
+	ID             int       `json:"id"`
+	UserID         int       `json:"user_id"`
+	Description    string    `json:"description"`
+	Amount         float64   `json:"amount"`
+	Date           time.Time `json:"date"`
+	CategoryID     int       `json:"category_id"`
+	OrganizationID *int      `json:"organization_id,omitempty"`
+	PayeeID        *int      `json:"payee_id,omitempty"`
+	AccountID      *int      `json:"account_id,omitempty"`
+	Status         string    `json:"status"`
+	Notes          string    `json:"notes"`
+	Latitude       *float64  `json:"latitude,omitempty"`
+	Longitude      *float64  `json:"longitude,omitempty"`
+	Currency       string    `json:"currency,omitempty"`
+	OriginalAmount *float64  `json:"original_amount,omitempty"`
+	ExchangeRate   *float64  `json:"exchange_rate,omitempty"`
+	// LinkedTransactionID is set on a refund and points at the expense it
+	// refunds.
+	LinkedTransactionID *int       `json:"linked_transaction_id,omitempty"`
+	ExcludeFromBudget   bool       `json:"exclude_from_budget"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	DeletedAt           *time.Time `json:"deleted_at,omitempty"`
+	// Version is bumped on every change; updates must send the version
+	// they were based on.
+	Version int `json:"version"`
+	// IsAdjustment marks a balance adjustment, which is always excluded
+	// from budgets and reports.
+	IsAdjustment bool `json:"is_adjustment,omitempty"`
+	// Warnings are returned on create, e.g. when a category cap is exceeded.
+	Warnings []string `json:"warnings,omitempty"`
+	// RunningBalance is the account's balance after this transaction, set in
+	// listings filtered by account.
+	RunningBalance *float64 `json:"running_balance,omitempty"`
+}
+
+// transactionColumns is the select list scanTransaction reads.
+const transactionColumns = `id, user_id, organization_id, COALESCE(description, ''), amount, date, COALESCE(category_id, 0), payee_id,
+    account_id, is_adjustment, status, notes, latitude, longitude, COALESCE(currency, ''), original_amount, exchange_rate, linked_transaction_id, exclude_from_budget, updated_at, deleted_at, version`
+
+// scanTransaction scans a row selected with transactionColumns, followed by
+// any extra columns into extra.
+func scanTransaction(row interface{ Scan(...interface{}) error }, t *Transaction, extra ...interface{}) error {
+	dest := []interface{}{&t.ID, &t.UserID, &t.OrganizationID, &t.Description, &t.Amount, &t.Date, &t.CategoryID, &t.PayeeID,
+		&t.AccountID, &t.IsAdjustment, &t.Status, &t.Notes, &t.Latitude, &t.Longitude, &t.Currency, &t.OriginalAmount, &t.ExchangeRate, &t.LinkedTransactionID, &t.ExcludeFromBudget, &t.UpdatedAt, &t.DeletedAt, &t.Version}
+	return row.Scan(append(dest, extra...)...)
+}
+
+// TransactionSummary aggregates the full filtered set of a transaction
+// listing, not just the current page.
+type TransactionSummary struct {
+	Count      int                `json:"count"`
+	Total      float64            `json:"total"`
+	Categories []CategorySubtotal `json:"categories"`
+}
+
+type CategorySubtotal struct {
+	CategoryID *int    `json:"category_id"`
+	Category   string  `json:"category"`
+	Total      float64 `json:"total"`
+	Count      int     `json:"count"`
 }
 
 type Budget struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	Period    time.Time `json:"period"`
-	Frequency string    `json:"frequency"` // "weekly", "monthly", "yearly"
-	Amount    float64   `json:"amount"`
+	ID             int        `json:"id"`
+	UserID         int        `json:"user_id"`
+	Period         time.Time  `json:"period"`
+	EndDate        *time.Time `json:"end_date,omitempty"` // last day of a custom budget
+	Frequency      string     `json:"frequency"`          // see budgetFrequencies
+	Amount         float64    `json:"amount"`
+	OrganizationID *int       `json:"organization_id,omitempty"`
+	Rollover       bool       `json:"rollover"` // carry unspent money into the next period
+	Kind           string     `json:"kind"`     // "expense" (default) or "income"
+	Name           string     `json:"name"`
+	Description    string     `json:"description"`
+	Notes          string     `json:"notes"`
+	ArchivedAt     *time.Time `json:"archived_at,omitempty"`
+	// Currency is set on budgets kept in a currency other than the owner's
+	// base currency, with the rate (base units per unit) used to convert.
+	Currency     *string  `json:"currency,omitempty"`
+	ExchangeRate *float64 `json:"exchange_rate,omitempty"`
+	// SinkingFundID links the budget to a savings goal that receives what is
+	// left under budget when each period closes. Set via /budgets/{id}/goal.
+	SinkingFundID *int `json:"sinking_fund_id,omitempty"`
+	// RequireApproval holds members' new transactions back from the budget
+	// until the owner approves them. Set via /budgets/{id}/approval.
+	RequireApproval bool `json:"require_approval"`
+	// Version is bumped on every change; updates must send the version
+	// they were based on.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// budgetColumns is the select list scanBudget reads.
+const budgetColumns = `id, user_id, organization_id, period, end_date, frequency, amount, rollover, kind, name, description, notes, archived_at, currency, exchange_rate, sinking_fund_id, version, updated_at, require_approval`
+
+// scanBudget scans a row selected with budgetColumns, followed by any extra
+// columns into extra.
+func scanBudget(row interface{ Scan(...interface{}) error }, b *Budget, extra ...interface{}) error {
+	dest := []interface{}{&b.ID, &b.UserID, &b.OrganizationID, &b.Period, &b.EndDate, &b.Frequency, &b.Amount, &b.Rollover, &b.Kind,
+		&b.Name, &b.Description, &b.Notes, &b.ArchivedAt, &b.Currency, &b.ExchangeRate, &b.SinkingFundID, &b.Version, &b.UpdatedAt,
+		&b.RequireApproval}
+	return row.Scan(append(dest, extra...)...)
 }
 
 type SharedBudget struct {
-	ID         int `json:"id"`
-	BudgetID   int `json:"budget_id"`
-	FromUserID int `json:"from_user_id"`
-	ToUserID   int `json:"to_user_id"`
+	ID         int    `json:"id"`
+	BudgetID   int    `json:"budget_id"`
+	FromUserID int    `json:"from_user_id"`
+	ToUserID   int    `json:"to_user_id"`
+	Permission string `json:"permission"` // "view", "edit"
+	// ShowTransactions lets the recipient see the owner's transactions
+	// that count towards the budget.
+	ShowTransactions bool `json:"show_transactions"`
+}
+
+// SharedBudgetDetail is a budget as seen by a share recipient.
+type SharedBudgetDetail struct {
+	Budget
+	ShareID          int    `json:"share_id"`
+	Permission       string `json:"permission"`
+	ShowTransactions bool   `json:"show_transactions"`
 }
 
 // --- HELPER FUNCTIONS ---
@@ -64,6 +185,259 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
+// requireVersion refuses, with 428, an update that does not say which
+// version it was based on.
+func requireVersion(w http.ResponseWriter, version int) bool {
+	if version <= 0 {
+		respondWithError(w, http.StatusPreconditionRequired, "version is required; send the version you last read")
+		return false
+	}
+	return true
+}
+
+// respondVersionConflict refuses, with 409, an update based on a version
+// that has since changed, returning the current state so the client can
+// reconcile the two.
+func respondVersionConflict(w http.ResponseWriter, current interface{}) {
+	respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":   "Someone else changed this in the meantime; review the current version and try again",
+		"current": current,
+	})
+}
+
+// parseDateParam parses an optional YYYY-MM-DD query parameter, returning
+// def when it is absent.
+func parseDateParam(r *http.Request, name string, def time.Time) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// monthStart returns midnight on the first day of t's month.
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// transactionSummary totals the transactions matching where. Category
+// subtotals come from transaction_lines, so split transactions count toward
+// each of their split categories.
+func transactionSummary(q queryer, where string, args []interface{}) (TransactionSummary, error) {
+	summary := TransactionSummary{Categories: []CategorySubtotal{}}
+	err := q.QueryRow("SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM transactions WHERE "+where, args...).Scan(&summary.Count, &summary.Total)
+	if err != nil {
+		return summary, err
+	}
+	rows, err := q.Query(`
+        SELECT l.category_id, COALESCE(c.name, 'Uncategorized'), SUM(l.amount), COUNT(DISTINCT l.transaction_id)
+        FROM transaction_lines l
+        LEFT JOIN categories c ON c.id = l.category_id
+        WHERE l.transaction_id IN (SELECT id FROM transactions WHERE `+where+`)
+        GROUP BY l.category_id, c.name
+        ORDER BY SUM(l.amount) DESC`, args...)
+	if err != nil {
+		return summary, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CategorySubtotal
+		if err := rows.Scan(&c.CategoryID, &c.Category, &c.Total, &c.Count); err != nil {
+			return summary, err
+		}
+		summary.Categories = append(summary.Categories, c)
+	}
+	return summary, rows.Err()
+}
+
+// parsePagination reads ?page (1-based) and ?per_page, applying the default
+// page size and capping it at maxPageSize.
+func parsePagination(r *http.Request) (page, perPage int, err error) {
+	page, perPage = 1, defaultPageSize
+	if v := r.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("invalid page")
+		}
+	}
+	if v := r.URL.Query().Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			return 0, 0, fmt.Errorf("invalid per_page")
+		}
+	}
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+	return page, perPage, nil
+}
+
+// setPaginationHeaders reports paging state in headers so list responses
+// stay plain JSON arrays.
+func setPaginationHeaders(w http.ResponseWriter, total, page, perPage int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("X-Page", strconv.Itoa(page))
+	w.Header().Set("X-Per-Page", strconv.Itoa(perPage))
+}
+
+// Sortable columns per list endpoint, keyed by the name clients use in ?sort.
+var (
+	transactionSortColumns = map[string]string{"date": "date", "amount": "amount", "description": "description", "category_id": "category_id", "id": "id"}
+	budgetSortColumns      = map[string]string{"period": "period", "amount": "amount", "frequency": "frequency", "name": "name", "id": "id"}
+	categorySortColumns    = map[string]string{"name": "name", "id": "id", "parent_id": "parent_id", "sort_order": "sort_order"}
+)
+
+// parseSort turns ?sort=amount,-date into an ORDER BY list using only the
+// whitelisted columns; a leading '-' sorts descending. id is appended as a
+// tiebreaker so paging stays stable. Without ?sort it returns def.
+func parseSort(r *http.Request, columns map[string]string, def string) (string, error) {
+	v := r.URL.Query().Get("sort")
+	if v == "" {
+		return def, nil
+	}
+	var terms []string
+	hasID := false
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		direction := "ASC"
+		if strings.HasPrefix(field, "-") {
+			field, direction = field[1:], "DESC"
+		}
+		column, ok := columns[field]
+		if !ok {
+			return "", fmt.Errorf("Cannot sort by '%s'", field)
+		}
+		hasID = hasID || column == "id"
+		terms = append(terms, column+" "+direction)
+	}
+	if !hasID {
+		terms = append(terms, "id ASC")
+	}
+	return strings.Join(terms, ", "), nil
+}
+
+// validateLocation requires latitude and longitude to be given together and
+// to be in range.
+func validateLocation(w http.ResponseWriter, t Transaction) bool {
+	if (t.Latitude == nil) != (t.Longitude == nil) {
+		respondWithError(w, http.StatusBadRequest, "Latitude and longitude must be provided together")
+		return false
+	}
+	if t.Latitude != nil && (*t.Latitude < -90 || *t.Latitude > 90 || *t.Longitude < -180 || *t.Longitude > 180) {
+		respondWithError(w, http.StatusBadRequest, "Latitude or longitude out of range")
+		return false
+	}
+	return true
+}
+
+// transactionFilters builds the WHERE clause for a user's live personal
+// transactions from the optional filters from, to (YYYY-MM-DD, inclusive),
+// category_id, payee_id, account_id, min_amount, max_amount, status, q
+// (description or notes contains, case-insensitive), description (the whole
+// description matches a case-insensitive pattern where * stands for any
+// text) and tags (comma-separated tag names; a transaction must carry all of
+// them). updated_since (RFC 3339) selects rows changed after that instant
+// and, for syncing, includes deleted ones. Values are always passed as
+// placeholders.
+func transactionFilters(query url.Values, userID int) (string, []interface{}, error) {
+	conditions := []string{"user_id = $1", "organization_id IS NULL"}
+	args := []interface{}{userID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(cond, len(args)))
+	}
+
+	if v := query.Get("updated_since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid 'updated_since'; use RFC 3339")
+		}
+		add("updated_at > $%d", since)
+	} else {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	if v := query.Get("from"); v != "" {
+		from, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid 'from' date")
+		}
+		add("date >= $%d", from)
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid 'to' date")
+		}
+		add("date < $%d", to.AddDate(0, 0, 1))
+	}
+	if v := query.Get("category_id"); v != "" {
+		categoryID, err := strconv.Atoi(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid category ID")
+		}
+		add("category_id = $%d", categoryID)
+	}
+	if v := query.Get("payee_id"); v != "" {
+		payeeID, err := strconv.Atoi(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid payee ID")
+		}
+		add("payee_id = $%d", payeeID)
+	}
+	if v := query.Get("account_id"); v != "" {
+		accountID, err := strconv.Atoi(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid account ID")
+		}
+		add("account_id = $%d", accountID)
+	}
+	if v := query.Get("min_amount"); v != "" {
+		amount, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid 'min_amount'")
+		}
+		add("amount >= $%d", amount)
+	}
+	if v := query.Get("max_amount"); v != "" {
+		amount, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid 'max_amount'")
+		}
+		add("amount <= $%d", amount)
+	}
+	if v := query.Get("status"); v != "" {
+		if v != statusPending && v != statusCleared && v != statusReconciled {
+			return "", nil, fmt.Errorf("Invalid 'status'")
+		}
+		add("status = $%d", v)
+	}
+	if v := query.Get("q"); v != "" {
+		add("strpos(LOWER(COALESCE(description, '') || ' ' || COALESCE(notes, '')), LOWER($%d)) > 0", v)
+	}
+	if v := query.Get("description"); v != "" {
+		pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(v)
+		add("description ILIKE $%d", strings.ReplaceAll(pattern, "*", "%"))
+	}
+	if v := query.Get("tags"); v != "" {
+		var names []string
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			args = append(args, pq.Array(names), len(names))
+			conditions = append(conditions, fmt.Sprintf(`id IN (SELECT tt.transaction_id FROM transaction_tags tt JOIN tags g ON g.id = tt.tag_id
+            WHERE g.name = ANY($%d) GROUP BY tt.transaction_id HAVING COUNT(DISTINCT g.name) = $%d)`, len(args)-1, len(args)))
+		}
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
 // --- USER HANDLERS ---
 
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -77,7 +451,16 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Failed to hash password")
 		return
 	}
-	err = db.QueryRow("INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id", u.Username, string(hashedPassword)).Scan(&u.ID)
+	// New accounts get the default category template in the same
+	// transaction, so a registration never leaves a half-seeded account.
+	err = withTx(r, func(q queryer) error {
+		err := q.QueryRow("INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id", u.Username, string(hashedPassword)).Scan(&u.ID)
+		if err != nil || defaultCategoryTemplate == "" {
+			return err
+		}
+		_, err = applyCategoryTemplate(q, u.ID, u.ID, findCategoryTemplate(defaultCategoryTemplate))
+		return err
+	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to register user")
 		return
@@ -93,8 +476,8 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var storedUser User
-	row := db.QueryRow("SELECT id, password, role FROM users WHERE username=$1", u.Username)
-	if err := row.Scan(&storedUser.ID, &storedUser.Password, &storedUser.Role); err != nil {
+	row := db.QueryRow("SELECT id, password, role, is_service FROM users WHERE username=$1", u.Username)
+	if err := row.Scan(&storedUser.ID, &storedUser.Password, &storedUser.Role, &storedUser.IsService); err != nil {
 		if err == sql.ErrNoRows {
 			respondWithError(w, http.StatusUnauthorized, "Invalid username or password")
 		} else {
@@ -102,15 +485,33 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(u.Password)); err != nil {
+	// Service accounts get the same answer as a wrong password, so the
+	// response doesn't tell anyone which usernames they are
+	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(u.Password)); err != nil || storedUser.IsService {
 		respondWithError(w, http.StatusUnauthorized, "Invalid username or password")
 		return
 	}
-	respondWithJSON(w, http.StatusOK, map[string]interface{}{"message": "Login successful", "user_id": storedUser.ID, "role": storedUser.Role})
+	if pending, err := isPendingDeletion(storedUser.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	} else if pending {
+		respondWithError(w, http.StatusForbidden, "Account is scheduled for deletion")
+		return
+	}
+	response, err := issueCredentials(w, storedUser.ID, storedUser.Role)
+	if err != nil {
+		log.Printf("Error issuing credentials for user %d: %v", storedUser.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+	response["message"] = "Login successful"
+	response["user_id"] = storedUser.ID
+	response["role"] = storedUser.Role
+	respondWithJSON(w, http.StatusOK, response)
 }
 
 func GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, username, role FROM users")
+	rows, err := db.Query("SELECT id, username, role, is_service FROM users")
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve users")
 		return
@@ -119,7 +520,7 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.Role); err != nil {
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role, &u.IsService); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to scan user")
 			return
 		}
@@ -128,6 +529,53 @@ func GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, users)
 }
 
+func GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var u User
+	err := db.QueryRow("SELECT id, username, role, is_service, base_currency, email FROM users WHERE id=$1", caller.ID).Scan(&u.ID, &u.Username, &u.Role, &u.IsService, &u.BaseCurrency, &u.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve user")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, u)
+}
+
+// UpdateCurrentUser lets a user rename themselves and set their base
+// currency and email; roles can only be changed by admins. Changing the base
+// currency does not convert existing transactions. An empty email clears it.
+func UpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var u User
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil || u.Username == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	u.BaseCurrency = strings.ToUpper(strings.TrimSpace(u.BaseCurrency))
+	if u.BaseCurrency != "" && !currencyCodePattern.MatchString(u.BaseCurrency) {
+		respondWithError(w, http.StatusBadRequest, "Currency must be a three-letter ISO 4217 code")
+		return
+	}
+	if u.Email != nil && *u.Email != "" {
+		if _, err := mail.ParseAddress(*u.Email); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid email address")
+			return
+		}
+	}
+	_, err := db.Exec("UPDATE users SET username=$1, base_currency=COALESCE(NULLIF($2, ''), base_currency), email=NULLIF(COALESCE($3, email), '') WHERE id=$4",
+		u.Username, u.BaseCurrency, u.Email, caller.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update user")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "User updated successfully"})
+}
+
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID, err := strconv.Atoi(params["id"])
@@ -140,14 +588,88 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	_, err = db.Exec("UPDATE users SET username=$1, role=$2 WHERE id=$3", u.Username, u.Role, userID)
-	if err != nil {
+	if u.Role != "admin" && u.Role != "user" {
+		respondWithError(w, http.StatusBadRequest, "Role must be 'admin' or 'user'")
+		return
+	}
+	var previousRole string
+	err = db.QueryRow("UPDATE users u SET username=$1, role=$2 FROM users old WHERE u.id=$3 AND old.id=u.id RETURNING old.role",
+		u.Username, u.Role, userID).Scan(&previousRole)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update user")
 		return
 	}
+	// Tokens carry the role they were issued with, so a changed role must
+	// not be left to outlive them
+	if previousRole != u.Role {
+		if err := revokeAllUserCredentials(userID); err != nil {
+			log.Printf("Error revoking credentials for user %d: %v", userID, err)
+			respondWithError(w, http.StatusInternalServerError, "User updated but failed to revoke existing sessions")
+			return
+		}
+	}
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "User updated successfully"})
 }
 
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	// Only the user themselves or an admin may change a password, so the
+	// current-password check can't be brute-forced anonymously
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	if !canAccess(u, userID) {
+		respondWithError(w, http.StatusForbidden, "You can only change your own password")
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	var stored string
+	err = db.QueryRow("SELECT password FROM users WHERE id=$1", userID).Scan(&stored)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(req.CurrentPassword)); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid password")
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), 8)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to hash password")
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET password=$1 WHERE id=$2", string(hashedPassword), userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update password")
+		return
+	}
+	// Existing tokens and sessions must not outlive the old password
+	if err := revokeAllUserCredentials(userID); err != nil {
+		log.Printf("Error revoking credentials for user %d: %v", userID, err)
+		respondWithError(w, http.StatusInternalServerError, "Password changed but failed to revoke existing sessions")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Password updated successfully"})
+}
+
 func DeleteUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID, err := strconv.Atoi(params["id"])
@@ -180,11 +702,16 @@ func CreateCategory(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	err := db.QueryRow("INSERT INTO categories (user_id, name) VALUES ($1, $2) RETURNING id", c.UserID, c.Name).Scan(&c.ID)
+	if !authorizeBodyOwner(w, r, &c.UserID) || !validateCategoryParent(w, 0, c.ParentID, resourceRef{OwnerID: c.UserID}) {
+		return
+	}
+	err := dbFor(r).QueryRow("INSERT INTO categories (user_id, name, parent_id, exclude_from_budget) VALUES ($1, $2, $3, $4) RETURNING id",
+		c.UserID, c.Name, c.ParentID, c.ExcludeFromBudget).Scan(&c.ID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to create category. It may already exist for this user.")
 		return
 	}
+	recordAudit(r, "category", c.ID, auditCreate, nil)
 	respondWithJSON(w, http.StatusCreated, c)
 }
 
@@ -195,7 +722,19 @@ func GetCategories(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
-	rows, err := db.Query("SELECT id, user_id, name FROM categories WHERE user_id=$1", userID)
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	orderBy, err := parseSort(r, categorySortColumns, "sort_order ASC, id ASC")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := visibleCategoriesSQL
+	if r.URL.Query().Get("include_hidden") != "true" {
+		query += " AND h.user_id IS NULL"
+	}
+	rows, err := dbFor(r).Query(query+" ORDER BY "+orderBy, userID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve categories")
 		return
@@ -204,7 +743,7 @@ func GetCategories(w http.ResponseWriter, r *http.Request) {
 	var categories []Category
 	for rows.Next() {
 		var c Category
-		if err := rows.Scan(&c.ID, &c.UserID, &c.Name); err != nil {
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Name, &c.ParentID, &c.ExcludeFromBudget, &c.IsGlobal, &c.Hidden, &c.SortOrder); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to scan category")
 			return
 		}
@@ -220,16 +759,29 @@ func UpdateCategory(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
 		return
 	}
+	if !authorizeResource(w, r, "category", categoryID) {
+		return
+	}
 	var c Category
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	_, err = db.Exec("UPDATE categories SET name=$1 WHERE id=$2", c.Name, categoryID)
+	owner, err := loadResource("category", categoryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify category owner")
+		return
+	}
+	if !validateCategoryParent(w, categoryID, c.ParentID, owner) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "category", categoryID)
+	_, err = dbFor(r).Exec("UPDATE categories SET name=$1, parent_id=$2, exclude_from_budget=$3 WHERE id=$4", c.Name, c.ParentID, c.ExcludeFromBudget, categoryID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update category")
 		return
 	}
+	recordAudit(r, "category", categoryID, auditUpdate, before)
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category updated successfully"})
 }
 
@@ -240,11 +792,16 @@ func DeleteCategory(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
 		return
 	}
-	_, err = db.Exec("DELETE FROM categories WHERE id=$1", categoryID)
+	if !authorizeResource(w, r, "category", categoryID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "category", categoryID)
+	_, err = dbFor(r).Exec("DELETE FROM categories WHERE id=$1", categoryID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete category")
 		return
 	}
+	recordAudit(r, "category", categoryID, auditDelete, before)
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category deleted successfully"})
 }
 
@@ -256,16 +813,72 @@ func CreateTransaction(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	if createTransaction(w, r, &t) {
+		respondWithJSON(w, http.StatusCreated, t)
+	}
+}
+
+// createTransaction validates and stores a new personal transaction. It
+// responds itself on failure, or with 202 when the transaction was queued
+// for a parent's approval, and returns true only once t has been inserted.
+func createTransaction(w http.ResponseWriter, r *http.Request, t *Transaction) bool {
+	if !authorizeTransactionWrite(w, r, t) || !authorizeCategory(w, t.CategoryID, resourceRef{OwnerID: t.UserID}) ||
+		!validateTransactionStatus(w, t) || !validateLocation(w, *t) {
+		return false
+	}
 	if t.Date.IsZero() {
 		t.Date = time.Now()
 	}
-	err := db.QueryRow("INSERT INTO transactions (user_id, description, amount, date, category_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		t.UserID, t.Description, t.Amount, t.Date, t.CategoryID).Scan(&t.ID)
+	if !authorizeUnlockedDates(w, r, resourceRef{OwnerID: t.UserID}, t.Date) || !applyCurrency(w, dbFor(r), t) ||
+		!authorizeAccount(w, t.AccountID, t.UserID, t.Date) {
+		return false
+	}
+	needsApproval, ok := enforceChildLimits(w, r, *t, 0)
+	if !ok {
+		return false
+	}
+	if needsApproval {
+		submitForApproval(w, *t)
+		return false
+	}
+	if !enforceCategoryCap(w, r, t) {
+		return false
+	}
+	if t.PayeeID == nil {
+		payeeID, err := resolvePayee(dbFor(r), t.UserID, t.Description)
+		if err != nil {
+			log.Printf("Failed to resolve payee for %q: %v", t.Description, err)
+		}
+		t.PayeeID = payeeID
+	} else if !authorizePayee(w, t.PayeeID, t.UserID) {
+		return false
+	}
+	u, _ := currentUser(r)
+	var approvals []approvalRequest
+	err := withTx(r, func(q queryer) error {
+		err := q.QueryRow(`INSERT INTO transactions (user_id, description, amount, date, category_id, payee_id, status, notes, latitude, longitude,
+                currency, original_amount, exchange_rate, exclude_from_budget, account_id)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id`,
+			t.UserID, t.Description, t.Amount, t.Date, t.CategoryID, t.PayeeID, t.Status, t.Notes, t.Latitude, t.Longitude,
+			t.Currency, t.OriginalAmount, t.ExchangeRate, t.ExcludeFromBudget, t.AccountID).Scan(&t.ID)
+		if err != nil {
+			return err
+		}
+		writeAudit(q, u.ID, "transaction", t.ID, auditCreate, nil)
+		approvals, err = requestBudgetApprovals(q, *t)
+		return err
+	})
 	if err != nil {
+		log.Printf("Error creating transaction for user %d: %v", t.UserID, err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to create transaction")
-		return
+		return false
 	}
-	respondWithJSON(w, http.StatusCreated, t)
+	created := *t
+	afterCommit(r, func() {
+		notifyApprovalsRequested(created, approvals)
+		notifyTransactionCreated(created)
+	})
+	return true
 }
 
 func GetTransactions(w http.ResponseWriter, r *http.Request) {
@@ -275,7 +888,52 @@ func GetTransactions(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
-	rows, err := db.Query("SELECT id, user_id, description, amount, date, category_id FROM transactions WHERE user_id=$1 ORDER BY date DESC", userID)
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	page, perPage, err := parsePagination(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid pagination parameters")
+		return
+	}
+	query := r.URL.Query()
+	if v := query.Get("view"); v != "" && !applySavedView(w, query, v, userID) {
+		return
+	}
+	where, args, err := transactionFilters(query, userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	withSummary := query.Get("include") == "summary"
+	if usesCursor(r) {
+		if withSummary {
+			respondWithError(w, http.StatusBadRequest, "'include=summary' cannot be combined with cursor pagination")
+			return
+		}
+		getTransactionsByCursor(w, r, where, args, perPage)
+		return
+	}
+	var total int
+	var summary TransactionSummary
+	if withSummary {
+		summary, err = transactionSummary(dbFor(r), where, args)
+		total = summary.Count
+	} else {
+		err = dbFor(r).QueryRow("SELECT COUNT(*) FROM transactions WHERE "+where, args...).Scan(&total)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
+		return
+	}
+	orderBy, err := parseSort(r, transactionSortColumns, "date DESC, id DESC")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	columns, source, args, running := transactionSource(query, args)
+	rows, err := dbFor(r).Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d",
+		columns, source, where, orderBy, len(args)+1, len(args)+2), append(args, perPage, (page-1)*perPage)...)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
 		return
@@ -284,12 +942,26 @@ func GetTransactions(w http.ResponseWriter, r *http.Request) {
 	var transactions []Transaction
 	for rows.Next() {
 		var t Transaction
-		if err := rows.Scan(&t.ID, &t.UserID, &t.Description, &t.Amount, &t.Date, &t.CategoryID); err != nil {
+		var extra []interface{}
+		if running {
+			extra = append(extra, &t.RunningBalance)
+		}
+		if err := scanTransaction(rows, &t, extra...); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
 			return
 		}
 		transactions = append(transactions, t)
 	}
+	setPaginationHeaders(w, total, page, perPage)
+	if withSummary {
+		// The plain array stays the default so existing clients are
+		// unaffected; the summary is opt-in and wraps the page.
+		if transactions == nil {
+			transactions = []Transaction{}
+		}
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"transactions": transactions, "summary": summary})
+		return
+	}
 	respondWithJSON(w, http.StatusOK, transactions)
 }
 
@@ -300,18 +972,89 @@ func UpdateTransaction(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
 		return
 	}
+	if !authorizeResource(w, r, "transaction", transactionID) {
+		return
+	}
 	var t Transaction
 	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	_, err = db.Exec("UPDATE transactions SET description=$1, amount=$2, date=$3, category_id=$4 WHERE id=$5",
-		t.Description, t.Amount, t.Date, t.CategoryID, transactionID)
+	owner, err := loadResource("transaction", transactionID)
 	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify transaction owner")
+		return
+	}
+	if !authorizeCategory(w, t.CategoryID, owner) {
+		return
+	}
+	if !authorizeTransactionUnlocked(w, r, transactionID) || !authorizeUnlockedDates(w, r, owner, t.Date) {
+		return
+	}
+	if !requireVersion(w, t.Version) || (t.Status != "" && !validateTransactionStatus(w, &t)) || !validateLocation(w, t) {
+		return
+	}
+	t.UserID = owner.OwnerID
+	if !applyCurrency(w, dbFor(r), &t) {
+		return
+	}
+	if !ensureSplitsMatch(w, dbFor(r), transactionID, t.Amount) || !authorizePayee(w, t.PayeeID, owner.OwnerID) ||
+		!authorizeAccount(w, t.AccountID, owner.OwnerID, t.Date) {
+		return
+	}
+	if !owner.OrgID.Valid {
+		needsApproval, ok := enforceChildLimits(w, r, t, transactionID)
+		if !ok {
+			return
+		}
+		if needsApproval {
+			respondWithError(w, http.StatusForbidden, "Amount exceeds the approval threshold; submit a new transaction for approval")
+			return
+		}
+	}
+	u, _ := currentUser(r)
+	before := snapshotResource(dbFor(r), "transaction", transactionID)
+	found := true
+	var version int
+	var conflict *Transaction
+	err = withTx(r, func(q queryer) error {
+		if err := saveTransactionVersion(q, transactionID, u.ID); err != nil {
+			return err
+		}
+		err := q.QueryRow(`UPDATE transactions SET description=$1, amount=$2, date=$3, category_id=$4, payee_id=COALESCE($5, payee_id),
+            status=COALESCE(NULLIF($6, ''), status), notes=$7, latitude=$8, longitude=$9, currency=$10, original_amount=$11, exchange_rate=$12,
+            exclude_from_budget=$13 OR is_adjustment, account_id=COALESCE($14, account_id)
+            WHERE id=$15 AND deleted_at IS NULL AND version=$16
+            RETURNING version`,
+			t.Description, t.Amount, t.Date, t.CategoryID, t.PayeeID, t.Status, t.Notes, t.Latitude, t.Longitude,
+			t.Currency, t.OriginalAmount, t.ExchangeRate, t.ExcludeFromBudget, t.AccountID, transactionID, t.Version).Scan(&version)
+		if err == sql.ErrNoRows {
+			// Either the transaction is gone or its version moved on.
+			var current Transaction
+			err = scanTransaction(q.QueryRow("SELECT "+transactionColumns+" FROM transactions WHERE id=$1 AND deleted_at IS NULL", transactionID), &current)
+			if err == sql.ErrNoRows {
+				found = false
+			} else if err == nil {
+				conflict = &current
+			}
+			return sql.ErrNoRows
+		} else if err != nil {
+			return err
+		}
+		writeAudit(q, u.ID, "transaction", transactionID, auditUpdate, before)
+		return nil
+	})
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	} else if conflict != nil {
+		respondVersionConflict(w, conflict)
+		return
+	} else if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update transaction")
 		return
 	}
-	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction updated successfully"})
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"message": "Transaction updated successfully", "version": version})
 }
 
 func DeleteTransaction(w http.ResponseWriter, r *http.Request) {
@@ -321,11 +1064,20 @@ func DeleteTransaction(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
 		return
 	}
-	_, err = db.Exec("DELETE FROM transactions WHERE id=$1", transactionID)
+	if !authorizeResource(w, r, "transaction", transactionID) || !authorizeTransactionUnlocked(w, r, transactionID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "transaction", transactionID)
+	res, err := dbFor(r).Exec("UPDATE transactions SET deleted_at = NOW() WHERE id=$1 AND deleted_at IS NULL", transactionID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete transaction")
 		return
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	}
+	recordAudit(r, "transaction", transactionID, auditDelete, before)
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction deleted successfully"})
 }
 
@@ -337,22 +1089,33 @@ func CreateBudget(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	if !authorizeBodyOwner(w, r, &b.UserID) || !validateBudgetPeriod(w, b) || !validateBudgetKind(w, &b) ||
+		!validateBudgetCurrency(w, dbFor(r), b.UserID, &b) {
+		return
+	}
 
-	// Corrected SQL query with standard spaces
+	// Recurring budgets are one per kind and frequency and replaced on conflict;
+	// custom ones never conflict, so each is a new budget.
 	query := `
-        INSERT INTO budgets (user_id, period, frequency, amount)
-        VALUES ($1, $2, $3, $4)
-        ON CONFLICT (user_id, frequency)
-        DO UPDATE SET amount = EXCLUDED.amount, period = EXCLUDED.period
-        RETURNING id
+        INSERT INTO budgets (user_id, period, end_date, frequency, amount, rollover, name, description, notes, kind, currency, exchange_rate)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        ON CONFLICT (user_id, kind, frequency) WHERE organization_id IS NULL AND frequency <> 'custom'
+        DO UPDATE SET amount = EXCLUDED.amount, period = EXCLUDED.period, rollover = EXCLUDED.rollover,
+            name = EXCLUDED.name, description = EXCLUDED.description, notes = EXCLUDED.notes,
+            currency = EXCLUDED.currency, exchange_rate = EXCLUDED.exchange_rate,
+            closed_through = CASE WHEN budgets.archived_at IS NULL THEN budgets.closed_through END, archived_at = NULL
+        RETURNING id, xmax = 0
     `
 
-	err := db.QueryRow(query, b.UserID, b.Period, b.Frequency, b.Amount).Scan(&b.ID)
+	var inserted bool
+	err := dbFor(r).QueryRow(query, b.UserID, b.Period, b.EndDate, b.Frequency, b.Amount, b.Rollover, b.Name, b.Description, b.Notes, b.Kind,
+		b.Currency, b.ExchangeRate).Scan(&b.ID, &inserted)
 	if err != nil {
 		log.Printf("Error creating/updating budget: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to create or update budget")
 		return
 	}
+	recordAudit(r, "budget", b.ID, upsertAction(inserted), nil)
 
 	respondWithJSON(w, http.StatusCreated, b)
 }
@@ -364,7 +1127,15 @@ func GetBudgets(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
-	rows, err := db.Query("SELECT id, user_id, period, frequency, amount FROM budgets WHERE user_id=$1", userID)
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	orderBy, err := parseSort(r, budgetSortColumns, "id ASC")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := dbFor(r).Query("SELECT "+budgetColumns+" FROM budgets WHERE user_id=$1 AND organization_id IS NULL"+archivedBudgetFilter(r, "archived_at")+" ORDER BY "+orderBy, userID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budgets")
 		return
@@ -373,7 +1144,7 @@ func GetBudgets(w http.ResponseWriter, r *http.Request) {
 	var budgets []Budget
 	for rows.Next() {
 		var b Budget
-		if err := rows.Scan(&b.ID, &b.UserID, &b.Period, &b.Frequency, &b.Amount); err != nil {
+		if err := scanBudget(rows, &b); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to scan budget")
 			return
 		}
@@ -389,18 +1160,52 @@ func UpdateBudget(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
 		return
 	}
+	if !authorizeBudgetEdit(w, r, budgetID) {
+		return
+	}
 	var b Budget
 	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
-	_, err = db.Exec("UPDATE budgets SET period=$1, frequency=$2, amount=$3 WHERE id=$4",
-		b.Period, b.Frequency, b.Amount, budgetID)
+	if !requireVersion(w, b.Version) || !validateBudgetPeriod(w, b) || !validateBudgetKind(w, &b) {
+		return
+	}
+	ref, err := loadResource("budget", budgetID)
 	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if !validateBudgetCurrency(w, dbFor(r), ref.OwnerID, &b) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "budget", budgetID)
+	// Moving the period or changing the frequency invalidates any carryover,
+	// which was computed against the old periods.
+	var version int
+	err = dbFor(r).QueryRow(`UPDATE budgets SET
+            carryover = CASE WHEN period = $1 AND frequency = $2 AND end_date IS NOT DISTINCT FROM $3 THEN carryover ELSE 0 END,
+            closed_through = CASE WHEN period = $1 AND frequency = $2 AND end_date IS NOT DISTINCT FROM $3 THEN closed_through END,
+            period=$1, frequency=$2, end_date=$3, amount=$4, rollover=$5, name=$6, description=$7, notes=$8, kind=$9,
+            currency=$10, exchange_rate=$11
+        WHERE id=$12 AND version=$13
+        RETURNING version`,
+		b.Period, b.Frequency, b.EndDate, b.Amount, b.Rollover, b.Name, b.Description, b.Notes, b.Kind, b.Currency, b.ExchangeRate,
+		budgetID, b.Version).Scan(&version)
+	if err == sql.ErrNoRows {
+		var current Budget
+		if err := scanBudget(dbFor(r).QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &current); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+			return
+		}
+		respondVersionConflict(w, current)
+		return
+	} else if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update budget")
 		return
 	}
-	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Budget updated successfully"})
+	recordAudit(r, "budget", budgetID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"message": "Budget updated successfully", "version": version})
 }
 
 func DeleteBudget(w http.ResponseWriter, r *http.Request) {
@@ -410,40 +1215,77 @@ func DeleteBudget(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
 		return
 	}
-	_, err = db.Exec("DELETE FROM shared_budgets WHERE budget_id=$1", budgetID)
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	_, err = dbFor(r).Exec("DELETE FROM shared_budgets WHERE budget_id=$1", budgetID)
 	if err != nil {
 		log.Printf("Could not delete shared budgets for budget ID %d: %v", budgetID, err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete associated shares")
 		return
 	}
-	_, err = db.Exec("DELETE FROM budgets WHERE id=$1", budgetID)
+	before := snapshotResource(dbFor(r), "budget", budgetID)
+	_, err = dbFor(r).Exec("DELETE FROM budgets WHERE id=$1", budgetID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete budget")
 		return
 	}
+	recordAudit(r, "budget", budgetID, auditDelete, before)
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Budget deleted successfully"})
 }
 
 // --- SHARING HANDLERS ---
 
+// ShareBudget shares one of the caller's own budgets with another user. The
+// sharer is always the caller; from_user_id in the body is ignored.
 func ShareBudget(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
 	var sb SharedBudget
 	if err := json.NewDecoder(r.Body).Decode(&sb); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
+	sb.FromUserID = u.ID
+	budget, err := loadResource("budget", sb.BudgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget ownership")
+		return
+	}
+	if budget.OrgID.Valid || budget.OwnerID != sb.FromUserID {
+		respondWithError(w, http.StatusForbidden, "You can only share your own budgets")
+		return
+	}
+	if sb.ToUserID == sb.FromUserID {
+		respondWithError(w, http.StatusBadRequest, "You cannot share a budget with yourself")
+		return
+	}
+	if sb.Permission == "" {
+		sb.Permission = permissionView
+	}
+	if sb.Permission != permissionView && sb.Permission != permissionEdit {
+		respondWithError(w, http.StatusBadRequest, "Permission must be 'view' or 'edit'")
+		return
+	}
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", sb.ToUserID).Scan(&exists)
+	err = dbFor(r).QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", sb.ToUserID).Scan(&exists)
 	if err != nil || !exists {
 		respondWithError(w, http.StatusBadRequest, "User to share with does not exist.")
 		return
 	}
-	err = db.QueryRow("INSERT INTO shared_budgets (budget_id, from_user_id, to_user_id) VALUES ($1, $2, $3) RETURNING id",
-		sb.BudgetID, sb.FromUserID, sb.ToUserID).Scan(&sb.ID)
+	err = dbFor(r).QueryRow(`INSERT INTO shared_budgets (budget_id, from_user_id, to_user_id, permission, show_transactions)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		sb.BudgetID, sb.FromUserID, sb.ToUserID, sb.Permission, sb.ShowTransactions).Scan(&sb.ID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to share budget. It might already be shared with this user.")
 		return
 	}
+	notifyBudgetEvent(u.ID, sb.ToUserID, notifyShared, sb.BudgetID)
 	respondWithJSON(w, http.StatusCreated, sb)
 }
 
@@ -454,21 +1296,24 @@ func GetSharedBudgets(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
 	query := `
-        SELECT b.id, b.user_id, b.period, b.frequency, b.amount
-        FROM budgets b
-        JOIN shared_budgets sb ON b.id = sb.budget_id
+        SELECT ` + budgetColumns + `, sb.share_id, sb.permission, sb.show_transactions
+        FROM budgets
+        JOIN (SELECT id AS share_id, budget_id, to_user_id, permission, show_transactions FROM shared_budgets) sb ON sb.budget_id = budgets.id
         WHERE sb.to_user_id = $1`
-	rows, err := db.Query(query, userID)
+	rows, err := dbFor(r).Query(query+archivedBudgetFilter(r, "archived_at"), userID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve shared budgets")
 		return
 	}
 	defer rows.Close()
-	var budgets []Budget
+	var budgets []SharedBudgetDetail
 	for rows.Next() {
-		var b Budget
-		if err := rows.Scan(&b.ID, &b.UserID, &b.Period, &b.Frequency, &b.Amount); err != nil {
+		var b SharedBudgetDetail
+		if err := scanBudget(rows, &b.Budget, &b.ShareID, &b.Permission, &b.ShowTransactions); err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to scan shared budget")
 			return
 		}
@@ -484,10 +1329,33 @@ func DeleteSharedBudget(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid share ID")
 		return
 	}
-	_, err = db.Exec("DELETE FROM shared_budgets WHERE id=$1", shareID)
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var budgetID, fromUserID, toUserID int
+	err = dbFor(r).QueryRow("SELECT budget_id, from_user_id, to_user_id FROM shared_budgets WHERE id=$1", shareID).Scan(&budgetID, &fromUserID, &toUserID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Share not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify share ownership")
+		return
+	}
+	// Either side of a share may end it
+	if !canAccess(u, fromUserID) && u.ID != toUserID {
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+		return
+	}
+	_, err = dbFor(r).Exec("DELETE FROM shared_budgets WHERE id=$1", shareID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to unshare budget")
 		return
 	}
+	other := toUserID
+	if u.ID == toUserID {
+		other = fromUserID
+	}
+	notifyBudgetEvent(u.ID, other, notifyUnshared, budgetID)
 	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Budget unshared successfully"})
 }
@@ -0,0 +1,147 @@
+// history.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type TransactionVersion struct {
+	TransactionID int       `json:"transaction_id"`
+	Version       int       `json:"version"`
+	Description   string    `json:"description"`
+	Amount        float64   `json:"amount"`
+	Date          time.Time `json:"date"`
+	CategoryID    *int      `json:"category_id"`
+	EditedBy      *int      `json:"edited_by"`
+	EditedAt      time.Time `json:"edited_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// saveTransactionVersion copies the transaction's current description,
+// amount, date and category into transaction_versions. Call it inside the
+// same transaction as the update that replaces them.
+func saveTransactionVersion(q queryer, transactionID, editorID int) error {
+	_, err := q.Exec(`
+        INSERT INTO transaction_versions (transaction_id, version, description, amount, date, category_id, edited_by)
+        SELECT t.id, COALESCE((SELECT MAX(v.version) FROM transaction_versions v WHERE v.transaction_id = t.id), 0) + 1,
+               t.description, t.amount, t.date, t.category_id, NULLIF($2, 0)
+        FROM transactions t WHERE t.id = $1`, transactionID, editorID)
+	return err
+}
+
+// --- HISTORY HANDLERS ---
+
+// GetTransactionHistory lists the prior versions of a transaction, newest
+// first. The current values are on the transaction itself.
+func GetTransactionHistory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) {
+		return
+	}
+	rows, err := dbFor(r).Query(`SELECT transaction_id, version, description, amount, date, category_id, edited_by, edited_at
+        FROM transaction_versions WHERE transaction_id=$1 ORDER BY version DESC`, transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve history")
+		return
+	}
+	defer rows.Close()
+	history := []TransactionVersion{}
+	for rows.Next() {
+		var v TransactionVersion
+		var description sql.NullString
+		if err := rows.Scan(&v.TransactionID, &v.Version, &description, &v.Amount, &v.Date, &v.CategoryID, &v.EditedBy, &v.EditedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan version")
+			return
+		}
+		v.Description = description.String
+		history = append(history, v)
+	}
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// RevertTransaction restores a transaction to one of its prior versions. The
+// values being replaced are saved as a new version first, so a revert can
+// itself be reverted.
+func RevertTransaction(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	version, err := strconv.Atoi(params["version"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) || !authorizeTransactionUnlocked(w, r, transactionID) {
+		return
+	}
+	u, _ := currentUser(r)
+
+	var v TransactionVersion
+	err = dbFor(r).QueryRow("SELECT amount, category_id FROM transaction_versions WHERE transaction_id=$1 AND version=$2",
+		transactionID, version).Scan(&v.Amount, &v.CategoryID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Version not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve version")
+		return
+	}
+	owner, err := loadResource("transaction", transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify transaction owner")
+		return
+	}
+	if v.CategoryID != nil && !authorizeCategory(w, *v.CategoryID, owner) {
+		return
+	}
+	if !ensureSplitsMatch(w, dbFor(r), transactionID, v.Amount) {
+		return
+	}
+
+	found := true
+	err = withTx(r, func(q queryer) error {
+		var live bool
+		err := q.QueryRow("SELECT deleted_at IS NULL FROM transactions WHERE id=$1 FOR UPDATE", transactionID).Scan(&live)
+		if err == sql.ErrNoRows || (err == nil && !live) {
+			found = false
+			return nil
+		} else if err != nil {
+			return err
+		}
+		before := snapshotResource(q, "transaction", transactionID)
+		if err := saveTransactionVersion(q, transactionID, u.ID); err != nil {
+			return err
+		}
+		_, err = q.Exec(`UPDATE transactions t SET description = v.description, amount = v.amount, date = v.date, category_id = v.category_id
+            FROM transaction_versions v
+            WHERE t.id = $1 AND v.transaction_id = t.id AND v.version = $2`, transactionID, version)
+		if err != nil {
+			return err
+		}
+		writeAudit(q, u.ID, "transaction", transactionID, auditUpdate, before)
+		return nil
+	})
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revert transaction")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction reverted successfully"})
+}
@@ -0,0 +1,486 @@
+// households.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type Household struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy int       `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type HouseholdMember struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type HouseholdInvitation struct {
+	ID            int       `json:"id"`
+	HouseholdID   int       `json:"household_id"`
+	HouseholdName string    `json:"household_name,omitempty"`
+	UserID        int       `json:"user_id"`
+	InvitedBy     int       `json:"invited_by"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type HouseholdCategory struct {
+	ID          int    `json:"id"`
+	HouseholdID int    `json:"household_id"`
+	Name        string `json:"name"`
+}
+
+type MemberSpending struct {
+	UserID   int     `json:"user_id"`
+	Username string  `json:"username"`
+	Total    float64 `json:"total"`
+}
+
+type CategorySpending struct {
+	Category string  `json:"category"`
+	Total    float64 `json:"total"`
+}
+
+type HouseholdSpending struct {
+	HouseholdID int                `json:"household_id"`
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	Total       float64            `json:"total"`
+	ByMember    []MemberSpending   `json:"by_member"`
+	ByCategory  []CategorySpending `json:"by_category"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func isHouseholdMember(householdID, userID int) (bool, error) {
+	var member bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM household_members WHERE household_id=$1 AND user_id=$2)", householdID, userID).Scan(&member)
+	return member, err
+}
+
+// authorizeHouseholdMember checks the caller belongs to the household (or is
+// a site admin) and returns the household ID from the path.
+func authorizeHouseholdMember(w http.ResponseWriter, r *http.Request) (int, bool) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return 0, false
+	}
+	householdID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid household ID")
+		return 0, false
+	}
+	if u.Role == "admin" {
+		return householdID, true
+	}
+	member, err := isHouseholdMember(householdID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify household membership")
+		return 0, false
+	}
+	if !member {
+		respondWithError(w, http.StatusForbidden, "You are not a member of this household")
+		return 0, false
+	}
+	return householdID, true
+}
+
+// --- HOUSEHOLD HANDLERS ---
+
+func CreateHousehold(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var h Household
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil || strings.TrimSpace(h.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create household")
+		return
+	}
+	defer tx.Rollback()
+	h.CreatedBy = u.ID
+	err = tx.QueryRow("INSERT INTO households (name, created_by) VALUES ($1, $2) RETURNING id, created_at", h.Name, h.CreatedBy).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create household")
+		return
+	}
+	if _, err := tx.Exec("INSERT INTO household_members (household_id, user_id) VALUES ($1, $2)", h.ID, u.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create household")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create household")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, h)
+}
+
+func GetHouseholds(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT h.id, h.name, COALESCE(h.created_by, 0), h.created_at
+        FROM households h
+        JOIN household_members m ON m.household_id = h.id
+        WHERE m.user_id = $1
+        ORDER BY h.name`
+	rows, err := db.Query(query, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve households")
+		return
+	}
+	defer rows.Close()
+	var households []Household
+	for rows.Next() {
+		var h Household
+		if err := rows.Scan(&h.ID, &h.Name, &h.CreatedBy, &h.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan household")
+			return
+		}
+		households = append(households, h)
+	}
+	respondWithJSON(w, http.StatusOK, households)
+}
+
+func GetHouseholdMembers(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT m.user_id, u.username, m.joined_at
+        FROM household_members m
+        JOIN users u ON u.id = m.user_id
+        WHERE m.household_id = $1
+        ORDER BY u.username`
+	rows, err := db.Query(query, householdID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve members")
+		return
+	}
+	defer rows.Close()
+	var members []HouseholdMember
+	for rows.Next() {
+		var m HouseholdMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.JoinedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan member")
+			return
+		}
+		members = append(members, m)
+	}
+	respondWithJSON(w, http.StatusOK, members)
+}
+
+// RemoveHouseholdMember lets the household creator remove anyone and any
+// member remove themselves.
+func RemoveHouseholdMember(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	u, _ := currentUser(r)
+	if u.ID != userID && u.Role != "admin" {
+		var createdBy sql.NullInt64
+		if err := db.QueryRow("SELECT created_by FROM households WHERE id=$1", householdID).Scan(&createdBy); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to remove member")
+			return
+		}
+		if !createdBy.Valid || int(createdBy.Int64) != u.ID {
+			respondWithError(w, http.StatusForbidden, "Only the household creator can remove other members")
+			return
+		}
+	}
+	res, err := db.Exec("DELETE FROM household_members WHERE household_id=$1 AND user_id=$2", householdID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Member removed successfully"})
+}
+
+// --- INVITATION HANDLERS ---
+
+func InviteToHousehold(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	u, _ := currentUser(r)
+	var inv HouseholdInvitation
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=$1 AND NOT is_service)", inv.UserID).Scan(&exists)
+	if err != nil || !exists {
+		respondWithError(w, http.StatusBadRequest, "User to invite does not exist.")
+		return
+	}
+	if member, err := isHouseholdMember(householdID, inv.UserID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify household membership")
+		return
+	} else if member {
+		respondWithError(w, http.StatusBadRequest, "User is already a member of this household")
+		return
+	}
+	inv.HouseholdID = householdID
+	inv.InvitedBy = u.ID
+	err = db.QueryRow(`INSERT INTO household_invitations (household_id, user_id, invited_by)
+        VALUES ($1, $2, $3) RETURNING id, status, created_at`,
+		inv.HouseholdID, inv.UserID, inv.InvitedBy).Scan(&inv.ID, &inv.Status, &inv.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, inv)
+}
+
+func GetHouseholdInvitations(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT i.id, i.household_id, h.name, i.user_id, COALESCE(i.invited_by, 0), i.status, i.created_at
+        FROM household_invitations i
+        JOIN households h ON h.id = i.household_id
+        WHERE i.user_id = $1 AND i.status = 'pending'
+        ORDER BY i.created_at DESC`
+	rows, err := db.Query(query, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve invitations")
+		return
+	}
+	defer rows.Close()
+	var invitations []HouseholdInvitation
+	for rows.Next() {
+		var inv HouseholdInvitation
+		if err := rows.Scan(&inv.ID, &inv.HouseholdID, &inv.HouseholdName, &inv.UserID, &inv.InvitedBy, &inv.Status, &inv.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan invitation")
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+	respondWithJSON(w, http.StatusOK, invitations)
+}
+
+func AcceptHouseholdInvitation(w http.ResponseWriter, r *http.Request) {
+	respondToHouseholdInvitation(w, r, true)
+}
+
+func DeclineHouseholdInvitation(w http.ResponseWriter, r *http.Request) {
+	respondToHouseholdInvitation(w, r, false)
+}
+
+func respondToHouseholdInvitation(w http.ResponseWriter, r *http.Request, accept bool) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	invitationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update invitation")
+		return
+	}
+	defer tx.Rollback()
+
+	var householdID int
+	err = tx.QueryRow(`SELECT household_id FROM household_invitations
+        WHERE id=$1 AND user_id=$2 AND status='pending' FOR UPDATE`, invitationID, u.ID).Scan(&householdID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Invitation not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update invitation")
+		return
+	}
+	status := "declined"
+	if accept {
+		status = "accepted"
+		_, err = tx.Exec(`INSERT INTO household_members (household_id, user_id) VALUES ($1, $2)
+            ON CONFLICT (household_id, user_id) DO NOTHING`, householdID, u.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to join household")
+			return
+		}
+	}
+	if _, err := tx.Exec("UPDATE household_invitations SET status=$1 WHERE id=$2", status, invitationID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update invitation")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update invitation")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Invitation " + status})
+}
+
+// --- SHARED CATEGORY HANDLERS ---
+
+func CreateHouseholdCategory(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	var c HouseholdCategory
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || strings.TrimSpace(c.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	c.HouseholdID = householdID
+	err := db.QueryRow("INSERT INTO household_categories (household_id, name) VALUES ($1, $2) RETURNING id", householdID, c.Name).Scan(&c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create category. It may already exist for this household.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+func GetHouseholdCategories(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT id, household_id, name FROM household_categories WHERE household_id=$1 ORDER BY name", householdID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve categories")
+		return
+	}
+	defer rows.Close()
+	var categories []HouseholdCategory
+	for rows.Next() {
+		var c HouseholdCategory
+		if err := rows.Scan(&c.ID, &c.HouseholdID, &c.Name); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category")
+			return
+		}
+		categories = append(categories, c)
+	}
+	respondWithJSON(w, http.StatusOK, categories)
+}
+
+func DeleteHouseholdCategory(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	categoryID, err := strconv.Atoi(mux.Vars(r)["category_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	_, err = db.Exec("DELETE FROM household_categories WHERE id=$1 AND household_id=$2", categoryID, householdID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete category")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Category deleted successfully"})
+}
+
+// --- COMBINED SPENDING ---
+
+// GetHouseholdSpending aggregates every member's personal transactions for a
+// date range (default: the current month). Member categories roll up into the
+// household's shared category of the same name, or "Other".
+func GetHouseholdSpending(w http.ResponseWriter, r *http.Request) {
+	householdID, ok := authorizeHouseholdMember(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	spending := HouseholdSpending{HouseholdID: householdID, From: from, To: to, ByMember: []MemberSpending{}, ByCategory: []CategorySpending{}}
+
+	memberQuery := `
+        SELECT m.user_id, u.username, COALESCE(SUM(l.amount), 0)
+        FROM household_members m
+        JOIN users u ON u.id = m.user_id
+        LEFT JOIN transaction_lines l ON l.user_id = m.user_id AND l.organization_id IS NULL AND NOT l.excluded
+            AND l.date >= $2 AND l.date < $3::date + 1
+        WHERE m.household_id = $1
+        GROUP BY m.user_id, u.username
+        ORDER BY u.username`
+	rows, err := db.Query(memberQuery, householdID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to compute household spending")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m MemberSpending
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Total); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan member spending")
+			return
+		}
+		spending.Total += m.Total
+		spending.ByMember = append(spending.ByMember, m)
+	}
+
+	categoryQuery := `
+        SELECT COALESCE(hc.name, 'Other'), SUM(l.amount)
+        FROM transaction_lines l
+        JOIN household_members m ON m.user_id = l.user_id AND m.household_id = $1
+        LEFT JOIN categories c ON c.id = l.category_id
+        LEFT JOIN household_categories hc ON hc.household_id = $1 AND LOWER(hc.name) = LOWER(c.name)
+        WHERE l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3::date + 1
+        GROUP BY COALESCE(hc.name, 'Other')
+        ORDER BY SUM(l.amount) DESC`
+	catRows, err := db.Query(categoryQuery, householdID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to compute household spending")
+		return
+	}
+	defer catRows.Close()
+	for catRows.Next() {
+		var c CategorySpending
+		if err := catRows.Scan(&c.Category, &c.Total); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category spending")
+			return
+		}
+		spending.ByCategory = append(spending.ByCategory, c)
+	}
+	respondWithJSON(w, http.StatusOK, spending)
+}
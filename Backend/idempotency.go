@@ -0,0 +1,145 @@
+// idempotency.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// responseRecorder passes writes through to the client while keeping a copy
+// of the status and body so they can be stored for replay.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes a POST handler safe to retry: the first response for a
+// given Idempotency-Key is stored and replayed verbatim, headers and all, on
+// later requests. Keys are scoped to the caller, so anonymous requests are
+// never cached: one client's key must not replay another's response.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		u, ok := currentUser(r)
+		if key == "" || !ok {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+		scope := strconv.Itoa(u.ID)
+
+		var storedHash string
+		var status sql.NullInt64
+		var storedBody sql.NullString
+		var storedHeaders []byte
+		err = db.QueryRow("SELECT request_hash, status_code, response_body, response_headers FROM idempotency_keys WHERE scope=$1 AND key=$2",
+			scope, key).Scan(&storedHash, &status, &storedBody, &storedHeaders)
+		switch {
+		case err == nil && storedHash != requestHash:
+			respondWithError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request")
+			return
+		case err == nil && !status.Valid:
+			respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+			return
+		case err == nil:
+			var header http.Header
+			if err := json.Unmarshal(storedHeaders, &header); err != nil {
+				// Responses stored before headers were kept were all JSON.
+				header = http.Header{"Content-Type": {"application/json"}}
+			}
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(int(status.Int64))
+			w.Write([]byte(storedBody.String))
+			return
+		case err != sql.ErrNoRows:
+			respondWithError(w, http.StatusInternalServerError, "Failed to check idempotency key")
+			return
+		}
+
+		// Reserve the key before running the handler so concurrent retries
+		// don't both execute.
+		res, err := db.Exec(`INSERT INTO idempotency_keys (scope, key, request_hash) VALUES ($1, $2, $3)
+            ON CONFLICT (scope, key) DO NOTHING`, scope, key, requestHash)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to store idempotency key")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			respondWithError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+			return
+		}
+
+		// Release the key unless a response is stored for it, so that a
+		// server error, a panic or a failure to store the response leaves
+		// the client free to retry rather than locked out until the key
+		// expires.
+		stored := false
+		defer func() {
+			if stored {
+				return
+			}
+			if _, err := db.Exec("DELETE FROM idempotency_keys WHERE scope=$1 AND key=$2", scope, key); err != nil {
+				log.Printf("Failed to release idempotency key %q: %v", key, err)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			// The handler wrote nothing, which net/http sends as 200.
+			rec.status = http.StatusOK
+		}
+
+		// Server errors are not cached so the client can retry them.
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+		header, _ := json.Marshal(rec.Header())
+		_, err = db.Exec("UPDATE idempotency_keys SET status_code=$1, response_body=$2, response_headers=$3 WHERE scope=$4 AND key=$5",
+			rec.status, rec.body.String(), header, scope, key)
+		if err != nil {
+			log.Printf("Failed to store response for idempotency key %q: %v", key, err)
+			return
+		}
+		stored = true
+	}
+}
+
+func purgeIdempotencyKeys() error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at < NOW() - INTERVAL '24 hours'")
+	return err
+}
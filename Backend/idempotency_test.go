@@ -0,0 +1,159 @@
+// idempotency_test.go
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// storedKey is a row of the fake idempotency_keys table.
+type storedKey struct {
+	hash    string
+	status  driver.Value
+	body    driver.Value
+	headers driver.Value
+}
+
+// useFakeIdempotencyKeys backs idempotency_keys with a map for the test.
+func useFakeIdempotencyKeys(t *testing.T) map[string]*storedKey {
+	keys := map[string]*storedKey{}
+	useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT request_hash"):
+			k, ok := keys[args[0].(string)+"/"+args[1].(string)]
+			if !ok {
+				return fakeResult{columns: []string{"request_hash", "status_code", "response_body", "response_headers"}}, nil
+			}
+			return fakeRow([]string{"request_hash", "status_code", "response_body", "response_headers"}, k.hash, k.status, k.body, k.headers), nil
+		case strings.HasPrefix(query, "INSERT INTO idempotency_keys"):
+			id := args[0].(string) + "/" + args[1].(string)
+			if _, ok := keys[id]; ok {
+				return fakeResult{}, nil
+			}
+			keys[id] = &storedKey{hash: args[2].(string)}
+			return fakeResult{affected: 1}, nil
+		case strings.HasPrefix(query, "UPDATE idempotency_keys"):
+			k := keys[args[3].(string)+"/"+args[4].(string)]
+			k.status, k.body, k.headers = args[0], args[1], args[2]
+			return fakeResult{affected: 1}, nil
+		case strings.HasPrefix(query, "DELETE FROM idempotency_keys"):
+			delete(keys, args[0].(string)+"/"+args[1].(string))
+			return fakeResult{affected: 1}, nil
+		}
+		t.Fatalf("unexpected query %q", query)
+		return fakeResult{}, nil
+	})
+	return keys
+}
+
+// idempotentRequest sends a POST through h as user 1, or anonymously if
+// anonymous is set.
+func idempotentRequest(h http.HandlerFunc, key, body string, anonymous bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/transactions", strings.NewReader(body))
+	r.Header.Set(idempotencyHeader, key)
+	if !anonymous {
+		r = r.WithContext(context.WithValue(r.Context(), userContextKey, &AuthUser{ID: 1}))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	useFakeIdempotencyKeys(t)
+	calls := 0
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/transactions/7")
+		respondWithJSON(w, http.StatusCreated, map[string]int{"id": 7})
+	})
+
+	first := idempotentRequest(h, "k1", `{"amount": 5}`, false)
+	replay := idempotentRequest(h, "k1", `{"amount": 5}`, false)
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+	if replay.Code != http.StatusCreated || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %q, want %d %q", replay.Code, replay.Body.String(), http.StatusCreated, first.Body.String())
+	}
+	for _, h := range []string{"Location", "Content-Type"} {
+		if got, want := replay.Header().Get(h), first.Header().Get(h); got != want {
+			t.Errorf("replayed %s = %q, want %q", h, got, want)
+		}
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is missing Idempotent-Replayed")
+	}
+
+	if w := idempotentRequest(h, "k1", `{"amount": 6}`, false); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reusing the key for another request = %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+}
+
+func TestIdempotentEmptyResponse(t *testing.T) {
+	useFakeIdempotencyKeys(t)
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {})
+	idempotentRequest(h, "k1", "{}", false)
+	if w := idempotentRequest(h, "k1", "{}", false); w.Code != http.StatusOK {
+		t.Errorf("replay = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestIdempotentRetriesAfterFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure func(w http.ResponseWriter)
+	}{
+		{"server error", func(w http.ResponseWriter) {
+			respondWithError(w, http.StatusInternalServerError, "Failed")
+		}},
+		{"panic", func(w http.ResponseWriter) {
+			panic("handler failed")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := useFakeIdempotencyKeys(t)
+			calls := 0
+			h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					tt.failure(w)
+					return
+				}
+				respondWithJSON(w, http.StatusCreated, map[string]int{"id": 7})
+			})
+			func() {
+				defer func() { recover() }()
+				idempotentRequest(h, "k1", "{}", false)
+			}()
+			if len(keys) != 0 {
+				t.Errorf("the failed request left %d keys reserved", len(keys))
+			}
+			if w := idempotentRequest(h, "k1", "{}", false); w.Code != http.StatusCreated || calls != 2 {
+				t.Errorf("retry = %d after %d calls, want %d after 2", w.Code, calls, http.StatusCreated)
+			}
+		})
+	}
+}
+
+func TestIdempotentAnonymous(t *testing.T) {
+	useFakeIdempotencyKeys(t)
+	calls := 0
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		respondWithJSON(w, http.StatusCreated, map[string]int{"id": calls})
+	})
+	idempotentRequest(h, "k1", "{}", true)
+	idempotentRequest(h, "k1", "{}", true)
+	if calls != 2 {
+		t.Errorf("handler ran %d times for anonymous requests, want 2", calls)
+	}
+}
@@ -0,0 +1,342 @@
+// imports.go
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxImportBytes   = 5 << 20
+	importBatchSize  = 5
+	importClaimLease = 30 * time.Minute
+)
+
+// --- MODELS ---
+
+// CSVMapping says how to read an uploaded statement. Columns are header
+// names when has_header is set, otherwise 0-based indexes; either form is
+// accepted in both cases. date_format uses YYYY, YY, MM and DD tokens.
+type CSVMapping struct {
+	UserID            int    `json:"user_id"`
+	CategoryID        int    `json:"category_id"`
+	DateColumn        string `json:"date_column"`
+	AmountColumn      string `json:"amount_column"`
+	DescriptionColumn string `json:"description_column"`
+	DateFormat        string `json:"date_format"`
+	DecimalSeparator  string `json:"decimal_separator"`
+	Delimiter         string `json:"delimiter"`
+	HasHeader         bool   `json:"has_header"`
+}
+
+type CSVImport struct {
+	ID          int            `json:"id"`
+	UserID      int            `json:"user_id"`
+	Status      string         `json:"status"`
+	Imported    int            `json:"imported"`
+	Duplicates  int            `json:"duplicates"`
+	Errors      []BulkRowError `json:"errors"`
+	Error       string         `json:"error,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	ProcessedAt *time.Time     `json:"processed_at,omitempty"`
+}
+
+// --- PARSING ---
+
+// goDateLayout converts a YYYY-MM-DD style format into a Go time layout.
+func goDateLayout(format string) string {
+	if format == "" {
+		format = "YYYY-MM-DD"
+	}
+	return strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02").Replace(format)
+}
+
+// parseStatementAmount reads an amount such as "1.234,56", "-12.50",
+// "(12.50)" or "$12.50" using the given decimal separator.
+func parseStatementAmount(raw, decimalSeparator string) (float64, error) {
+	s := strings.TrimSpace(raw)
+	negative := strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")
+	s = strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || r == '-' || r == '.' || r == ',' {
+			return r
+		}
+		return -1
+	}, s)
+	if decimalSeparator == "," {
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.ReplaceAll(s, ",", ".")
+	} else {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", raw)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// columnIndex resolves a mapping column against the header row.
+func columnIndex(column string, header []string) (int, error) {
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(column)) {
+			return i, nil
+		}
+	}
+	if i, err := strconv.Atoi(column); err == nil && i >= 0 {
+		return i, nil
+	}
+	return 0, fmt.Errorf("column %q not found", column)
+}
+
+func (m CSVMapping) validate() error {
+	if m.CategoryID == 0 {
+		return fmt.Errorf("category_id is required")
+	}
+	if m.DateColumn == "" || m.AmountColumn == "" || m.DescriptionColumn == "" {
+		return fmt.Errorf("date_column, amount_column and description_column are required")
+	}
+	if m.DecimalSeparator != "" && m.DecimalSeparator != "." && m.DecimalSeparator != "," {
+		return fmt.Errorf("decimal_separator must be '.' or ','")
+	}
+	if len([]rune(m.Delimiter)) > 1 {
+		return fmt.Errorf("delimiter must be a single character")
+	}
+	return nil
+}
+
+// --- WORKER ---
+
+// processImports claims queued CSV imports (or ones whose worker lease
+// expired) and runs each one.
+func processImports() error {
+	rows, err := db.Query(`
+        UPDATE csv_imports SET status = 'processing', claimed_at = NOW()
+        WHERE id IN (
+            SELECT id FROM csv_imports
+            WHERE status = 'pending' OR (status = 'processing' AND claimed_at < $1)
+            ORDER BY created_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, user_id, created_by, file, mapping`, time.Now().Add(-importClaimLease), importBatchSize)
+	if err != nil {
+		return err
+	}
+	type claimed struct {
+		id, userID, createdBy int
+		file, mapping         []byte
+	}
+	var batch []claimed
+	for rows.Next() {
+		var c claimed
+		if err := rows.Scan(&c.id, &c.userID, &c.createdBy, &c.file, &c.mapping); err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, c)
+	}
+	rows.Close()
+
+	for _, c := range batch {
+		var mapping CSVMapping
+		json.Unmarshal(c.mapping, &mapping)
+		mapping.UserID = c.userID
+		imported, duplicates, rowErrors, err := runImport(c.file, mapping, c.createdBy)
+		if err != nil {
+			log.Printf("CSV import %d failed: %v", c.id, err)
+			if _, err := db.Exec("UPDATE csv_imports SET status='failed', error=$1, processed_at=NOW() WHERE id=$2", err.Error(), c.id); err != nil {
+				log.Printf("Failed to record failure for CSV import %d: %v", c.id, err)
+			}
+			continue
+		}
+		report, _ := json.Marshal(rowErrors)
+		_, err = db.Exec(`UPDATE csv_imports SET status='done', imported=$1, duplicates=$2, errors=$3, processed_at=NOW() WHERE id=$4`,
+			imported, duplicates, report, c.id)
+		if err != nil {
+			log.Printf("Failed to save result for CSV import %d: %v", c.id, err)
+		}
+	}
+	return nil
+}
+
+// runImport inserts every valid row of a CSV file in one transaction. Rows
+// that fail to parse are reported by line number; rows matching an existing
+// transaction (same day, amount and description) or an earlier row in the
+// file are skipped as duplicates.
+func runImport(file []byte, m CSVMapping, actorID int) (imported, duplicates int, rowErrors []BulkRowError, err error) {
+	reader := csv.NewReader(bytes.NewReader(file))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if m.Delimiter != "" {
+		reader.Comma = []rune(m.Delimiter)[0]
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("could not read CSV: %w", err)
+	}
+	var header []string
+	first := 1
+	if m.HasHeader && len(records) > 0 {
+		header, records, first = records[0], records[1:], 2
+	}
+	dateCol, err := columnIndex(m.DateColumn, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	amountCol, err := columnIndex(m.AmountColumn, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	descriptionCol, err := columnIndex(m.DescriptionColumn, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	layout := goDateLayout(m.DateFormat)
+	base, err := baseCurrency(db, m.UserID)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	rowErrors = []BulkRowError{}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer tx.Rollback()
+	for i, record := range records {
+		line := first + i
+		if len(record) <= dateCol || len(record) <= amountCol || len(record) <= descriptionCol {
+			rowErrors = append(rowErrors, BulkRowError{Index: line, Error: "missing columns"})
+			continue
+		}
+		date, err := time.Parse(layout, strings.TrimSpace(record[dateCol]))
+		if err != nil {
+			rowErrors = append(rowErrors, BulkRowError{Index: line, Error: fmt.Sprintf("invalid date %q", record[dateCol])})
+			continue
+		}
+		amount, err := parseStatementAmount(record[amountCol], m.DecimalSeparator)
+		if err != nil {
+			rowErrors = append(rowErrors, BulkRowError{Index: line, Error: err.Error()})
+			continue
+		}
+		description := strings.TrimSpace(record[descriptionCol])
+
+		var exists bool
+		err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM transactions
+            WHERE user_id = $1 AND organization_id IS NULL AND deleted_at IS NULL
+              AND date >= $2 AND date < $3 AND amount = $4 AND COALESCE(description, '') = $5)`,
+			m.UserID, date, date.AddDate(0, 0, 1), amount, description).Scan(&exists)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if exists {
+			duplicates++
+			continue
+		}
+		payeeID, err := resolvePayee(tx, m.UserID, description)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		var id int
+		err = tx.QueryRow(`INSERT INTO transactions (user_id, description, amount, date, category_id, payee_id, currency, original_amount, exchange_rate)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $3, 1) RETURNING id`,
+			m.UserID, description, amount, date, m.CategoryID, payeeID, base).Scan(&id)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		writeAudit(tx, actorID, "transaction", id, auditCreate, nil)
+		imported++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, nil, err
+	}
+	return imported, duplicates, rowErrors, nil
+}
+
+// --- IMPORT HANDLERS ---
+
+// UploadCSVImport accepts a multipart form with the statement in "file" and
+// the CSVMapping as JSON in "mapping", and queues it for import.
+func UploadCSVImport(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Missing 'file'")
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "CSV file is too large")
+		return
+	}
+	var mapping CSVMapping
+	if err := json.Unmarshal([]byte(r.FormValue("mapping")), &mapping); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'mapping'")
+		return
+	}
+	if err := mapping.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !authorizeBodyOwner(w, r, &mapping.UserID) || !authorizeCategory(w, mapping.CategoryID, resourceRef{OwnerID: mapping.UserID}) ||
+		!requireParentForChild(w, r, mapping.UserID, "Imports into a child account must be made by the parent") {
+		return
+	}
+	spec, _ := json.Marshal(mapping)
+
+	imp := CSVImport{UserID: mapping.UserID, Errors: []BulkRowError{}}
+	err = db.QueryRow("INSERT INTO csv_imports (user_id, created_by, file, mapping) VALUES ($1, $2, $3, $4) RETURNING id, status, created_at",
+		mapping.UserID, u.ID, content, spec).Scan(&imp.ID, &imp.Status, &imp.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to queue import")
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, imp)
+}
+
+// GetCSVImport reports an import's status and, once done, its row report.
+func GetCSVImport(w http.ResponseWriter, r *http.Request) {
+	importID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid import ID")
+		return
+	}
+	var imp CSVImport
+	var errMsg sql.NullString
+	var report []byte
+	err = db.QueryRow(`SELECT id, user_id, status, imported, duplicates, errors, error, created_at, processed_at
+        FROM csv_imports WHERE id=$1`, importID).Scan(&imp.ID, &imp.UserID, &imp.Status, &imp.Imported, &imp.Duplicates, &report, &errMsg, &imp.CreatedAt, &imp.ProcessedAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Import not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve import")
+		return
+	}
+	if !authorizeOwner(w, r, imp.UserID) {
+		return
+	}
+	imp.Error = errMsg.String
+	imp.Errors = []BulkRowError{}
+	json.Unmarshal(report, &imp.Errors)
+	respondWithJSON(w, http.StatusOK, imp)
+}
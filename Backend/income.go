@@ -0,0 +1,165 @@
+// income.go
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Budget kinds. An income budget sets the income expected each period
+// rather than a spending limit; what it has received is the owner's income,
+// i.e. negative amounts that are not linked refunds.
+const (
+	budgetKindExpense = "expense"
+	budgetKindIncome  = "income"
+)
+
+// --- MODELS ---
+type IncomePeriod struct {
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"` // last day of the period, inclusive
+	Expected    float64   `json:"expected"`
+	Received    float64   `json:"received"`
+	Difference  float64   `json:"difference"` // received - expected
+}
+
+type IncomeBudgetReport struct {
+	BudgetID  int            `json:"budget_id"`
+	Name      string         `json:"name"`
+	Frequency string         `json:"frequency"`
+	Expected  float64        `json:"expected"`
+	Received  float64        `json:"received"`
+	Periods   []IncomePeriod `json:"periods"`
+}
+
+// IncomeReport compares expected with received income over a date range.
+// Received is the income that arrived within the range; each budget's
+// figures cover its whole periods that overlap it.
+type IncomeReport struct {
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	Received float64              `json:"received"`
+	Budgets  []IncomeBudgetReport `json:"budgets"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// validateBudgetKind defaults an empty kind to expense and rejects unknown
+// kinds. Income budgets don't roll over.
+func validateBudgetKind(w http.ResponseWriter, b *Budget) bool {
+	if b.Kind == "" {
+		b.Kind = budgetKindExpense
+	}
+	switch {
+	case b.Kind != budgetKindExpense && b.Kind != budgetKindIncome:
+		respondWithError(w, http.StatusBadRequest, "Kind must be 'expense' or 'income'")
+	case b.Kind == budgetKindIncome && b.Rollover:
+		respondWithError(w, http.StatusBadRequest, "Income budgets cannot roll over")
+	default:
+		return true
+	}
+	return false
+}
+
+// --- INCOME HANDLERS ---
+
+// GetIncomeReport compares each of a user's personal income budgets with
+// the income actually received, period by period, for ?from= to ?to=
+// (default: the current month). A closed period is measured against the
+// amount expected when it closed.
+func GetIncomeReport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	if to.Before(from) {
+		respondWithError(w, http.StatusBadRequest, "'to' cannot be before 'from'")
+		return
+	}
+	// Periods are computed in the server's time zone, like the close job.
+	from, to = dateOnly(from, now.Location()), dateOnly(to, now.Location())
+
+	report := IncomeReport{From: from, To: to, Budgets: []IncomeBudgetReport{}}
+	err = db.QueryRow(`SELECT COALESCE(-SUM(amount), 0) FROM transaction_lines
+        WHERE user_id=$1 AND organization_id IS NULL AND NOT excluded AND amount < 0 AND linked_transaction_id IS NULL
+          AND date >= $2 AND date < $3::date + 1`, userID, from, to).Scan(&report.Received)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate income")
+		return
+	}
+
+	rows, err := db.Query("SELECT "+budgetColumns+" FROM budgets WHERE user_id=$1 AND organization_id IS NULL AND kind=$2 AND archived_at IS NULL ORDER BY id",
+		userID, budgetKindIncome)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve income budgets")
+		return
+	}
+	var budgets []Budget
+	for rows.Next() {
+		var b Budget
+		if err := scanBudget(rows, &b); err != nil {
+			rows.Close()
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan budget")
+			return
+		}
+		budgets = append(budgets, b)
+	}
+	rows.Close()
+
+	for _, b := range budgets {
+		br := IncomeBudgetReport{BudgetID: b.ID, Name: b.Name, Frequency: b.Frequency, Periods: []IncomePeriod{}}
+		for t := from; !t.After(to); {
+			start, end, err := budgetPeriod(b, t)
+			if err != nil {
+				respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			if !end.After(from) || start.After(to) {
+				break
+			}
+			p := IncomePeriod{PeriodStart: start, PeriodEnd: end.AddDate(0, 0, -1), Expected: b.Amount}
+			err = db.QueryRow("SELECT budgeted FROM budget_periods WHERE budget_id=$1 AND period_start=$2", b.ID, start).Scan(&p.Expected)
+			if err != nil && err != sql.ErrNoRows {
+				respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget history")
+				return
+			}
+			if p.Received, err = budgetSpent(db, b, start, end); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to calculate income")
+				return
+			}
+			p.Difference = math.Round((p.Received-p.Expected)*100) / 100
+			br.Expected += p.Expected
+			br.Received += p.Received
+			br.Periods = append(br.Periods, p)
+			if b.Frequency == frequencyCustom {
+				break
+			}
+			t = end
+		}
+		br.Expected = math.Round(br.Expected*100) / 100
+		br.Received = math.Round(br.Received*100) / 100
+		report.Budgets = append(report.Budgets, br)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,408 @@
+// investments.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Investment accounts hold cash, moved by transactions like any other
+// account, and holdings: a quantity of a security with what was paid for
+// it. Holdings are valued at the latest quote for their ticker, or at cost
+// until one is known, and count towards the account's balance and so its
+// owner's net worth. Quotes come from the configured provider once a day,
+// when each account's holdings value is also stored, and admins can enter
+// them by hand.
+
+var tickerPattern = regexp.MustCompile(`^[A-Z0-9.^=-]{1,20}$`)
+
+// holdingValueSQL is the market value of the holding aliased h: its
+// quantity at the latest quote, or its cost basis while it has none.
+const holdingValueSQL = `COALESCE(h.quantity * (SELECT p.price FROM security_prices p WHERE p.ticker = h.ticker ORDER BY p.date DESC LIMIT 1),
+                h.cost_basis)`
+
+// holdingsValueSQL is the market value of all holdings of the account
+// aliased a; 0 for accounts without any.
+const holdingsValueSQL = `(SELECT COALESCE(SUM(` + holdingValueSQL + `), 0) FROM holdings h WHERE h.account_id = a.id)`
+
+// quoteProvider looks up the latest price of a security. Implementations
+// wrap an external market data service.
+type quoteProvider interface {
+	Quote(ticker string) (float64, error)
+}
+
+// httpQuoteProvider requests QUOTE_PROVIDER_URL with ?symbol=<ticker> and
+// expects a JSON response of the form {"price": 123.45}.
+type httpQuoteProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (p *httpQuoteProvider) Quote(ticker string) (float64, error) {
+	req, err := http.NewRequest(http.MethodGet, p.url+"?symbol="+url.QueryEscape(ticker), nil)
+	if err != nil {
+		return 0, err
+	}
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("quote provider returned %s", resp.Status)
+	}
+	var out struct {
+		Price *float64 `json:"price"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	if out.Price == nil || *out.Price < 0 {
+		return 0, fmt.Errorf("quote provider returned no price for %s", ticker)
+	}
+	return *out.Price, nil
+}
+
+// quotes is the configured provider, or nil when QUOTE_PROVIDER_URL is
+// unset.
+var quotes quoteProvider
+
+func initQuoteProvider() {
+	providerURL := os.Getenv("QUOTE_PROVIDER_URL")
+	if providerURL == "" {
+		log.Println("QUOTE_PROVIDER_URL not set; security prices must be entered manually.")
+		return
+	}
+	quotes = &httpQuoteProvider{url: providerURL, apiKey: os.Getenv("QUOTE_API_KEY"), client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// --- MODELS ---
+
+// Holding is a security held in an investment account. CostBasis is the
+// total paid for it; the price fields are filled in on reads.
+type Holding struct {
+	ID          int        `json:"id"`
+	AccountID   int        `json:"account_id"`
+	Ticker      string     `json:"ticker"`
+	Quantity    float64    `json:"quantity"`
+	CostBasis   float64    `json:"cost_basis"`
+	Price       *float64   `json:"price,omitempty"`
+	PriceDate   *time.Time `json:"price_date,omitempty"`
+	MarketValue float64    `json:"market_value"`
+	Gain        float64    `json:"gain"`
+}
+
+// Portfolio is an investment account's cash and holdings.
+type Portfolio struct {
+	AccountID   int       `json:"account_id"`
+	Currency    string    `json:"currency"`
+	Cash        float64   `json:"cash"`
+	MarketValue float64   `json:"market_value"`
+	CostBasis   float64   `json:"cost_basis"`
+	Gain        float64   `json:"gain"`
+	Holdings    []Holding `json:"holdings"`
+}
+
+type InvestmentValuation struct {
+	Date        time.Time `json:"date"`
+	MarketValue float64   `json:"market_value"`
+	CostBasis   float64   `json:"cost_basis"`
+	Gain        float64   `json:"gain"`
+}
+
+// SecurityPrice is a quote entered by hand; date defaults to today.
+type SecurityPrice struct {
+	Ticker string  `json:"ticker"`
+	Date   string  `json:"date"`
+	Price  float64 `json:"price"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+const holdingSelectSQL = `SELECT h.id, h.account_id, h.ticker, h.quantity, h.cost_basis, p.price, p.date
+        FROM holdings h
+        LEFT JOIN LATERAL (SELECT price, date FROM security_prices WHERE ticker = h.ticker ORDER BY date DESC LIMIT 1) p ON TRUE`
+
+func scanHolding(row interface{ Scan(...interface{}) error }, h *Holding) error {
+	if err := row.Scan(&h.ID, &h.AccountID, &h.Ticker, &h.Quantity, &h.CostBasis, &h.Price, &h.PriceDate); err != nil {
+		return err
+	}
+	h.MarketValue = h.CostBasis
+	if h.Price != nil {
+		h.MarketValue = float64(toCents(h.Quantity**h.Price)) / 100
+	}
+	h.Gain = float64(toCents(h.MarketValue)-toCents(h.CostBasis)) / 100
+	return nil
+}
+
+func validateHolding(w http.ResponseWriter, h *Holding) bool {
+	h.Ticker = strings.ToUpper(strings.TrimSpace(h.Ticker))
+	switch {
+	case !tickerPattern.MatchString(h.Ticker):
+		respondWithError(w, http.StatusBadRequest, "A valid ticker is required")
+	case h.Quantity < 0:
+		respondWithError(w, http.StatusBadRequest, "quantity cannot be negative")
+	case h.CostBasis < 0:
+		respondWithError(w, http.StatusBadRequest, "cost_basis cannot be negative")
+	default:
+		return true
+	}
+	return false
+}
+
+// investmentAccountFromPath reads {id}, checks the caller owns the account,
+// and loads it, requiring an investment account.
+func investmentAccountFromPath(w http.ResponseWriter, r *http.Request) (Account, bool) {
+	var a Account
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return a, false
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return a, false
+	}
+	if a, err = loadAccount(dbFor(r), accountID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return a, false
+	}
+	if a.Type != accountInvestment {
+		respondWithError(w, http.StatusBadRequest, "Account is not an investment account")
+		return a, false
+	}
+	return a, true
+}
+
+// --- JOBS ---
+
+// snapshotInvestments refreshes the quote of every ticker held in an open
+// investment account, when a provider is configured, and stores today's
+// holdings value for each of those accounts. A ticker the provider cannot
+// quote keeps its last price.
+func snapshotInvestments() error {
+	if quotes != nil {
+		rows, err := db.Query(`SELECT DISTINCT h.ticker FROM holdings h JOIN accounts a ON a.id = h.account_id
+            WHERE a.type = 'investment' AND a.closed_at IS NULL AND h.quantity > 0`)
+		if err != nil {
+			return err
+		}
+		var tickers []string
+		for rows.Next() {
+			var ticker string
+			if err := rows.Scan(&ticker); err != nil {
+				rows.Close()
+				return err
+			}
+			tickers = append(tickers, ticker)
+		}
+		rows.Close()
+		for _, ticker := range tickers {
+			price, err := quotes.Quote(ticker)
+			if err != nil {
+				log.Printf("Quote for %s failed: %v", ticker, err)
+				continue
+			}
+			_, err = db.Exec(`INSERT INTO security_prices (ticker, date, price) VALUES ($1, CURRENT_DATE, $2)
+                ON CONFLICT (ticker, date) DO UPDATE SET price = EXCLUDED.price`, ticker, price)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := db.Exec(`INSERT INTO investment_valuations (account_id, date, market_value, cost_basis)
+        SELECT a.id, CURRENT_DATE, ` + holdingsValueSQL + `, (SELECT COALESCE(SUM(h.cost_basis), 0) FROM holdings h WHERE h.account_id = a.id)
+        FROM accounts a WHERE a.type = 'investment' AND a.closed_at IS NULL
+        ON CONFLICT (account_id, date) DO UPDATE SET market_value = EXCLUDED.market_value, cost_basis = EXCLUDED.cost_basis`)
+	return err
+}
+
+// --- INVESTMENT HANDLERS ---
+
+// CreateHolding adds a security to an investment account.
+func CreateHolding(w http.ResponseWriter, r *http.Request) {
+	a, ok := investmentAccountFromPath(w, r)
+	if !ok {
+		return
+	}
+	var h Holding
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !validateHolding(w, &h) {
+		return
+	}
+	if a.ClosedAt != nil {
+		respondWithError(w, http.StatusConflict, "Account is closed")
+		return
+	}
+	err := dbFor(r).QueryRow("INSERT INTO holdings (account_id, ticker, quantity, cost_basis) VALUES ($1, $2, $3, $4) RETURNING id",
+		a.ID, h.Ticker, h.Quantity, h.CostBasis).Scan(&h.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create holding. The account may already hold this ticker.")
+		return
+	}
+	if err := scanHolding(dbFor(r).QueryRow(holdingSelectSQL+" WHERE h.id = $1", h.ID), &h); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve holding")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, h)
+}
+
+// GetPortfolio returns an investment account's cash and holdings with their
+// market value and gain.
+func GetPortfolio(w http.ResponseWriter, r *http.Request) {
+	a, ok := investmentAccountFromPath(w, r)
+	if !ok {
+		return
+	}
+	p := Portfolio{AccountID: a.ID, Currency: a.Currency, Cash: float64(toCents(a.Balance)-toCents(a.HoldingsValue)) / 100, Holdings: []Holding{}}
+	rows, err := dbFor(r).Query(holdingSelectSQL+" WHERE h.account_id = $1 ORDER BY h.ticker", a.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve holdings")
+		return
+	}
+	defer rows.Close()
+	var value, cost int64
+	for rows.Next() {
+		var h Holding
+		if err := scanHolding(rows, &h); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan holding")
+			return
+		}
+		value += toCents(h.MarketValue)
+		cost += toCents(h.CostBasis)
+		p.Holdings = append(p.Holdings, h)
+	}
+	p.MarketValue, p.CostBasis, p.Gain = float64(value)/100, float64(cost)/100, float64(value-cost)/100
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// UpdateHolding changes a holding's ticker, quantity or cost basis, e.g.
+// after a trade.
+func UpdateHolding(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	holdingID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid holding ID")
+		return
+	}
+	if !authorizeResource(w, r, "holding", holdingID) {
+		return
+	}
+	var h Holding
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !validateHolding(w, &h) {
+		return
+	}
+	_, err = dbFor(r).Exec("UPDATE holdings SET ticker=$1, quantity=$2, cost_basis=$3 WHERE id=$4", h.Ticker, h.Quantity, h.CostBasis, holdingID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update holding. The account may already hold this ticker.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Holding updated successfully"})
+}
+
+func DeleteHolding(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	holdingID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid holding ID")
+		return
+	}
+	if !authorizeResource(w, r, "holding", holdingID) {
+		return
+	}
+	if _, err := dbFor(r).Exec("DELETE FROM holdings WHERE id=$1", holdingID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete holding")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Holding deleted successfully"})
+}
+
+// GetInvestmentValuations returns an investment account's stored daily
+// holdings values between ?from= and ?to= (default: the last year).
+func GetInvestmentValuations(w http.ResponseWriter, r *http.Request) {
+	a, ok := investmentAccountFromPath(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", now.AddDate(-1, 0, 0))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", now)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	rows, err := dbFor(r).Query(`SELECT date, market_value, cost_basis FROM investment_valuations
+        WHERE account_id = $1 AND date >= $2 AND date <= $3 ORDER BY date`, a.ID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve valuations")
+		return
+	}
+	defer rows.Close()
+	valuations := []InvestmentValuation{}
+	for rows.Next() {
+		var v InvestmentValuation
+		if err := rows.Scan(&v.Date, &v.MarketValue, &v.CostBasis); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan valuation")
+			return
+		}
+		v.Gain = float64(toCents(v.MarketValue)-toCents(v.CostBasis)) / 100
+		valuations = append(valuations, v)
+	}
+	respondWithJSON(w, http.StatusOK, valuations)
+}
+
+// SetSecurityPrice records a quote by hand, replacing the one for that day.
+// Quotes are shared by every user, so only admins enter them.
+func SetSecurityPrice(w http.ResponseWriter, r *http.Request) {
+	var p SecurityPrice
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	p.Ticker = strings.ToUpper(strings.TrimSpace(p.Ticker))
+	if !tickerPattern.MatchString(p.Ticker) || p.Price < 0 {
+		respondWithError(w, http.StatusBadRequest, "A valid ticker and a non-negative price are required")
+		return
+	}
+	now := time.Now()
+	date := dateOnly(now, now.Location())
+	if p.Date != "" {
+		var err error
+		if date, err = time.Parse("2006-01-02", p.Date); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+			return
+		}
+	}
+	p.Date = date.Format("2006-01-02")
+	_, err := db.Exec(`INSERT INTO security_prices (ticker, date, price) VALUES ($1, $2, $3)
+        ON CONFLICT (ticker, date) DO UPDATE SET price = EXCLUDED.price`, p.Ticker, date, p.Price)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record price")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, p)
+}
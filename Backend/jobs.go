@@ -0,0 +1,23 @@
+// jobs.go
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// startJob runs fn immediately and then on every tick of interval in its own
+// goroutine. Errors are logged and the job keeps running.
+func startJob(name string, interval time.Duration, fn func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := fn(); err != nil {
+				log.Printf("Job %s failed: %v", name, err)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Job %s scheduled every %s.", name, interval)
+}
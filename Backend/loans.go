@@ -0,0 +1,381 @@
+// loans.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A loan account is repaid in equal monthly payments over its term. Each
+// payment first covers the month's interest on what is still owed, and the
+// rest pays down the principal. Logging a payment records the principal as
+// a credit on the loan, and, when it is paid from another account, as a
+// matching debit there; both are kept out of budgets, since they only move
+// money. The interest is recorded as an expense.
+
+// --- MODELS ---
+
+type AmortizationPayment struct {
+	Number    int       `json:"number"`
+	Date      time.Time `json:"date"`
+	Payment   float64   `json:"payment"`
+	Principal float64   `json:"principal"`
+	Interest  float64   `json:"interest"`
+	Balance   float64   `json:"balance"`
+}
+
+// AmortizationSchedule is a loan's repayment plan from its terms. Amounts
+// owed are positive.
+type AmortizationSchedule struct {
+	AccountID      int                   `json:"account_id"`
+	Principal      float64               `json:"principal"`
+	InterestRate   float64               `json:"interest_rate"`
+	TermMonths     int                   `json:"term_months"`
+	MonthlyPayment float64               `json:"monthly_payment"`
+	TotalInterest  float64               `json:"total_interest"`
+	Payments       []AmortizationPayment `json:"payments"`
+}
+
+// LoanPayment is a logged payment. Balance is what was owed after it.
+type LoanPayment struct {
+	ID                    int       `json:"id"`
+	AccountID             int       `json:"account_id"`
+	Date                  time.Time `json:"date"`
+	Amount                float64   `json:"amount"`
+	Principal             float64   `json:"principal"`
+	Interest              float64   `json:"interest"`
+	Balance               float64   `json:"balance,omitempty"`
+	FromAccountID         *int      `json:"from_account_id,omitempty"`
+	LoanTransactionID     *int      `json:"loan_transaction_id,omitempty"`
+	TransferTransactionID *int      `json:"transfer_transaction_id,omitempty"`
+	InterestTransactionID *int      `json:"interest_transaction_id,omitempty"`
+}
+
+// LoanPaymentRequest is the body of the payment route. Date defaults to
+// today; category_id categorizes the interest.
+type LoanPaymentRequest struct {
+	Amount        float64 `json:"amount"`
+	Date          string  `json:"date"`
+	FromAccountID *int    `json:"from_account_id"`
+	CategoryID    int     `json:"category_id"`
+}
+
+// LoanPayoff compares paying a loan off on schedule with paying extra_monthly
+// on top of each payment and lump_sum now.
+type LoanPayoff struct {
+	AccountID           int       `json:"account_id"`
+	Outstanding         float64   `json:"outstanding"`
+	MonthlyPayment      float64   `json:"monthly_payment"`
+	ExtraMonthly        float64   `json:"extra_monthly"`
+	LumpSum             float64   `json:"lump_sum"`
+	ScheduledPayoffDate time.Time `json:"scheduled_payoff_date"`
+	ScheduledMonths     int       `json:"scheduled_months"`
+	ScheduledInterest   float64   `json:"scheduled_interest"`
+	PayoffDate          time.Time `json:"payoff_date"`
+	Months              int       `json:"months"`
+	TotalInterest       float64   `json:"total_interest"`
+	MonthsSaved         int       `json:"months_saved"`
+	InterestSaved       float64   `json:"interest_saved"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// monthlyInterest is a month's interest in cents on balance cents at an
+// annual rate in percent.
+func monthlyInterest(balance int64, annualRate float64) int64 {
+	return int64(math.Round(float64(balance) * annualRate / 1200))
+}
+
+// loanPayment is the monthly payment in cents that repays principal cents
+// at an annual rate in percent over months.
+func loanPayment(principal int64, annualRate float64, months int) int64 {
+	if annualRate == 0 {
+		return int64(math.Ceil(float64(principal) / float64(months)))
+	}
+	rate := annualRate / 1200
+	return int64(math.Round(float64(principal) * rate / (1 - math.Pow(1+rate, -float64(months)))))
+}
+
+// amortize repays balance cents with payment cents a month, the first due
+// on first, until it is paid off. The last of the term's months payments
+// settles whatever is left, so rounding, or a payment too small for the
+// balance, never runs past the term.
+func amortize(balance int64, annualRate float64, payment int64, first time.Time, months int) ([]AmortizationPayment, int64) {
+	payments := []AmortizationPayment{}
+	var totalInterest int64
+	for i := 0; i < months && balance > 0; i++ {
+		interest := monthlyInterest(balance, annualRate)
+		principal := payment - interest
+		if principal > balance || i == months-1 {
+			principal = balance
+		}
+		balance -= principal
+		totalInterest += interest
+		payments = append(payments, AmortizationPayment{
+			Number:    i + 1,
+			Date:      addMonthsClamped(first, i),
+			Payment:   float64(principal+interest) / 100,
+			Principal: float64(principal) / 100,
+			Interest:  float64(interest) / 100,
+			Balance:   float64(balance) / 100,
+		})
+	}
+	return payments, totalInterest
+}
+
+// loanFromPath reads {id}, checks the caller owns the account, and loads
+// it, requiring a loan.
+func loanFromPath(w http.ResponseWriter, r *http.Request) (Account, bool) {
+	var a Account
+	accountID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return a, false
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return a, false
+	}
+	if a, err = loadAccount(dbFor(r), accountID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve account")
+		return a, false
+	}
+	if a.Type != accountLoan {
+		respondWithError(w, http.StatusBadRequest, "Account is not a loan")
+		return a, false
+	}
+	return a, true
+}
+
+// insertAccountTransaction stores a transaction the server generates on an
+// account, such as a loan payment, once the caller has been authorized.
+func insertAccountTransaction(q queryer, t *Transaction) error {
+	return q.QueryRow(`INSERT INTO transactions (user_id, description, amount, date, category_id, status, currency, original_amount,
+            exchange_rate, exclude_from_budget, account_id)
+        VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7, $8, $9, $10, $11) RETURNING id`,
+		t.UserID, t.Description, t.Amount, t.Date, t.CategoryID, t.Status, t.Currency, t.OriginalAmount,
+		t.ExchangeRate, t.ExcludeFromBudget, t.AccountID).Scan(&t.ID)
+}
+
+// --- LOAN HANDLERS ---
+
+// GetAmortizationSchedule returns a loan's full repayment schedule from its
+// terms.
+func GetAmortizationSchedule(w http.ResponseWriter, r *http.Request) {
+	a, ok := loanFromPath(w, r)
+	if !ok {
+		return
+	}
+	principal := -toCents(a.OpeningBalance)
+	payment := loanPayment(principal, *a.InterestRate, *a.TermMonths)
+	payments, totalInterest := amortize(principal, *a.InterestRate, payment, *a.FirstPaymentDate, *a.TermMonths)
+	respondWithJSON(w, http.StatusOK, AmortizationSchedule{
+		AccountID:      a.ID,
+		Principal:      float64(principal) / 100,
+		InterestRate:   *a.InterestRate,
+		TermMonths:     *a.TermMonths,
+		MonthlyPayment: float64(payment) / 100,
+		TotalInterest:  float64(totalInterest) / 100,
+		Payments:       payments,
+	})
+}
+
+// LogLoanPayment records a payment on a loan, split between the month's
+// interest on the outstanding balance and principal.
+func LogLoanPayment(w http.ResponseWriter, r *http.Request) {
+	a, ok := loanFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req LoanPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	amount := toCents(req.Amount)
+	if amount <= 0 {
+		respondWithError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	date := time.Now()
+	if req.Date != "" {
+		var err error
+		if date, err = time.Parse("2006-01-02", req.Date); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+			return
+		}
+	}
+	owed := -toCents(a.Balance)
+	if owed <= 0 {
+		respondWithError(w, http.StatusConflict, "The loan is paid off")
+		return
+	}
+	interest := monthlyInterest(owed, *a.InterestRate)
+	if interest > amount {
+		interest = amount
+	}
+	principal := amount - interest
+	if principal > owed {
+		respondWithError(w, http.StatusBadRequest, "The payment is more than the payoff amount of "+strconv.FormatFloat(float64(owed+interest)/100, 'f', 2, 64))
+		return
+	}
+	if req.FromAccountID != nil {
+		from, err := loadAccount(dbFor(r), *req.FromAccountID)
+		if err == nil && from.UserID == a.UserID && from.Currency != a.Currency {
+			respondWithError(w, http.StatusBadRequest, "The paying account must be in the loan's currency")
+			return
+		}
+	}
+	if !authorizeAccount(w, &a.ID, a.UserID, date) || !authorizeAccount(w, req.FromAccountID, a.UserID, date) ||
+		!authorizeCategory(w, req.CategoryID, resourceRef{OwnerID: a.UserID}) ||
+		!authorizeUnlockedDates(w, r, resourceRef{OwnerID: a.UserID}, date) {
+		return
+	}
+
+	p := LoanPayment{AccountID: a.ID, Date: dateOnly(date, date.Location()), Amount: float64(amount) / 100, Principal: float64(principal) / 100,
+		Interest: float64(interest) / 100, Balance: float64(owed-principal) / 100, FromAccountID: req.FromAccountID}
+	newTransaction := func(description string, cents int64, accountID *int, excluded bool) *Transaction {
+		amount := float64(cents) / 100
+		return &Transaction{UserID: a.UserID, Description: description, Amount: amount, Date: date, AccountID: accountID, Status: statusCleared,
+			Currency: a.Currency, OriginalAmount: &amount, ExchangeRate: a.ExchangeRate, ExcludeFromBudget: excluded}
+	}
+	var transactions []*Transaction
+	var loanT, transferT, interestT *Transaction
+	if principal > 0 {
+		loanT = newTransaction("Loan payment: "+a.Name, -principal, &a.ID, true)
+		transactions = append(transactions, loanT)
+		if req.FromAccountID != nil {
+			transferT = newTransaction("Loan payment: "+a.Name, principal, req.FromAccountID, true)
+			transactions = append(transactions, transferT)
+		}
+	}
+	if interest > 0 {
+		interestT = newTransaction("Loan interest: "+a.Name, interest, req.FromAccountID, false)
+		interestT.CategoryID = req.CategoryID
+		transactions = append(transactions, interestT)
+	}
+	for _, t := range transactions {
+		if !applyCurrency(w, dbFor(r), t) {
+			return
+		}
+	}
+	err := withTx(r, func(q queryer) error {
+		for _, t := range transactions {
+			if err := insertAccountTransaction(q, t); err != nil {
+				return err
+			}
+		}
+		if loanT != nil {
+			p.LoanTransactionID = &loanT.ID
+		}
+		if transferT != nil {
+			p.TransferTransactionID = &transferT.ID
+		}
+		if interestT != nil {
+			p.InterestTransactionID = &interestT.ID
+		}
+		return q.QueryRow(`INSERT INTO loan_payments (account_id, date, amount, principal, interest, from_account_id,
+                loan_transaction_id, transfer_transaction_id, interest_transaction_id)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+			p.AccountID, p.Date, p.Amount, p.Principal, p.Interest, p.FromAccountID,
+			p.LoanTransactionID, p.TransferTransactionID, p.InterestTransactionID).Scan(&p.ID)
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record loan payment")
+		return
+	}
+	for _, t := range transactions {
+		recordAudit(r, "transaction", t.ID, auditCreate, nil)
+	}
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+// GetLoanPayments lists the payments logged on a loan, latest first.
+func GetLoanPayments(w http.ResponseWriter, r *http.Request) {
+	a, ok := loanFromPath(w, r)
+	if !ok {
+		return
+	}
+	rows, err := dbFor(r).Query(`SELECT id, account_id, date, amount, principal, interest, from_account_id,
+            loan_transaction_id, transfer_transaction_id, interest_transaction_id
+        FROM loan_payments WHERE account_id = $1 ORDER BY date DESC, id DESC`, a.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve loan payments")
+		return
+	}
+	defer rows.Close()
+	payments := []LoanPayment{}
+	for rows.Next() {
+		var p LoanPayment
+		if err := rows.Scan(&p.ID, &p.AccountID, &p.Date, &p.Amount, &p.Principal, &p.Interest, &p.FromAccountID,
+			&p.LoanTransactionID, &p.TransferTransactionID, &p.InterestTransactionID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan loan payment")
+			return
+		}
+		payments = append(payments, p)
+	}
+	respondWithJSON(w, http.StatusOK, payments)
+}
+
+// GetLoanPayoff works out when the loan's outstanding balance will be paid
+// off on schedule, and how much sooner and cheaper paying ?extra_monthly=
+// on top of each payment and a ?lump_sum= now would make it.
+func GetLoanPayoff(w http.ResponseWriter, r *http.Request) {
+	a, ok := loanFromPath(w, r)
+	if !ok {
+		return
+	}
+	var extra, lump float64
+	var err error
+	if v := r.URL.Query().Get("extra_monthly"); v != "" {
+		if extra, err = strconv.ParseFloat(v, 64); err != nil || extra < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'extra_monthly'")
+			return
+		}
+	}
+	if v := r.URL.Query().Get("lump_sum"); v != "" {
+		if lump, err = strconv.ParseFloat(v, 64); err != nil || lump < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'lump_sum'")
+			return
+		}
+	}
+
+	payment := loanPayment(-toCents(a.OpeningBalance), *a.InterestRate, *a.TermMonths)
+	// The next payment is the first one due after today; any left of the
+	// term after it set the schedule's length.
+	now := time.Now()
+	today := dateOnly(now, now.Location())
+	due := 0
+	for due < *a.TermMonths-1 && !addMonthsClamped(*a.FirstPaymentDate, due).After(today) {
+		due++
+	}
+	next, remaining := addMonthsClamped(*a.FirstPaymentDate, due), *a.TermMonths-due
+	owed := -toCents(a.Balance)
+	if owed < 0 {
+		owed = 0
+	}
+	payoff := LoanPayoff{AccountID: a.ID, Outstanding: float64(owed) / 100, MonthlyPayment: float64(payment) / 100, ExtraMonthly: extra, LumpSum: lump}
+	if toCents(lump) > owed {
+		respondWithError(w, http.StatusBadRequest, "'lump_sum' is more than the outstanding balance")
+		return
+	}
+
+	scheduled, scheduledInterest := amortize(owed, *a.InterestRate, payment, next, remaining)
+	accelerated, totalInterest := amortize(owed-toCents(lump), *a.InterestRate, payment+toCents(extra), next, remaining)
+	payoff.ScheduledMonths, payoff.ScheduledInterest = len(scheduled), float64(scheduledInterest)/100
+	payoff.Months, payoff.TotalInterest = len(accelerated), float64(totalInterest)/100
+	payoff.ScheduledPayoffDate, payoff.PayoffDate = today, today
+	if len(scheduled) > 0 {
+		payoff.ScheduledPayoffDate = scheduled[len(scheduled)-1].Date
+	}
+	if len(accelerated) > 0 {
+		payoff.PayoffDate = accelerated[len(accelerated)-1].Date
+	}
+	payoff.MonthsSaved = payoff.ScheduledMonths - payoff.Months
+	payoff.InterestSaved = float64(scheduledInterest-totalInterest) / 100
+	respondWithJSON(w, http.StatusOK, payoff)
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -46,38 +48,360 @@ func main() {
 		log.Fatal("Failed to create admin user:", err)
 	}
 
+	if rlsEnabled() {
+		if err := createRLSPolicies(); err != nil {
+			log.Fatal("Failed to create row-level security policies:", err)
+		}
+	}
+
+	initAuth()
+	if err := initRevocationStore(); err != nil {
+		log.Fatal("Failed to initialize token revocation store:", err)
+	}
+	initOCRProvider()
+	initQuoteProvider()
+	initMailProvider()
+	if err := initCategoryTemplates(); err != nil {
+		log.Fatal("Failed to load category templates:", err)
+	}
+
+	// Background jobs
+	startJob("account-deletions", time.Hour, processAccountDeletions)
+	startJob("expired-sessions", time.Hour, purgeExpiredSessions)
+	startJob("idempotency-keys", time.Hour, purgeIdempotencyKeys)
+	startJob("allowances", time.Hour, creditAllowances)
+	startJob("trash-purge", time.Hour, purgeTrash)
+	startJob("budget-periods", time.Hour, closeBudgetPeriods)
+	startJob("subscriptions", 24*time.Hour, detectSubscriptions)
+	startJob("investments", 24*time.Hour, snapshotInvestments)
+	startJob("net-worth", 24*time.Hour, snapshotNetWorth)
+	startJob("budget-digests", time.Hour, sendBudgetDigests)
+	startJob("recurring-splits", time.Hour, processRecurringSplits)
+	startJob("receipt-ocr", time.Duration(getEnvInt("RECEIPT_POLL_SECONDS", 10))*time.Second, processReceipts)
+	startJob("csv-imports", time.Duration(getEnvInt("IMPORT_POLL_SECONDS", 10))*time.Second, processImports)
+
 	// Router
 	r := mux.NewRouter()
+	r.Use(authMiddleware)
+	if rlsEnabled() {
+		r.Use(rlsMiddleware)
+	}
 
 	// --- User Routes ---
 	r.HandleFunc("/register", RegisterUser).Methods("POST")
 	r.HandleFunc("/login", LoginUser).Methods("POST")
-	r.HandleFunc("/users", GetAllUsers).Methods("GET")
-	r.HandleFunc("/users/{id}", UpdateUser).Methods("PUT")
-	r.HandleFunc("/users/{id}", DeleteUser).Methods("DELETE")
+	r.HandleFunc("/logout", LogoutUser).Methods("POST")
+	r.HandleFunc("/users/me", GetCurrentUser).Methods("GET")
+	r.HandleFunc("/users/me", UpdateCurrentUser).Methods("PUT")
+	r.HandleFunc("/users", adminOnly(GetAllUsers)).Methods("GET")
+	r.HandleFunc("/users/{id}", adminOnly(UpdateUser)).Methods("PUT")
+	r.HandleFunc("/users/{id}", adminOnly(DeleteUser)).Methods("DELETE")
+	r.HandleFunc("/users/{id}/password", ChangePassword).Methods("PUT")
+	r.HandleFunc("/users/{id}/logout", adminOnly(ForceLogoutUser)).Methods("POST")
+	r.HandleFunc("/users/{id}/deletion", RequestAccountDeletion).Methods("POST")
+	r.HandleFunc("/users/{id}/deletion", GetAccountDeletion).Methods("GET")
+	r.HandleFunc("/users/{id}/deletion/status", CheckAccountDeletion).Methods("POST")
+	r.HandleFunc("/users/{id}/deletion/cancel", CancelAccountDeletion).Methods("POST")
+
+	// --- Token Routes ---
+	r.HandleFunc("/tokens", CreateReadOnlyToken).Methods("POST")
+	r.HandleFunc("/tokens", GetTokens).Methods("GET")
+	r.HandleFunc("/tokens/{id}", RevokeToken).Methods("DELETE")
+
+	// --- Notification Routes ---
+	r.HandleFunc("/notifications", GetNotifications).Methods("GET")
+	r.HandleFunc("/notifications/read-all", MarkAllNotificationsRead).Methods("POST")
+	r.HandleFunc("/notifications/{id}/read", MarkNotificationRead).Methods("POST")
+
+	// --- Service Account Routes ---
+	r.HandleFunc("/service-accounts", adminOnly(CreateServiceAccount)).Methods("POST")
+	r.HandleFunc("/service-accounts", adminOnly(GetServiceAccounts)).Methods("GET")
+	r.HandleFunc("/service-accounts/{id}", adminOnly(DeleteServiceAccount)).Methods("DELETE")
+	r.HandleFunc("/service-accounts/{id}/keys", adminOnly(CreateAPIKey)).Methods("POST")
+	r.HandleFunc("/service-accounts/{id}/keys", adminOnly(GetAPIKeys)).Methods("GET")
+	r.HandleFunc("/service-accounts/{id}/keys/{key_id}", adminOnly(RevokeAPIKey)).Methods("DELETE")
+
+	// --- Organization Routes ---
+	r.HandleFunc("/organizations", CreateOrganization).Methods("POST")
+	r.HandleFunc("/organizations", GetOrganizations).Methods("GET")
+	r.HandleFunc("/organizations/invitations", GetOrganizationInvitations).Methods("GET")
+	r.HandleFunc("/organizations/invitations/{id}/accept", AcceptOrganizationInvitation).Methods("POST")
+	r.HandleFunc("/organizations/invitations/{id}/decline", DeclineOrganizationInvitation).Methods("POST")
+	r.HandleFunc("/organizations/{id}/members", GetOrganizationMembers).Methods("GET")
+	r.HandleFunc("/organizations/{id}/members/{user_id}", RemoveOrganizationMember).Methods("DELETE")
+	r.HandleFunc("/organizations/{id}/invitations", InviteToOrganization).Methods("POST")
+	r.HandleFunc("/organizations/{id}/categories", CreateOrganizationCategory).Methods("POST")
+	r.HandleFunc("/organizations/{id}/categories", GetOrganizationCategories).Methods("GET")
+	r.HandleFunc("/organizations/{id}/transactions", CreateOrganizationTransaction).Methods("POST")
+	r.HandleFunc("/organizations/{id}/transactions", GetOrganizationTransactions).Methods("GET")
+	r.HandleFunc("/organizations/{id}/budgets", CreateOrganizationBudget).Methods("POST")
+	r.HandleFunc("/organizations/{id}/budgets", GetOrganizationBudgets).Methods("GET")
+
+	// --- Household Routes ---
+	r.HandleFunc("/households", CreateHousehold).Methods("POST")
+	r.HandleFunc("/households", GetHouseholds).Methods("GET")
+	r.HandleFunc("/households/invitations", GetHouseholdInvitations).Methods("GET")
+	r.HandleFunc("/households/invitations/{id}/accept", AcceptHouseholdInvitation).Methods("POST")
+	r.HandleFunc("/households/invitations/{id}/decline", DeclineHouseholdInvitation).Methods("POST")
+	r.HandleFunc("/households/{id}/members", GetHouseholdMembers).Methods("GET")
+	r.HandleFunc("/households/{id}/members/{user_id}", RemoveHouseholdMember).Methods("DELETE")
+	r.HandleFunc("/households/{id}/invitations", InviteToHousehold).Methods("POST")
+	r.HandleFunc("/households/{id}/categories", CreateHouseholdCategory).Methods("POST")
+	r.HandleFunc("/households/{id}/categories", GetHouseholdCategories).Methods("GET")
+	r.HandleFunc("/households/{id}/categories/{category_id}", DeleteHouseholdCategory).Methods("DELETE")
+	r.HandleFunc("/households/{id}/spending", GetHouseholdSpending).Methods("GET")
+
+	// --- Child Account Routes ---
+	r.HandleFunc("/children", CreateChildAccount).Methods("POST")
+	r.HandleFunc("/children", GetChildAccounts).Methods("GET")
+	r.HandleFunc("/children/approvals", GetPendingApprovals).Methods("GET")
+	r.HandleFunc("/children/approvals/{id}/approve", ApproveTransaction).Methods("POST")
+	r.HandleFunc("/children/approvals/{id}/reject", RejectTransaction).Methods("POST")
+	r.HandleFunc("/children/{id}", UpdateChildSettings).Methods("PUT")
+	r.HandleFunc("/children/{id}/limits", GetCategoryLimits).Methods("GET")
+	r.HandleFunc("/children/{id}/limits", SetCategoryLimit).Methods("PUT")
+	r.HandleFunc("/children/{id}/limits/{category_id}", DeleteCategoryLimit).Methods("DELETE")
+	r.HandleFunc("/children/{id}/allowance", GetAllowance).Methods("GET")
+
+	// --- Delegation Routes ---
+	r.HandleFunc("/delegations", CreateDelegation).Methods("POST")
+	r.HandleFunc("/delegations", GetDelegations).Methods("GET")
+	r.HandleFunc("/delegations/{id}", RevokeDelegation).Methods("DELETE")
+	r.HandleFunc("/delegations/{id}/access-log", GetDelegationAccessLog).Methods("GET")
+	r.HandleFunc("/delegations/{user_id}/categories", delegated(GetDelegatedCategories)).Methods("GET")
+	r.HandleFunc("/delegations/{user_id}/transactions", delegated(GetDelegatedTransactions)).Methods("GET")
+	r.HandleFunc("/delegations/{user_id}/budgets", delegated(GetDelegatedBudgets)).Methods("GET")
+
+	// --- Audit Routes ---
+	r.HandleFunc("/audit", GetAuditLog).Methods("GET")
 
 	// --- Category Routes ---
 	r.HandleFunc("/categories", CreateCategory).Methods("POST")
 	r.HandleFunc("/categories/{user_id}", GetCategories).Methods("GET")
+	r.HandleFunc("/categories/{user_id}/summary", GetCategorySummary).Methods("GET")
+	r.HandleFunc("/categories/{user_id}/order", ReorderCategories).Methods("PUT")
+	r.HandleFunc("/category-caps/{user_id}", GetCategoryCaps).Methods("GET")
+	r.HandleFunc("/category-caps/{user_id}", SetCategoryCap).Methods("PUT")
+	r.HandleFunc("/category-caps/{user_id}/{category_id}", DeleteCategoryCap).Methods("DELETE")
 	r.HandleFunc("/categories/{id}", UpdateCategory).Methods("PUT")
 	r.HandleFunc("/categories/{id}", DeleteCategory).Methods("DELETE")
+	r.HandleFunc("/categories/{id}/merge", MergeCategory).Methods("POST")
+	r.HandleFunc("/categories/global", adminOnly(CreateGlobalCategory)).Methods("POST")
+	r.HandleFunc("/categories/{id}/hide", HideCategory).Methods("POST")
+	r.HandleFunc("/categories/{id}/unhide", UnhideCategory).Methods("POST")
+	r.HandleFunc("/category-templates", GetCategoryTemplates).Methods("GET")
+	r.HandleFunc("/category-templates/{name}/apply", ApplyCategoryTemplate).Methods("POST")
 
 	// --- Transaction Routes ---
-	r.HandleFunc("/transactions", CreateTransaction).Methods("POST")
+	r.HandleFunc("/transactions", idempotent(CreateTransaction)).Methods("POST")
+	r.HandleFunc("/transactions/bulk", idempotent(CreateTransactionsBulk)).Methods("POST")
+	r.HandleFunc("/transactions/bulk/update", UpdateTransactionsBulk).Methods("POST")
+	r.HandleFunc("/transactions/bulk/delete", DeleteTransactionsBulk).Methods("POST")
+	r.HandleFunc("/transactions/bulk/recategorize", RecategorizeTransactions).Methods("POST")
+	r.HandleFunc("/transactions/reconcile", ReconcileTransactions).Methods("POST")
+	r.HandleFunc("/transactions/suggest-category", SuggestCategory).Methods("POST")
+	r.HandleFunc("/transactions/from-template/{id}", idempotent(CreateTransactionFromTemplate)).Methods("POST")
+	r.HandleFunc("/reconciliations/{user_id}", GetReconciliations).Methods("GET")
+	r.HandleFunc("/accounts/{id}/reconciliation-sessions", StartReconciliationSession).Methods("POST")
+	r.HandleFunc("/reconciliation-sessions/{id}", GetReconciliationSession).Methods("GET")
+	r.HandleFunc("/reconciliation-sessions/{id}", CancelReconciliationSession).Methods("DELETE")
+	r.HandleFunc("/reconciliation-sessions/{id}/transactions/{transaction_id}", CheckSessionTransaction).Methods("POST")
+	r.HandleFunc("/reconciliation-sessions/{id}/transactions/{transaction_id}", UncheckSessionTransaction).Methods("DELETE")
+	r.HandleFunc("/reconciliation-sessions/{id}/finish", FinishReconciliationSession).Methods("POST")
 	r.HandleFunc("/transactions/{user_id}", GetTransactions).Methods("GET")
+	r.HandleFunc("/transactions/{user_id}/trash", GetTrash).Methods("GET")
+	r.HandleFunc("/transactions/{user_id}/export", ExportTransactions).Methods("GET")
+	r.HandleFunc("/transactions/{id}/restore", RestoreTransaction).Methods("POST")
+	r.HandleFunc("/transactions/{id}/history", GetTransactionHistory).Methods("GET")
+	r.HandleFunc("/transactions/{id}/link", LinkRefund).Methods("POST")
+	r.HandleFunc("/transactions/{id}/link", UnlinkRefund).Methods("DELETE")
+	r.HandleFunc("/transactions/{id}/history/{version}/revert", RevertTransaction).Methods("POST")
 	r.HandleFunc("/transactions/{id}", UpdateTransaction).Methods("PUT")
 	r.HandleFunc("/transactions/{id}", DeleteTransaction).Methods("DELETE")
+	r.HandleFunc("/transactions/{id}/tags", GetTransactionTags).Methods("GET")
+	r.HandleFunc("/transactions/{id}/tags", TagTransaction).Methods("POST")
+	r.HandleFunc("/transactions/{id}/tags/{tag_id}", UntagTransaction).Methods("DELETE")
+	r.HandleFunc("/transactions/{id}/splits", GetTransactionSplits).Methods("GET")
+	r.HandleFunc("/transactions/{id}/splits", SetTransactionSplits).Methods("PUT")
+
+	// --- Template Routes ---
+	r.HandleFunc("/templates", CreateTemplate).Methods("POST")
+	r.HandleFunc("/templates/{user_id}", GetTemplates).Methods("GET")
+	r.HandleFunc("/templates/{id}", UpdateTemplate).Methods("PUT")
+	r.HandleFunc("/templates/{id}", DeleteTemplate).Methods("DELETE")
+
+	// --- Subscription Routes ---
+	r.HandleFunc("/subscriptions/{user_id}", GetSubscriptions).Methods("GET")
+	r.HandleFunc("/subscriptions/{id}/confirm", ConfirmSubscription).Methods("POST")
+	r.HandleFunc("/subscriptions/{id}/dismiss", DismissSubscription).Methods("POST")
+
+	// --- Saved View Routes ---
+	r.HandleFunc("/saved-views", CreateSavedView).Methods("POST")
+	r.HandleFunc("/saved-views/{user_id}", GetSavedViews).Methods("GET")
+	r.HandleFunc("/saved-views/{id}", UpdateSavedView).Methods("PUT")
+	r.HandleFunc("/saved-views/{id}", DeleteSavedView).Methods("DELETE")
+
+	// --- Report Routes ---
+	r.HandleFunc("/reports/categories/{user_id}", GetCategoryReport).Methods("GET")
+	r.HandleFunc("/reports/payees/{user_id}", GetPayeeReport).Methods("GET")
+	r.HandleFunc("/reports/global-categories", adminOnly(GetGlobalCategoryReport)).Methods("GET")
+	r.HandleFunc("/reports/{user_id}/monthly", GetMonthlyReport).Methods("GET")
+	r.HandleFunc("/reports/{user_id}/category-breakdown", GetCategoryBreakdown).Methods("GET")
+	r.HandleFunc("/reports/{user_id}/cashflow", GetCashFlow).Methods("GET")
+	r.HandleFunc("/reports/{user_id}/trends", GetSpendingTrends).Methods("GET")
+	r.HandleFunc("/reports/{user_id}/top-payees", GetTopPayees).Methods("GET")
+
+	// --- Payee Routes ---
+	r.HandleFunc("/payees", CreatePayee).Methods("POST")
+	r.HandleFunc("/payees/{user_id}", GetPayees).Methods("GET")
+	r.HandleFunc("/payees/{id}", UpdatePayee).Methods("PUT")
+	r.HandleFunc("/payees/{id}", DeletePayee).Methods("DELETE")
+	r.HandleFunc("/payees/{id}/aliases", AddPayeeAlias).Methods("POST")
+
+	// --- Receipt Routes ---
+	r.HandleFunc("/receipts", UploadReceipt).Methods("POST")
+	r.HandleFunc("/receipts/{id}", GetReceipt).Methods("GET")
+	r.HandleFunc("/receipts/{id}", DeleteReceipt).Methods("DELETE")
+
+	// --- Import Routes ---
+	r.HandleFunc("/imports/csv", UploadCSVImport).Methods("POST")
+	r.HandleFunc("/imports/{id}", GetCSVImport).Methods("GET")
+
+	// --- Tag Routes ---
+	r.HandleFunc("/tags", CreateTag).Methods("POST")
+	r.HandleFunc("/tags/{user_id}", GetTags).Methods("GET")
+	r.HandleFunc("/tags/{id}", UpdateTag).Methods("PUT")
+	r.HandleFunc("/tags/{id}", DeleteTag).Methods("DELETE")
 
 	// --- Budget Routes ---
-	r.HandleFunc("/budgets", CreateBudget).Methods("POST")
+	r.HandleFunc("/budgets", idempotent(CreateBudget)).Methods("POST")
 	r.HandleFunc("/budgets/{user_id}", GetBudgets).Methods("GET")
+	r.HandleFunc("/budgets/suggestions/{user_id}", GetBudgetSuggestions).Methods("GET")
+	r.HandleFunc("/budgets/suggestions/{user_id}", AcceptBudgetSuggestions).Methods("POST")
 	r.HandleFunc("/budgets/{id}", UpdateBudget).Methods("PUT")
 	r.HandleFunc("/budgets/{id}", DeleteBudget).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/progress", GetBudgetProgress).Methods("GET")
+	r.HandleFunc("/budgets/{id}/history", GetBudgetHistory).Methods("GET")
+	r.HandleFunc("/budgets/{id}/forecast", GetBudgetForecast).Methods("GET")
+	r.HandleFunc("/budgets/{id}/variance", GetBudgetVariance).Methods("GET")
+	r.HandleFunc("/budgets/{id}/approval", RequireBudgetApproval).Methods("PUT")
+	r.HandleFunc("/budgets/{id}/approval", UnrequireBudgetApproval).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/approvals", GetBudgetApprovals).Methods("GET")
+	r.HandleFunc("/budgets/{id}/approvals/{transaction_id}/approve", ApproveBudgetTransaction).Methods("POST")
+	r.HandleFunc("/budgets/{id}/approvals/{transaction_id}/reject", RejectBudgetTransaction).Methods("POST")
+	r.HandleFunc("/budgets/{id}/comments", GetBudgetComments).Methods("GET")
+	r.HandleFunc("/budgets/{id}/comments", CreateBudgetComment).Methods("POST")
+	r.HandleFunc("/budgets/{id}/comments/{comment_id}", UpdateBudgetComment).Methods("PUT")
+	r.HandleFunc("/budgets/{id}/comments/{comment_id}", DeleteBudgetComment).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/category-mappings", GetBudgetCategoryMappings).Methods("GET")
+	r.HandleFunc("/budgets/{id}/category-mappings", SetBudgetCategoryMapping).Methods("PUT")
+	r.HandleFunc("/budgets/{id}/category-mappings/{category_id}", DeleteBudgetCategoryMapping).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/copy", CopyBudget).Methods("POST")
+	r.HandleFunc("/budgets/{id}/archive", ArchiveBudget).Methods("POST")
+	r.HandleFunc("/budgets/{id}/restore", RestoreBudget).Methods("POST")
+	r.HandleFunc("/budgets/{id}/reallocate", Reallocate).Methods("POST")
+	r.HandleFunc("/budgets/{id}/reallocations", GetReallocations).Methods("GET")
+	r.HandleFunc("/budgets/{id}/goal", LinkBudgetGoal).Methods("PUT")
+	r.HandleFunc("/budgets/{id}/goal", UnlinkBudgetGoal).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/close", ClosePeriod).Methods("POST")
+	r.HandleFunc("/budgets/{id}/reopen", ReopenPeriod).Methods("POST")
+	r.HandleFunc("/budgets/{id}/transfer", TransferBudget).Methods("POST")
+	r.HandleFunc("/budgets/{id}/activity", GetBudgetActivity).Methods("GET")
+	r.HandleFunc("/budgets/{id}/members", InviteBudgetMember).Methods("POST")
+	r.HandleFunc("/budgets/{id}/members", GetBudgetMembers).Methods("GET")
+	r.HandleFunc("/budgets/{id}/members/accept", AcceptBudgetMembership).Methods("POST")
+	r.HandleFunc("/budgets/{id}/members/{user_id}", SetBudgetMemberRole).Methods("PUT")
+	r.HandleFunc("/budgets/{id}/members/{user_id}", RemoveBudgetMember).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/notification-preferences", GetNotificationPreferences).Methods("GET")
+	r.HandleFunc("/budgets/{id}/notification-preferences", UpdateNotificationPreferences).Methods("PUT")
+	r.HandleFunc("/budgets/{id}/share-link", CreateShareLink).Methods("POST")
+	r.HandleFunc("/budgets/{id}/share-links/{link_id}", RevokeShareLink).Methods("DELETE")
+	r.HandleFunc("/share-links/{token}", GetShareLinkSnapshot).Methods("GET")
+	r.HandleFunc("/budgets/{id}/digests", CreateBudgetDigest).Methods("POST")
+	r.HandleFunc("/budgets/{id}/digests", GetBudgetDigests).Methods("GET")
+	r.HandleFunc("/budgets/{id}/digests/{digest_id}", DeleteBudgetDigest).Methods("DELETE")
+	r.HandleFunc("/digests/{digest_id}/{token}/confirm", ConfirmBudgetDigest).Methods("GET")
+	r.HandleFunc("/digests/{digest_id}/{token}/unsubscribe", UnsubscribeBudgetDigest).Methods("GET")
+	r.HandleFunc("/income/{user_id}/report", GetIncomeReport).Methods("GET")
+	r.HandleFunc("/budgets/from-template/{id}", CreateBudgetFromTemplate).Methods("POST")
+
+	// --- Allocation Routes ---
+	r.HandleFunc("/allocations/{user_id}", GetAllocations).Methods("GET")
+	r.HandleFunc("/allocations/{user_id}", SetAllocation).Methods("PUT")
+	r.HandleFunc("/allocations/{user_id}/assign-remaining", AssignRemaining).Methods("POST")
+
+	// --- Sinking Fund Routes ---
+	r.HandleFunc("/sinking-funds", CreateSinkingFund).Methods("POST")
+	r.HandleFunc("/sinking-funds/{user_id}", GetSinkingFunds).Methods("GET")
+	r.HandleFunc("/sinking-funds/{id}", UpdateSinkingFund).Methods("PUT")
+	r.HandleFunc("/sinking-funds/{id}", DeleteSinkingFund).Methods("DELETE")
+	r.HandleFunc("/sinking-funds/{id}/progress", GetSinkingFundProgress).Methods("GET")
+	r.HandleFunc("/sinking-funds/{id}/contributions", AddSinkingFundContribution).Methods("POST")
+	r.HandleFunc("/sinking-funds/{id}/contributions", GetSinkingFundContributions).Methods("GET")
+	r.HandleFunc("/sinking-funds/{id}/contributions/{contribution_id}", DeleteSinkingFundContribution).Methods("DELETE")
+
+	// --- Account Routes ---
+	r.HandleFunc("/accounts", CreateAccount).Methods("POST")
+	r.HandleFunc("/accounts/{user_id}", GetAccounts).Methods("GET")
+	r.HandleFunc("/accounts/{id}/balance", GetAccountBalance).Methods("GET")
+	r.HandleFunc("/accounts/{id}/close", CloseAccount).Methods("POST")
+	r.HandleFunc("/accounts/{id}/reopen", ReopenAccount).Methods("POST")
+	r.HandleFunc("/accounts/{id}/adjust-balance", AdjustAccountBalance).Methods("POST")
+	r.HandleFunc("/accounts/{id}", UpdateAccount).Methods("PUT")
+	r.HandleFunc("/accounts/{id}", DeleteAccount).Methods("DELETE")
+	r.HandleFunc("/accounts/{id}/statement", GetCreditCardStatement).Methods("GET")
+	r.HandleFunc("/accounts/{id}/statement-payments", LinkStatementPayment).Methods("POST")
+	r.HandleFunc("/accounts/{id}/statement-payments/{transaction_id}", UnlinkStatementPayment).Methods("DELETE")
+
+	// --- Investment Routes ---
+	r.HandleFunc("/accounts/{id}/holdings", CreateHolding).Methods("POST")
+	r.HandleFunc("/accounts/{id}/holdings", GetPortfolio).Methods("GET")
+	r.HandleFunc("/accounts/{id}/valuations", GetInvestmentValuations).Methods("GET")
+	r.HandleFunc("/holdings/{id}", UpdateHolding).Methods("PUT")
+	r.HandleFunc("/holdings/{id}", DeleteHolding).Methods("DELETE")
+	r.HandleFunc("/security-prices", adminOnly(SetSecurityPrice)).Methods("POST")
+
+	// --- Loan Routes ---
+	r.HandleFunc("/accounts/{id}/amortization", GetAmortizationSchedule).Methods("GET")
+	r.HandleFunc("/accounts/{id}/loan-payments", LogLoanPayment).Methods("POST")
+	r.HandleFunc("/accounts/{id}/loan-payments", GetLoanPayments).Methods("GET")
+	r.HandleFunc("/accounts/{id}/loan-payoff", GetLoanPayoff).Methods("GET")
+
+	// --- Net Worth Routes ---
+	r.HandleFunc("/networth/{user_id}", GetNetWorth).Methods("GET")
+
+	// --- Exchange Rate Routes ---
+	r.HandleFunc("/exchange-rates", SetExchangeRate).Methods("POST")
+	r.HandleFunc("/exchange-rates/{user_id}", GetExchangeRates).Methods("GET")
+
+	// --- Budget Template Routes ---
+	r.HandleFunc("/budget-templates", CreateBudgetTemplate).Methods("POST")
+	r.HandleFunc("/budget-templates/{user_id}", GetBudgetTemplates).Methods("GET")
+	r.HandleFunc("/budget-templates/{id}", UpdateBudgetTemplate).Methods("PUT")
+	r.HandleFunc("/budget-templates/{id}", DeleteBudgetTemplate).Methods("DELETE")
 
 	// --- Sharing Routes ---
-	r.HandleFunc("/budgets/share", ShareBudget).Methods("POST")
+	r.HandleFunc("/budgets/share", idempotent(ShareBudget)).Methods("POST")
 	r.HandleFunc("/budgets/shared/{user_id}", GetSharedBudgets).Methods("GET")
+	r.HandleFunc("/budgets/shared/{id}/transactions", GetSharedBudgetTransactions).Methods("GET")
+	r.HandleFunc("/budgets/shares/{user_id}", GetShares).Methods("GET")
 	r.HandleFunc("/budgets/share/{id}", DeleteSharedBudget).Methods("DELETE") // To unshare
+	r.HandleFunc("/budgets/shares/{user_id}/with/{other_id}", RevokeSharesWithUser).Methods("DELETE")
+	r.HandleFunc("/budgets/{id}/shares", RevokeBudgetShares).Methods("DELETE")
+
+	// --- Settle-Up Routes ---
+	r.HandleFunc("/settle-ups", idempotent(RecordSettleUp)).Methods("POST")
+	r.HandleFunc("/settle-ups/{user_id}", GetOwedLedger).Methods("GET")
+	r.HandleFunc("/recurring-splits", GetRecurringSplits).Methods("GET")
+	r.HandleFunc("/recurring-splits", idempotent(CreateRecurringSplit)).Methods("POST")
+	r.HandleFunc("/recurring-splits/{id}", DeleteRecurringSplit).Methods("DELETE")
+	r.HandleFunc("/recurring-splits/{id}/accept", AcceptRecurringSplit).Methods("POST")
+	r.HandleFunc("/recurring-splits/{id}/participants/{user_id}", RemoveRecurringSplitParticipant).Methods("DELETE")
+
+	// --- Inbound Webhook Routes (HMAC-signed) ---
+	inbound := r.PathPrefix("/webhooks/inbound").Subrouter()
+	inbound.Use(verifyWebhookSignature)
+	inbound.HandleFunc("/{source}", ReceiveInboundWebhook).Methods("POST")
 
 	// CORS Configuration
 	allowedOrigin := os.Getenv("CORS_ORIGIN")
@@ -87,10 +411,17 @@ func main() {
 
 	allowedOrigins := handlers.AllowedOrigins([]string{allowedOrigin})
 	allowedMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
-	allowedHeaders := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	allowedHeaders := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "X-API-Key", "Idempotency-Key"})
+	exposedHeaders := handlers.ExposedHeaders([]string{"X-Total-Count", "X-Page", "X-Per-Page", "X-Next-Cursor", "Idempotent-Replayed",
+		categoryCapWarningHeader})
+	corsOptions := []handlers.CORSOption{allowedOrigins, allowedMethods, allowedHeaders, exposedHeaders}
+	if authMode == authModeSession {
+		// Browsers only send the session cookie cross-origin with credentials allowed
+		corsOptions = append(corsOptions, handlers.AllowCredentials())
+	}
 
 	log.Printf("Budgello server starting on :8080, allowing origin: %s", allowedOrigin)
-	log.Fatal(http.ListenAndServe(":8080", handlers.CORS(allowedOrigins, allowedMethods, allowedHeaders)(r)))
+	log.Fatal(http.ListenAndServe(":8080", handlers.CORS(corsOptions...)(r)))
 }
 
 func createAdminUser() error {
@@ -121,3 +452,13 @@ func createAdminUser() error {
 
 	return nil
 }
+
+// getEnvInt reads an integer from the environment, falling back to def when
+// the variable is unset or malformed.
+func getEnvInt(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
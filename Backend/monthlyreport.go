@@ -0,0 +1,116 @@
+// monthlyreport.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The monthly summary sets a month's income against its expenses. As with
+// income budgets, income is negative amounts that are not linked refunds;
+// everything else is spending, with refunds netted against it. Spending
+// excluded from budgets is left out of both.
+
+// --- MODELS ---
+type IncomeExpenseTotals struct {
+	Income   float64 `json:"income"`
+	Expenses float64 `json:"expenses"`
+	Net      float64 `json:"net"` // income - expenses
+}
+
+type MonthlyReport struct {
+	Month               string              `json:"month"` // YYYY-MM
+	IncomeExpenseTotals                     // the month's
+	Previous            IncomeExpenseTotals `json:"previous"`
+	IncomeChange        *float64            `json:"income_change_percent"`
+	ExpenseChange       *float64            `json:"expenses_change_percent"`
+	Categories          []CategorySummary   `json:"categories"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// incomeLineSQL is true of a transaction line l that is income.
+func incomeLineSQL(l string) string {
+	return l + ".amount < 0 AND " + l + ".linked_transaction_id IS NULL"
+}
+
+// newIncomeExpenseTotals rounds income and expenses and works out the net.
+func newIncomeExpenseTotals(income, expenses float64) IncomeExpenseTotals {
+	income, expenses = math.Round(income*100)/100, math.Round(expenses*100)/100
+	return IncomeExpenseTotals{Income: income, Expenses: expenses, Net: math.Round((income-expenses)*100) / 100}
+}
+
+// --- MONTHLY REPORT HANDLERS ---
+
+// GetMonthlyReport summarizes a user's personal income and spending for
+// ?month= (YYYY-MM, default the current month) with a breakdown of spending
+// per category, each next to the month before.
+func GetMonthlyReport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	start := monthStart(time.Now().UTC())
+	if v := r.URL.Query().Get("month"); v != "" {
+		if start, err = time.Parse("2006-01", v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "'month' must be in YYYY-MM format")
+			return
+		}
+	}
+	prev, end := start.AddDate(0, -1, 0), start.AddDate(0, 1, 0)
+	q := dbFor(r)
+
+	var income, expenses, prevIncome, prevExpenses float64
+	err = q.QueryRow(`
+        SELECT COALESCE(-SUM(l.amount) FILTER (WHERE l.date >= $2 AND `+incomeLineSQL("l")+`), 0),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.date >= $2 AND NOT (`+incomeLineSQL("l")+`)), 0),
+            COALESCE(-SUM(l.amount) FILTER (WHERE l.date < $2 AND `+incomeLineSQL("l")+`), 0),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.date < $2 AND NOT (`+incomeLineSQL("l")+`)), 0)
+        FROM transaction_lines l
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $3 AND l.date < $4`,
+		userID, start, prev, end).Scan(&income, &expenses, &prevIncome, &prevExpenses)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build monthly report")
+		return
+	}
+	report := MonthlyReport{Month: start.Format("2006-01"), IncomeExpenseTotals: newIncomeExpenseTotals(income, expenses),
+		Previous: newIncomeExpenseTotals(prevIncome, prevExpenses), Categories: []CategorySummary{}}
+	report.IncomeChange = percentChange(report.Previous.Income, report.Income)
+	report.ExpenseChange = percentChange(report.Previous.Expenses, report.Expenses)
+
+	rows, err := q.Query(`
+        SELECT l.category_id, COALESCE(c.name, 'Uncategorized'),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.date >= $2), 0), COUNT(DISTINCT l.transaction_id) FILTER (WHERE l.date >= $2),
+            COALESCE(SUM(l.amount) FILTER (WHERE l.date < $2), 0), COUNT(DISTINCT l.transaction_id) FILTER (WHERE l.date < $2)
+        FROM transaction_lines l
+        LEFT JOIN categories c ON c.id = l.category_id
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $3 AND l.date < $4
+          AND NOT (`+incomeLineSQL("l")+`)
+        GROUP BY l.category_id, c.name
+        ORDER BY 3 DESC, 2`, userID, start, prev, end)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build monthly report")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CategorySummary
+		if err := rows.Scan(&c.CategoryID, &c.Category, &c.Total, &c.Count, &c.PreviousTotal, &c.PreviousCount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan monthly report")
+			return
+		}
+		c.Change = math.Round((c.Total-c.PreviousTotal)*100) / 100
+		c.ChangePercent = percentChange(c.PreviousTotal, c.Total)
+		report.Categories = append(report.Categories, c)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,135 @@
+// networth.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Net worth is what a user's accounts hold less what they owe, in their base
+// currency. Credit cards and liabilities count as debts; everything else,
+// including manually valued assets and investment holdings, counts as
+// assets. Closed accounts no longer count, and nor do accounts in a
+// currency with no known exchange rate. A nightly job stores each user's
+// figures so the history can be charted.
+
+// netWorthSQL totals assets and liabilities per user from their accounts.
+// Manual values, balances and exchange rates are taken as they stand today.
+const netWorthSQL = `SELECT b.user_id,
+            COALESCE(SUM(b.balance * b.exchange_rate) FILTER (WHERE b.type NOT IN ` + liabilityTypesSQL + `), 0),
+            COALESCE(-SUM(b.balance * b.exchange_rate) FILTER (WHERE b.type IN ` + liabilityTypesSQL + `), 0)
+        FROM (` + accountSelectSQL + ` WHERE a.closed_at IS NULL GROUP BY a.id) b
+        GROUP BY b.user_id`
+
+// --- MODELS ---
+type NetWorth struct {
+	Date        time.Time `json:"date"`
+	Assets      float64   `json:"assets"`
+	Liabilities float64   `json:"liabilities"`
+	NetWorth    float64   `json:"net_worth"`
+}
+
+// NetWorthReport is a user's net worth today, the accounts that make it up,
+// and the stored history, all in Currency. MissingRates lists the currencies
+// of accounts left out for want of an exchange rate.
+type NetWorthReport struct {
+	Currency     string     `json:"currency"`
+	Current      NetWorth   `json:"current"`
+	Accounts     []Account  `json:"accounts"`
+	History      []NetWorth `json:"history"`
+	MissingRates []string   `json:"missing_rates,omitempty"`
+}
+
+// --- JOBS ---
+
+// snapshotNetWorth stores today's net worth for every user with accounts,
+// replacing an earlier snapshot from the same day.
+func snapshotNetWorth() error {
+	_, err := db.Exec(`INSERT INTO net_worth_snapshots (user_id, date, assets, liabilities)
+        SELECT n.user_id, CURRENT_DATE, n.assets, n.liabilities FROM (` + netWorthSQL + `) n (user_id, assets, liabilities)
+        ON CONFLICT (user_id, date) DO UPDATE SET assets = EXCLUDED.assets, liabilities = EXCLUDED.liabilities`)
+	return err
+}
+
+// --- NET WORTH HANDLERS ---
+
+// GetNetWorth returns a user's current net worth and its daily history
+// between ?from= and ?to= (default: the last year).
+func GetNetWorth(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", now.AddDate(-1, 0, 0))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", now)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+
+	report := NetWorthReport{Current: NetWorth{Date: dateOnly(now, now.Location())}, Accounts: []Account{}, History: []NetWorth{}}
+	if report.Currency, err = baseCurrency(dbFor(r), userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to look up base currency")
+		return
+	}
+	rows, err := dbFor(r).Query(accountSelectSQL+" WHERE a.user_id = $1 AND a.closed_at IS NULL GROUP BY a.id ORDER BY a.type IN "+liabilityTypesSQL+", a.name, a.id", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve accounts")
+		return
+	}
+	defer rows.Close()
+	var assets, liabilities int64
+	for rows.Next() {
+		var a Account
+		if err := scanAccount(rows, &a); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan account")
+			return
+		}
+		switch {
+		case a.BaseBalance == nil:
+			if !slices.Contains(report.MissingRates, a.Currency) {
+				report.MissingRates = append(report.MissingRates, a.Currency)
+			}
+		case isLiability(a.Type):
+			liabilities -= toCents(*a.BaseBalance)
+		default:
+			assets += toCents(*a.BaseBalance)
+		}
+		report.Accounts = append(report.Accounts, a)
+	}
+	report.Current.Assets, report.Current.Liabilities = float64(assets)/100, float64(liabilities)/100
+	report.Current.NetWorth = float64(assets-liabilities) / 100
+
+	history, err := dbFor(r).Query(`SELECT date, assets, liabilities FROM net_worth_snapshots
+        WHERE user_id = $1 AND date >= $2 AND date <= $3 ORDER BY date`, userID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve net worth history")
+		return
+	}
+	defer history.Close()
+	for history.Next() {
+		var n NetWorth
+		if err := history.Scan(&n.Date, &n.Assets, &n.Liabilities); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan net worth snapshot")
+			return
+		}
+		n.NetWorth = math.Round((n.Assets-n.Liabilities)*100) / 100
+		report.History = append(report.History, n)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
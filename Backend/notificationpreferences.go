@@ -0,0 +1,212 @@
+// notificationpreferences.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Everyone taking part in a budget - its owner, members and share
+// recipients - chooses which of its events they hear about. Without a saved
+// choice they get threshold alerts and member changes but no per-transaction
+// notices, which they opt into with a minimum amount.
+
+// budgetThresholds are the percentages of an expense budget's amount whose
+// crossing raises a threshold alert.
+var budgetThresholds = []float64{80, 100}
+
+// --- MODELS ---
+type NotificationPreferences struct {
+	BudgetID int `json:"budget_id"`
+	// TransactionsAbove notifies of new transactions counted towards the
+	// budget of at least this amount; nil turns these notices off. Share
+	// recipients only get them if their share shows transactions.
+	TransactionsAbove *float64 `json:"transactions_above"`
+	ThresholdAlerts   bool     `json:"threshold_alerts"`
+	MemberChanges     bool     `json:"member_changes"`
+}
+
+// budgetParticipant is someone taking part in a budget, with their
+// notification preferences for it.
+type budgetParticipant struct {
+	UserID           int
+	SeesTransactions bool
+	NotificationPreferences
+}
+
+// --- HELPER FUNCTIONS ---
+
+// budgetParticipants lists a budget's owner, accepted members and share
+// recipients with their preferences, or the defaults where they have none.
+func budgetParticipants(budgetID int) ([]budgetParticipant, error) {
+	rows, err := db.Query(`SELECT p.user_id, BOOL_OR(p.sees_transactions), np.transactions_above,
+            COALESCE(np.threshold_alerts, TRUE), COALESCE(np.member_changes, TRUE)
+        FROM (SELECT user_id, TRUE AS sees_transactions FROM budgets WHERE id = $1
+              UNION SELECT user_id, TRUE FROM budget_members WHERE budget_id = $1 AND accepted_at IS NOT NULL
+              UNION SELECT to_user_id, show_transactions FROM shared_budgets WHERE budget_id = $1) p
+        LEFT JOIN notification_preferences np ON np.budget_id = $1 AND np.user_id = p.user_id
+        GROUP BY p.user_id, np.transactions_above, np.threshold_alerts, np.member_changes`, budgetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	participants := []budgetParticipant{}
+	for rows.Next() {
+		p := budgetParticipant{NotificationPreferences: NotificationPreferences{BudgetID: budgetID}}
+		if err := rows.Scan(&p.UserID, &p.SeesTransactions, &p.TransactionsAbove, &p.ThresholdAlerts, &p.MemberChanges); err != nil {
+			return nil, err
+		}
+		participants = append(participants, p)
+	}
+	return participants, rows.Err()
+}
+
+// notifyMemberChange tells the budget's participants who want to hear about
+// member changes that actorID joined or left it.
+func notifyMemberChange(actorID int, kind string, budgetID int) {
+	participants, err := budgetParticipants(budgetID)
+	if err != nil {
+		log.Printf("Failed to look up participants of budget %d: %v", budgetID, err)
+		return
+	}
+	for _, p := range participants {
+		if p.MemberChanges {
+			notifyBudgetEvent(actorID, p.UserID, kind, budgetID)
+		}
+	}
+}
+
+// notifyTransactionCreated tells the participants of the personal expense
+// budgets t counts towards in their current period about it, as their
+// preferences ask, and raises a threshold alert on each budget it takes past
+// one of budgetThresholds.
+func notifyTransactionCreated(t Transaction) {
+	// The budgets and their other participants' spending are hidden by
+	// row-level security, so this reads through db.
+	rows, err := db.Query(`SELECT `+budgetColumns+` FROM budgets
+        WHERE organization_id IS NULL AND archived_at IS NULL AND kind = $2
+          AND (user_id = $1 OR id IN (SELECT budget_id FROM budget_members WHERE user_id = $1 AND accepted_at IS NOT NULL))`,
+		t.UserID, budgetKindExpense)
+	if err != nil {
+		log.Printf("Failed to look up budgets for transaction %d: %v", t.ID, err)
+		return
+	}
+	budgets := []Budget{}
+	for rows.Next() {
+		var b Budget
+		if err := scanBudget(rows, &b); err != nil {
+			log.Printf("Failed to scan budget for transaction %d: %v", t.ID, err)
+			rows.Close()
+			return
+		}
+		budgets = append(budgets, b)
+	}
+	rows.Close()
+
+	for _, b := range budgets {
+		from, to, err := budgetPeriod(b, time.Now())
+		if err != nil || t.Date.Before(from) || !t.Date.Before(to) {
+			continue
+		}
+		var counted float64
+		err = db.QueryRow(`SELECT COALESCE(ROUND(SUM(`+budgetAmountSQL("l", "$3", "$4")+`), 2), 0) FROM transaction_lines l
+            WHERE transaction_id = $1 AND NOT excluded AND `+budgetApprovedSQL("$2"),
+			append([]interface{}{t.ID, b.ID}, budgetCurrencyArgs(b)...)...).Scan(&counted)
+		if err != nil || counted <= 0 {
+			continue
+		}
+		spent, err := budgetSpent(db, b, from, to)
+		if err != nil {
+			log.Printf("Failed to compute spending of budget %d: %v", b.ID, err)
+			continue
+		}
+		participants, err := budgetParticipants(b.ID)
+		if err != nil {
+			log.Printf("Failed to look up participants of budget %d: %v", b.ID, err)
+			continue
+		}
+		crossed := 0.0
+		if b.Amount > 0 {
+			for _, pct := range budgetThresholds {
+				limit := b.Amount * pct / 100
+				if spent-counted < limit && spent >= limit {
+					crossed = pct
+				}
+			}
+		}
+		for _, p := range participants {
+			if p.SeesTransactions && p.TransactionsAbove != nil && t.Amount >= *p.TransactionsAbove {
+				notifyBudgetEvent(t.UserID, p.UserID, notifyTransaction, b.ID, t.Description, t.Amount)
+			}
+			if crossed > 0 && p.ThresholdAlerts {
+				notifyBudgetEvent(t.UserID, p.UserID, notifyThreshold, b.ID, crossed)
+			}
+		}
+	}
+}
+
+// --- NOTIFICATION PREFERENCE HANDLERS ---
+
+// GetNotificationPreferences returns the caller's preferences for a budget
+// they can see, or the defaults if they have saved none.
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	u, _ := currentUser(r)
+	prefs := NotificationPreferences{BudgetID: budgetID, ThresholdAlerts: true, MemberChanges: true}
+	err = db.QueryRow("SELECT transactions_above, threshold_alerts, member_changes FROM notification_preferences WHERE budget_id=$1 AND user_id=$2",
+		budgetID, u.ID).Scan(&prefs.TransactionsAbove, &prefs.ThresholdAlerts, &prefs.MemberChanges)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve notification preferences")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, prefs)
+}
+
+// UpdateNotificationPreferences saves the caller's preferences for a budget
+// they can see. Fields left out of the request keep their defaults.
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	u, _ := currentUser(r)
+	prefs := NotificationPreferences{ThresholdAlerts: true, MemberChanges: true}
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	prefs.BudgetID = budgetID
+	if prefs.TransactionsAbove != nil && *prefs.TransactionsAbove < 0 {
+		respondWithError(w, http.StatusBadRequest, "transactions_above cannot be negative")
+		return
+	}
+	_, err = db.Exec(`INSERT INTO notification_preferences (budget_id, user_id, transactions_above, threshold_alerts, member_changes)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (budget_id, user_id) DO UPDATE SET transactions_above = EXCLUDED.transactions_above,
+            threshold_alerts = EXCLUDED.threshold_alerts, member_changes = EXCLUDED.member_changes`,
+		budgetID, u.ID, prefs.TransactionsAbove, prefs.ThresholdAlerts, prefs.MemberChanges)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save notification preferences")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, prefs)
+}
@@ -0,0 +1,217 @@
+// notifications.go
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notifications tell users about things others did that concern them, such
+// as sharing a budget with them. Each one is kept in-app until read, and
+// mailed as well to users who have given an email address when a mail
+// provider is configured.
+
+// Notification kinds.
+const (
+	notifyShared        = "budget_shared"
+	notifyUnshared      = "budget_unshared"
+	notifyMemberInvited = "member_invited"
+	notifyMemberJoined  = "member_joined"
+	notifyMemberRemoved = "member_removed"
+	notifyMemberLeft    = "member_left"
+	notifyTransaction   = "budget_transaction"
+	notifyThreshold     = "budget_threshold"
+	notifyMentioned     = "mentioned"
+
+	notifyApprovalRequested   = "approval_requested"
+	notifyTransactionApproved = "transaction_approved"
+	notifyTransactionRejected = "transaction_rejected"
+)
+
+// notificationMessages formats each kind's message from the actor's
+// username and the budget's name, followed by any details of the event.
+var notificationMessages = map[string]string{
+	notifyShared:        "%s shared the budget %q with you",
+	notifyUnshared:      "%s ended the share of the budget %q",
+	notifyMemberInvited: "%s invited you to join the budget %q",
+	notifyMemberJoined:  "%s joined the budget %q",
+	notifyMemberRemoved: "%s removed you from the budget %q",
+	notifyMemberLeft:    "%s left the budget %q",
+	notifyTransaction:   "%s added a transaction to the budget %q: %s for %.2f",
+	notifyThreshold:     "%s's spending took the budget %q to %.0f%% of its amount",
+	notifyMentioned:     "%s mentioned you on the budget %q: %s",
+
+	notifyApprovalRequested:   "%s asks you to approve a transaction on the budget %q: %s for %.2f",
+	notifyTransactionApproved: "%s approved your transaction on the budget %q: %s",
+	notifyTransactionRejected: "%s rejected your transaction on the budget %q: %s",
+}
+
+// --- MAIL PROVIDER ---
+
+// mailProvider delivers a plain-text email. Implementations wrap an
+// external mail service.
+type mailProvider interface {
+	Send(to, subject, body string) error
+}
+
+type httpMailProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (p *httpMailProvider) Send(to, subject, body string) error {
+	payload, err := json.Marshal(map[string]string{"to": to, "subject": subject, "text": body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("mail provider returned %s", resp.Status)
+	}
+	return nil
+}
+
+// mailer is the configured provider, or nil when MAIL_PROVIDER_URL is unset.
+var mailer mailProvider
+
+func initMailProvider() {
+	url := os.Getenv("MAIL_PROVIDER_URL")
+	if url == "" {
+		log.Println("MAIL_PROVIDER_URL not set; notifications will not be emailed.")
+		return
+	}
+	mailer = &httpMailProvider{url: url, apiKey: os.Getenv("MAIL_API_KEY"), client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// --- MODELS ---
+type Notification struct {
+	ID        int        `json:"id"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	BudgetID  *int       `json:"budget_id,omitempty"`
+	ActorID   *int       `json:"actor_id,omitempty"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// notifyBudgetEvent tells userID that actorID did something of the given
+// kind to a budget; details fill in the rest of the kind's message. Users
+// are not told about their own actions. Like audit entries, notifications
+// never fail the change they report; failures are logged.
+func notifyBudgetEvent(actorID, userID int, kind string, budgetID int, details ...interface{}) {
+	if actorID == userID {
+		return
+	}
+	var actor, budget string
+	var email sql.NullString
+	err := db.QueryRow("SELECT (SELECT username FROM users WHERE id=$1), (SELECT name FROM budgets WHERE id=$2), (SELECT email FROM users WHERE id=$3)",
+		actorID, budgetID, userID).Scan(&actor, &budget, &email)
+	if err != nil {
+		log.Printf("Failed to look up %s notification for user %d: %v", kind, userID, err)
+		return
+	}
+	message := fmt.Sprintf(notificationMessages[kind], append([]interface{}{actor, budget}, details...)...)
+	_, err = db.Exec("INSERT INTO notifications (user_id, kind, message, budget_id, actor_id) VALUES ($1, $2, $3, $4, $5)",
+		userID, kind, message, budgetID, actorID)
+	if err != nil {
+		log.Printf("Failed to write %s notification for user %d: %v", kind, userID, err)
+		return
+	}
+	if mailer != nil && email.Valid {
+		go func() {
+			if err := mailer.Send(email.String, "Budgello: "+message, message+"."); err != nil {
+				log.Printf("Failed to email %s notification to user %d: %v", kind, userID, err)
+			}
+		}()
+	}
+}
+
+// --- NOTIFICATION HANDLERS ---
+
+// GetNotifications lists the caller's notifications, newest first; with
+// ?unread=true only those not yet read.
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := "SELECT id, kind, message, budget_id, actor_id, read_at, created_at FROM notifications WHERE user_id=$1"
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	rows, err := db.Query(query+" ORDER BY created_at DESC, id DESC", caller.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve notifications")
+		return
+	}
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Message, &n.BudgetID, &n.ActorID, &n.ReadAt, &n.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan notification")
+			return
+		}
+		notifications = append(notifications, n)
+	}
+	respondWithJSON(w, http.StatusOK, notifications)
+}
+
+func MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	params := mux.Vars(r)
+	notificationID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid notification ID")
+		return
+	}
+	res, err := db.Exec("UPDATE notifications SET read_at = COALESCE(read_at, NOW()) WHERE id=$1 AND user_id=$2", notificationID, caller.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update notification")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Notification not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Notification marked as read"})
+}
+
+func MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("UPDATE notifications SET read_at = NOW() WHERE user_id=$1 AND read_at IS NULL", caller.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update notifications")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Notifications marked as read"})
+}
@@ -0,0 +1,520 @@
+// organizations.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	orgRoleAdmin  = "admin"
+	orgRoleMember = "member"
+)
+
+// --- MODELS ---
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"` // caller's role in the organization
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrganizationMember struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type OrganizationInvitation struct {
+	ID               int       `json:"id"`
+	OrganizationID   int       `json:"organization_id"`
+	OrganizationName string    `json:"organization_name,omitempty"`
+	UserID           int       `json:"user_id"`
+	Role             string    `json:"role"`
+	InvitedBy        int       `json:"invited_by"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func orgMemberRole(orgID, userID int) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM organization_members WHERE organization_id=$1 AND user_id=$2", orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// authorizeOrgRole checks the caller belongs to the organization with at
+// least the required role. Site admins may act on any organization.
+func authorizeOrgRole(w http.ResponseWriter, r *http.Request, orgID int, required string) bool {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return false
+	}
+	if u.Role == "admin" {
+		return true
+	}
+	role, err := orgMemberRole(orgID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify organization membership")
+		return false
+	}
+	if role == "" {
+		respondWithError(w, http.StatusForbidden, "You are not a member of this organization")
+		return false
+	}
+	if required == orgRoleAdmin && role != orgRoleAdmin {
+		respondWithError(w, http.StatusForbidden, "Organization admin access required")
+		return false
+	}
+	return true
+}
+
+func orgIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	orgID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid organization ID")
+		return 0, false
+	}
+	return orgID, true
+}
+
+// --- ORGANIZATION HANDLERS ---
+
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var o Organization
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil || strings.TrimSpace(o.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	err := withTx(r, func(q queryer) error {
+		err := q.QueryRow("INSERT INTO organizations (name) VALUES ($1) RETURNING id, created_at", o.Name).Scan(&o.ID, &o.CreatedAt)
+		if err != nil {
+			return err
+		}
+		// The creator administers the new organization
+		_, err = q.Exec("INSERT INTO organization_members (organization_id, user_id, role) VALUES ($1, $2, $3)", o.ID, u.ID, orgRoleAdmin)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create organization")
+		return
+	}
+	o.Role = orgRoleAdmin
+	respondWithJSON(w, http.StatusCreated, o)
+}
+
+func GetOrganizations(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT o.id, o.name, m.role, o.created_at
+        FROM organizations o
+        JOIN organization_members m ON m.organization_id = o.id
+        WHERE m.user_id = $1
+        ORDER BY o.name`
+	rows, err := db.Query(query, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve organizations")
+		return
+	}
+	defer rows.Close()
+	var orgs []Organization
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Role, &o.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan organization")
+			return
+		}
+		orgs = append(orgs, o)
+	}
+	respondWithJSON(w, http.StatusOK, orgs)
+}
+
+func GetOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleMember) {
+		return
+	}
+	query := `
+        SELECT m.user_id, u.username, m.role, m.joined_at
+        FROM organization_members m
+        JOIN users u ON u.id = m.user_id
+        WHERE m.organization_id = $1
+        ORDER BY u.username`
+	rows, err := db.Query(query, orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve members")
+		return
+	}
+	defer rows.Close()
+	var members []OrganizationMember
+	for rows.Next() {
+		var m OrganizationMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.JoinedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan member")
+			return
+		}
+		members = append(members, m)
+	}
+	respondWithJSON(w, http.StatusOK, members)
+}
+
+// RemoveOrganizationMember removes a member. Org admins can remove anyone;
+// members can only remove themselves (leave).
+func RemoveOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	required := orgRoleAdmin
+	if u.ID == userID {
+		required = orgRoleMember
+	}
+	if !authorizeOrgRole(w, r, orgID, required) {
+		return
+	}
+	var remainingAdmins int
+	err = db.QueryRow("SELECT COUNT(*) FROM organization_members WHERE organization_id=$1 AND role='admin' AND user_id<>$2", orgID, userID).Scan(&remainingAdmins)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	if remainingAdmins == 0 {
+		respondWithError(w, http.StatusBadRequest, "An organization must keep at least one admin")
+		return
+	}
+	res, err := db.Exec("DELETE FROM organization_members WHERE organization_id=$1 AND user_id=$2", orgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Member not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Member removed successfully"})
+}
+
+// --- INVITATION HANDLERS ---
+
+func InviteToOrganization(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleAdmin) {
+		return
+	}
+	u, _ := currentUser(r)
+	var inv OrganizationInvitation
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if inv.Role == "" {
+		inv.Role = orgRoleMember
+	}
+	if inv.Role != orgRoleAdmin && inv.Role != orgRoleMember {
+		respondWithError(w, http.StatusBadRequest, "Role must be 'admin' or 'member'")
+		return
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=$1 AND NOT is_service)", inv.UserID).Scan(&exists)
+	if err != nil || !exists {
+		respondWithError(w, http.StatusBadRequest, "User to invite does not exist.")
+		return
+	}
+	if role, err := orgMemberRole(orgID, inv.UserID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify organization membership")
+		return
+	} else if role != "" {
+		respondWithError(w, http.StatusBadRequest, "User is already a member of this organization")
+		return
+	}
+	inv.OrganizationID = orgID
+	inv.InvitedBy = u.ID
+	err = db.QueryRow(`INSERT INTO organization_invitations (organization_id, user_id, role, invited_by)
+        VALUES ($1, $2, $3, $4) RETURNING id, status, created_at`,
+		inv.OrganizationID, inv.UserID, inv.Role, inv.InvitedBy).Scan(&inv.ID, &inv.Status, &inv.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, inv)
+}
+
+func GetOrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT i.id, i.organization_id, o.name, i.user_id, i.role, COALESCE(i.invited_by, 0), i.status, i.created_at
+        FROM organization_invitations i
+        JOIN organizations o ON o.id = i.organization_id
+        WHERE i.user_id = $1 AND i.status = 'pending'
+        ORDER BY i.created_at DESC`
+	rows, err := db.Query(query, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve invitations")
+		return
+	}
+	defer rows.Close()
+	var invitations []OrganizationInvitation
+	for rows.Next() {
+		var inv OrganizationInvitation
+		if err := rows.Scan(&inv.ID, &inv.OrganizationID, &inv.OrganizationName, &inv.UserID, &inv.Role, &inv.InvitedBy, &inv.Status, &inv.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan invitation")
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+	respondWithJSON(w, http.StatusOK, invitations)
+}
+
+func AcceptOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	respondToInvitation(w, r, true)
+}
+
+func DeclineOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	respondToInvitation(w, r, false)
+}
+
+func respondToInvitation(w http.ResponseWriter, r *http.Request, accept bool) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	invitationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+	status := "declined"
+	if accept {
+		status = "accepted"
+	}
+	err = withTx(r, func(q queryer) error {
+		var orgID int
+		var role string
+		err := q.QueryRow(`SELECT organization_id, role FROM organization_invitations
+            WHERE id=$1 AND user_id=$2 AND status='pending' FOR UPDATE`, invitationID, u.ID).Scan(&orgID, &role)
+		if err != nil {
+			return err
+		}
+		if accept {
+			_, err = q.Exec(`INSERT INTO organization_members (organization_id, user_id, role) VALUES ($1, $2, $3)
+                ON CONFLICT (organization_id, user_id) DO NOTHING`, orgID, u.ID, role)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = q.Exec("UPDATE organization_invitations SET status=$1 WHERE id=$2", status, invitationID)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Invitation not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update invitation")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Invitation " + status})
+}
+
+// --- ORGANIZATION LEDGER HANDLERS ---
+
+func CreateOrganizationCategory(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleAdmin) {
+		return
+	}
+	u, _ := currentUser(r)
+	var c Category
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	c.UserID = u.ID
+	c.OrganizationID = &orgID
+	if !validateCategoryParent(w, 0, c.ParentID, resourceRef{OwnerID: u.ID, OrgID: sql.NullInt64{Int64: int64(orgID), Valid: true}}) {
+		return
+	}
+	err := dbFor(r).QueryRow("INSERT INTO categories (user_id, organization_id, name, parent_id, exclude_from_budget) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		c.UserID, orgID, c.Name, c.ParentID, c.ExcludeFromBudget).Scan(&c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create category. It may already exist for this organization.")
+		return
+	}
+	recordAudit(r, "category", c.ID, auditCreate, nil)
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+func GetOrganizationCategories(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleMember) {
+		return
+	}
+	rows, err := dbFor(r).Query("SELECT id, user_id, organization_id, name, parent_id, exclude_from_budget FROM categories WHERE organization_id=$1", orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve categories")
+		return
+	}
+	defer rows.Close()
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.UserID, &c.OrganizationID, &c.Name, &c.ParentID, &c.ExcludeFromBudget); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan category")
+			return
+		}
+		categories = append(categories, c)
+	}
+	respondWithJSON(w, http.StatusOK, categories)
+}
+
+func CreateOrganizationTransaction(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleMember) {
+		return
+	}
+	u, _ := currentUser(r)
+	var t Transaction
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	t.UserID = u.ID
+	t.OrganizationID = &orgID
+	ref := resourceRef{OwnerID: t.UserID, OrgID: sql.NullInt64{Int64: int64(orgID), Valid: true}}
+	if !authorizeCategory(w, t.CategoryID, ref) ||
+		!validateTransactionStatus(w, &t) || !validateLocation(w, t) || !applyCurrency(w, dbFor(r), &t) {
+		return
+	}
+	if t.Date.IsZero() {
+		t.Date = time.Now()
+	}
+	if !authorizeUnlockedDates(w, r, ref, t.Date) {
+		return
+	}
+	err := dbFor(r).QueryRow(`INSERT INTO transactions (user_id, organization_id, description, amount, date, category_id, status, notes, latitude, longitude,
+            currency, original_amount, exchange_rate, exclude_from_budget)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id`,
+		t.UserID, orgID, t.Description, t.Amount, t.Date, t.CategoryID, t.Status, t.Notes, t.Latitude, t.Longitude,
+		t.Currency, t.OriginalAmount, t.ExchangeRate, t.ExcludeFromBudget).Scan(&t.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create transaction")
+		return
+	}
+	recordAudit(r, "transaction", t.ID, auditCreate, nil)
+	respondWithJSON(w, http.StatusCreated, t)
+}
+
+func GetOrganizationTransactions(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleMember) {
+		return
+	}
+	rows, err := dbFor(r).Query("SELECT "+transactionColumns+" FROM transactions WHERE organization_id=$1 AND deleted_at IS NULL ORDER BY date DESC", orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
+		return
+	}
+	defer rows.Close()
+	var transactions []Transaction
+	for rows.Next() {
+		var t Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	respondWithJSON(w, http.StatusOK, transactions)
+}
+
+func CreateOrganizationBudget(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleAdmin) {
+		return
+	}
+	u, _ := currentUser(r)
+	var b Budget
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	b.UserID = u.ID
+	b.OrganizationID = &orgID
+	if !validateBudgetPeriod(w, b) || !validateBudgetKind(w, &b) || !validateBudgetCurrency(w, dbFor(r), b.UserID, &b) {
+		return
+	}
+	query := `
+        INSERT INTO budgets (user_id, organization_id, period, end_date, frequency, amount, rollover, name, description, notes, kind,
+            currency, exchange_rate)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        ON CONFLICT (organization_id, kind, frequency) WHERE organization_id IS NOT NULL AND frequency <> 'custom'
+        DO UPDATE SET amount = EXCLUDED.amount, period = EXCLUDED.period, rollover = EXCLUDED.rollover,
+            name = EXCLUDED.name, description = EXCLUDED.description, notes = EXCLUDED.notes,
+            currency = EXCLUDED.currency, exchange_rate = EXCLUDED.exchange_rate,
+            closed_through = CASE WHEN budgets.archived_at IS NULL THEN budgets.closed_through END, archived_at = NULL
+        RETURNING id, xmax = 0
+    `
+	var inserted bool
+	err := dbFor(r).QueryRow(query, b.UserID, orgID, b.Period, b.EndDate, b.Frequency, b.Amount, b.Rollover, b.Name, b.Description, b.Notes, b.Kind,
+		b.Currency, b.ExchangeRate).Scan(&b.ID, &inserted)
+	if err != nil {
+		log.Printf("Error creating/updating organization budget: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create or update budget")
+		return
+	}
+	recordAudit(r, "budget", b.ID, upsertAction(inserted), nil)
+	respondWithJSON(w, http.StatusCreated, b)
+}
+
+func GetOrganizationBudgets(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := orgIDFromPath(w, r)
+	if !ok || !authorizeOrgRole(w, r, orgID, orgRoleMember) {
+		return
+	}
+	rows, err := dbFor(r).Query("SELECT "+budgetColumns+" FROM budgets WHERE organization_id=$1"+archivedBudgetFilter(r, "archived_at"), orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budgets")
+		return
+	}
+	defer rows.Close()
+	var budgets []Budget
+	for rows.Next() {
+		var b Budget
+		if err := scanBudget(rows, &b); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan budget")
+			return
+		}
+		budgets = append(budgets, b)
+	}
+	respondWithJSON(w, http.StatusOK, budgets)
+}
@@ -0,0 +1,437 @@
+// payees.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type Payee struct {
+	ID               int    `json:"id"`
+	UserID           int    `json:"user_id"`
+	Name             string `json:"name"`
+	TransactionCount int    `json:"transaction_count"`
+}
+
+type PayeeAlias struct {
+	PayeeID    int    `json:"payee_id"`
+	Descriptor string `json:"descriptor"`
+}
+
+type PayeeSpending struct {
+	PayeeID *int    `json:"payee_id"`
+	Payee   string  `json:"payee"`
+	Total   float64 `json:"total"`
+	Count   int     `json:"count"`
+}
+
+// TopPayee is a payee's spending with the average expense there.
+type TopPayee struct {
+	PayeeSpending
+	Average float64 `json:"average"`
+}
+
+// topPayeeOrders maps the ?sort= values of the top payees report to their
+// ORDER BY expressions.
+var topPayeeOrders = map[string]string{
+	"total":   "SUM(l.amount) DESC",
+	"count":   "COUNT(DISTINCT t.id) FILTER (WHERE t.linked_transaction_id IS NULL) DESC",
+	"average": "SUM(l.amount) / NULLIF(COUNT(DISTINCT t.id) FILTER (WHERE t.linked_transaction_id IS NULL), 0) DESC NULLS LAST",
+}
+
+// --- NORMALIZATION ---
+
+// descriptorPrefixes are payment-processor and card-network noise that banks
+// put in front of the merchant name.
+var descriptorPrefixes = []string{"SQ *", "SQ*", "TST* ", "TST*", "PAYPAL *", "PP*", "POS ", "DEBIT ", "PURCHASE ", "CHECKCARD "}
+
+// knownMerchants maps the start of a cleaned descriptor to a canonical name.
+var knownMerchants = []struct {
+	prefix string
+	name   string
+}{
+	{"AMZN", "Amazon"},
+	{"AMAZON", "Amazon"},
+	{"WAL-MART", "Walmart"},
+	{"WALMART", "Walmart"},
+	{"WM SUPERCENTER", "Walmart"},
+	{"COSTCO", "Costco"},
+	{"TARGET", "Target"},
+	{"STARBUCKS", "Starbucks"},
+	{"MCDONALD", "McDonald's"},
+	{"UBER", "Uber"},
+	{"LYFT", "Lyft"},
+	{"NETFLIX", "Netflix"},
+	{"SPOTIFY", "Spotify"},
+	{"APPLE.COM", "Apple"},
+	{"GOOGLE", "Google"},
+}
+
+// normalizeDescriptor turns a raw bank descriptor such as "AMZN Mktp US*1234"
+// into a stable lookup key ("AMZN MKTP") and a display name ("Amazon").
+// Processor prefixes, reference numbers after '*' or '#', and tokens
+// containing digits are dropped.
+func normalizeDescriptor(raw string) (key, name string) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	for _, prefix := range descriptorPrefixes {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	if i := strings.IndexAny(s, "*#"); i > 0 {
+		s = s[:i]
+	}
+	var words []string
+	for _, word := range strings.Fields(s) {
+		if strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			continue
+		}
+		words = append(words, word)
+	}
+	if n := len(words); n > 1 && words[n-1] == "US" {
+		words = words[:n-1]
+	}
+	key = strings.Join(words, " ")
+	if key == "" {
+		return "", ""
+	}
+	for _, m := range knownMerchants {
+		if strings.HasPrefix(key, m.prefix) {
+			return key, m.name
+		}
+	}
+	for i, word := range words {
+		words[i] = word[:1] + strings.ToLower(word[1:])
+	}
+	return key, strings.Join(words, " ")
+}
+
+// resolvePayee finds or creates the payee for a transaction description,
+// remembering the descriptor so later transactions map the same way. It
+// returns nil when the description has nothing usable.
+func resolvePayee(q queryer, userID int, description string) (*int, error) {
+	key, name := normalizeDescriptor(description)
+	if key == "" {
+		return nil, nil
+	}
+	var payeeID int
+	err := q.QueryRow("SELECT payee_id FROM payee_aliases WHERE user_id=$1 AND descriptor=$2", userID, key).Scan(&payeeID)
+	if err == nil {
+		return &payeeID, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	err = q.QueryRow(`INSERT INTO payees (user_id, name) VALUES ($1, $2)
+        ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
+        RETURNING id`, userID, name).Scan(&payeeID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = q.Exec("INSERT INTO payee_aliases (user_id, descriptor, payee_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", userID, key, payeeID)
+	if err != nil {
+		return nil, err
+	}
+	return &payeeID, nil
+}
+
+// authorizePayee rejects payees outside the given user's ledger. A nil
+// payeeID is not checked.
+func authorizePayee(w http.ResponseWriter, payeeID *int, ownerID int) bool {
+	if payeeID == nil {
+		return true
+	}
+	owner, err := resourceOwner("payee", *payeeID)
+	if err == sql.ErrNoRows || (err == nil && owner != ownerID) {
+		respondWithError(w, http.StatusBadRequest, "Invalid payee")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify payee")
+		return false
+	}
+	return true
+}
+
+// --- PAYEE HANDLERS ---
+
+func CreatePayee(w http.ResponseWriter, r *http.Request) {
+	var p Payee
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || strings.TrimSpace(p.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &p.UserID) {
+		return
+	}
+	err := dbFor(r).QueryRow("INSERT INTO payees (user_id, name) VALUES ($1, $2) RETURNING id", p.UserID, p.Name).Scan(&p.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create payee. It may already exist for this user.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+// GetPayees lists a user's payees, most used first. ?q= filters by name
+// prefix for autocomplete.
+func GetPayees(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	query := `
+        SELECT p.id, p.user_id, p.name, COUNT(t.id)
+        FROM payees p
+        LEFT JOIN transactions t ON t.payee_id = p.id AND t.deleted_at IS NULL
+        WHERE p.user_id = $1 AND LOWER(p.name) LIKE LOWER($2) || '%'
+        GROUP BY p.id
+        ORDER BY COUNT(t.id) DESC, p.name
+        LIMIT 50`
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(r.URL.Query().Get("q"))
+	rows, err := dbFor(r).Query(query, userID, prefix)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve payees")
+		return
+	}
+	defer rows.Close()
+	var payees []Payee
+	for rows.Next() {
+		var p Payee
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.TransactionCount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan payee")
+			return
+		}
+		payees = append(payees, p)
+	}
+	respondWithJSON(w, http.StatusOK, payees)
+}
+
+func UpdatePayee(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	payeeID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid payee ID")
+		return
+	}
+	if !authorizeResource(w, r, "payee", payeeID) {
+		return
+	}
+	var p Payee
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || strings.TrimSpace(p.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	_, err = dbFor(r).Exec("UPDATE payees SET name=$1 WHERE id=$2", p.Name, payeeID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update payee. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Payee updated successfully"})
+}
+
+func DeletePayee(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	payeeID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid payee ID")
+		return
+	}
+	if !authorizeResource(w, r, "payee", payeeID) {
+		return
+	}
+	_, err = dbFor(r).Exec("DELETE FROM payees WHERE id=$1", payeeID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete payee")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Payee deleted successfully"})
+}
+
+// AddPayeeAlias teaches the normalizer that a raw descriptor belongs to this
+// payee, e.g. mapping "SQ *BLUE BOTTLE 123" to an existing "Blue Bottle".
+func AddPayeeAlias(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	payeeID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid payee ID")
+		return
+	}
+	if !authorizeResource(w, r, "payee", payeeID) {
+		return
+	}
+	var a PayeeAlias
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	key, _ := normalizeDescriptor(a.Descriptor)
+	if key == "" {
+		respondWithError(w, http.StatusBadRequest, "Descriptor is empty after normalization")
+		return
+	}
+	ownerID, err := resourceOwner("payee", payeeID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify payee")
+		return
+	}
+	_, err = dbFor(r).Exec(`INSERT INTO payee_aliases (user_id, descriptor, payee_id) VALUES ($1, $2, $3)
+        ON CONFLICT (user_id, descriptor) DO UPDATE SET payee_id = EXCLUDED.payee_id`, ownerID, key, payeeID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save alias")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, PayeeAlias{PayeeID: payeeID, Descriptor: key})
+}
+
+// GetPayeeReport totals a user's personal spending per payee for a date
+// range (default: the current month). Linked refunds are netted against the
+// original expense's payee unless ?refunds=gross. Spending excluded from
+// budgets is left out.
+func GetPayeeReport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	mode, ok := refundReportMode(w, r)
+	if !ok {
+		return
+	}
+	query := `
+        SELECT p.id, COALESCE(p.name, 'Unknown'), SUM(l.amount), COUNT(DISTINCT t.id)
+        FROM transaction_lines l
+        JOIN transactions t ON t.id = l.transaction_id
+        LEFT JOIN transactions o ON o.id = t.linked_transaction_id
+        LEFT JOIN payees p ON p.id = CASE WHEN o.id IS NULL THEN t.payee_id ELSE o.payee_id END
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3::date + 1`
+	if mode == "gross" {
+		query += " AND t.linked_transaction_id IS NULL"
+	}
+	query += `
+        GROUP BY p.id, p.name
+        ORDER BY SUM(l.amount) DESC`
+	rows, err := dbFor(r).Query(query, userID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build report")
+		return
+	}
+	defer rows.Close()
+	report := []PayeeSpending{}
+	for rows.Next() {
+		var p PayeeSpending
+		if err := rows.Scan(&p.PayeeID, &p.Payee, &p.Total, &p.Count); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan report row")
+			return
+		}
+		report = append(report, p)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// GetTopPayees ranks the payees of a user's personal spending over a date
+// range (default: the current month) by ?sort= ('total', 'count' or
+// 'average'; default total), returning the first ?limit= (default 10, at
+// most 100). Count is the number of expenses, not refunds, and Average is
+// the total over that count. Spending without a payee is left out; refunds
+// work as in the payee report.
+func GetTopPayees(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	mode, ok := refundReportMode(w, r)
+	if !ok {
+		return
+	}
+	sort := r.URL.Query().Get("sort")
+	if sort == "" {
+		sort = "total"
+	}
+	order, ok := topPayeeOrders[sort]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "'sort' must be 'total', 'count' or 'average'")
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 100 {
+			respondWithError(w, http.StatusBadRequest, "'limit' must be between 1 and 100")
+			return
+		}
+	}
+	query := `
+        SELECT p.id, p.name, SUM(l.amount), COUNT(DISTINCT t.id) FILTER (WHERE t.linked_transaction_id IS NULL)
+        FROM transaction_lines l
+        JOIN transactions t ON t.id = l.transaction_id
+        LEFT JOIN transactions o ON o.id = t.linked_transaction_id
+        JOIN payees p ON p.id = CASE WHEN o.id IS NULL THEN t.payee_id ELSE o.payee_id END
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3::date + 1
+          AND NOT (` + incomeLineSQL("l") + `)`
+	if mode == "gross" {
+		query += " AND t.linked_transaction_id IS NULL"
+	}
+	query += `
+        GROUP BY p.id, p.name
+        ORDER BY ` + order + `, p.name
+        LIMIT $4`
+	rows, err := dbFor(r).Query(query, userID, from, to, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build report")
+		return
+	}
+	defer rows.Close()
+	report := []TopPayee{}
+	for rows.Next() {
+		var p TopPayee
+		if err := rows.Scan(&p.PayeeID, &p.Payee, &p.Total, &p.Count); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan report row")
+			return
+		}
+		if p.Count > 0 {
+			p.Average = math.Round(p.Total/float64(p.Count)*100) / 100
+		}
+		report = append(report, p)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
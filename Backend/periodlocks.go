@@ -0,0 +1,290 @@
+// periodlocks.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// A closed budget period is locked: transactions dated in it, in the
+// budget's ledger, and the owner's allocations for months overlapping it
+// can no longer be changed except by admins, so reports on the period stay
+// as they were when it was closed. Locks live on the budget_periods
+// snapshot and are read through db, since the lock applies whoever can see
+// the budget.
+
+// lockedPeriodSQL is an EXISTS condition that is true when a locked period
+// in the ledger of ownerCol/orgCol covers dateCol.
+func lockedPeriodSQL(dateCol, ownerCol, orgCol string) string {
+	return `EXISTS (SELECT 1 FROM budget_periods p JOIN budgets b ON b.id = p.budget_id
+        WHERE p.locked_at IS NOT NULL AND ` + dateCol + `::date BETWEEN p.period_start AND p.period_end
+          AND ((` + orgCol + ` IS NULL AND b.organization_id IS NULL AND b.user_id = ` + ownerCol + `) OR b.organization_id = ` + orgCol + `))`
+}
+
+var errPeriodLocked = errors.New("period is closed")
+
+// --- MODELS ---
+
+// PeriodCloseRequest picks the period containing Date, or by default the
+// last one to have ended.
+type PeriodCloseRequest struct {
+	Date *time.Time `json:"date"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func isAdmin(r *http.Request) bool {
+	u, ok := currentUser(r)
+	return ok && u.Role == "admin"
+}
+
+func respondPeriodLocked(w http.ResponseWriter, date time.Time) {
+	respondWithError(w, http.StatusLocked, "The budget period containing "+date.Format("2006-01-02")+" is closed")
+}
+
+// authorizeUnlockedDates refuses, with 423, changes dated in a locked period
+// of ref's ledger. Admins may change locked periods.
+func authorizeUnlockedDates(w http.ResponseWriter, r *http.Request, ref resourceRef, dates ...time.Time) bool {
+	if isAdmin(r) {
+		return true
+	}
+	for _, date := range dates {
+		var locked bool
+		err := db.QueryRow("SELECT "+lockedPeriodSQL("$1", "$2", "$3::INTEGER"), date, ref.OwnerID, ref.OrgID).Scan(&locked)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to check for closed periods")
+			return false
+		}
+		if locked {
+			respondPeriodLocked(w, date)
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeTransactionUnlocked refuses changes to a transaction dated in a
+// locked period.
+func authorizeTransactionUnlocked(w http.ResponseWriter, r *http.Request, transactionID int) bool {
+	if isAdmin(r) {
+		return true
+	}
+	var date time.Time
+	var locked bool
+	err := db.QueryRow(`SELECT t.date, `+lockedPeriodSQL("t.date", "t.user_id", "t.organization_id")+`
+        FROM transactions t WHERE t.id=$1`, transactionID).Scan(&date, &locked)
+	if err == sql.ErrNoRows {
+		return true // the handler reports the missing transaction
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check for closed periods")
+		return false
+	}
+	if locked {
+		respondPeriodLocked(w, date)
+		return false
+	}
+	return true
+}
+
+// firstLockedTransaction returns the date of the earliest of ids that falls
+// in a locked period, if any.
+func firstLockedTransaction(q queryer, ids []int64) (time.Time, bool, error) {
+	var date sql.NullTime
+	err := q.QueryRow(`SELECT MIN(t.date) FROM transactions t WHERE t.id = ANY($1) AND `+
+		lockedPeriodSQL("t.date", "t.user_id", "t.organization_id"), pq.Array(ids)).Scan(&date)
+	return date.Time, date.Valid, err
+}
+
+// checkBulkUnlocked fails a bulk change that touches a transaction in a
+// locked period, setting lockedOn to its date.
+func checkBulkUnlocked(r *http.Request, q queryer, ids []int64, lockedOn **time.Time) error {
+	if isAdmin(r) {
+		return nil
+	}
+	date, locked, err := firstLockedTransaction(q, ids)
+	if err != nil {
+		return err
+	}
+	if locked {
+		*lockedOn = &date
+		return errPeriodLocked
+	}
+	return nil
+}
+
+// authorizeAllocationUnlocked refuses changes to userID's allocations for a
+// month that overlaps a locked period of their personal budgets.
+func authorizeAllocationUnlocked(w http.ResponseWriter, r *http.Request, userID int, month time.Time) bool {
+	if isAdmin(r) {
+		return true
+	}
+	var locked bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM budget_periods p JOIN budgets b ON b.id = p.budget_id
+        WHERE p.locked_at IS NOT NULL AND b.user_id = $1 AND b.organization_id IS NULL
+          AND p.period_start < $2::date + INTERVAL '1 month' AND p.period_end >= $2::date)`, userID, month).Scan(&locked)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check for closed periods")
+		return false
+	}
+	if locked {
+		respondWithError(w, http.StatusLocked, "Allocations for "+month.Format("2006-01")+" are in a closed budget period")
+		return false
+	}
+	return true
+}
+
+// closingPeriod resolves the period a close or reopen request refers to.
+func closingPeriod(w http.ResponseWriter, r *http.Request, budgetID int) (Budget, time.Time, time.Time, bool) {
+	var req PeriodCloseRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return Budget{}, time.Time{}, time.Time{}, false
+		}
+	}
+	var b Budget
+	err := scanBudget(db.QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &b)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return Budget{}, time.Time{}, time.Time{}, false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return Budget{}, time.Time{}, time.Time{}, false
+	}
+	now := time.Now()
+	start, end, err := budgetPeriod(b, now)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return Budget{}, time.Time{}, time.Time{}, false
+	}
+	if req.Date != nil {
+		start, end, _ = budgetPeriod(b, time.Date(req.Date.Year(), req.Date.Month(), req.Date.Day(), 12, 0, 0, 0, now.Location()))
+	} else if b.Frequency != frequencyCustom {
+		start, end, _ = budgetPeriod(b, start.AddDate(0, 0, -1))
+	}
+	return b, start, end, true
+}
+
+// --- PERIOD CLOSE HANDLERS ---
+
+// ClosePeriod closes and locks one ended period of a budget: its numbers are
+// snapshotted as they stand, overwriting any earlier snapshot's spending,
+// and the period is locked against further edits.
+func ClosePeriod(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	b, start, end, ok := closingPeriod(w, r, budgetID)
+	if !ok {
+		return
+	}
+	if end.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "Only periods that have ended can be closed")
+		return
+	}
+	if b.ArchivedAt == nil {
+		// Let the close job snapshot, roll over and sweep the period first,
+		// so closing it here only has to lock it.
+		var carryover float64
+		var closedThrough sql.NullTime
+		err := db.QueryRow("SELECT carryover, closed_through FROM budgets WHERE id=$1", b.ID).Scan(&carryover, &closedThrough)
+		if err == nil {
+			err = closeElapsedPeriods(b, carryover, closedThrough, time.Now())
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to close period")
+			return
+		}
+	}
+	u, _ := currentUser(r)
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to close period")
+		return
+	}
+	defer tx.Rollback()
+	spent, err := budgetSpent(tx, b, start, end)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate spending")
+		return
+	}
+	var p BudgetPeriodRecord
+	err = tx.QueryRow(`INSERT INTO budget_periods (budget_id, period_start, period_end, frequency, budgeted, spent, locked_at, locked_by)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7)
+        ON CONFLICT (budget_id, period_start) DO UPDATE SET spent = EXCLUDED.spent, locked_at = EXCLUDED.locked_at, locked_by = EXCLUDED.locked_by
+            WHERE budget_periods.locked_at IS NULL
+        RETURNING period_start, period_end, frequency, budgeted, carryover, spent, locked_at`,
+		b.ID, start, end.AddDate(0, 0, -1), b.Frequency, b.Amount, spent, u.ID).
+		Scan(&p.PeriodStart, &p.PeriodEnd, &p.Frequency, &p.Budgeted, &p.Carryover, &p.Spent, &p.LockedAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusConflict, "This period is already closed")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to close period")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to close period")
+		return
+	}
+	available := p.Budgeted + p.Carryover
+	if available != 0 {
+		p.PercentUsed = math.Round(p.Spent/available*10000) / 100
+	}
+	p.WithinLimit = p.Spent <= available
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// ReopenPeriod unlocks a closed period. Only admins can reopen one.
+func ReopenPeriod(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !isAdmin(r) {
+		respondWithError(w, http.StatusForbidden, "Only admins can reopen a closed period")
+		return
+	}
+	_, start, _, ok := closingPeriod(w, r, budgetID)
+	if !ok {
+		return
+	}
+	err = withTx(r, func(q queryer) error {
+		before := snapshotResource(q, "budget", budgetID)
+		res, err := q.Exec("UPDATE budget_periods SET locked_at = NULL, locked_by = NULL WHERE budget_id=$1 AND period_start=$2 AND locked_at IS NOT NULL",
+			budgetID, start)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+		u, _ := currentUser(r)
+		writeAudit(q, u.ID, "budget", budgetID, auditUpdate, before)
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "This period is not closed")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reopen period")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Period reopened successfully"})
+}
@@ -0,0 +1,244 @@
+// periods.go
+package main
+
+import (
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+
+// BudgetPeriodRecord is the final result of one ended budget period, as
+// snapshotted when it closed.
+type BudgetPeriodRecord struct {
+	PeriodStart time.Time  `json:"period_start"`
+	PeriodEnd   time.Time  `json:"period_end"` // last day of the period, inclusive
+	Frequency   string     `json:"frequency"`
+	Budgeted    float64    `json:"budgeted"`
+	Carryover   float64    `json:"carryover"`
+	Spent       float64    `json:"spent"`
+	PercentUsed float64    `json:"percent_used"`
+	WithinLimit bool       `json:"within_limit"`
+	LockedAt    *time.Time `json:"locked_at,omitempty"` // set once the period is closed
+}
+
+// --- HELPER FUNCTIONS ---
+
+// sweepToGoal records what was left under budget in a period ending at end
+// as a contribution to the budget's linked savings goal. Nothing is
+// recorded for a period that ended on or over budget.
+func sweepToGoal(tx *sql.Tx, b Budget, end time.Time, leftover float64) error {
+	leftover = math.Round(leftover*budgetRate(b)*100) / 100
+	if leftover <= 0 {
+		return nil
+	}
+	label := b.Name
+	if label == "" {
+		label = b.Frequency + " budget"
+	}
+	_, err := tx.Exec(`INSERT INTO sinking_fund_contributions (fund_id, amount, date, note, budget_id)
+        VALUES ($1, $2, $3, $4, $5)`, *b.SinkingFundID, leftover, end.AddDate(0, 0, -1), "Unspent from "+label, b.ID)
+	return err
+}
+
+// --- JOBS ---
+
+// closeBudgetPeriods closes every budget period that has ended since the
+// budget's closed_through: it snapshots budgeted vs actual into
+// budget_periods. Unspent money (never a deficit) is swept into the
+// budget's linked savings goal if it has one, or else carried into the next
+// period for rollover budgets. A budget seen for the first time starts from
+// its current period, with no history or carryover. Each budget's period is
+// also advanced to the start of its current period, so clients reading it
+// never see a stale one. Archived budgets are skipped.
+func closeBudgetPeriods() error {
+	rows, err := db.Query("SELECT " + budgetColumns + ", carryover, closed_through FROM budgets WHERE archived_at IS NULL")
+	if err != nil {
+		return err
+	}
+	type openBudget struct {
+		Budget
+		carryover     float64
+		closedThrough sql.NullTime
+	}
+	var budgets []openBudget
+	for rows.Next() {
+		var b openBudget
+		if err := scanBudget(rows, &b.Budget, &b.carryover, &b.closedThrough); err != nil {
+			rows.Close()
+			return err
+		}
+		budgets = append(budgets, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, b := range budgets {
+		if err := closeElapsedPeriods(b.Budget, b.carryover, b.closedThrough, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeElapsedPeriods snapshots whatever periods of b have ended since it
+// was last closed.
+func closeElapsedPeriods(b Budget, carryover float64, closedThrough sql.NullTime, now time.Time) error {
+	if b.Frequency == frequencyCustom {
+		return closeCustomBudget(b, closedThrough, now)
+	}
+	current, _, err := budgetPeriod(b, now)
+	if err != nil {
+		log.Printf("budget %d: %v", b.ID, err)
+		return nil
+	}
+	return closeBudget(b, carryover, closedThrough, current, now)
+}
+
+// closeBudget snapshots and rolls over each of b's periods from
+// closedThrough up to current, and renews b's period, in one transaction.
+func closeBudget(b Budget, carryover float64, closedThrough sql.NullTime, current, now time.Time) error {
+	// A period set in the future is left alone until it begins.
+	anchor := time.Date(b.Period.Year(), b.Period.Month(), b.Period.Day(), 0, 0, 0, 0, now.Location())
+	renewed := anchor
+	if current.After(anchor) {
+		renewed = current
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	carry := 0.0
+	if closedThrough.Valid {
+		through := time.Date(closedThrough.Time.Year(), closedThrough.Time.Month(), closedThrough.Time.Day(), 0, 0, 0, 0, now.Location())
+		if through.Equal(current) && renewed.Equal(anchor) {
+			return nil
+		}
+		carry = carryover
+		for through.Before(current) {
+			start, end, _ := budgetPeriod(b, through)
+			if !start.Equal(through) {
+				// The budget was re-anchored; its old periods no longer
+				// line up, so history resumes from now.
+				break
+			}
+			spent, err := budgetSpent(tx, b, start, end)
+			if err != nil {
+				return err
+			}
+			res, err := tx.Exec(`INSERT INTO budget_periods (budget_id, period_start, period_end, frequency, budgeted, carryover, spent)
+                VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (budget_id, period_start) DO NOTHING`,
+				b.ID, start, end.AddDate(0, 0, -1), b.Frequency, b.Amount, carry, spent)
+			if err != nil {
+				return err
+			}
+			if b.SinkingFundID != nil {
+				// Money swept into a savings goal can't also roll over.
+				if n, _ := res.RowsAffected(); n == 1 {
+					if err := sweepToGoal(tx, b, end, b.Amount+carry-spent); err != nil {
+						return err
+					}
+				}
+				carry = 0
+			} else if b.Rollover {
+				carry = math.Max(math.Round((b.Amount+carry-spent)*100)/100, 0)
+			} else {
+				carry = 0
+			}
+			through = end
+		}
+		if !through.Equal(current) {
+			carry = 0
+		}
+	}
+	// The closed_through guard skips the write if the budget was edited
+	// while this ran; the next run starts from the new state.
+	_, err = tx.Exec(`UPDATE budgets SET carryover=$1, closed_through=$2, period=$3
+        WHERE id=$4 AND closed_through IS NOT DISTINCT FROM $5 AND period=$6`,
+		carry, current, renewed, b.ID, closedThrough, b.Period)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// closeCustomBudget snapshots a custom budget's single period once it has
+// ended. Custom budgets neither renew nor roll over.
+func closeCustomBudget(b Budget, closedThrough sql.NullTime, now time.Time) error {
+	start, end, err := budgetPeriod(b, now)
+	if err != nil || now.Before(end) || closedThrough.Valid {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	spent, err := budgetSpent(tx, b, start, end)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`INSERT INTO budget_periods (budget_id, period_start, period_end, frequency, budgeted, spent)
+        VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (budget_id, period_start) DO NOTHING`,
+		b.ID, start, end.AddDate(0, 0, -1), b.Frequency, b.Amount, spent)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 1 && b.SinkingFundID != nil {
+		if err := sweepToGoal(tx, b, end, b.Amount-spent); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE budgets SET closed_through=$1 WHERE id=$2", end, b.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// --- BUDGET HISTORY HANDLERS ---
+
+// GetBudgetHistory lists a budget's closed periods, newest first, with the
+// amounts as they stood when each period ended.
+func GetBudgetHistory(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	rows, err := db.Query(`SELECT period_start, period_end, frequency, budgeted, carryover, spent, locked_at
+        FROM budget_periods WHERE budget_id=$1 ORDER BY period_start DESC`, budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget history")
+		return
+	}
+	defer rows.Close()
+	history := []BudgetPeriodRecord{}
+	for rows.Next() {
+		var p BudgetPeriodRecord
+		if err := rows.Scan(&p.PeriodStart, &p.PeriodEnd, &p.Frequency, &p.Budgeted, &p.Carryover, &p.Spent, &p.LockedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan budget period")
+			return
+		}
+		available := p.Budgeted + p.Carryover
+		if available != 0 {
+			p.PercentUsed = math.Round(p.Spent/available*10000) / 100
+		}
+		p.WithinLimit = p.Spent <= available
+		history = append(history, p)
+	}
+	respondWithJSON(w, http.StatusOK, history)
+}
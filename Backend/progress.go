@@ -0,0 +1,184 @@
+// progress.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type BudgetProgress struct {
+	BudgetID    int       `json:"budget_id"`
+	Frequency   string    `json:"frequency"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"` // last day of the period, inclusive
+	Budgeted    float64   `json:"budgeted"`
+	Carryover   float64   `json:"carryover"` // unspent money rolled over from earlier periods
+	Available   float64   `json:"available"` // budgeted plus carryover
+	Spent       float64   `json:"spent"`
+	Remaining   float64   `json:"remaining"`
+	PercentUsed float64   `json:"percent_used"`
+	DaysLeft    int       `json:"days_left"`
+	// Pace compares spending with an even rate across the period.
+	ExpectedSpend  float64 `json:"expected_spend"`  // spent by now at an even rate
+	Pace           string  `json:"pace"`            // "ahead", "behind" or "on_track"
+	DailyAllowance float64 `json:"daily_allowance"` // per remaining day, today included, to end on budget
+	// Contributions splits Spent between the owner and members of a group budget.
+	Contributions []BudgetContribution `json:"contributions,omitempty"`
+}
+
+// paceTolerance is the share of the available amount spending may differ
+// from the expected spend and still count as on track; "ahead" means
+// spending faster than that.
+const paceTolerance = 0.05
+
+// --- HELPER FUNCTIONS ---
+
+// budgetPace fills in the pace fields of p for a period [start, end) as of
+// now.
+func budgetPace(p *BudgetProgress, start, end, now time.Time) {
+	elapsed := now.Sub(start).Hours() / end.Sub(start).Hours()
+	elapsed = math.Min(math.Max(elapsed, 0), 1)
+	p.ExpectedSpend = math.Round(p.Available*elapsed*100) / 100
+	switch diff := p.Spent - p.ExpectedSpend; {
+	case diff > math.Abs(p.Available)*paceTolerance:
+		p.Pace = "ahead"
+	case diff < -math.Abs(p.Available)*paceTolerance:
+		p.Pace = "behind"
+	default:
+		p.Pace = "on_track"
+	}
+	if p.DaysLeft > 0 && p.Remaining > 0 {
+		p.DailyAllowance = math.Floor(p.Remaining/float64(p.DaysLeft)*100) / 100
+	}
+}
+
+// budgetSpent sums the spending a budget covers between from and to: the
+// personal transactions of the owner and the budget's members, or the
+// organization's for an organization budget. For an income budget it sums the income received instead. The
+// total is in the budget's currency.
+func budgetSpent(q queryer, b Budget, from, to time.Time) (float64, error) {
+	ledger, args := budgetLedgerSQL("$4"), []interface{}{b.UserID, from, to, b.ID}
+	if b.OrganizationID != nil {
+		ledger, args = "organization_id = $1", []interface{}{*b.OrganizationID, from, to}
+	}
+	amount := budgetAmountSQL("l", fmt.Sprintf("$%d", len(args)+1), fmt.Sprintf("$%d", len(args)+2))
+	sum, filter := "SUM("+amount+")", ""
+	if b.Kind == budgetKindIncome {
+		sum, filter = "-"+sum, " AND amount < 0 AND linked_transaction_id IS NULL"
+	}
+	var spent float64
+	err := q.QueryRow(`SELECT COALESCE(ROUND(`+sum+`, 2), 0) FROM transaction_lines l
+        WHERE `+ledger+` AND NOT excluded AND date >= $2 AND date < $3`+filter,
+		append(args, budgetCurrencyArgs(b)...)...).Scan(&spent)
+	return spent, err
+}
+
+// --- BUDGET PROGRESS HANDLERS ---
+
+// progressError is why a budget's progress couldn't be computed, with the
+// status to respond with.
+type progressError struct {
+	status  int
+	message string
+}
+
+func (e *progressError) Error() string { return e.message }
+
+// computeBudgetProgress compares spending in the budget's current period
+// with the budgeted amount. Personal budgets count the personal transactions
+// of the owner and any members, organization budgets the organization's.
+// Rollover budgets add the carryover closed into the current period. Errors
+// are *progressError.
+func computeBudgetProgress(budgetID int) (Budget, BudgetProgress, error) {
+	// Share recipients can't see the owner's transactions under row-level
+	// security, so this reads through db; callers check access first.
+	var b Budget
+	var carryover float64
+	var closedThrough sql.NullTime
+	err := scanBudget(db.QueryRow("SELECT "+budgetColumns+", carryover, closed_through FROM budgets WHERE id=$1", budgetID),
+		&b, &carryover, &closedThrough)
+	if err == sql.ErrNoRows {
+		return b, BudgetProgress{}, &progressError{http.StatusNotFound, "Budget not found"}
+	} else if err != nil {
+		return b, BudgetProgress{}, &progressError{http.StatusInternalServerError, "Failed to retrieve budget"}
+	}
+	if b.Kind == budgetKindIncome {
+		return b, BudgetProgress{}, &progressError{http.StatusUnprocessableEntity, "Income budgets are tracked by the income report"}
+	}
+	now := time.Now()
+	start, end, err := budgetPeriod(b, now)
+	if err != nil {
+		return b, BudgetProgress{}, &progressError{http.StatusUnprocessableEntity, err.Error()}
+	}
+
+	spent, err := budgetSpent(db, b, start, end)
+	if err != nil {
+		return b, BudgetProgress{}, &progressError{http.StatusInternalServerError, "Failed to calculate spending"}
+	}
+
+	progress := BudgetProgress{
+		BudgetID:    b.ID,
+		Frequency:   b.Frequency,
+		PeriodStart: start,
+		PeriodEnd:   end.AddDate(0, 0, -1),
+		Budgeted:    b.Amount,
+		Spent:       spent,
+		DaysLeft:    int(math.Max(math.Ceil(end.Sub(now).Hours()/24), 0)),
+	}
+	// Carryover only counts once the close job has rolled it into this
+	// period; until then it still belongs to the previous one.
+	if b.Rollover && closedThrough.Valid && closedThrough.Time.Format("2006-01-02") == start.Format("2006-01-02") {
+		progress.Carryover = carryover
+	}
+	progress.Available = b.Amount + progress.Carryover
+	progress.Remaining = math.Round((progress.Available-spent)*100) / 100
+	if progress.Available != 0 {
+		progress.PercentUsed = math.Round(spent/progress.Available*10000) / 100
+	}
+	budgetPace(&progress, start, end, now)
+	if b.OrganizationID == nil {
+		contributions, err := budgetContributions(db, b, start, end)
+		if err != nil {
+			return b, BudgetProgress{}, &progressError{http.StatusInternalServerError, "Failed to calculate contributions"}
+		}
+		if len(contributions) > 1 {
+			progress.Contributions = contributions
+		}
+	}
+	return b, progress, nil
+}
+
+// loadBudgetProgress is computeBudgetProgress for handlers: it responds with
+// the error and returns false if progress can't be computed.
+func loadBudgetProgress(w http.ResponseWriter, budgetID int) (Budget, BudgetProgress, bool) {
+	b, progress, err := computeBudgetProgress(budgetID)
+	if err != nil {
+		e := err.(*progressError)
+		respondWithError(w, e.status, e.message)
+		return b, progress, false
+	}
+	return b, progress, true
+}
+
+// GetBudgetProgress reports the progress of a budget the caller can view.
+func GetBudgetProgress(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	if _, progress, ok := loadBudgetProgress(w, budgetID); ok {
+		respondWithJSON(w, http.StatusOK, progress)
+	}
+}
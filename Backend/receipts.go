@@ -0,0 +1,322 @@
+// receipts.go
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxReceiptBytes   = 10 << 20
+	receiptBatchSize  = 10
+	receiptClaimLease = 10 * time.Minute
+)
+
+// ocrProvider turns a receipt image into plain text. Implementations wrap
+// an external OCR service.
+type ocrProvider interface {
+	RecognizeText(image []byte, contentType string) (string, error)
+}
+
+// httpOCRProvider posts the raw image to OCR_PROVIDER_URL and expects a JSON
+// response of the form {"text": "..."}.
+type httpOCRProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (p *httpOCRProvider) RecognizeText(image []byte, contentType string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(image))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OCR provider returned %s", resp.Status)
+	}
+	var out struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Text, nil
+}
+
+// ocr is the configured provider, or nil when OCR_PROVIDER_URL is unset.
+var ocr ocrProvider
+
+func initOCRProvider() {
+	url := os.Getenv("OCR_PROVIDER_URL")
+	if url == "" {
+		log.Println("OCR_PROVIDER_URL not set; receipt uploads will not be processed.")
+		return
+	}
+	ocr = &httpOCRProvider{url: url, apiKey: os.Getenv("OCR_API_KEY"), client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// --- MODELS ---
+type Receipt struct {
+	ID          int                    `json:"id"`
+	UserID      int                    `json:"user_id"`
+	Status      string                 `json:"status"`
+	Error       string                 `json:"error,omitempty"`
+	Suggestion  *TransactionSuggestion `json:"suggestion,omitempty"`
+	CreatedAt   time.Time              `json:"created_at"`
+	ProcessedAt *time.Time             `json:"processed_at,omitempty"`
+}
+
+// TransactionSuggestion is what OCR extracted, shaped like a transaction so
+// the client can confirm it with POST /transactions.
+type TransactionSuggestion struct {
+	UserID      int        `json:"user_id"`
+	Description string     `json:"description"`
+	Amount      *float64   `json:"amount"`
+	Date        *time.Time `json:"date"`
+}
+
+// --- RECEIPT PARSING ---
+
+var (
+	receiptAmountPattern = regexp.MustCompile(`\d{1,3}(?:,\d{3})*\.\d{2}|\d+\.\d{2}`)
+	receiptDatePatterns  = []struct {
+		re     *regexp.Regexp
+		layout string
+	}{
+		{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`), "2006-01-02"},
+		{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{4}\b`), "1/2/2006"},
+		{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{2}\b`), "1/2/06"},
+	}
+)
+
+// parseReceiptText pulls the merchant (first non-empty line), the first
+// recognisable date, and the total from OCR output. The total is the last
+// amount on a line mentioning "total" (ignoring subtotals), falling back to
+// the largest amount on the receipt.
+func parseReceiptText(text string) (merchant string, date *time.Time, total *float64) {
+	var largest float64
+	found := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if merchant == "" {
+			merchant = line
+		}
+		if date == nil {
+			for _, p := range receiptDatePatterns {
+				if m := p.re.FindString(line); m != "" {
+					if d, err := time.Parse(p.layout, m); err == nil {
+						date = &d
+						break
+					}
+				}
+			}
+		}
+		amounts := receiptAmountPattern.FindAllString(line, -1)
+		for _, a := range amounts {
+			v, err := strconv.ParseFloat(strings.ReplaceAll(a, ",", ""), 64)
+			if err == nil && (!found || v > largest) {
+				largest, found = v, true
+			}
+		}
+		lower := strings.ToLower(line)
+		if len(amounts) > 0 && strings.Contains(lower, "total") && !strings.Contains(lower, "subtotal") {
+			if v, err := strconv.ParseFloat(strings.ReplaceAll(amounts[len(amounts)-1], ",", ""), 64); err == nil {
+				total = &v
+			}
+		}
+	}
+	if total == nil && found {
+		total = &largest
+	}
+	return merchant, date, total
+}
+
+// --- WORKER ---
+
+// processReceipts claims a batch of pending receipts (or ones whose worker
+// lease expired) and runs them through the OCR provider.
+func processReceipts() error {
+	if ocr == nil {
+		return nil
+	}
+	rows, err := db.Query(`
+        UPDATE receipts SET status = 'processing', claimed_at = NOW()
+        WHERE id IN (
+            SELECT id FROM receipts
+            WHERE status = 'pending' OR (status = 'processing' AND claimed_at < $1)
+            ORDER BY created_at
+            LIMIT $2
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, image, content_type`, time.Now().Add(-receiptClaimLease), receiptBatchSize)
+	if err != nil {
+		return err
+	}
+	type claimed struct {
+		id          int
+		image       []byte
+		contentType string
+	}
+	var batch []claimed
+	for rows.Next() {
+		var c claimed
+		if err := rows.Scan(&c.id, &c.image, &c.contentType); err != nil {
+			rows.Close()
+			return err
+		}
+		batch = append(batch, c)
+	}
+	rows.Close()
+
+	for _, c := range batch {
+		text, err := ocr.RecognizeText(c.image, c.contentType)
+		if err != nil {
+			log.Printf("OCR failed for receipt %d: %v", c.id, err)
+			if _, err := db.Exec("UPDATE receipts SET status='failed', error=$1, processed_at=NOW() WHERE id=$2", err.Error(), c.id); err != nil {
+				log.Printf("Failed to record OCR failure for receipt %d: %v", c.id, err)
+			}
+			continue
+		}
+		merchant, date, total := parseReceiptText(text)
+		_, err = db.Exec(`UPDATE receipts SET status='done', raw_text=$1, merchant=$2, receipt_date=$3, total=$4, processed_at=NOW()
+            WHERE id=$5`, text, merchant, date, total, c.id)
+		if err != nil {
+			log.Printf("Failed to save OCR result for receipt %d: %v", c.id, err)
+		}
+	}
+	return nil
+}
+
+// --- RECEIPT HANDLERS ---
+
+// UploadReceipt accepts a receipt image, either as the "image" field of a
+// multipart form or as the raw request body, and queues it for OCR.
+func UploadReceipt(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxReceiptBytes)
+	var image []byte
+	var contentType string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("image")
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Missing 'image' file")
+			return
+		}
+		defer file.Close()
+		if image, err = io.ReadAll(file); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Receipt image is too large")
+			return
+		}
+		contentType = header.Header.Get("Content-Type")
+	} else {
+		var err error
+		if image, err = io.ReadAll(r.Body); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Receipt image is too large")
+			return
+		}
+		contentType = r.Header.Get("Content-Type")
+	}
+	if len(image) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Receipt image is empty")
+		return
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(image)
+	}
+	if !strings.HasPrefix(contentType, "image/") && contentType != "application/pdf" {
+		respondWithError(w, http.StatusBadRequest, "Receipt must be an image or PDF")
+		return
+	}
+
+	receipt := Receipt{UserID: u.ID}
+	err := db.QueryRow("INSERT INTO receipts (user_id, image, content_type) VALUES ($1, $2, $3) RETURNING id, status, created_at",
+		u.ID, image, contentType).Scan(&receipt.ID, &receipt.Status, &receipt.CreatedAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to store receipt")
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, receipt)
+}
+
+// GetReceipt reports processing status and, once done, the suggested
+// transaction.
+func GetReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid receipt ID")
+		return
+	}
+	var receipt Receipt
+	var errMsg, merchant sql.NullString
+	var date *time.Time
+	var total *float64
+	err = db.QueryRow(`SELECT id, user_id, status, error, merchant, receipt_date, total, created_at, processed_at
+        FROM receipts WHERE id=$1`, receiptID).Scan(&receipt.ID, &receipt.UserID, &receipt.Status, &errMsg, &merchant, &date, &total, &receipt.CreatedAt, &receipt.ProcessedAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Receipt not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve receipt")
+		return
+	}
+	if !authorizeOwner(w, r, receipt.UserID) {
+		return
+	}
+	receipt.Error = errMsg.String
+	if receipt.Status == "done" {
+		receipt.Suggestion = &TransactionSuggestion{UserID: receipt.UserID, Description: merchant.String, Amount: total, Date: date}
+	}
+	respondWithJSON(w, http.StatusOK, receipt)
+}
+
+func DeleteReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid receipt ID")
+		return
+	}
+	var ownerID int
+	err = db.QueryRow("SELECT user_id FROM receipts WHERE id=$1", receiptID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Receipt not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve receipt")
+		return
+	}
+	if !authorizeOwner(w, r, ownerID) {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM receipts WHERE id=$1", receiptID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete receipt")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Receipt deleted successfully"})
+}
@@ -0,0 +1,189 @@
+// reconcile.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Transaction statuses. New transactions start pending; the user marks them
+// cleared once they appear on a statement, and reconciliation locks them in.
+const (
+	statusPending    = "pending"
+	statusCleared    = "cleared"
+	statusReconciled = "reconciled"
+)
+
+// --- MODELS ---
+type ReconciliationRequest struct {
+	UserID           int     `json:"user_id"`
+	From             string  `json:"from"`
+	To               string  `json:"to"`
+	OpeningBalance   float64 `json:"opening_balance"`
+	StatementBalance float64 `json:"statement_balance"`
+	DryRun           bool    `json:"dry_run"`
+}
+
+type Reconciliation struct {
+	ID               int       `json:"id,omitempty"`
+	UserID           int       `json:"user_id"`
+	AccountID        *int      `json:"account_id,omitempty"` // set when finished through a session
+	From             string    `json:"from"`
+	To               string    `json:"to"`
+	OpeningBalance   float64   `json:"opening_balance"`
+	StatementBalance float64   `json:"statement_balance"`
+	ClearedTotal     float64   `json:"cleared_total"`
+	ClearedCount     int       `json:"cleared_count"`
+	Difference       float64   `json:"difference"`
+	Reconciled       bool      `json:"reconciled"`
+	CreatedAt        time.Time `json:"created_at,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// validateTransactionStatus defaults an empty status to pending and rejects
+// anything other than pending or cleared; only reconciliation may set
+// reconciled.
+func validateTransactionStatus(w http.ResponseWriter, t *Transaction) bool {
+	if t.Status == "" {
+		t.Status = statusPending
+	}
+	if t.Status != statusPending && t.Status != statusCleared {
+		respondWithError(w, http.StatusBadRequest, "Status must be 'pending' or 'cleared'")
+		return false
+	}
+	return true
+}
+
+// --- RECONCILIATION HANDLERS ---
+
+// ReconcileTransactions compares a statement's ending balance with the
+// opening balance plus the user's cleared transactions dated within the
+// statement period. When they agree to the cent, those transactions are
+// marked reconciled; otherwise nothing changes and the difference is
+// returned with 409 so the user can find the missing or extra entries.
+func ReconcileTransactions(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req ReconciliationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &req.UserID) {
+		return
+	}
+	from, err := time.Parse("2006-01-02", req.From)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := time.Parse("2006-01-02", req.To)
+	if err != nil || to.Before(from) {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+
+	result := Reconciliation{
+		UserID:           req.UserID,
+		From:             req.From,
+		To:               req.To,
+		OpeningBalance:   req.OpeningBalance,
+		StatementBalance: req.StatementBalance,
+	}
+	err = withTx(r, func(q queryer) error {
+		rows, err := q.Query(`SELECT id, amount FROM transactions
+            WHERE user_id = $1 AND organization_id IS NULL AND deleted_at IS NULL AND status = $2 AND date >= $3 AND date < $4
+            FOR UPDATE`, req.UserID, statusCleared, from, to.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		var cents int64
+		for rows.Next() {
+			var id int64
+			var amount float64
+			if err := rows.Scan(&id, &amount); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			cents += toCents(amount)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		result.ClearedCount = len(ids)
+		result.ClearedTotal = float64(cents) / 100
+		diff := toCents(req.StatementBalance) - toCents(req.OpeningBalance) - cents
+		result.Difference = float64(diff) / 100
+		if diff != 0 || req.DryRun {
+			return nil
+		}
+		for _, id := range ids {
+			before := snapshotResource(q, "transaction", int(id))
+			if _, err := q.Exec("UPDATE transactions SET status = $1 WHERE id = $2", statusReconciled, id); err != nil {
+				return err
+			}
+			writeAudit(q, u.ID, "transaction", int(id), auditUpdate, before)
+		}
+		err = q.QueryRow(`INSERT INTO reconciliations (user_id, period_start, period_end, opening_balance, statement_balance, cleared_total, transaction_count, created_by)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+			req.UserID, from, to, req.OpeningBalance, req.StatementBalance, result.ClearedTotal, len(ids), u.ID).Scan(&result.ID, &result.CreatedAt)
+		if err != nil {
+			return err
+		}
+		result.Reconciled = true
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to reconcile transactions")
+		return
+	}
+	if result.Difference != 0 {
+		respondWithJSON(w, http.StatusConflict, result)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
+
+// GetReconciliations lists a user's completed reconciliations, newest first.
+func GetReconciliations(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	rows, err := db.Query(`SELECT id, user_id, account_id, period_start, period_end, opening_balance, statement_balance, cleared_total, transaction_count, created_at
+        FROM reconciliations WHERE user_id = $1 ORDER BY period_end DESC, id DESC`, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reconciliations")
+		return
+	}
+	defer rows.Close()
+	reconciliations := []Reconciliation{}
+	for rows.Next() {
+		var rec Reconciliation
+		var from, to time.Time
+		if err := rows.Scan(&rec.ID, &rec.UserID, &rec.AccountID, &from, &to, &rec.OpeningBalance, &rec.StatementBalance, &rec.ClearedTotal, &rec.ClearedCount, &rec.CreatedAt); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan reconciliation")
+			return
+		}
+		rec.From, rec.To = from.Format("2006-01-02"), to.Format("2006-01-02")
+		rec.Reconciled = true
+		reconciliations = append(reconciliations, rec)
+	}
+	respondWithJSON(w, http.StatusOK, reconciliations)
+}
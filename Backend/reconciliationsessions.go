@@ -0,0 +1,371 @@
+// reconciliationsessions.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A reconciliation session walks through one account statement: the user
+// starts it with the statement's date and ending balance, checks off the
+// transactions the statement lists, and watches the difference between the
+// statement and the account's checked-off balance. Finishing it when the
+// difference is zero marks the checked transactions reconciled and records
+// the reconciliation. Balances use the account's sign convention, so a
+// credit card statement owing 500.00 has a balance of -500.00.
+
+// Reconciliation session statuses.
+const (
+	sessionOpen     = "open"
+	sessionFinished = "finished"
+)
+
+// --- MODELS ---
+type ReconciliationSession struct {
+	ID               int       `json:"id"`
+	AccountID        int       `json:"account_id"`
+	UserID           int       `json:"user_id"`
+	StatementDate    time.Time `json:"statement_date"`
+	StatementBalance float64   `json:"statement_balance"`
+	Status           string    `json:"status"`
+	// OpeningBalance is the account's balance from transactions reconciled
+	// before this session, and ClearedBalance applies the checked ones to it.
+	// Difference is what is left between the statement and ClearedBalance.
+	OpeningBalance   float64              `json:"opening_balance"`
+	CheckedTotal     float64              `json:"checked_total"`
+	CheckedCount     int                  `json:"checked_count"`
+	ClearedBalance   float64              `json:"cleared_balance"`
+	Difference       float64              `json:"difference"`
+	ReconciliationID *int                 `json:"reconciliation_id,omitempty"`
+	CreatedAt        time.Time            `json:"created_at"`
+	FinishedAt       *time.Time           `json:"finished_at,omitempty"`
+	Transactions     []SessionTransaction `json:"transactions,omitempty"`
+}
+
+// SessionTransaction is a transaction a session can check off, i.e. an
+// unreconciled one on the account dated on or before the statement.
+type SessionTransaction struct {
+	Transaction
+	Checked bool `json:"checked"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// loadReconciliationSession loads a session with its live figures. A
+// finished session reports the figures it was finished with.
+func loadReconciliationSession(q queryer, id int) (ReconciliationSession, error) {
+	var s ReconciliationSession
+	err := q.QueryRow(`SELECT s.id, s.account_id, s.user_id, s.statement_date, s.statement_balance, s.status, s.reconciliation_id, s.created_at, s.finished_at,
+            COALESCE(rec.opening_balance, a.opening_balance - COALESCE((SELECT SUM(`+accountAmountSQL+`) FROM transactions t
+                WHERE t.account_id = a.id AND t.deleted_at IS NULL AND t.status = $2
+                  AND NOT EXISTS (SELECT 1 FROM reconciliation_session_items i WHERE i.session_id = s.id AND i.transaction_id = t.id)), 0)),
+            COALESCE(rec.cleared_total, (SELECT COALESCE(SUM(`+accountAmountSQL+`), 0) FROM reconciliation_session_items i
+                JOIN transactions t ON t.id = i.transaction_id WHERE i.session_id = s.id AND t.deleted_at IS NULL)),
+            COALESCE(rec.transaction_count, (SELECT COUNT(*) FROM reconciliation_session_items i
+                JOIN transactions t ON t.id = i.transaction_id WHERE i.session_id = s.id AND t.deleted_at IS NULL))
+        FROM reconciliation_sessions s
+        JOIN accounts a ON a.id = s.account_id
+        LEFT JOIN reconciliations rec ON rec.id = s.reconciliation_id
+        WHERE s.id = $1`, id, statusReconciled).
+		Scan(&s.ID, &s.AccountID, &s.UserID, &s.StatementDate, &s.StatementBalance, &s.Status, &s.ReconciliationID, &s.CreatedAt, &s.FinishedAt,
+			&s.OpeningBalance, &s.CheckedTotal, &s.CheckedCount)
+	if err != nil {
+		return s, err
+	}
+	cleared := toCents(s.OpeningBalance) - toCents(s.CheckedTotal)
+	s.ClearedBalance = float64(cleared) / 100
+	s.Difference = float64(toCents(s.StatementBalance)-cleared) / 100
+	return s, nil
+}
+
+// sessionTransactions lists what s can check off, oldest first, or for a
+// finished session the transactions it reconciled.
+func sessionTransactions(q queryer, s ReconciliationSession) ([]SessionTransaction, error) {
+	rows, err := q.Query(`SELECT `+transactionColumns+`,
+            EXISTS (SELECT 1 FROM reconciliation_session_items i WHERE i.session_id = $2 AND i.transaction_id = transactions.id)
+        FROM transactions
+        WHERE account_id = $1 AND deleted_at IS NULL
+          AND (($3 AND status <> $4 AND date <= $5)
+            OR id IN (SELECT transaction_id FROM reconciliation_session_items WHERE session_id = $2))
+        ORDER BY date, id`, s.AccountID, s.ID, s.Status == sessionOpen, statusReconciled, s.StatementDate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transactions := []SessionTransaction{}
+	for rows.Next() {
+		var t SessionTransaction
+		if err := scanTransaction(rows, &t.Transaction, &t.Checked); err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+// openSessionFromPath reads {id}, checks the caller owns the session and
+// that it is still open, and loads it.
+func openSessionFromPath(w http.ResponseWriter, r *http.Request) (ReconciliationSession, bool) {
+	sessionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return ReconciliationSession{}, false
+	}
+	if !authorizeResource(w, r, "reconciliation_session", sessionID) {
+		return ReconciliationSession{}, false
+	}
+	s, err := loadReconciliationSession(dbFor(r), sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reconciliation session")
+		return s, false
+	}
+	if s.Status != sessionOpen {
+		respondWithError(w, http.StatusConflict, "Reconciliation session is already finished")
+		return s, false
+	}
+	return s, true
+}
+
+// sessionTransactionFromPath reads {transaction_id} for an open session.
+func sessionTransactionFromPath(w http.ResponseWriter, r *http.Request) (ReconciliationSession, int, bool) {
+	s, ok := openSessionFromPath(w, r)
+	if !ok {
+		return s, 0, false
+	}
+	transactionID, err := strconv.Atoi(mux.Vars(r)["transaction_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return s, 0, false
+	}
+	return s, transactionID, true
+}
+
+// --- RECONCILIATION SESSION HANDLERS ---
+
+// StartReconciliationSession opens a session on the account in {id} for a
+// statement given as {"statement_date": "YYYY-MM-DD", "statement_balance": n}.
+func StartReconciliationSession(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	params := mux.Vars(r)
+	accountID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+	if !authorizeResource(w, r, "account", accountID) {
+		return
+	}
+	var req struct {
+		StatementDate    string  `json:"statement_date"`
+		StatementBalance float64 `json:"statement_balance"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	date, err := time.Parse("2006-01-02", req.StatementDate)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'statement_date'")
+		return
+	}
+	ownerID, err := resourceOwner("account", accountID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify account")
+		return
+	}
+	var sessionID int
+	err = dbFor(r).QueryRow(`INSERT INTO reconciliation_sessions (account_id, user_id, statement_date, statement_balance, created_by)
+        VALUES ($1, $2, $3, $4, $5) ON CONFLICT (account_id) WHERE status = 'open' DO NOTHING RETURNING id`,
+		accountID, ownerID, date, req.StatementBalance, u.ID).Scan(&sessionID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusConflict, "This account already has an open reconciliation session")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start reconciliation session")
+		return
+	}
+	s, err := loadReconciliationSession(dbFor(r), sessionID)
+	if err == nil {
+		s.Transactions, err = sessionTransactions(dbFor(r), s)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reconciliation session")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, s)
+}
+
+// GetReconciliationSession returns a session's live figures and the
+// transactions it can check off.
+func GetReconciliationSession(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	sessionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+	if !authorizeResource(w, r, "reconciliation_session", sessionID) {
+		return
+	}
+	s, err := loadReconciliationSession(dbFor(r), sessionID)
+	if err == nil {
+		s.Transactions, err = sessionTransactions(dbFor(r), s)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reconciliation session")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// CheckSessionTransaction checks off a transaction in an open session and
+// returns the updated figures.
+func CheckSessionTransaction(w http.ResponseWriter, r *http.Request) {
+	s, transactionID, ok := sessionTransactionFromPath(w, r)
+	if !ok {
+		return
+	}
+	var eligible bool
+	err := dbFor(r).QueryRow(`SELECT EXISTS (SELECT 1 FROM transactions
+        WHERE id = $1 AND account_id = $2 AND deleted_at IS NULL AND status <> $3 AND date <= $4)`,
+		transactionID, s.AccountID, statusReconciled, s.StatementDate).Scan(&eligible)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify transaction")
+		return
+	}
+	if !eligible {
+		respondWithError(w, http.StatusBadRequest, "Transaction is not an unreconciled one on this account dated on or before the statement")
+		return
+	}
+	_, err = dbFor(r).Exec("INSERT INTO reconciliation_session_items (session_id, transaction_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", s.ID, transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to check off transaction")
+		return
+	}
+	if s, err = loadReconciliationSession(dbFor(r), s.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reconciliation session")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+func UncheckSessionTransaction(w http.ResponseWriter, r *http.Request) {
+	s, transactionID, ok := sessionTransactionFromPath(w, r)
+	if !ok {
+		return
+	}
+	_, err := dbFor(r).Exec("DELETE FROM reconciliation_session_items WHERE session_id=$1 AND transaction_id=$2", s.ID, transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to uncheck transaction")
+		return
+	}
+	if s, err = loadReconciliationSession(dbFor(r), s.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve reconciliation session")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// FinishReconciliationSession marks the checked transactions reconciled and
+// records the reconciliation once the difference is zero. Otherwise nothing
+// changes and the session is returned with 409.
+func FinishReconciliationSession(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	s, ok := openSessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	finished := true
+	err := withTx(r, func(q queryer) error {
+		var status string
+		if err := q.QueryRow("SELECT status FROM reconciliation_sessions WHERE id=$1 FOR UPDATE", s.ID).Scan(&status); err != nil {
+			return err
+		}
+		var err error
+		if s, err = loadReconciliationSession(q, s.ID); err != nil {
+			return err
+		}
+		if status != sessionOpen || s.Difference != 0 {
+			finished = false
+			return nil
+		}
+		rows, err := q.Query(`SELECT t.id, t.date FROM reconciliation_session_items i JOIN transactions t ON t.id = i.transaction_id
+            WHERE i.session_id = $1 AND t.deleted_at IS NULL ORDER BY t.date FOR UPDATE OF t`, s.ID)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		from := s.StatementDate
+		for rows.Next() {
+			var id int
+			var date time.Time
+			if err := rows.Scan(&id, &date); err != nil {
+				rows.Close()
+				return err
+			}
+			if date.Before(from) {
+				from = date
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			before := snapshotResource(q, "transaction", id)
+			if _, err := q.Exec("UPDATE transactions SET status = $1 WHERE id = $2", statusReconciled, id); err != nil {
+				return err
+			}
+			writeAudit(q, u.ID, "transaction", id, auditUpdate, before)
+		}
+		var reconciliationID int
+		err = q.QueryRow(`INSERT INTO reconciliations (user_id, account_id, period_start, period_end, opening_balance, statement_balance, cleared_total,
+                transaction_count, created_by)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+			s.UserID, s.AccountID, from, s.StatementDate, s.OpeningBalance, s.StatementBalance, s.CheckedTotal, len(ids), u.ID).Scan(&reconciliationID)
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec("UPDATE reconciliation_sessions SET status = $1, reconciliation_id = $2, finished_at = NOW() WHERE id = $3",
+			sessionFinished, reconciliationID, s.ID)
+		if err != nil {
+			return err
+		}
+		s, err = loadReconciliationSession(q, s.ID)
+		return err
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to finish reconciliation session")
+		return
+	}
+	if !finished {
+		respondWithJSON(w, http.StatusConflict, s)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// CancelReconciliationSession discards an open session and its check marks.
+func CancelReconciliationSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := openSessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	if _, err := dbFor(r).Exec("DELETE FROM reconciliation_sessions WHERE id=$1 AND status = $2", s.ID, sessionOpen); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel reconciliation session")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Reconciliation session cancelled"})
+}
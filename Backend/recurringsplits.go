@@ -0,0 +1,406 @@
+// recurringsplits.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A recurring split is a shared expense one user pays every period, such as
+// rent, with fixed shares owed by others. Each time it falls due the payer's
+// transaction is recorded, and an expense entry in the owed ledger for each
+// participant's share. Participants are only charged once they have accepted
+// their share.
+
+// recurringSplitFrequencies are the frequencies a recurring split can have.
+var recurringSplitFrequencies = map[string]bool{
+	frequencyWeekly: true, frequencyBiweekly: true, frequencyMonthly: true, frequencyYearly: true,
+}
+
+// --- MODELS ---
+type RecurringSplit struct {
+	ID          int     `json:"id"`
+	UserID      int     `json:"user_id"` // who pays
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+	CategoryID  int     `json:"category_id"`
+	AccountID   *int    `json:"account_id,omitempty"`
+	Frequency   string  `json:"frequency"`
+	StartDate   string  `json:"start_date"` // YYYY-MM-DD, default today
+	NextDate    string  `json:"next_date"`
+	// SplitEqually divides Amount evenly between the payer and the
+	// participants in place of their own amounts, the payer keeping any odd
+	// cent.
+	SplitEqually bool                        `json:"split_equally,omitempty"`
+	Participants []RecurringSplitParticipant `json:"participants"`
+}
+
+type RecurringSplitParticipant struct {
+	UserID     int        `json:"user_id"`
+	Username   string     `json:"username,omitempty"`
+	Amount     float64    `json:"amount"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// recurringSplitDate is the date of occurrence n of a split starting on
+// start, counting from 0.
+func recurringSplitDate(start time.Time, frequency string, n int) time.Time {
+	switch frequency {
+	case frequencyWeekly:
+		return start.AddDate(0, 0, 7*n)
+	case frequencyBiweekly:
+		return start.AddDate(0, 0, 14*n)
+	case frequencyYearly:
+		return addMonthsClamped(start, 12*n)
+	default:
+		return addMonthsClamped(start, n)
+	}
+}
+
+// recurringSplitFromPath loads the split {id} from the path and the IDs of
+// its participants, responding with 404 unless the caller pays it or takes
+// part in it.
+func recurringSplitFromPath(w http.ResponseWriter, r *http.Request) (RecurringSplit, bool) {
+	var s RecurringSplit
+	u, ok := requireUser(w, r)
+	if !ok {
+		return s, false
+	}
+	splitID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid recurring split ID")
+		return s, false
+	}
+	var participant bool
+	err = db.QueryRow(`SELECT id, user_id, EXISTS(SELECT 1 FROM recurring_split_participants WHERE recurring_split_id = s.id AND user_id = $2)
+        FROM recurring_splits s WHERE id = $1`, splitID, u.ID).Scan(&s.ID, &s.UserID, &participant)
+	if err == nil && !canAccess(u, s.UserID) && !participant {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Recurring split not found")
+		return s, false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve recurring split")
+		return s, false
+	}
+	return s, true
+}
+
+// processRecurringSplits records every occurrence of a recurring split that
+// has fallen due, each in its own transaction.
+func processRecurringSplits() error {
+	rows, err := db.Query(`SELECT id, user_id, description, amount, COALESCE(category_id, 0), account_id, frequency, start_date, occurrences
+        FROM recurring_splits WHERE next_date <= CURRENT_DATE`)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		split       RecurringSplit
+		start       time.Time
+		occurrences int
+	}
+	var splits []due
+	for rows.Next() {
+		var d due
+		s := &d.split
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Description, &s.Amount, &s.CategoryID, &s.AccountID, &s.Frequency, &d.start, &d.occurrences); err != nil {
+			rows.Close()
+			return err
+		}
+		splits = append(splits, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	today := dateOnly(now, now.Location())
+	for _, d := range splits {
+		start := dateOnly(d.start, now.Location())
+		for n := d.occurrences; !recurringSplitDate(start, d.split.Frequency, n).After(today); n++ {
+			if err := recordRecurringSplit(d.split, recurringSplitDate(start, d.split.Frequency, n), recurringSplitDate(start, d.split.Frequency, n+1)); err != nil {
+				log.Printf("Failed to record recurring split %d: %v", d.split.ID, err)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// recordRecurringSplit records the occurrence of s on date and moves the
+// split on to next.
+func recordRecurringSplit(s RecurringSplit, date, next time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	base, err := baseCurrency(tx, s.UserID)
+	if err != nil {
+		return err
+	}
+	rate, amount := 1.0, s.Amount
+	t := &Transaction{UserID: s.UserID, Description: s.Description, Amount: s.Amount, Date: date, CategoryID: s.CategoryID,
+		AccountID: s.AccountID, Status: statusCleared, Currency: base, OriginalAmount: &amount, ExchangeRate: &rate}
+	if err := insertAccountTransaction(tx, t); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO owed_entries (creditor_id, debtor_id, kind, amount, date, note, creditor_transaction_id, recurring_split_id, created_by)
+        SELECT $1, user_id, $2, amount, $3, $4, $5, $6, $1 FROM recurring_split_participants
+        WHERE recurring_split_id = $6 AND accepted_at IS NOT NULL`,
+		s.UserID, owedExpense, date, s.Description, t.ID, s.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE recurring_splits SET occurrences = occurrences + 1, next_date = $1 WHERE id = $2", next, s.ID); err != nil {
+		return err
+	}
+	writeAudit(tx, s.UserID, "transaction", t.ID, auditCreate, nil)
+	return tx.Commit()
+}
+
+// loadRecurringSplitParticipants fills in the participants of each split.
+func loadRecurringSplitParticipants(splits []RecurringSplit) error {
+	for i := range splits {
+		splits[i].Participants = []RecurringSplitParticipant{}
+		rows, err := db.Query(`SELECT p.user_id, u.username, p.amount, p.accepted_at FROM recurring_split_participants p
+            JOIN users u ON u.id = p.user_id
+            WHERE p.recurring_split_id = $1 ORDER BY u.username`, splits[i].ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var p RecurringSplitParticipant
+			if err := rows.Scan(&p.UserID, &p.Username, &p.Amount, &p.AcceptedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			splits[i].Participants = append(splits[i].Participants, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- RECURRING SPLIT HANDLERS ---
+
+// CreateRecurringSplit sets up a recurring split paid by the caller and
+// invites its participants to accept their shares.
+func CreateRecurringSplit(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var s RecurringSplit
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	s.UserID = u.ID
+	total := toCents(s.Amount)
+	if strings.TrimSpace(s.Description) == "" || total <= 0 {
+		respondWithError(w, http.StatusBadRequest, "A description and a positive amount are required")
+		return
+	}
+	if !recurringSplitFrequencies[s.Frequency] {
+		respondWithError(w, http.StatusBadRequest, "Frequency must be 'weekly', 'biweekly', 'monthly' or 'yearly'")
+		return
+	}
+	now := time.Now()
+	today := dateOnly(now, now.Location())
+	start := today
+	if s.StartDate != "" {
+		var err error
+		if start, err = time.ParseInLocation("2006-01-02", s.StartDate, now.Location()); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'start_date'")
+			return
+		}
+		if start.Before(today) {
+			respondWithError(w, http.StatusBadRequest, "start_date cannot be in the past")
+			return
+		}
+	}
+	s.StartDate, s.NextDate = start.Format("2006-01-02"), start.Format("2006-01-02")
+	if len(s.Participants) == 0 {
+		respondWithError(w, http.StatusBadRequest, "A recurring split needs at least one participant")
+		return
+	}
+	if s.SplitEqually {
+		share := total / int64(len(s.Participants)+1)
+		for i := range s.Participants {
+			s.Participants[i].Amount = float64(share) / 100
+		}
+	}
+	seen := map[int]bool{}
+	var owed int64
+	for _, p := range s.Participants {
+		if p.UserID == s.UserID || seen[p.UserID] {
+			respondWithError(w, http.StatusBadRequest, "Participants must be other users, each listed once")
+			return
+		}
+		seen[p.UserID] = true
+		if toCents(p.Amount) <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Each participant's amount must be positive")
+			return
+		}
+		owed += toCents(p.Amount)
+	}
+	if owed > total {
+		respondWithError(w, http.StatusBadRequest, "Participants' shares add up to more than the amount")
+		return
+	}
+	if !authorizeCategory(w, s.CategoryID, resourceRef{OwnerID: s.UserID}) || !authorizeAccount(w, s.AccountID, s.UserID, start) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create recurring split")
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`INSERT INTO recurring_splits (user_id, description, amount, category_id, account_id, frequency, start_date, next_date)
+        VALUES ($1, $2, $3, NULLIF($4, 0), $5, $6, $7, $7) RETURNING id`,
+		s.UserID, s.Description, s.Amount, s.CategoryID, s.AccountID, s.Frequency, start).Scan(&s.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create recurring split")
+		return
+	}
+	for i, p := range s.Participants {
+		err := tx.QueryRow(`INSERT INTO recurring_split_participants (recurring_split_id, user_id, amount) VALUES ($1, $2, $3)
+            RETURNING (SELECT username FROM users WHERE id = $2)`, s.ID, p.UserID, p.Amount).Scan(&s.Participants[i].Username)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Participant "+strconv.Itoa(p.UserID)+" does not exist")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create recurring split")
+		return
+	}
+	s.SplitEqually = false
+	respondWithJSON(w, http.StatusCreated, s)
+}
+
+// GetRecurringSplits lists the recurring splits the caller pays or takes
+// part in.
+func GetRecurringSplits(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	// Participants see splits paid by others, so this reads through db
+	// rather than the caller's connection.
+	rows, err := db.Query(`SELECT id, user_id, description, amount, COALESCE(category_id, 0), account_id, frequency,
+            TO_CHAR(start_date, 'YYYY-MM-DD'), TO_CHAR(next_date, 'YYYY-MM-DD')
+        FROM recurring_splits
+        WHERE user_id = $1 OR id IN (SELECT recurring_split_id FROM recurring_split_participants WHERE user_id = $1)
+        ORDER BY next_date, id`, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve recurring splits")
+		return
+	}
+	defer rows.Close()
+	splits := []RecurringSplit{}
+	for rows.Next() {
+		var s RecurringSplit
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Description, &s.Amount, &s.CategoryID, &s.AccountID, &s.Frequency, &s.StartDate, &s.NextDate); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan recurring split")
+			return
+		}
+		// Participants don't see the payer's account or category.
+		if s.UserID != u.ID {
+			s.AccountID, s.CategoryID = nil, 0
+		}
+		splits = append(splits, s)
+	}
+	if err := loadRecurringSplitParticipants(splits); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve participants")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, splits)
+}
+
+// DeleteRecurringSplit stops a recurring split. What it already recorded,
+// transactions and owed entries alike, stays.
+func DeleteRecurringSplit(w http.ResponseWriter, r *http.Request) {
+	s, ok := recurringSplitFromPath(w, r)
+	if !ok {
+		return
+	}
+	u, _ := currentUser(r)
+	if !canAccess(u, s.UserID) {
+		respondWithError(w, http.StatusForbidden, "Only the payer can stop a recurring split")
+		return
+	}
+	if _, err := db.Exec("DELETE FROM recurring_splits WHERE id=$1", s.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete recurring split")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Recurring split deleted successfully"})
+}
+
+// AcceptRecurringSplit accepts the caller's share of a recurring split, from
+// its next occurrence on.
+func AcceptRecurringSplit(w http.ResponseWriter, r *http.Request) {
+	s, ok := recurringSplitFromPath(w, r)
+	if !ok {
+		return
+	}
+	u, _ := currentUser(r)
+	res, err := db.Exec("UPDATE recurring_split_participants SET accepted_at = COALESCE(accepted_at, NOW()) WHERE recurring_split_id=$1 AND user_id=$2",
+		s.ID, u.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to accept recurring split")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "You are not a participant of this recurring split")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Recurring split accepted"})
+}
+
+// RemoveRecurringSplitParticipant takes a participant out of a recurring
+// split. The payer can remove anyone; participants can remove themselves,
+// which also declines a share not yet accepted.
+func RemoveRecurringSplitParticipant(w http.ResponseWriter, r *http.Request) {
+	s, ok := recurringSplitFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	u, _ := currentUser(r)
+	if !canAccess(u, s.UserID) && u.ID != userID {
+		respondWithError(w, http.StatusForbidden, "Only the payer can remove other participants")
+		return
+	}
+	res, err := db.Exec("DELETE FROM recurring_split_participants WHERE recurring_split_id=$1 AND user_id=$2", s.ID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove participant")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Participant not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Participant removed successfully"})
+}
@@ -0,0 +1,133 @@
+// refunds.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type RefundLink struct {
+	LinkedTransactionID int `json:"linked_transaction_id"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// refundReportMode reads ?refunds= for spending reports. "net" (the default)
+// counts a linked refund against the original expense's category and payee,
+// so the two cancel out; "gross" leaves linked refunds out entirely.
+func refundReportMode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch mode := r.URL.Query().Get("refunds"); mode {
+	case "", "net":
+		return "net", true
+	case "gross":
+		return "gross", true
+	default:
+		respondWithError(w, http.StatusBadRequest, "'refunds' must be 'net' or 'gross'")
+		return "", false
+	}
+}
+
+// --- REFUND HANDLERS ---
+
+// LinkRefund marks the transaction in the path as a refund of another. Both
+// must belong to the same ledger, be live, and have amounts of opposite
+// sign; an expense cannot itself be a refund, and refunds cannot be chained.
+func LinkRefund(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	refundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	var link RefundLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil || link.LinkedTransactionID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if link.LinkedTransactionID == refundID {
+		respondWithError(w, http.StatusBadRequest, "A transaction cannot refund itself")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", refundID) || !authorizeResource(w, r, "transaction", link.LinkedTransactionID) {
+		return
+	}
+
+	q := dbFor(r)
+	var refund, original Transaction
+	var originalIsRefund, refundHasRefunds bool
+	err = q.QueryRow(`SELECT user_id, organization_id, amount,
+            EXISTS (SELECT 1 FROM transactions WHERE linked_transaction_id = t.id AND deleted_at IS NULL)
+        FROM transactions t WHERE id=$1 AND deleted_at IS NULL`, refundID).
+		Scan(&refund.UserID, &refund.OrganizationID, &refund.Amount, &refundHasRefunds)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Transaction not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction")
+		return
+	}
+	err = q.QueryRow(`SELECT user_id, organization_id, amount, linked_transaction_id IS NOT NULL
+        FROM transactions WHERE id=$1 AND deleted_at IS NULL`, link.LinkedTransactionID).
+		Scan(&original.UserID, &original.OrganizationID, &original.Amount, &originalIsRefund)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Linked transaction not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction")
+		return
+	}
+
+	sameLedger := refund.UserID == original.UserID
+	if refund.OrganizationID != nil || original.OrganizationID != nil {
+		sameLedger = refund.OrganizationID != nil && original.OrganizationID != nil && *refund.OrganizationID == *original.OrganizationID
+	}
+	if !sameLedger {
+		respondWithError(w, http.StatusBadRequest, "Both transactions must belong to the same ledger")
+		return
+	}
+	if refund.Amount*original.Amount >= 0 {
+		respondWithError(w, http.StatusBadRequest, "A refund and the expense it refunds must have amounts of opposite sign")
+		return
+	}
+	if originalIsRefund || refundHasRefunds {
+		respondWithError(w, http.StatusConflict, "Refunds cannot be chained")
+		return
+	}
+
+	before := snapshotResource(q, "transaction", refundID)
+	if _, err := q.Exec("UPDATE transactions SET linked_transaction_id=$1 WHERE id=$2", link.LinkedTransactionID, refundID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to link refund")
+		return
+	}
+	recordAudit(r, "transaction", refundID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Refund linked successfully"})
+}
+
+func UnlinkRefund(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	refundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", refundID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "transaction", refundID)
+	res, err := dbFor(r).Exec("UPDATE transactions SET linked_transaction_id=NULL WHERE id=$1 AND linked_transaction_id IS NOT NULL", refundID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to unlink refund")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Transaction is not linked to an expense")
+		return
+	}
+	recordAudit(r, "transaction", refundID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Refund unlinked successfully"})
+}
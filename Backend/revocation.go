@@ -0,0 +1,196 @@
+// revocation.go
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// revocationStore is a denylist of JWT IDs, plus a generation per user that
+// every token carries: moving a user on to a new generation revokes all
+// their tokens at once. Entries only need to live as long as the tokens they
+// revoke, so every entry carries a TTL.
+type revocationStore interface {
+	Revoke(tokenID string, ttl time.Duration) error
+	IsRevoked(tokenID string) (bool, error)
+	// UserGeneration returns the generation of the user's valid tokens, 0
+	// until their tokens are first revoked, and keeps it for at least ttl,
+	// the lifetime of a token about to be issued with it.
+	UserGeneration(userID int, ttl time.Duration) (int64, error)
+	// RevokeUserTokens moves the user on to a new generation.
+	RevokeUserTokens(userID int, ttl time.Duration) error
+}
+
+var revocations revocationStore
+
+// initRevocationStore uses Redis when REDIS_URL is set so revocations are
+// shared between instances, and falls back to an in-process store otherwise.
+func initRevocationStore() error {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		revocations = newMemoryRevocationStore()
+		log.Println("REDIS_URL not set; using in-memory token revocation list.")
+		return nil
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return err
+	}
+	revocations = &redisRevocationStore{client: client}
+	log.Println("Successfully connected to Redis for token revocation.")
+	return nil
+}
+
+// --- REDIS STORE ---
+
+type redisRevocationStore struct {
+	client *redis.Client
+}
+
+func (s *redisRevocationStore) Revoke(tokenID string, ttl time.Duration) error {
+	return s.client.Set(context.Background(), "revoked:jti:"+tokenID, 1, ttl).Err()
+}
+
+func (s *redisRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	n, err := s.client.Exists(context.Background(), "revoked:jti:"+tokenID).Result()
+	return n > 0, err
+}
+
+func (s *redisRevocationStore) UserGeneration(userID int, ttl time.Duration) (int64, error) {
+	key := "revoked:user:" + strconv.Itoa(userID)
+	gen, err := s.client.Get(context.Background(), key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	// Tokens live for ttl at most, so this never cuts short the life of a
+	// generation a token was issued with.
+	if ttl > 0 {
+		if err := s.client.Expire(context.Background(), key, ttl).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return gen, nil
+}
+
+func (s *redisRevocationStore) RevokeUserTokens(userID int, ttl time.Duration) error {
+	key := "revoked:user:" + strconv.Itoa(userID)
+	if err := s.client.Incr(context.Background(), key).Err(); err != nil {
+		return err
+	}
+	return s.client.Expire(context.Background(), key, ttl).Err()
+}
+
+// --- IN-MEMORY STORE ---
+
+type memoryRevocationStore struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+	users  map[int]userGeneration
+}
+
+type userGeneration struct {
+	gen     int64
+	expires time.Time
+}
+
+func newMemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{tokens: map[string]time.Time{}, users: map[int]userGeneration{}}
+}
+
+func (s *memoryRevocationStore) Revoke(tokenID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[tokenID] = time.Now().Add(ttl)
+	s.sweep()
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.tokens[tokenID]
+	return ok && time.Now().Before(expires), nil
+}
+
+func (s *memoryRevocationStore) UserGeneration(userID int, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ug, ok := s.users[userID]
+	if !ok || time.Now().After(ug.expires) {
+		return 0, nil
+	}
+	if ttl > 0 {
+		ug.expires = time.Now().Add(ttl)
+		s.users[userID] = ug
+	}
+	return ug.gen, nil
+}
+
+func (s *memoryRevocationStore) RevokeUserTokens(userID int, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ug := s.users[userID]
+	if time.Now().After(ug.expires) {
+		ug.gen = 0
+	}
+	ug.gen++
+	ug.expires = time.Now().Add(ttl)
+	s.users[userID] = ug
+	s.sweep()
+	return nil
+}
+
+// sweep drops expired entries; callers must hold s.mu.
+func (s *memoryRevocationStore) sweep() {
+	now := time.Now()
+	for id, expires := range s.tokens {
+		if now.After(expires) {
+			delete(s.tokens, id)
+		}
+	}
+	for id, ug := range s.users {
+		if now.After(ug.expires) {
+			delete(s.users, id)
+		}
+	}
+}
+
+// --- HELPER FUNCTIONS ---
+
+// isTokenRevoked checks both the per-token denylist and the user's token
+// generation. A token from any other generation is revoked: the in-memory
+// store forgets generations on restart, and a token must not outlive that.
+func isTokenRevoked(u *AuthUser) (bool, error) {
+	revoked, err := revocations.IsRevoked(u.TokenID)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	gen, err := revocations.UserGeneration(u.ID, 0)
+	if err != nil {
+		return false, err
+	}
+	return u.Generation != gen, nil
+}
+
+// revokeAllUserCredentials logs the user out everywhere: outstanding JWTs are
+// cut off and any server-side sessions are deleted. Tokens issued afterwards,
+// even within the same second, carry the new generation and stay valid.
+func revokeAllUserCredentials(userID int) error {
+	if err := revocations.RevokeUserTokens(userID, authTTL()); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id=$1", userID)
+	return err
+}
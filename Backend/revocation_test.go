@@ -0,0 +1,86 @@
+// revocation_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// login issues and parses a token for userID, as a request carrying it
+// would see it.
+func login(t *testing.T, userID int) *AuthUser {
+	t.Helper()
+	token, _, err := issueToken(userID, "user")
+	if err != nil {
+		t.Fatalf("issueToken: %v", err)
+	}
+	u, err := parseToken(token)
+	if err != nil {
+		t.Fatalf("parseToken: %v", err)
+	}
+	return u
+}
+
+func TestIsTokenRevoked(t *testing.T) {
+	jwtSecret = []byte("test secret")
+	tests := []struct {
+		name string
+		// steps runs against a fresh store and returns the token to check.
+		steps func(t *testing.T) *AuthUser
+		want  bool
+	}{
+		{"fresh token", func(t *testing.T) *AuthUser {
+			return login(t, 1)
+		}, false},
+		{"logged out token", func(t *testing.T) *AuthUser {
+			u := login(t, 1)
+			revocations.Revoke(u.TokenID, time.Hour)
+			return u
+		}, true},
+		{"other token of a logged out user", func(t *testing.T) *AuthUser {
+			revocations.Revoke(login(t, 1).TokenID, time.Hour)
+			return login(t, 1)
+		}, false},
+		{"token issued before revoking all", func(t *testing.T) *AuthUser {
+			u := login(t, 1)
+			revocations.RevokeUserTokens(1, time.Hour)
+			return u
+		}, true},
+		{"token issued straight after revoking all", func(t *testing.T) *AuthUser {
+			login(t, 1)
+			revocations.RevokeUserTokens(1, time.Hour)
+			return login(t, 1)
+		}, false},
+		{"token from before the last of several revocations", func(t *testing.T) *AuthUser {
+			revocations.RevokeUserTokens(1, time.Hour)
+			u := login(t, 1)
+			revocations.RevokeUserTokens(1, time.Hour)
+			login(t, 1)
+			return u
+		}, true},
+		{"another user revoking all", func(t *testing.T) *AuthUser {
+			u := login(t, 1)
+			revocations.RevokeUserTokens(2, time.Hour)
+			return u
+		}, false},
+		{"generation forgotten, as after a restart", func(t *testing.T) *AuthUser {
+			revocations.RevokeUserTokens(1, time.Hour)
+			u := login(t, 1)
+			revocations = newMemoryRevocationStore()
+			return u
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocations = newMemoryRevocationStore()
+			u := tt.steps(t)
+			revoked, err := isTokenRevoked(u)
+			if err != nil {
+				t.Fatalf("isTokenRevoked: %v", err)
+			}
+			if revoked != tt.want {
+				t.Errorf("isTokenRevoked = %v, want %v", revoked, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+// rls.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// rlsRole is the unprivileged role requests switch to so Postgres enforces
+// row-level security (superusers and table owners bypass policies).
+const rlsRole = "budgello_app"
+
+type txContextKey struct{}
+
+type afterCommitContextKey struct{}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func rlsEnabled() bool {
+	return os.Getenv("RLS_ENABLED") == "true"
+}
+
+// dbFor returns the request-scoped transaction when row-level security is
+// active, so queries run as the caller, and the shared pool otherwise.
+func dbFor(r *http.Request) queryer {
+	if tx, ok := r.Context().Value(txContextKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return db
+}
+
+// withTx runs fn inside a transaction: the request's own when row-level
+// security is active, otherwise a new one committed when fn succeeds.
+func withTx(r *http.Request, fn func(q queryer) error) error {
+	if tx, ok := r.Context().Value(txContextKey{}).(*sql.Tx); ok {
+		return fn(tx)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// afterCommit runs fn once what the request has written is committed, for
+// work that reads it back through db, like notifications. Without row-level
+// security withTx has already committed, so fn runs straight away; with it,
+// fn runs after the request transaction commits, and not at all if it
+// rolls back.
+func afterCommit(r *http.Request, fn func()) {
+	if hooks, ok := r.Context().Value(afterCommitContextKey{}).(*[]func()); ok {
+		*hooks = append(*hooks, fn)
+		return
+	}
+	fn()
+}
+
+// createRLSPolicies sets up the application role and the policies that
+// restrict categories, transactions and budgets to their owners, admins,
+// parents of child accounts, share participants, and organization members.
+func createRLSPolicies() error {
+	statements := []string{
+		`DO $$ BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = '` + rlsRole + `') THEN
+                CREATE ROLE ` + rlsRole + ` NOLOGIN;
+            END IF;
+        END $$`,
+		`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO ` + rlsRole,
+		`GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO ` + rlsRole,
+		`CREATE OR REPLACE FUNCTION app_user_id() RETURNS INTEGER AS $$
+            SELECT NULLIF(current_setting('app.user_id', true), '')::INTEGER
+        $$ LANGUAGE sql STABLE`,
+		`CREATE OR REPLACE FUNCTION app_is_admin() RETURNS BOOLEAN AS $$
+            SELECT COALESCE(current_setting('app.is_admin', true), '') = 'true'
+        $$ LANGUAGE sql STABLE`,
+
+		`ALTER TABLE shared_budgets ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS participant_access ON shared_budgets`,
+		`CREATE POLICY participant_access ON shared_budgets
+            USING (app_is_admin() OR from_user_id = app_user_id() OR to_user_id = app_user_id())
+            WITH CHECK (app_is_admin() OR from_user_id = app_user_id())`,
+
+		`ALTER TABLE categories ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON categories`,
+		`CREATE POLICY owner_access ON categories
+            USING (app_is_admin() OR user_id = app_user_id() OR ` + orgMemberClause("categories") + ` OR ` + parentClause("categories") + `
+                OR EXISTS (SELECT 1 FROM shared_budgets sb WHERE sb.from_user_id = categories.user_id AND sb.to_user_id = app_user_id()))
+            WITH CHECK (app_is_admin() OR user_id = app_user_id() OR ` + orgMemberClause("categories") + ` OR ` + parentClause("categories") + `)`,
+		// Global categories are readable by everyone; only admins write them.
+		`DROP POLICY IF EXISTS global_read ON categories`,
+		`CREATE POLICY global_read ON categories FOR SELECT USING (is_global)`,
+
+		`ALTER TABLE transactions ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON transactions`,
+		`CREATE POLICY owner_access ON transactions
+            USING (app_is_admin() OR user_id = app_user_id() OR ` + orgMemberClause("transactions") + ` OR ` + parentClause("transactions") + `)`,
+		// Share recipients see the owner's transactions; editors may add ones
+		// that count towards the shared budget, but change nothing.
+		`DROP POLICY IF EXISTS share_read ON transactions`,
+		`CREATE POLICY share_read ON transactions FOR SELECT
+            USING (EXISTS (SELECT 1 FROM shared_budgets sb WHERE sb.from_user_id = transactions.user_id AND sb.to_user_id = app_user_id()))`,
+		`DROP POLICY IF EXISTS share_insert ON transactions`,
+		`CREATE POLICY share_insert ON transactions FOR INSERT
+            WITH CHECK (organization_id IS NULL AND NOT exclude_from_budget
+                AND NOT EXISTS (SELECT 1 FROM categories c WHERE c.id = transactions.category_id AND c.exclude_from_budget)
+                AND EXISTS (SELECT 1 FROM shared_budgets sb JOIN budgets b ON b.id = sb.budget_id
+                    WHERE sb.from_user_id = transactions.user_id AND sb.to_user_id = app_user_id() AND sb.permission = 'edit'
+                      AND b.archived_at IS NULL))`,
+
+		`ALTER TABLE budgets ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON budgets`,
+		`CREATE POLICY owner_access ON budgets
+            USING (app_is_admin() OR user_id = app_user_id() OR ` + orgMemberClause("budgets") + ` OR ` + parentClause("budgets") + `)`,
+		// Members see the group budgets they have joined, so a member's new
+		// transaction can be held back for the owner's approval.
+		`DROP POLICY IF EXISTS member_read ON budgets`,
+		`CREATE POLICY member_read ON budgets FOR SELECT
+            USING (EXISTS (SELECT 1 FROM budget_members m WHERE m.budget_id = budgets.id AND m.accepted_at IS NOT NULL
+                AND (m.user_id = app_user_id() OR EXISTS (SELECT 1 FROM users c WHERE c.id = m.user_id AND c.parent_id = app_user_id()))))`,
+		`DROP POLICY IF EXISTS share_read ON budgets`,
+		`CREATE POLICY share_read ON budgets FOR SELECT
+            USING (EXISTS (SELECT 1 FROM shared_budgets sb WHERE sb.budget_id = budgets.id AND sb.to_user_id = app_user_id()))`,
+
+		`ALTER TABLE tags ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON tags`,
+		`CREATE POLICY owner_access ON tags
+            USING (app_is_admin() OR user_id = app_user_id() OR ` + parentClause("tags") + `)`,
+
+		`ALTER TABLE payees ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON payees`,
+		`CREATE POLICY owner_access ON payees
+            USING (app_is_admin() OR user_id = app_user_id() OR ` + parentClause("payees") + `)`,
+
+		`ALTER TABLE payee_aliases ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON payee_aliases`,
+		`CREATE POLICY owner_access ON payee_aliases
+            USING (app_is_admin() OR user_id = app_user_id() OR ` + parentClause("payee_aliases") + `)`,
+
+		`ALTER TABLE transaction_versions ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS owner_access ON transaction_versions`,
+		`CREATE POLICY owner_access ON transaction_versions
+            USING (EXISTS (SELECT 1 FROM transactions t WHERE t.id = transaction_versions.transaction_id))`,
+
+		// Tag links follow the visibility of their transaction.
+		`ALTER TABLE transaction_tags ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS transaction_access ON transaction_tags`,
+		`CREATE POLICY transaction_access ON transaction_tags
+            USING (EXISTS (SELECT 1 FROM transactions t WHERE t.id = transaction_tags.transaction_id))`,
+
+		`ALTER TABLE transaction_splits ENABLE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS transaction_access ON transaction_splits`,
+		`CREATE POLICY transaction_access ON transaction_splits
+            USING (EXISTS (SELECT 1 FROM transactions t WHERE t.id = transaction_splits.transaction_id))`,
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	log.Println("Row-level security policies created or updated.")
+	return nil
+}
+
+// orgMemberClause matches rows in an organization ledger the caller belongs to.
+func orgMemberClause(table string) string {
+	return `(` + table + `.organization_id IS NOT NULL AND EXISTS (SELECT 1 FROM organization_members m
+                WHERE m.organization_id = ` + table + `.organization_id AND m.user_id = app_user_id()))`
+}
+
+// parentClause matches rows owned by a child account of the caller.
+func parentClause(table string) string {
+	return `EXISTS (SELECT 1 FROM users c WHERE c.id = ` + table + `.user_id AND c.parent_id = app_user_id())`
+}
+
+// bufferedResponse holds the response until the request transaction has
+// committed, so clients never see success for work that was rolled back.
+// Read-only handlers that stream large bodies can opt out with
+// streamResponse.
+type bufferedResponse struct {
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	dst       http.ResponseWriter
+	streaming bool
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	if b.streaming {
+		return b.dst.Header()
+	}
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.streaming {
+		return b.dst.Write(p)
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.streaming {
+		b.dst.WriteHeader(code)
+		return
+	}
+	b.status = code
+}
+
+func (b *bufferedResponse) Flush() {
+	if f, ok := b.dst.(http.Flusher); b.streaming && ok {
+		f.Flush()
+	}
+}
+
+// streamResponse makes writes to w go straight to the client instead of
+// waiting for the request transaction to commit. Only read-only handlers may
+// use it, since nothing written afterwards can be taken back.
+func streamResponse(w http.ResponseWriter) {
+	b, ok := w.(*bufferedResponse)
+	if !ok || b.streaming {
+		return
+	}
+	for k, v := range b.header {
+		b.dst.Header()[k] = v
+	}
+	b.streaming = true
+}
+
+// rlsMiddleware runs each authenticated request inside a transaction that
+// has switched to the application role and set app.user_id, so Postgres
+// row-level security applies to everything the handler queries via dbFor.
+func rlsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := currentUser(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to start transaction")
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("SET LOCAL ROLE " + rlsRole); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to set database role")
+			return
+		}
+		_, err = tx.Exec("SELECT set_config('app.user_id', $1, true), set_config('app.is_admin', $2, true)",
+			strconv.Itoa(u.ID), strconv.FormatBool(u.Role == "admin"))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to set database user")
+			return
+		}
+
+		buf := &bufferedResponse{header: http.Header{}, dst: w}
+		var hooks []func()
+		ctx := context.WithValue(context.WithValue(r.Context(), txContextKey{}, tx), afterCommitContextKey{}, &hooks)
+		next.ServeHTTP(buf, r.WithContext(ctx))
+		if buf.streaming {
+			return
+		}
+
+		if buf.status == 0 {
+			buf.status = http.StatusOK
+		}
+		if buf.status < http.StatusBadRequest {
+			if err := tx.Commit(); err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+				return
+			}
+		}
+		for k, v := range buf.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+		if buf.status < http.StatusBadRequest {
+			for _, fn := range hooks {
+				fn()
+			}
+		}
+	})
+}
@@ -0,0 +1,50 @@
+// rls_test.go
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAfterCommit(t *testing.T) {
+	useFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		return fakeResult{}, nil
+	})
+	tests := []struct {
+		name   string
+		status int
+		want   bool
+	}{
+		{"committed", http.StatusCreated, true},
+		{"rolled back", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			h := rlsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				afterCommit(r, func() { ran = true })
+				if ran {
+					t.Error("hook ran before the request transaction committed")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, &AuthUser{ID: 1}))
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status || ran != tt.want {
+				t.Errorf("status %d, hook ran %v; want %d, %v", w.Code, ran, tt.status, tt.want)
+			}
+		})
+	}
+
+	// Without row-level security there is no request transaction to wait for.
+	ran := false
+	afterCommit(httptest.NewRequest(http.MethodPost, "/", nil), func() { ran = true })
+	if !ran {
+		t.Error("hook did not run without a request transaction")
+	}
+}
@@ -0,0 +1,221 @@
+// serviceaccounts.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const apiKeyPrefix = "bgk_"
+
+// --- MODELS ---
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	Key        string     `json:"key,omitempty"` // only returned on creation
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// lookupAPIKey resolves a raw API key to the account that owns it.
+func lookupAPIKey(key string) (*AuthUser, error) {
+	var keyID int
+	u := AuthUser{}
+	err := db.QueryRow(`
+        SELECT k.id, k.user_id, u.role, k.scope
+        FROM api_keys k
+        JOIN users u ON u.id = k.user_id
+        WHERE k.key_hash = $1 AND k.revoked_at IS NULL`, hashToken(key)).Scan(&keyID, &u.ID, &u.Role, &u.Scope)
+	if err != nil {
+		return nil, err
+	}
+	u.TokenID = "apikey:" + strconv.Itoa(keyID)
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE id=$1", keyID); err != nil {
+		log.Printf("Failed to record API key usage for key %d: %v", keyID, err)
+	}
+	return &u, nil
+}
+
+// insertAPIKey generates a new secret for k and stores its hash. The plaintext
+// key is left on k so it can be shown to the caller exactly once.
+func insertAPIKey(k *APIKey) error {
+	k.Key = apiKeyPrefix + randomToken()
+	k.Prefix = k.Key[:len(apiKeyPrefix)+8]
+	return db.QueryRow("INSERT INTO api_keys (user_id, name, prefix, key_hash, scope) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		k.UserID, k.Name, k.Prefix, hashToken(k.Key), k.Scope).Scan(&k.ID, &k.CreatedAt)
+}
+
+func listAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := db.Query("SELECT id, user_id, name, prefix, scope, created_at, last_used_at FROM api_keys WHERE user_id=$1 AND revoked_at IS NULL ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Scope, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func isServiceAccount(userID int) (bool, error) {
+	var isService bool
+	err := db.QueryRow("SELECT is_service FROM users WHERE id=$1", userID).Scan(&isService)
+	return isService, err
+}
+
+// --- SERVICE ACCOUNT HANDLERS ---
+
+func CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	var u User
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil || u.Username == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	// Service accounts get an unguessable password; they can never log in anyway.
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(randomToken()), 8)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to hash password")
+		return
+	}
+	err = db.QueryRow("INSERT INTO users (username, password, is_service) VALUES ($1, $2, TRUE) RETURNING id, role",
+		u.Username, string(hashedPassword)).Scan(&u.ID, &u.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create service account. The username may be taken.")
+		return
+	}
+	u.Password = ""
+	u.IsService = true
+	respondWithJSON(w, http.StatusCreated, u)
+}
+
+func GetServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, username, role FROM users WHERE is_service ORDER BY username")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve service accounts")
+		return
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		u := User{IsService: true}
+		if err := rows.Scan(&u.ID, &u.Username, &u.Role); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan service account")
+			return
+		}
+		users = append(users, u)
+	}
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+func DeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	res, err := db.Exec("DELETE FROM users WHERE id=$1 AND is_service", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete service account")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Service account not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Service account deleted successfully"})
+}
+
+// --- API KEY HANDLERS ---
+
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	isService, err := isServiceAccount(userID)
+	if err == sql.ErrNoRows || (err == nil && !isService) {
+		respondWithError(w, http.StatusNotFound, "Service account not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	var k APIKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil || strings.TrimSpace(k.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if k.Scope == "" {
+		k.Scope = scopeFull
+	}
+	if k.Scope != scopeFull && k.Scope != scopeRead {
+		respondWithError(w, http.StatusBadRequest, "Scope must be 'full' or 'read'")
+		return
+	}
+	k.UserID = userID
+	if err := insertAPIKey(&k); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, k)
+}
+
+func GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	keys, err := listAPIKeys(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve API keys")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	keyID, err := strconv.Atoi(params["key_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+	res, err := db.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL", keyID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "API key not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+}
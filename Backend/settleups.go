@@ -0,0 +1,229 @@
+// settleups.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The owed ledger tracks what users owe one another. An expense entry says
+// its debtor owes its creditor for something the creditor paid; a
+// settlement entry says the debtor paid the creditor back. Settling up
+// records such a repayment and can also record the money moving between
+// the two users' accounts, as a transfer out of the payer's account and
+// into the payee's, both kept out of budgets.
+
+// Owed entry kinds.
+const (
+	owedExpense    = "expense"
+	owedSettlement = "settlement"
+)
+
+// owedBalanceSQL is what the counterpart of the owed_entries row aliased e
+// owes user $1 because of it; negative when $1 owes them.
+const owedBalanceSQL = `CASE WHEN e.creditor_id = $1 THEN 1 ELSE -1 END * CASE e.kind WHEN 'expense' THEN e.amount ELSE -e.amount END`
+
+// --- MODELS ---
+type OwedEntry struct {
+	ID                    int       `json:"id"`
+	CreditorID            int       `json:"creditor_id"`
+	DebtorID              int       `json:"debtor_id"`
+	Kind                  string    `json:"kind"`
+	Amount                float64   `json:"amount"`
+	Date                  time.Time `json:"date"`
+	Note                  string    `json:"note"`
+	CreditorTransactionID *int      `json:"creditor_transaction_id,omitempty"`
+	DebtorTransactionID   *int      `json:"debtor_transaction_id,omitempty"`
+	RecurringSplitID      *int      `json:"recurring_split_id,omitempty"`
+}
+
+// OwedBalance is where a user stands with one other user; Balance is what
+// the other user owes, negative when it is the other way round.
+type OwedBalance struct {
+	UserID   int     `json:"user_id"`
+	Username string  `json:"username"`
+	Balance  float64 `json:"balance"`
+}
+
+type OwedLedger struct {
+	Balances []OwedBalance `json:"balances"`
+	Entries  []OwedEntry   `json:"entries"`
+}
+
+// SettleUp is the body of the settle-up route: payer_id paid payee_id back
+// amount on date (default today). The caller must be one of the two, and
+// payer_id defaults to the caller. With payer_account_id or
+// payee_account_id the payment is also recorded on those accounts.
+type SettleUp struct {
+	PayerID        int     `json:"payer_id"`
+	PayeeID        int     `json:"payee_id"`
+	Amount         float64 `json:"amount"`
+	Date           string  `json:"date"`
+	Note           string  `json:"note"`
+	PayerAccountID *int    `json:"payer_account_id"`
+	PayeeAccountID *int    `json:"payee_account_id"`
+}
+
+// --- SETTLE-UP HANDLERS ---
+
+// RecordSettleUp records a repayment between two users.
+func RecordSettleUp(w http.ResponseWriter, r *http.Request) {
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var s SettleUp
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if s.PayerID == 0 {
+		s.PayerID = u.ID
+	}
+	if !canAccess(u, s.PayerID) && !canAccess(u, s.PayeeID) {
+		respondWithError(w, http.StatusForbidden, "You can only record settle-ups you are part of")
+		return
+	}
+	if s.PayeeID == s.PayerID {
+		respondWithError(w, http.StatusBadRequest, "payer_id and payee_id must be different users")
+		return
+	}
+	amount := toCents(s.Amount)
+	if amount <= 0 {
+		respondWithError(w, http.StatusBadRequest, "amount must be positive")
+		return
+	}
+	now := time.Now()
+	date := dateOnly(now, now.Location())
+	if s.Date != "" {
+		var err error
+		if date, err = time.Parse("2006-01-02", s.Date); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+			return
+		}
+	}
+	var payerName, payeeName string
+	err := db.QueryRow("SELECT (SELECT username FROM users WHERE id=$1), (SELECT username FROM users WHERE id=$2)", s.PayerID, s.PayeeID).
+		Scan(&payerName, &payeeName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Both users must exist")
+		return
+	}
+
+	newTransaction := func(userID int, description string, cents int64, accountID *int) *Transaction {
+		return &Transaction{UserID: userID, Description: description, Amount: float64(cents) / 100, Date: date, AccountID: accountID,
+			Status: statusCleared, ExcludeFromBudget: true}
+	}
+	var payerT, payeeT *Transaction
+	if s.PayerAccountID != nil {
+		payerT = newTransaction(s.PayerID, "Settle-up with "+payeeName, amount, s.PayerAccountID)
+	}
+	if s.PayeeAccountID != nil {
+		payeeT = newTransaction(s.PayeeID, "Settle-up from "+payerName, -amount, s.PayeeAccountID)
+	}
+	for _, t := range []*Transaction{payerT, payeeT} {
+		if t != nil && (!authorizeAccount(w, t.AccountID, t.UserID, date) ||
+			!authorizeUnlockedDates(w, r, resourceRef{OwnerID: t.UserID}, date) || !applyCurrency(w, db, t)) {
+			return
+		}
+	}
+
+	// Each side's transaction lands in their own ledger, which the caller
+	// cannot write to under row-level security, so this writes through db
+	// once both sides have been checked.
+	e := OwedEntry{CreditorID: s.PayeeID, DebtorID: s.PayerID, Kind: owedSettlement, Amount: float64(amount) / 100, Date: date, Note: s.Note}
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record settle-up")
+		return
+	}
+	defer tx.Rollback()
+	if payerT != nil {
+		if err := insertAccountTransaction(tx, payerT); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to record settle-up")
+			return
+		}
+		e.DebtorTransactionID = &payerT.ID
+	}
+	if payeeT != nil {
+		if err := insertAccountTransaction(tx, payeeT); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to record settle-up")
+			return
+		}
+		e.CreditorTransactionID = &payeeT.ID
+	}
+	err = tx.QueryRow(`INSERT INTO owed_entries (creditor_id, debtor_id, kind, amount, date, note, creditor_transaction_id, debtor_transaction_id, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		e.CreditorID, e.DebtorID, e.Kind, e.Amount, e.Date, e.Note, e.CreditorTransactionID, e.DebtorTransactionID, u.ID).Scan(&e.ID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record settle-up")
+		return
+	}
+	for _, t := range []*Transaction{payerT, payeeT} {
+		if t != nil {
+			recordAudit(r, "transaction", t.ID, auditCreate, nil)
+		}
+	}
+	respondWithJSON(w, http.StatusCreated, e)
+}
+
+// GetOwedLedger returns what a user and each person they have dealings with
+// owe one another, and the entries behind it, latest first.
+func GetOwedLedger(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	ledger := OwedLedger{Balances: []OwedBalance{}, Entries: []OwedEntry{}}
+	rows, err := db.Query(`SELECT o.id, o.username, b.balance FROM (
+            SELECT CASE WHEN e.creditor_id = $1 THEN e.debtor_id ELSE e.creditor_id END AS user_id, SUM(`+owedBalanceSQL+`) AS balance
+            FROM owed_entries e WHERE e.creditor_id = $1 OR e.debtor_id = $1 GROUP BY 1
+        ) b JOIN users o ON o.id = b.user_id
+        WHERE b.balance <> 0
+        ORDER BY o.username`, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve balances")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b OwedBalance
+		if err := rows.Scan(&b.UserID, &b.Username, &b.Balance); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan balance")
+			return
+		}
+		ledger.Balances = append(ledger.Balances, b)
+	}
+
+	entries, err := db.Query(`SELECT id, creditor_id, debtor_id, kind, amount, date, note, creditor_transaction_id, debtor_transaction_id,
+            recurring_split_id
+        FROM owed_entries WHERE creditor_id = $1 OR debtor_id = $1
+        ORDER BY date DESC, id DESC`, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve ledger")
+		return
+	}
+	defer entries.Close()
+	for entries.Next() {
+		var e OwedEntry
+		if err := entries.Scan(&e.ID, &e.CreditorID, &e.DebtorID, &e.Kind, &e.Amount, &e.Date, &e.Note,
+			&e.CreditorTransactionID, &e.DebtorTransactionID, &e.RecurringSplitID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan ledger entry")
+			return
+		}
+		ledger.Entries = append(ledger.Entries, e)
+	}
+	respondWithJSON(w, http.StatusOK, ledger)
+}
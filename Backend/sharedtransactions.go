@@ -0,0 +1,107 @@
+// sharedtransactions.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A share created with show_transactions lets its recipient see why the
+// budget is as used as it is: the transactions of the owner and the
+// budget's members that count towards it in a period. Excluded transactions and categories stay hidden, just as
+// they are left out of the budget's spending.
+
+// --- MODELS ---
+type SharedBudgetTransactions struct {
+	ShareID      int           `json:"share_id"`
+	BudgetID     int           `json:"budget_id"`
+	PeriodStart  time.Time     `json:"period_start"`
+	PeriodEnd    time.Time     `json:"period_end"` // last day of the period, inclusive
+	Transactions []Transaction `json:"transactions"`
+}
+
+// --- SHARED TRANSACTION HANDLERS ---
+
+// GetSharedBudgetTransactions lists the transactions behind the budget of
+// share {id} in the period containing ?date= (default today). The
+// recipient can only see them if the share allows it.
+func GetSharedBudgetTransactions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	shareID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid share ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var budgetID, fromUserID, toUserID int
+	var showTransactions bool
+	err = dbFor(r).QueryRow("SELECT budget_id, from_user_id, to_user_id, show_transactions FROM shared_budgets WHERE id=$1", shareID).
+		Scan(&budgetID, &fromUserID, &toUserID, &showTransactions)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Share not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve share")
+		return
+	}
+	if !canAccess(u, fromUserID) && u.ID != toUserID {
+		respondWithError(w, http.StatusForbidden, "You do not have access to this resource")
+		return
+	}
+	if !canAccess(u, fromUserID) && !showTransactions {
+		respondWithError(w, http.StatusForbidden, "This share does not include transactions")
+		return
+	}
+	date, err := parseDateParam(r, "date", time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'date'")
+		return
+	}
+
+	// Recipients can't see the owner's transactions under row-level
+	// security, so this reads through db once access has been checked.
+	var b Budget
+	if err := scanBudget(db.QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &b); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if b.OrganizationID != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "Organization budgets do not share transactions")
+		return
+	}
+	start, end, err := budgetPeriod(b, date)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	filter := ""
+	if b.Kind == budgetKindIncome {
+		filter = " AND amount < 0 AND linked_transaction_id IS NULL"
+	}
+	rows, err := db.Query(`SELECT `+transactionColumns+` FROM transactions
+        WHERE id IN (SELECT transaction_id FROM transaction_lines
+            WHERE `+budgetLedgerSQL("$4")+` AND NOT excluded AND date >= $2 AND date < $3`+filter+`)
+        ORDER BY date DESC, id DESC`, b.UserID, start, end, b.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
+		return
+	}
+	defer rows.Close()
+	result := SharedBudgetTransactions{ShareID: shareID, BudgetID: b.ID, PeriodStart: start, PeriodEnd: end.AddDate(0, 0, -1), Transactions: []Transaction{}}
+	for rows.Next() {
+		var t Transaction
+		if err := scanTransaction(rows, &t); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
+			return
+		}
+		result.Transactions = append(result.Transactions, t)
+	}
+	respondWithJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,197 @@
+// sharelinks.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// A share link lets someone without an account follow a budget: whoever
+// holds it can read a snapshot of the budget's progress until it expires or
+// the owner revokes it. The link carries a token signed like login tokens
+// but for a different audience, so neither can stand in for the other.
+
+const (
+	shareLinkAudience     = "share-link"
+	defaultShareLinkHours = 24 * 7
+)
+
+// --- MODELS ---
+type ShareLink struct {
+	ID        string    `json:"id"`
+	BudgetID  int       `json:"budget_id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BudgetSnapshot is what a share link shows: the budget's progress without
+// who contributed to it.
+type BudgetSnapshot struct {
+	Name      string         `json:"name"`
+	Currency  *string        `json:"currency,omitempty"`
+	ExpiresAt time.Time      `json:"expires_at"`
+	Progress  BudgetProgress `json:"progress"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func maxShareLinkHours() int {
+	return getEnvInt("SHARE_LINK_MAX_HOURS", 24*30)
+}
+
+func shareLinkSubject(budgetID int) string {
+	return "budget:" + strconv.Itoa(budgetID)
+}
+
+// parseShareLink verifies a share link token and returns its ID and budget.
+func parseShareLink(token string) (string, int, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(shareLinkAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", 0, err
+	}
+	id, ok := strings.CutPrefix(claims.Subject, "budget:")
+	if !ok {
+		return "", 0, errors.New("invalid subject")
+	}
+	budgetID, err := strconv.Atoi(id)
+	return claims.ID, budgetID, err
+}
+
+// requestBaseURL is the scheme and host the request was made to.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// --- SHARE LINK HANDLERS ---
+
+// CreateShareLink issues a link to a read-only snapshot of a budget's
+// progress, valid for expires_in_hours (default a week). Only the owner of a
+// personal budget can create one.
+func CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	u, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ExpiresInHours int `json:"expires_in_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if req.ExpiresInHours == 0 {
+		req.ExpiresInHours = defaultShareLinkHours
+	}
+	if req.ExpiresInHours < 0 || req.ExpiresInHours > maxShareLinkHours() {
+		respondWithError(w, http.StatusBadRequest, "expires_in_hours must be between 1 and "+strconv.Itoa(maxShareLinkHours()))
+		return
+	}
+	budget, err := loadResource("budget", budgetID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify budget ownership")
+		return
+	}
+	if budget.OrgID.Valid || !canAccess(u, budget.OwnerID) {
+		respondWithError(w, http.StatusForbidden, "You can only share your own budgets")
+		return
+	}
+
+	now := time.Now()
+	link := ShareLink{ID: randomToken(), BudgetID: budgetID, ExpiresAt: now.Add(time.Duration(req.ExpiresInHours) * time.Hour)}
+	claims := jwt.RegisteredClaims{
+		ID:        link.ID,
+		Subject:   shareLinkSubject(budgetID),
+		Audience:  jwt.ClaimStrings{shareLinkAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to sign share link")
+		return
+	}
+	_, err = db.Exec("INSERT INTO share_links (id, budget_id, created_by, expires_at) VALUES ($1, $2, $3, $4)",
+		link.ID, budgetID, u.ID, link.ExpiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create share link")
+		return
+	}
+	link.URL = requestBaseURL(r) + "/share-links/" + token
+	respondWithJSON(w, http.StatusCreated, link)
+}
+
+// GetShareLinkSnapshot serves the snapshot behind a share link. It needs no
+// account; the signed token is the credential.
+func GetShareLinkSnapshot(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	linkID, budgetID, err := parseShareLink(params["token"])
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Share link not found or expired")
+		return
+	}
+	var expiresAt time.Time
+	err = db.QueryRow("SELECT expires_at FROM share_links WHERE id=$1 AND budget_id=$2 AND revoked_at IS NULL AND expires_at > NOW()",
+		linkID, budgetID).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Share link not found or expired")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify share link")
+		return
+	}
+	b, progress, ok := loadBudgetProgress(w, budgetID)
+	if !ok {
+		return
+	}
+	progress.Contributions = nil
+	respondWithJSON(w, http.StatusOK, BudgetSnapshot{Name: b.Name, Currency: b.Currency, ExpiresAt: expiresAt, Progress: progress})
+}
+
+// RevokeShareLink stops a share link from working before it expires.
+func RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	res, err := db.Exec("UPDATE share_links SET revoked_at = NOW() WHERE id=$1 AND budget_id=$2 AND revoked_at IS NULL",
+		params["link_id"], budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke share link")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Share link not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Share link revoked successfully"})
+}
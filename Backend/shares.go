@@ -0,0 +1,203 @@
+// shares.go
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Share statuses as listed. A share takes effect as soon as it is created,
+// so it is active until its budget is archived.
+const (
+	shareActive   = "active"
+	shareArchived = "archived"
+)
+
+// --- MODELS ---
+
+// ShareListing is one share as either side sees it, with both usernames.
+type ShareListing struct {
+	ShareID          int    `json:"share_id"`
+	BudgetID         int    `json:"budget_id"`
+	BudgetName       string `json:"budget_name"`
+	FromUserID       int    `json:"from_user_id"`
+	FromUsername     string `json:"from_username"`
+	ToUserID         int    `json:"to_user_id"`
+	ToUsername       string `json:"to_username"`
+	Permission       string `json:"permission"`
+	ShowTransactions bool   `json:"show_transactions"`
+	Status           string `json:"status"`
+}
+
+// ShareRevocation counts what a bulk revocation ended.
+type ShareRevocation struct {
+	Shares     int64 `json:"shares"`
+	ShareLinks int64 `json:"share_links"`
+	Digests    int64 `json:"digests,omitempty"`
+}
+
+// ShareOverview splits a user's shares into the budgets they have shared
+// and the budgets shared with them.
+type ShareOverview struct {
+	Outgoing []ShareListing `json:"outgoing"`
+	Incoming []ShareListing `json:"incoming"`
+}
+
+// --- SHARE HANDLERS ---
+
+// GetShares lists every share a user is party to, in either direction.
+func GetShares(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	// The other side's budget and username are hidden by row-level
+	// security, so this reads through db once access has been checked.
+	rows, err := db.Query(`SELECT sb.id, sb.budget_id, b.name, sb.from_user_id, fu.username, sb.to_user_id, tu.username,
+            sb.permission, sb.show_transactions, b.archived_at IS NOT NULL
+        FROM shared_budgets sb
+        JOIN budgets b ON b.id = sb.budget_id
+        JOIN users fu ON fu.id = sb.from_user_id
+        JOIN users tu ON tu.id = sb.to_user_id
+        WHERE sb.from_user_id = $1 OR sb.to_user_id = $1
+        ORDER BY b.name, sb.id`, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve shares")
+		return
+	}
+	defer rows.Close()
+	overview := ShareOverview{Outgoing: []ShareListing{}, Incoming: []ShareListing{}}
+	for rows.Next() {
+		var s ShareListing
+		var archived bool
+		if err := rows.Scan(&s.ShareID, &s.BudgetID, &s.BudgetName, &s.FromUserID, &s.FromUsername, &s.ToUserID, &s.ToUsername,
+			&s.Permission, &s.ShowTransactions, &archived); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan share")
+			return
+		}
+		s.Status = shareActive
+		if archived {
+			s.Status = shareArchived
+		}
+		if s.FromUserID == userID {
+			overview.Outgoing = append(overview.Outgoing, s)
+		} else {
+			overview.Incoming = append(overview.Incoming, s)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, overview)
+}
+
+// RevokeSharesWithUser ends every share between a user and another user, in
+// either direction, for when the two stop sharing altogether. Either side may
+// end a share, so this needs no say from the other user.
+func RevokeSharesWithUser(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	otherID, err := strconv.Atoi(params["other_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	rows, err := dbFor(r).Query(`DELETE FROM shared_budgets
+        WHERE (from_user_id = $1 AND to_user_id = $2) OR (from_user_id = $2 AND to_user_id = $1)
+        RETURNING budget_id`, userID, otherID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke shares")
+		return
+	}
+	var budgetIDs []int
+	for rows.Next() {
+		var budgetID int
+		if err := rows.Scan(&budgetID); err != nil {
+			rows.Close()
+			respondWithError(w, http.StatusInternalServerError, "Failed to revoke shares")
+			return
+		}
+		budgetIDs = append(budgetIDs, budgetID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke shares")
+		return
+	}
+	for _, budgetID := range budgetIDs {
+		notifyBudgetEvent(userID, otherID, notifyUnshared, budgetID)
+	}
+	respondWithJSON(w, http.StatusOK, ShareRevocation{Shares: int64(len(budgetIDs))})
+}
+
+// RevokeBudgetShares ends every share of a budget and revokes its share
+// links, for when the budget is being retired.
+func RevokeBudgetShares(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke shares")
+		return
+	}
+	defer tx.Rollback()
+	var revoked ShareRevocation
+	var recipients []int
+	rows, err := tx.Query("DELETE FROM shared_budgets WHERE budget_id=$1 RETURNING to_user_id", budgetID)
+	if err == nil {
+		for rows.Next() {
+			var recipient int
+			if err = rows.Scan(&recipient); err != nil {
+				break
+			}
+			recipients = append(recipients, recipient)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+	if err == nil {
+		revoked.Shares = int64(len(recipients))
+		var res sql.Result
+		res, err = tx.Exec("UPDATE share_links SET revoked_at = NOW() WHERE budget_id=$1 AND revoked_at IS NULL AND expires_at > NOW()", budgetID)
+		if err == nil {
+			revoked.ShareLinks, _ = res.RowsAffected()
+			res, err = tx.Exec("DELETE FROM budget_digests WHERE budget_id=$1", budgetID)
+		}
+		if err == nil {
+			revoked.Digests, _ = res.RowsAffected()
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke shares")
+		return
+	}
+	u, _ := currentUser(r)
+	for _, recipient := range recipients {
+		notifyBudgetEvent(u.ID, recipient, notifyUnshared, budgetID)
+	}
+	respondWithJSON(w, http.StatusOK, revoked)
+}
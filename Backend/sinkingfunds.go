@@ -0,0 +1,401 @@
+// sinkingfunds.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A sinking fund saves toward a known future expense, e.g. $1,200 of
+// insurance due in December, by setting money aside each month. Money is
+// moved in and out of a fund with contributions; a negative contribution is
+// a withdrawal. A budget linked to a fund sweeps what it leaves unspent
+// into the fund as each period closes.
+
+// --- MODELS ---
+type SinkingFund struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	Name         string    `json:"name"`
+	TargetAmount float64   `json:"target_amount"`
+	TargetDate   time.Time `json:"target_date"`
+}
+
+type SinkingFundContribution struct {
+	ID     int       `json:"id"`
+	FundID int       `json:"fund_id"`
+	Amount float64   `json:"amount"`
+	Date   time.Time `json:"date"`
+	Note   string    `json:"note"`
+	// BudgetID is set on contributions swept from a linked budget.
+	BudgetID *int `json:"budget_id,omitempty"`
+}
+
+// BudgetGoalLink names the savings goal a budget feeds.
+type BudgetGoalLink struct {
+	SinkingFundID int `json:"sinking_fund_id"`
+}
+
+// SinkingFundProgress reports how far a fund is from its target. The
+// monthly contribution spreads what was still missing at the start of this
+// month evenly over the months up to and including the target month, so
+// contributing during the month doesn't move the figure until the next one.
+type SinkingFundProgress struct {
+	SinkingFund
+	Saved                float64 `json:"saved"`
+	Remaining            float64 `json:"remaining"`
+	PercentSaved         float64 `json:"percent_saved"`
+	MonthsLeft           int     `json:"months_left"`
+	MonthlyContribution  float64 `json:"monthly_contribution"`
+	ContributedThisMonth float64 `json:"contributed_this_month"`
+	StillNeededThisMonth float64 `json:"still_needed_this_month"`
+	Funded               bool    `json:"funded"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+func validateSinkingFund(w http.ResponseWriter, f SinkingFund) bool {
+	switch {
+	case strings.TrimSpace(f.Name) == "":
+		respondWithError(w, http.StatusBadRequest, "Fund name is required")
+	case f.TargetAmount <= 0:
+		respondWithError(w, http.StatusBadRequest, "target_amount must be positive")
+	case f.TargetDate.IsZero():
+		respondWithError(w, http.StatusBadRequest, "target_date is required")
+	default:
+		return true
+	}
+	return false
+}
+
+// sinkingFundProgress calculates f's progress as of now.
+func sinkingFundProgress(f SinkingFund, now time.Time) (SinkingFundProgress, error) {
+	p := SinkingFundProgress{SinkingFund: f}
+	month := monthStart(now)
+	err := db.QueryRow(`
+        SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(amount) FILTER (WHERE date >= $2), 0)
+        FROM sinking_fund_contributions WHERE fund_id = $1`, f.ID, month).
+		Scan(&p.Saved, &p.ContributedThisMonth)
+	if err != nil {
+		return p, err
+	}
+	p.Remaining = math.Max(math.Round((f.TargetAmount-p.Saved)*100)/100, 0)
+	p.PercentSaved = math.Round(p.Saved/f.TargetAmount*10000) / 100
+	p.Funded = p.Remaining == 0
+
+	target := time.Date(f.TargetDate.Year(), f.TargetDate.Month(), 1, 0, 0, 0, 0, now.Location())
+	p.MonthsLeft = (target.Year()-month.Year())*12 + int(target.Month()-month.Month()) + 1
+	if p.MonthsLeft < 0 {
+		p.MonthsLeft = 0
+	}
+	missing := math.Max(f.TargetAmount-(p.Saved-p.ContributedThisMonth), 0)
+	if p.MonthsLeft > 0 {
+		p.MonthlyContribution = math.Round(missing/float64(p.MonthsLeft)*100) / 100
+	} else {
+		p.MonthlyContribution = p.Remaining
+	}
+	p.StillNeededThisMonth = math.Min(math.Max(math.Round((p.MonthlyContribution-p.ContributedThisMonth)*100)/100, 0), p.Remaining)
+	return p, nil
+}
+
+func loadSinkingFund(id int) (SinkingFund, error) {
+	var f SinkingFund
+	err := db.QueryRow("SELECT id, user_id, name, target_amount, target_date FROM sinking_funds WHERE id=$1", id).
+		Scan(&f.ID, &f.UserID, &f.Name, &f.TargetAmount, &f.TargetDate)
+	return f, err
+}
+
+// --- SINKING FUND HANDLERS ---
+
+func CreateSinkingFund(w http.ResponseWriter, r *http.Request) {
+	var f SinkingFund
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &f.UserID) || !validateSinkingFund(w, f) {
+		return
+	}
+	err := db.QueryRow(`INSERT INTO sinking_funds (user_id, name, target_amount, target_date)
+        VALUES ($1, $2, $3, $4) RETURNING id`, f.UserID, f.Name, f.TargetAmount, f.TargetDate).Scan(&f.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create sinking fund")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, f)
+}
+
+// GetSinkingFunds lists a user's funds with their progress, soonest target
+// first.
+func GetSinkingFunds(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	rows, err := db.Query("SELECT id, user_id, name, target_amount, target_date FROM sinking_funds WHERE user_id=$1 ORDER BY target_date, name", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve sinking funds")
+		return
+	}
+	var funds []SinkingFund
+	for rows.Next() {
+		var f SinkingFund
+		if err := rows.Scan(&f.ID, &f.UserID, &f.Name, &f.TargetAmount, &f.TargetDate); err != nil {
+			rows.Close()
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan sinking fund")
+			return
+		}
+		funds = append(funds, f)
+	}
+	rows.Close()
+	now := time.Now()
+	progress := []SinkingFundProgress{}
+	for _, f := range funds {
+		p, err := sinkingFundProgress(f, now)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to calculate sinking fund progress")
+			return
+		}
+		progress = append(progress, p)
+	}
+	respondWithJSON(w, http.StatusOK, progress)
+}
+
+func GetSinkingFundProgress(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	fundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sinking fund ID")
+		return
+	}
+	if !authorizeResource(w, r, "sinking_fund", fundID) {
+		return
+	}
+	f, err := loadSinkingFund(fundID)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Sinking fund not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve sinking fund")
+		return
+	}
+	p, err := sinkingFundProgress(f, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate sinking fund progress")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func UpdateSinkingFund(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	fundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sinking fund ID")
+		return
+	}
+	if !authorizeResource(w, r, "sinking_fund", fundID) {
+		return
+	}
+	var f SinkingFund
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !validateSinkingFund(w, f) {
+		return
+	}
+	_, err = db.Exec("UPDATE sinking_funds SET name=$1, target_amount=$2, target_date=$3 WHERE id=$4",
+		f.Name, f.TargetAmount, f.TargetDate, fundID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update sinking fund")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Sinking fund updated successfully"})
+}
+
+func DeleteSinkingFund(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	fundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sinking fund ID")
+		return
+	}
+	if !authorizeResource(w, r, "sinking_fund", fundID) {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM sinking_funds WHERE id=$1", fundID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete sinking fund")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Sinking fund deleted successfully"})
+}
+
+// --- CONTRIBUTION HANDLERS ---
+
+// AddSinkingFundContribution records money put into (or, when negative,
+// taken out of) a fund. The date defaults to today.
+func AddSinkingFundContribution(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	fundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sinking fund ID")
+		return
+	}
+	if !authorizeResource(w, r, "sinking_fund", fundID) {
+		return
+	}
+	var c SinkingFundContribution
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Amount == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	c.FundID = fundID
+	if c.Date.IsZero() {
+		c.Date = time.Now()
+	}
+	err = db.QueryRow(`INSERT INTO sinking_fund_contributions (fund_id, amount, date, note)
+        VALUES ($1, $2, $3, $4) RETURNING id`, c.FundID, c.Amount, c.Date, c.Note).Scan(&c.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to record contribution")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, c)
+}
+
+func GetSinkingFundContributions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	fundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sinking fund ID")
+		return
+	}
+	if !authorizeResource(w, r, "sinking_fund", fundID) {
+		return
+	}
+	rows, err := db.Query("SELECT id, fund_id, amount, date, note, budget_id FROM sinking_fund_contributions WHERE fund_id=$1 ORDER BY date DESC, id DESC", fundID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve contributions")
+		return
+	}
+	defer rows.Close()
+	contributions := []SinkingFundContribution{}
+	for rows.Next() {
+		var c SinkingFundContribution
+		if err := rows.Scan(&c.ID, &c.FundID, &c.Amount, &c.Date, &c.Note, &c.BudgetID); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan contribution")
+			return
+		}
+		contributions = append(contributions, c)
+	}
+	respondWithJSON(w, http.StatusOK, contributions)
+}
+
+func DeleteSinkingFundContribution(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	fundID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid sinking fund ID")
+		return
+	}
+	contributionID, err := strconv.Atoi(params["contribution_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid contribution ID")
+		return
+	}
+	if !authorizeResource(w, r, "sinking_fund", fundID) {
+		return
+	}
+	res, err := db.Exec("DELETE FROM sinking_fund_contributions WHERE id=$1 AND fund_id=$2", contributionID, fundID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete contribution")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Contribution not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Contribution deleted successfully"})
+}
+
+// --- BUDGET GOAL HANDLERS ---
+
+// LinkBudgetGoal links a personal budget to one of its owner's sinking
+// funds. From then on, money left under budget when a period closes is
+// contributed to the fund instead of rolling over.
+func LinkBudgetGoal(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	var link BudgetGoalLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil || link.SinkingFundID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	var b Budget
+	if err := scanBudget(dbFor(r).QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &b); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if b.OrganizationID != nil || b.Kind == budgetKindIncome {
+		respondWithError(w, http.StatusUnprocessableEntity, "Only personal expense budgets can feed a savings goal")
+		return
+	}
+	fund, err := loadSinkingFund(link.SinkingFundID)
+	if err == sql.ErrNoRows || (err == nil && fund.UserID != b.UserID) {
+		respondWithError(w, http.StatusBadRequest, "Sinking fund does not belong to the budget's owner")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve sinking fund")
+		return
+	}
+	before := snapshotResource(dbFor(r), "budget", budgetID)
+	if _, err := dbFor(r).Exec("UPDATE budgets SET sinking_fund_id=$1 WHERE id=$2", fund.ID, budgetID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to link savings goal")
+		return
+	}
+	recordAudit(r, "budget", budgetID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Savings goal linked successfully"})
+}
+
+func UnlinkBudgetGoal(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	if !authorizeResource(w, r, "budget", budgetID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "budget", budgetID)
+	res, err := dbFor(r).Exec("UPDATE budgets SET sinking_fund_id=NULL WHERE id=$1 AND sinking_fund_id IS NOT NULL", budgetID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to unlink savings goal")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Budget is not linked to a savings goal")
+		return
+	}
+	recordAudit(r, "budget", budgetID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Savings goal unlinked successfully"})
+}
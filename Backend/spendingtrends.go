@@ -0,0 +1,139 @@
+// spendingtrends.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Spending trends give each category's spending month by month, with the
+// trend of a line fitted through it, so a client can draw trend lines and
+// say "groceries are creeping up 8% a month" without aggregating anything
+// itself. Only whole months count: the current one is still filling up and
+// would drag every trend down.
+
+const (
+	defaultTrendMonths = 6
+	maxTrendMonths     = 36
+)
+
+// --- MODELS ---
+type TrendPoint struct {
+	Month string  `json:"month"` // YYYY-MM
+	Total float64 `json:"total"`
+}
+
+type CategoryTrend struct {
+	CategoryID *int    `json:"category_id"`
+	Category   string  `json:"category"`
+	Average    float64 `json:"average"` // per month
+	// TrendPercent is the slope of the fitted line as a percentage of the
+	// average: how much spending grows (or, negative, shrinks) each month.
+	// Null when the category's average is not positive.
+	TrendPercent *float64     `json:"trend_percent"`
+	Series       []TrendPoint `json:"series"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// trendPercent fits a least-squares line through totals, one a month, and
+// returns its slope as a percentage of their mean, or nil when the mean is
+// not positive.
+func trendPercent(totals []float64) (mean float64, trend *float64) {
+	n := float64(len(totals))
+	if n == 0 {
+		return 0, nil
+	}
+	for _, t := range totals {
+		mean += t
+	}
+	mean /= n
+	if mean <= 0 || n < 2 {
+		return mean, nil
+	}
+	xMean := (n - 1) / 2
+	var num, den float64
+	for i, t := range totals {
+		num += (float64(i) - xMean) * (t - mean)
+		den += (float64(i) - xMean) * (float64(i) - xMean)
+	}
+	p := math.Round(num/den/mean*10000) / 100
+	return mean, &p
+}
+
+// --- SPENDING TREND HANDLERS ---
+
+// GetSpendingTrends returns a user's personal spending per category for each
+// of the last ?months= whole months (default 6, at most 36), oldest first,
+// with each category's trend. Categories without spending in those months
+// are left out; months without spending in a category count as zero.
+func GetSpendingTrends(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	months := defaultTrendMonths
+	if v := r.URL.Query().Get("months"); v != "" {
+		if months, err = strconv.Atoi(v); err != nil || months < 1 || months > maxTrendMonths {
+			respondWithError(w, http.StatusBadRequest, "'months' must be between 1 and "+strconv.Itoa(maxTrendMonths))
+			return
+		}
+	}
+	end := monthStart(time.Now().UTC())
+	start := end.AddDate(0, -months, 0)
+	rows, err := dbFor(r).Query(`
+        WITH months AS (
+            SELECT generate_series($2::timestamp, $3::timestamp - INTERVAL '1 month', INTERVAL '1 month') AS start
+        ), spending AS (
+            SELECT l.category_id, date_trunc('month', l.date::timestamp) AS start, SUM(l.amount) AS total
+            FROM transaction_lines l
+            WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3
+              AND NOT (`+incomeLineSQL("l")+`)
+            GROUP BY 1, 2
+        )
+        SELECT k.category_id, COALESCE(c.name, 'Uncategorized'), TO_CHAR(m.start, 'YYYY-MM'), COALESCE(s.total, 0)
+        FROM (SELECT DISTINCT category_id FROM spending) k
+        CROSS JOIN months m
+        LEFT JOIN spending s ON s.category_id IS NOT DISTINCT FROM k.category_id AND s.start = m.start
+        LEFT JOIN categories c ON c.id = k.category_id
+        ORDER BY 2, 1, m.start`, userID, start, end)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build spending trends")
+		return
+	}
+	defer rows.Close()
+	trends := []CategoryTrend{}
+	for rows.Next() {
+		var categoryID *int
+		var category string
+		var p TrendPoint
+		if err := rows.Scan(&categoryID, &category, &p.Month, &p.Total); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan spending trend")
+			return
+		}
+		// Rows come grouped by category, each with a row per month.
+		if len(trends) == 0 || len(trends[len(trends)-1].Series) == months {
+			trends = append(trends, CategoryTrend{CategoryID: categoryID, Category: category, Series: []TrendPoint{}})
+		}
+		t := &trends[len(trends)-1]
+		t.Series = append(t.Series, p)
+	}
+	for i := range trends {
+		totals := make([]float64, len(trends[i].Series))
+		for j, p := range trends[i].Series {
+			totals[j] = p.Total
+		}
+		mean, trend := trendPercent(totals)
+		trends[i].Average, trends[i].TrendPercent = math.Round(mean*100)/100, trend
+	}
+	respondWithJSON(w, http.StatusOK, trends)
+}
@@ -0,0 +1,228 @@
+// splits.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type TransactionSplit struct {
+	ID            int     `json:"id"`
+	TransactionID int     `json:"transaction_id"`
+	CategoryID    int     `json:"category_id"`
+	Amount        float64 `json:"amount"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// toCents rounds an amount to whole cents so sums can be compared exactly.
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// splitTotal returns the number of splits on a transaction and their sum.
+func splitTotal(q queryer, transactionID int) (int, float64, error) {
+	var count int
+	var total float64
+	err := q.QueryRow("SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM transaction_splits WHERE transaction_id=$1", transactionID).Scan(&count, &total)
+	return count, total, err
+}
+
+// ensureSplitsMatch rejects a new amount for a split transaction unless it
+// still equals the sum of its splits.
+func ensureSplitsMatch(w http.ResponseWriter, q queryer, transactionID int, amount float64) bool {
+	count, total, err := splitTotal(q, transactionID)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify splits")
+		return false
+	}
+	if count > 0 && toCents(total) != toCents(amount) {
+		respondWithError(w, http.StatusBadRequest, "Amount must equal the sum of the transaction's splits; update the splits first")
+		return false
+	}
+	return true
+}
+
+// --- SPLIT HANDLERS ---
+
+func GetTransactionSplits(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) {
+		return
+	}
+	rows, err := dbFor(r).Query("SELECT id, transaction_id, COALESCE(category_id, 0), amount FROM transaction_splits WHERE transaction_id=$1 ORDER BY id", transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve splits")
+		return
+	}
+	defer rows.Close()
+	splits := []TransactionSplit{}
+	for rows.Next() {
+		var s TransactionSplit
+		if err := rows.Scan(&s.ID, &s.TransactionID, &s.CategoryID, &s.Amount); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan split")
+			return
+		}
+		splits = append(splits, s)
+	}
+	respondWithJSON(w, http.StatusOK, splits)
+}
+
+// SetTransactionSplits replaces a transaction's splits. The split amounts
+// must add up to the transaction amount; an empty list removes the split.
+func SetTransactionSplits(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) || !authorizeTransactionUnlocked(w, r, transactionID) {
+		return
+	}
+	var splits []TransactionSplit
+	if err := json.NewDecoder(r.Body).Decode(&splits); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	owner, err := loadResource("transaction", transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify transaction owner")
+		return
+	}
+	var amount float64
+	if err := dbFor(r).QueryRow("SELECT amount FROM transactions WHERE id=$1", transactionID).Scan(&amount); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transaction")
+		return
+	}
+	if len(splits) == 1 {
+		respondWithError(w, http.StatusBadRequest, "A split needs at least two parts")
+		return
+	}
+	var sum int64
+	for _, s := range splits {
+		if s.CategoryID == 0 || s.Amount == 0 {
+			respondWithError(w, http.StatusBadRequest, "Each split needs a category and a non-zero amount")
+			return
+		}
+		if !authorizeCategory(w, s.CategoryID, owner) {
+			return
+		}
+		sum += toCents(s.Amount)
+	}
+	if len(splits) > 0 && sum != toCents(amount) {
+		respondWithError(w, http.StatusBadRequest, "Split amounts must add up to the transaction amount")
+		return
+	}
+
+	err = withTx(r, func(q queryer) error {
+		if _, err := q.Exec("DELETE FROM transaction_splits WHERE transaction_id=$1", transactionID); err != nil {
+			return err
+		}
+		for i := range splits {
+			splits[i].TransactionID = transactionID
+			err := q.QueryRow("INSERT INTO transaction_splits (transaction_id, category_id, amount) VALUES ($1, $2, $3) RETURNING id",
+				transactionID, splits[i].CategoryID, splits[i].Amount).Scan(&splits[i].ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save splits")
+		return
+	}
+	if splits == nil {
+		splits = []TransactionSplit{}
+	}
+	respondWithJSON(w, http.StatusOK, splits)
+}
+
+// --- REPORT HANDLERS ---
+
+// GetCategoryReport totals a user's personal spending per category for a
+// date range (default: the current month). Split transactions count toward
+// each of their split categories rather than the parent's. Linked refunds are
+// netted against the original expense's category unless ?refunds=gross.
+// Spending excluded from budgets is left out. With ?level=parent spending in
+// subcategories is rolled up into their top-level category.
+func GetCategoryReport(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	now := time.Now()
+	from, err := parseDateParam(r, "from", monthStart(now))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'from' date")
+		return
+	}
+	to, err := parseDateParam(r, "to", monthStart(now).AddDate(0, 1, -1))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid 'to' date")
+		return
+	}
+	mode, ok := refundReportMode(w, r)
+	if !ok {
+		return
+	}
+	level, ok := categoryReportLevel(w, r)
+	if !ok {
+		return
+	}
+	categoryID := "CASE WHEN o.id IS NULL THEN l.category_id ELSE o.category_id END"
+	query := `
+        SELECT COALESCE(c.name, 'Uncategorized'), SUM(l.amount)
+        FROM transaction_lines l
+        LEFT JOIN transactions o ON o.id = l.linked_transaction_id`
+	if level == "parent" {
+		query = categoryRootsCTE + query + `
+        LEFT JOIN category_roots cr ON cr.id = ` + categoryID + `
+        LEFT JOIN categories c ON c.id = cr.root_id`
+	} else {
+		query += `
+        LEFT JOIN categories c ON c.id = ` + categoryID
+	}
+	query += `
+        WHERE l.user_id = $1 AND l.organization_id IS NULL AND NOT l.excluded AND l.date >= $2 AND l.date < $3::date + 1`
+	if mode == "gross" {
+		query += " AND l.linked_transaction_id IS NULL"
+	}
+	query += `
+        GROUP BY COALESCE(c.name, 'Uncategorized')
+        ORDER BY SUM(l.amount) DESC`
+	rows, err := dbFor(r).Query(query, userID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build report")
+		return
+	}
+	defer rows.Close()
+	report := []CategorySpending{}
+	for rows.Next() {
+		var c CategorySpending
+		if err := rows.Scan(&c.Category, &c.Total); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan report row")
+			return
+		}
+		report = append(report, c)
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
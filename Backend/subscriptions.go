@@ -0,0 +1,231 @@
+// subscriptions.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	subscriptionLookbackDays = 400
+	minSubscriptionCharges   = 3
+	// subscriptionAmountTolerance is how far a charge may stray from the
+	// median amount and still count as the same subscription.
+	subscriptionAmountTolerance = 0.2
+	daysPerMonth                = 30.44
+)
+
+// subscriptionPeriods are the billing intervals the analyzer recognises, in
+// days, with how far an observed gap may drift from them.
+var subscriptionPeriods = []struct {
+	days, tolerance float64
+}{
+	{7, 1}, {14, 2}, {30.44, 4}, {91.31, 10}, {182.62, 14}, {365.25, 20},
+}
+
+// --- MODELS ---
+type Subscription struct {
+	ID            int       `json:"id"`
+	UserID        int       `json:"user_id"`
+	PayeeID       int       `json:"payee_id"`
+	Payee         string    `json:"payee"`
+	AverageAmount float64   `json:"average_amount"`
+	IntervalDays  int       `json:"interval_days"`
+	MonthlyCost   float64   `json:"monthly_cost"`
+	LastCharged   time.Time `json:"last_charged"`
+	NextExpected  time.Time `json:"next_expected"`
+	Status        string    `json:"status"`
+}
+
+type recurringCharge struct {
+	date   time.Time
+	amount float64
+}
+
+// --- DETECTION ---
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// detectRecurring decides whether charges (sorted by date) to one payee look
+// like a subscription: at least three charges, every gap close to one of
+// subscriptionPeriods, and amounts within tolerance of the median. It
+// returns the billing interval in days and the average amount.
+func detectRecurring(charges []recurringCharge) (float64, float64, bool) {
+	if len(charges) < minSubscriptionCharges {
+		return 0, 0, false
+	}
+	gaps := make([]float64, 0, len(charges)-1)
+	amounts := make([]float64, 0, len(charges))
+	for i, c := range charges {
+		amounts = append(amounts, c.amount)
+		if i > 0 {
+			gaps = append(gaps, c.date.Sub(charges[i-1].date).Hours()/24)
+		}
+	}
+	typical := median(gaps)
+	var period float64
+	for _, p := range subscriptionPeriods {
+		if math.Abs(typical-p.days) <= p.tolerance {
+			period = p.days
+			for _, gap := range gaps {
+				if math.Abs(gap-p.days) > p.tolerance {
+					return 0, 0, false
+				}
+			}
+			break
+		}
+	}
+	if period == 0 {
+		return 0, 0, false
+	}
+	mid := median(amounts)
+	var sum float64
+	for _, a := range amounts {
+		if math.Abs(a-mid) > math.Abs(mid)*subscriptionAmountTolerance {
+			return 0, 0, false
+		}
+		sum += a
+	}
+	return period, sum / float64(len(amounts)), true
+}
+
+// --- JOBS ---
+
+// detectSubscriptions scans recent personal transactions per payee and
+// records recurring charges. Existing detections are refreshed, but a user's
+// confirm or dismiss decision is kept.
+func detectSubscriptions() error {
+	rows, err := db.Query(`
+        SELECT user_id, payee_id, date, amount FROM transactions
+        WHERE payee_id IS NOT NULL AND organization_id IS NULL AND deleted_at IS NULL AND date >= $1
+        ORDER BY user_id, payee_id, date`, time.Now().AddDate(0, 0, -subscriptionLookbackDays))
+	if err != nil {
+		return err
+	}
+	type series struct {
+		userID, payeeID int
+		charges         []recurringCharge
+	}
+	var all []series
+	for rows.Next() {
+		var userID, payeeID int
+		var c recurringCharge
+		if err := rows.Scan(&userID, &payeeID, &c.date, &c.amount); err != nil {
+			rows.Close()
+			return err
+		}
+		if n := len(all); n == 0 || all[n-1].userID != userID || all[n-1].payeeID != payeeID {
+			all = append(all, series{userID: userID, payeeID: payeeID})
+		}
+		all[len(all)-1].charges = append(all[len(all)-1].charges, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range all {
+		period, average, ok := detectRecurring(s.charges)
+		if !ok {
+			continue
+		}
+		last := s.charges[len(s.charges)-1].date
+		next := last.Add(time.Duration(period*24) * time.Hour)
+		_, err := db.Exec(`
+            INSERT INTO subscriptions (user_id, payee_id, average_amount, interval_days, last_charged, next_expected)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (user_id, payee_id) DO UPDATE
+            SET average_amount = EXCLUDED.average_amount, interval_days = EXCLUDED.interval_days,
+                last_charged = EXCLUDED.last_charged, next_expected = EXCLUDED.next_expected, updated_at = NOW()`,
+			s.userID, s.payeeID, math.Round(average*100)/100, int(math.Round(period)), last, next)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- SUBSCRIPTION HANDLERS ---
+
+// GetSubscriptions lists detected subscriptions with their estimated
+// monthly cost, most expensive first. Dismissed ones are hidden unless
+// ?include_dismissed=true.
+func GetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	query := `
+        SELECT s.id, s.user_id, s.payee_id, p.name, s.average_amount, s.interval_days, s.last_charged, s.next_expected, s.status
+        FROM subscriptions s
+        JOIN payees p ON p.id = s.payee_id
+        WHERE s.user_id = $1`
+	if r.URL.Query().Get("include_dismissed") != "true" {
+		query += " AND s.status <> 'dismissed'"
+	}
+	rows, err := db.Query(query+" ORDER BY s.average_amount / s.interval_days DESC", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve subscriptions")
+		return
+	}
+	defer rows.Close()
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		var s Subscription
+		if err := rows.Scan(&s.ID, &s.UserID, &s.PayeeID, &s.Payee, &s.AverageAmount, &s.IntervalDays, &s.LastCharged, &s.NextExpected, &s.Status); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan subscription")
+			return
+		}
+		s.MonthlyCost = math.Round(s.AverageAmount*daysPerMonth/float64(s.IntervalDays)*100) / 100
+		subscriptions = append(subscriptions, s)
+	}
+	respondWithJSON(w, http.StatusOK, subscriptions)
+}
+
+func ConfirmSubscription(w http.ResponseWriter, r *http.Request) {
+	decideSubscription(w, r, "confirmed")
+}
+
+func DismissSubscription(w http.ResponseWriter, r *http.Request) {
+	decideSubscription(w, r, "dismissed")
+}
+
+func decideSubscription(w http.ResponseWriter, r *http.Request, status string) {
+	params := mux.Vars(r)
+	subscriptionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return
+	}
+	if !authorizeResource(w, r, "subscription", subscriptionID) {
+		return
+	}
+	res, err := db.Exec("UPDATE subscriptions SET status=$1, updated_at=NOW() WHERE id=$2", status, subscriptionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update subscription")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Subscription " + status})
+}
@@ -0,0 +1,172 @@
+// suggest.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	suggestionHistoryLimit = 5000
+	maxCategorySuggestions = 5
+)
+
+// --- MODELS ---
+type CategorySuggestionRequest struct {
+	UserID      int     `json:"user_id"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+}
+
+type CategorySuggestion struct {
+	CategoryID  int     `json:"category_id"`
+	Category    string  `json:"category"`
+	Probability float64 `json:"probability"`
+}
+
+// --- NAIVE BAYES ---
+
+// suggestionFeatures turns a transaction into bag-of-words features: the
+// lowercased description words (tokens with digits are reference numbers
+// and dropped) plus a coarse order-of-magnitude bucket for the amount.
+func suggestionFeatures(description string, amount float64) []string {
+	var features []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	}) {
+		if len(word) < 2 || strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			continue
+		}
+		features = append(features, word)
+	}
+	bucket := 0
+	if a := math.Abs(amount); a >= 1 {
+		bucket = int(math.Log10(a)*2) + 1
+	}
+	return append(features, "#amount:"+strconv.Itoa(bucket))
+}
+
+// categoryModel is a multinomial naive Bayes classifier over
+// suggestionFeatures with add-one smoothing.
+type categoryModel struct {
+	docs       map[int]int
+	features   map[int]map[string]int
+	totals     map[int]int
+	vocabulary map[string]bool
+	samples    int
+}
+
+func newCategoryModel() *categoryModel {
+	return &categoryModel{
+		docs:       map[int]int{},
+		features:   map[int]map[string]int{},
+		totals:     map[int]int{},
+		vocabulary: map[string]bool{},
+	}
+}
+
+func (m *categoryModel) train(categoryID int, features []string) {
+	m.samples++
+	m.docs[categoryID]++
+	if m.features[categoryID] == nil {
+		m.features[categoryID] = map[string]int{}
+	}
+	for _, f := range features {
+		m.features[categoryID][f]++
+		m.totals[categoryID]++
+		m.vocabulary[f] = true
+	}
+}
+
+// rank scores every trained category for the features and returns category
+// IDs with normalised probabilities, best first.
+func (m *categoryModel) rank(features []string) ([]int, []float64) {
+	if m.samples == 0 {
+		return nil, nil
+	}
+	vocab := float64(len(m.vocabulary) + 1)
+	ids := make([]int, 0, len(m.docs))
+	scores := map[int]float64{}
+	best := math.Inf(-1)
+	for id, n := range m.docs {
+		score := math.Log(float64(n) / float64(m.samples))
+		for _, f := range features {
+			score += math.Log((float64(m.features[id][f]) + 1) / (float64(m.totals[id]) + vocab))
+		}
+		scores[id] = score
+		ids = append(ids, id)
+		best = math.Max(best, score)
+	}
+	var sum float64
+	for id, score := range scores {
+		scores[id] = math.Exp(score - best)
+		sum += scores[id]
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	probs := make([]float64, len(ids))
+	for i, id := range ids {
+		probs[i] = scores[id] / sum
+	}
+	return ids, probs
+}
+
+// --- SUGGESTION HANDLERS ---
+
+// SuggestCategory ranks the user's categories for a new transaction by
+// training a naive Bayes model on their most recent categorised
+// transactions. Users with no history get an empty list.
+func SuggestCategory(w http.ResponseWriter, r *http.Request) {
+	var req CategorySuggestionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Description) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &req.UserID) {
+		return
+	}
+	rows, err := dbFor(r).Query(`
+        SELECT COALESCE(t.description, ''), t.amount, t.category_id, c.name
+        FROM transactions t
+        JOIN categories c ON c.id = t.category_id
+        WHERE t.user_id = $1 AND t.organization_id IS NULL AND t.deleted_at IS NULL
+        ORDER BY t.date DESC
+        LIMIT $2`, req.UserID, suggestionHistoryLimit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to load transaction history")
+		return
+	}
+	defer rows.Close()
+	model := newCategoryModel()
+	names := map[int]string{}
+	for rows.Next() {
+		var description, name string
+		var amount float64
+		var categoryID int
+		if err := rows.Scan(&description, &amount, &categoryID, &name); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
+			return
+		}
+		model.train(categoryID, suggestionFeatures(description, amount))
+		names[categoryID] = name
+	}
+
+	suggestions := []CategorySuggestion{}
+	ids, probs := model.rank(suggestionFeatures(req.Description, req.Amount))
+	for i, id := range ids {
+		if i == maxCategorySuggestions {
+			break
+		}
+		suggestions = append(suggestions, CategorySuggestion{CategoryID: id, Category: names[id], Probability: math.Round(probs[i]*1000) / 1000})
+	}
+	respondWithJSON(w, http.StatusOK, suggestions)
+}
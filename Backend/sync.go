@@ -0,0 +1,89 @@
+// sync.go
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// encodeCursor makes an opaque keyset cursor from the (date, id) of the last
+// transaction on a page.
+func encodeCursor(date time.Time, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(date.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (time.Time, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("malformed cursor")
+	}
+	date, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	id, err := strconv.Atoi(parts[1])
+	return date, id, err
+}
+
+// usesCursor reports whether a transaction list request wants keyset
+// pagination rather than page numbers.
+func usesCursor(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Has("after") || query.Get("updated_since") != ""
+}
+
+// getTransactionsByCursor serves GET /transactions/{user_id} in sync mode:
+// rows ascend by (date, id) from just after ?after, and X-Next-Cursor is set
+// while more remain. Combined with updated_since it also returns deleted
+// transactions, with deleted_at set, so clients can drop them locally.
+func getTransactionsByCursor(w http.ResponseWriter, r *http.Request, where string, args []interface{}, perPage int) {
+	if r.URL.Query().Get("sort") != "" {
+		respondWithError(w, http.StatusBadRequest, "'sort' cannot be combined with cursor pagination")
+		return
+	}
+	if after := r.URL.Query().Get("after"); after != "" {
+		date, id, err := decodeCursor(after)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		args = append(args, date, id)
+		where += fmt.Sprintf(" AND (date, id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	columns, source, args, running := transactionSource(r.URL.Query(), args)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY date, id LIMIT $%d", columns, source, where, len(args)+1)
+	rows, err := dbFor(r).Query(query, append(args, perPage+1)...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve transactions")
+		return
+	}
+	defer rows.Close()
+	transactions := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		var extra []interface{}
+		if running {
+			extra = append(extra, &t.RunningBalance)
+		}
+		if err := scanTransaction(rows, &t, extra...); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if len(transactions) > perPage {
+		transactions = transactions[:perPage]
+		last := transactions[perPage-1]
+		w.Header().Set("X-Next-Cursor", encodeCursor(last.Date, last.ID))
+	}
+	w.Header().Set("X-Per-Page", strconv.Itoa(perPage))
+	respondWithJSON(w, http.StatusOK, transactions)
+}
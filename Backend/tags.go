@@ -0,0 +1,199 @@
+// tags.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+type Tag struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// --- TAG HANDLERS ---
+
+func CreateTag(w http.ResponseWriter, r *http.Request) {
+	var t Tag
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil || strings.TrimSpace(t.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &t.UserID) {
+		return
+	}
+	err := dbFor(r).QueryRow("INSERT INTO tags (user_id, name) VALUES ($1, $2) RETURNING id", t.UserID, t.Name).Scan(&t.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create tag. It may already exist for this user.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, t)
+}
+
+func GetTags(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	rows, err := dbFor(r).Query("SELECT id, user_id, name FROM tags WHERE user_id=$1 ORDER BY name", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve tags")
+		return
+	}
+	defer rows.Close()
+	var tags []Tag
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan tag")
+			return
+		}
+		tags = append(tags, t)
+	}
+	respondWithJSON(w, http.StatusOK, tags)
+}
+
+func UpdateTag(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	tagID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+	if !authorizeResource(w, r, "tag", tagID) {
+		return
+	}
+	var t Tag
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil || strings.TrimSpace(t.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	_, err = dbFor(r).Exec("UPDATE tags SET name=$1 WHERE id=$2", t.Name, tagID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update tag. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Tag updated successfully"})
+}
+
+func DeleteTag(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	tagID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+	if !authorizeResource(w, r, "tag", tagID) {
+		return
+	}
+	_, err = dbFor(r).Exec("DELETE FROM tags WHERE id=$1", tagID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete tag")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Tag deleted successfully"})
+}
+
+// --- TRANSACTION TAG HANDLERS ---
+
+func GetTransactionTags(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) {
+		return
+	}
+	query := `
+        SELECT t.id, t.user_id, t.name
+        FROM tags t
+        JOIN transaction_tags tt ON tt.tag_id = t.id
+        WHERE tt.transaction_id = $1
+        ORDER BY t.name`
+	rows, err := dbFor(r).Query(query, transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve tags")
+		return
+	}
+	defer rows.Close()
+	var tags []Tag
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan tag")
+			return
+		}
+		tags = append(tags, t)
+	}
+	respondWithJSON(w, http.StatusOK, tags)
+}
+
+// TagTransaction attaches one of the transaction owner's tags to it.
+func TagTransaction(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) {
+		return
+	}
+	var t Tag
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil || t.ID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	transactionOwner, err := resourceOwner("transaction", transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify transaction owner")
+		return
+	}
+	tagOwner, err := resourceOwner("tag", t.ID)
+	if err != nil || tagOwner != transactionOwner {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag")
+		return
+	}
+	_, err = dbFor(r).Exec("INSERT INTO transaction_tags (transaction_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", transactionID, t.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to tag transaction")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction tagged successfully"})
+}
+
+func UntagTransaction(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	tagID, err := strconv.Atoi(params["tag_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tag ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) {
+		return
+	}
+	_, err = dbFor(r).Exec("DELETE FROM transaction_tags WHERE transaction_id=$1 AND tag_id=$2", transactionID, tagID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to untag transaction")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Tag removed successfully"})
+}
@@ -0,0 +1,215 @@
+// templates.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// --- MODELS ---
+type TransactionTemplate struct {
+	ID          int     `json:"id"`
+	UserID      int     `json:"user_id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+	CategoryID  int     `json:"category_id"`
+	TagIDs      []int64 `json:"tag_ids"`
+	Favorite    bool    `json:"favorite"`
+}
+
+// TemplateUse optionally overrides a template's values for one transaction.
+type TemplateUse struct {
+	Amount *float64  `json:"amount"`
+	Date   time.Time `json:"date"`
+	Notes  string    `json:"notes"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// validateTemplate requires a name and category and checks the category and
+// tags belong to the template's owner.
+func validateTemplate(w http.ResponseWriter, t *TransactionTemplate) bool {
+	if strings.TrimSpace(t.Name) == "" || t.CategoryID == 0 {
+		respondWithError(w, http.StatusBadRequest, "Template name and category_id are required")
+		return false
+	}
+	if !authorizeCategory(w, t.CategoryID, resourceRef{OwnerID: t.UserID}) {
+		return false
+	}
+	for _, tagID := range t.TagIDs {
+		if owner, err := resourceOwner("tag", int(tagID)); err != nil || owner != t.UserID {
+			respondWithError(w, http.StatusBadRequest, "Invalid tag")
+			return false
+		}
+	}
+	if t.TagIDs == nil {
+		t.TagIDs = []int64{}
+	}
+	return true
+}
+
+// --- TEMPLATE HANDLERS ---
+
+func CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var t TransactionTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &t.UserID) || !validateTemplate(w, &t) {
+		return
+	}
+	err := db.QueryRow(`INSERT INTO transaction_templates (user_id, name, description, amount, category_id, tag_ids, favorite)
+        VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7) RETURNING id`,
+		t.UserID, t.Name, t.Description, t.Amount, t.CategoryID, pq.Array(t.TagIDs), t.Favorite).Scan(&t.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create template. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, t)
+}
+
+// GetTemplates lists a user's templates, favorites first.
+func GetTemplates(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	query := `SELECT id, user_id, name, description, amount, COALESCE(category_id, 0), tag_ids, favorite
+        FROM transaction_templates WHERE user_id=$1`
+	if r.URL.Query().Get("favorite") == "true" {
+		query += " AND favorite"
+	}
+	rows, err := db.Query(query+" ORDER BY favorite DESC, name", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve templates")
+		return
+	}
+	defer rows.Close()
+	templates := []TransactionTemplate{}
+	for rows.Next() {
+		var t TransactionTemplate
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Description, &t.Amount, &t.CategoryID, pq.Array(&t.TagIDs), &t.Favorite); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan template")
+			return
+		}
+		templates = append(templates, t)
+	}
+	respondWithJSON(w, http.StatusOK, templates)
+}
+
+func UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	templateID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+	if !authorizeResource(w, r, "template", templateID) {
+		return
+	}
+	var t TransactionTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if t.UserID, err = resourceOwner("template", templateID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify template owner")
+		return
+	}
+	if !validateTemplate(w, &t) {
+		return
+	}
+	_, err = db.Exec(`UPDATE transaction_templates SET name=$1, description=$2, amount=$3, category_id=NULLIF($4, 0), tag_ids=$5, favorite=$6
+        WHERE id=$7`, t.Name, t.Description, t.Amount, t.CategoryID, pq.Array(t.TagIDs), t.Favorite, templateID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update template. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Template updated successfully"})
+}
+
+func DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	templateID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+	if !authorizeResource(w, r, "template", templateID) {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM transaction_templates WHERE id=$1", templateID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete template")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Template deleted successfully"})
+}
+
+// CreateTransactionFromTemplate records a transaction from a template,
+// dated today unless the body says otherwise, and applies its tags. It goes
+// through the same checks as POST /transactions.
+func CreateTransactionFromTemplate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	templateID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+	if !authorizeResource(w, r, "template", templateID) {
+		return
+	}
+	var use TemplateUse
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&use); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+	var tmpl TransactionTemplate
+	err = db.QueryRow(`SELECT user_id, description, amount, COALESCE(category_id, 0), tag_ids FROM transaction_templates WHERE id=$1`,
+		templateID).Scan(&tmpl.UserID, &tmpl.Description, &tmpl.Amount, &tmpl.CategoryID, pq.Array(&tmpl.TagIDs))
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Template not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve template")
+		return
+	}
+
+	if tmpl.CategoryID == 0 {
+		respondWithError(w, http.StatusConflict, "The template's category no longer exists; update the template first")
+		return
+	}
+	t := Transaction{UserID: tmpl.UserID, Description: tmpl.Description, Amount: tmpl.Amount, CategoryID: tmpl.CategoryID, Date: use.Date, Notes: use.Notes}
+	if use.Amount != nil {
+		t.Amount = *use.Amount
+	}
+	if !createTransaction(w, r, &t) {
+		return
+	}
+	if len(tmpl.TagIDs) > 0 {
+		_, err := dbFor(r).Exec(`INSERT INTO transaction_tags (transaction_id, tag_id)
+            SELECT $1, g FROM unnest($2::INTEGER[]) g
+            WHERE EXISTS (SELECT 1 FROM tags WHERE id = g AND user_id = $3)
+            ON CONFLICT DO NOTHING`, t.ID, pq.Array(tmpl.TagIDs), t.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to tag transaction")
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusCreated, t)
+}
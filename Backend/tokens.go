@@ -0,0 +1,97 @@
+// tokens.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	scopeFull = "full"
+	scopeRead = "read"
+)
+
+// readScopePrefixes are the only routes a read-only token may reach: each
+// prefix itself and the paths beneath it, so /budgets covers /budgets/1 but
+// not a /budgets-export route added later.
+var readScopePrefixes = []string{"/transactions", "/budgets", "/tags", "/reports", "/payees"}
+
+// scopeAllows reports whether a credential with the given scope may make
+// the request. Interactive logins carry no scope and are unrestricted.
+func scopeAllows(scope string, r *http.Request) bool {
+	if scope != scopeRead {
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, prefix := range readScopePrefixes {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// --- TOKEN HANDLERS ---
+
+// CreateReadOnlyToken issues a personal read-only API key for the caller,
+// e.g. for a wall-mounted dashboard that should never change data.
+func CreateReadOnlyToken(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	var k APIKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil || strings.TrimSpace(k.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	k.UserID = caller.ID
+	k.Scope = scopeRead
+	if err := insertAPIKey(&k); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, k)
+}
+
+func GetTokens(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	keys, err := listAPIKeys(caller.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve tokens")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+	params := mux.Vars(r)
+	keyID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+	res, err := db.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL", keyID, caller.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Token revoked successfully"})
+}
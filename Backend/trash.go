@@ -0,0 +1,100 @@
+// trash.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashRetention is how long deleted transactions stay restorable before the
+// purge job removes them for good.
+var trashRetention = time.Duration(getEnvInt("TRASH_RETENTION_DAYS", 30)) * 24 * time.Hour
+
+// --- MODELS ---
+type TrashedTransaction struct {
+	Transaction
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+// --- TRASH HANDLERS ---
+
+// GetTrash lists a user's deleted personal transactions, most recently
+// deleted first.
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	page, perPage, err := parsePagination(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid pagination parameters")
+		return
+	}
+	var total int
+	err = dbFor(r).QueryRow("SELECT COUNT(*) FROM transactions WHERE user_id=$1 AND organization_id IS NULL AND deleted_at IS NOT NULL", userID).Scan(&total)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve trash")
+		return
+	}
+	rows, err := dbFor(r).Query(`SELECT `+transactionColumns+`
+        FROM transactions WHERE user_id=$1 AND organization_id IS NULL AND deleted_at IS NOT NULL
+        ORDER BY deleted_at DESC, id DESC LIMIT $2 OFFSET $3`, userID, perPage, (page-1)*perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve trash")
+		return
+	}
+	defer rows.Close()
+	trash := []TrashedTransaction{}
+	for rows.Next() {
+		var t TrashedTransaction
+		if err := scanTransaction(rows, &t.Transaction); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan transaction")
+			return
+		}
+		t.PurgeAt = t.DeletedAt.Add(trashRetention)
+		trash = append(trash, t)
+	}
+	setPaginationHeaders(w, total, page, perPage)
+	respondWithJSON(w, http.StatusOK, trash)
+}
+
+func RestoreTransaction(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	transactionID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid transaction ID")
+		return
+	}
+	if !authorizeResource(w, r, "transaction", transactionID) || !authorizeTransactionUnlocked(w, r, transactionID) {
+		return
+	}
+	before := snapshotResource(dbFor(r), "transaction", transactionID)
+	res, err := dbFor(r).Exec("UPDATE transactions SET deleted_at = NULL WHERE id=$1 AND deleted_at IS NOT NULL", transactionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to restore transaction")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondWithError(w, http.StatusNotFound, "Transaction is not in the trash")
+		return
+	}
+	recordAudit(r, "transaction", transactionID, auditUpdate, before)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction restored successfully"})
+}
+
+// --- JOBS ---
+
+// purgeTrash permanently deletes transactions that have been in the trash
+// longer than the retention window.
+func purgeTrash() error {
+	_, err := db.Exec("DELETE FROM transactions WHERE deleted_at < $1", time.Now().Add(-trashRetention))
+	return err
+}
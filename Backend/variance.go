@@ -0,0 +1,183 @@
+// variance.go
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var varianceCSVHeader = []string{"category", "budgeted", "actual", "variance", "percent_used"}
+
+// --- MODELS ---
+
+// CategoryVariance compares a category's spending with its allocations for
+// the months starting in the period. Budgeted, and with it Variance and
+// PercentUsed, is null for categories nothing was allocated to.
+type CategoryVariance struct {
+	CategoryID  *int     `json:"category_id"`
+	Category    string   `json:"category"`
+	Budgeted    *float64 `json:"budgeted"`
+	Actual      float64  `json:"actual"`
+	Variance    *float64 `json:"variance"` // budgeted - actual; negative when over
+	PercentUsed *float64 `json:"percent_used"`
+}
+
+type VarianceReport struct {
+	BudgetID    int                `json:"budget_id"`
+	Name        string             `json:"name"`
+	PeriodStart time.Time          `json:"period_start"`
+	PeriodEnd   time.Time          `json:"period_end"` // last day of the period, inclusive
+	Budgeted    float64            `json:"budgeted"`
+	Actual      float64            `json:"actual"`
+	Variance    float64            `json:"variance"`
+	PercentUsed *float64           `json:"percent_used"`
+	Categories  []CategoryVariance `json:"categories"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// percentUsed is actual as a percentage of budgeted, or nil when nothing
+// was budgeted.
+func percentUsed(budgeted, actual float64) *float64 {
+	if budgeted == 0 {
+		return nil
+	}
+	p := math.Round(actual/budgeted*10000) / 100
+	return &p
+}
+
+// --- VARIANCE HANDLERS ---
+
+// GetBudgetVariance reports budgeted vs actual spending, overall and per
+// category, for one period of a budget: the period containing ?date=, or by
+// default the last one to have ended. ?format=csv returns it as a CSV
+// download with a closing Total row; the default is JSON. Amounts are in
+// the budget's currency.
+func GetBudgetVariance(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	budgetID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid budget ID")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		respondWithError(w, http.StatusBadRequest, "'format' must be 'json' or 'csv'")
+		return
+	}
+	if !authorizeBudgetView(w, r, budgetID) {
+		return
+	}
+	var b Budget
+	err = scanBudget(db.QueryRow("SELECT "+budgetColumns+" FROM budgets WHERE id=$1", budgetID), &b)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Budget not found")
+		return
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget")
+		return
+	}
+	if b.Kind == budgetKindIncome {
+		respondWithError(w, http.StatusUnprocessableEntity, "Income budgets are tracked by the income report")
+		return
+	}
+	now := time.Now()
+	start, end, err := budgetPeriod(b, now)
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if v := r.URL.Query().Get("date"); v != "" {
+		date, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid 'date'; use YYYY-MM-DD")
+			return
+		}
+		start, end, _ = budgetPeriod(b, time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, now.Location()))
+	} else if b.Frequency != frequencyCustom {
+		start, end, _ = budgetPeriod(b, start.AddDate(0, 0, -1))
+	}
+
+	report := VarianceReport{BudgetID: b.ID, Name: b.Name, PeriodStart: start, PeriodEnd: end.AddDate(0, 0, -1),
+		Budgeted: b.Amount, Categories: []CategoryVariance{}}
+	// A closed period is measured against what was available when it
+	// closed, carryover included.
+	err = db.QueryRow("SELECT budgeted + carryover FROM budget_periods WHERE budget_id=$1 AND period_start=$2", b.ID, start).
+		Scan(&report.Budgeted)
+	if err != nil && err != sql.ErrNoRows {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve budget history")
+		return
+	}
+
+	// Members' spending counts under the owner's categories the budget maps
+	// theirs onto.
+	ledger, category, allocations := budgetLedgerSQL("$4"), budgetCategorySQL("l", "$4"), "user_id = $1"
+	args := []interface{}{b.UserID, start, end, b.ID}
+	if b.OrganizationID != nil {
+		// Allocations are personal, so organization budgets have none.
+		ledger, category, allocations, args = "organization_id = $1", "category_id", "FALSE", []interface{}{*b.OrganizationID, start, end}
+	}
+	amount := budgetAmountSQL("l", fmt.Sprintf("$%d", len(args)+1), fmt.Sprintf("$%d", len(args)+2))
+	rows, err := db.Query(`
+        SELECT c.id, COALESCE(c.name, 'Uncategorized'), a.allocated, COALESCE(s.spent, 0)
+        FROM (SELECT `+category+` AS category_id, ROUND(SUM(`+amount+`), 2) AS spent FROM transaction_lines l
+              WHERE `+ledger+` AND NOT excluded AND date >= $2 AND date < $3
+              GROUP BY 1) s
+        FULL JOIN (SELECT category_id, SUM(amount) AS allocated FROM category_allocations
+              WHERE `+allocations+` AND month >= $2 AND month < $3
+              GROUP BY category_id) a ON a.category_id = s.category_id
+        LEFT JOIN categories c ON c.id = COALESCE(s.category_id, a.category_id)
+        ORDER BY c.name NULLS LAST`, append(args, budgetCurrencyArgs(b)...)...)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to build variance report")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CategoryVariance
+		var allocated sql.NullFloat64
+		if err := rows.Scan(&c.CategoryID, &c.Category, &allocated, &c.Actual); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan variance row")
+			return
+		}
+		if allocated.Valid {
+			// Allocations are kept in the base currency.
+			budgeted := math.Round(allocated.Float64/budgetRate(b)*100) / 100
+			variance := math.Round((budgeted-c.Actual)*100) / 100
+			c.Budgeted, c.Variance, c.PercentUsed = &budgeted, &variance, percentUsed(budgeted, c.Actual)
+		}
+		report.Actual += c.Actual
+		report.Categories = append(report.Categories, c)
+	}
+	report.Actual = math.Round(report.Actual*100) / 100
+	report.Variance = math.Round((report.Budgeted-report.Actual)*100) / 100
+	report.PercentUsed = percentUsed(report.Budgeted, report.Actual)
+
+	if format == "json" {
+		respondWithJSON(w, http.StatusOK, report)
+		return
+	}
+	filename := "budget-" + strconv.Itoa(b.ID) + "-variance-" + start.Format("2006-01-02") + ".csv"
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(varianceCSVHeader)
+	for _, c := range report.Categories {
+		csvWriter.Write([]string{c.Category, formatOptionalFloat(c.Budgeted), strconv.FormatFloat(c.Actual, 'f', 2, 64),
+			formatOptionalFloat(c.Variance), formatOptionalFloat(c.PercentUsed)})
+	}
+	csvWriter.Write([]string{"Total", strconv.FormatFloat(report.Budgeted, 'f', 2, 64), strconv.FormatFloat(report.Actual, 'f', 2, 64),
+		strconv.FormatFloat(report.Variance, 'f', 2, 64), formatOptionalFloat(report.PercentUsed)})
+	csvWriter.Flush()
+}
@@ -0,0 +1,179 @@
+// views.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// --- MODELS ---
+
+// SavedView is a named set of transaction filters, using the same keys and
+// formats as the GET /transactions/{user_id} query string.
+type SavedView struct {
+	ID      int               `json:"id"`
+	UserID  int               `json:"user_id"`
+	Name    string            `json:"name"`
+	Filters map[string]string `json:"filters"`
+}
+
+// --- HELPER FUNCTIONS ---
+
+// validateViewFilters accepts only the transaction filters, checked the same
+// way a live query would be.
+func validateViewFilters(w http.ResponseWriter, v SavedView) bool {
+	filter := url.Values{}
+	for key, value := range v.Filters {
+		if !bulkFilterKeys[key] {
+			respondWithError(w, http.StatusBadRequest, "Unknown filter '"+key+"'")
+			return false
+		}
+		filter.Set(key, value)
+	}
+	if _, _, err := transactionFilters(filter, v.UserID); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// applySavedView fills query with the filters of the given saved view.
+// Parameters already in the query string take precedence, so a client can
+// narrow a view without editing it.
+func applySavedView(w http.ResponseWriter, query url.Values, viewParam string, userID int) bool {
+	viewID, err := strconv.Atoi(viewParam)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid view ID")
+		return false
+	}
+	var raw []byte
+	err = db.QueryRow("SELECT filters FROM saved_views WHERE id=$1 AND user_id=$2", viewID, userID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "View not found")
+		return false
+	} else if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to load view")
+		return false
+	}
+	var filters map[string]string
+	if err := json.Unmarshal(raw, &filters); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to load view")
+		return false
+	}
+	for key, value := range filters {
+		if !query.Has(key) {
+			query.Set(key, value)
+		}
+	}
+	return true
+}
+
+// --- SAVED VIEW HANDLERS ---
+
+func CreateSavedView(w http.ResponseWriter, r *http.Request) {
+	var v SavedView
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil || strings.TrimSpace(v.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !authorizeBodyOwner(w, r, &v.UserID) || !validateViewFilters(w, v) {
+		return
+	}
+	if v.Filters == nil {
+		v.Filters = map[string]string{}
+	}
+	filters, _ := json.Marshal(v.Filters)
+	err := db.QueryRow("INSERT INTO saved_views (user_id, name, filters) VALUES ($1, $2, $3) RETURNING id", v.UserID, v.Name, filters).Scan(&v.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create view. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, v)
+}
+
+func GetSavedViews(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["user_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if !authorizeOwner(w, r, userID) {
+		return
+	}
+	rows, err := db.Query("SELECT id, user_id, name, filters FROM saved_views WHERE user_id=$1 ORDER BY name", userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve views")
+		return
+	}
+	defer rows.Close()
+	views := []SavedView{}
+	for rows.Next() {
+		var v SavedView
+		var filters []byte
+		if err := rows.Scan(&v.ID, &v.UserID, &v.Name, &filters); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to scan view")
+			return
+		}
+		json.Unmarshal(filters, &v.Filters)
+		views = append(views, v)
+	}
+	respondWithJSON(w, http.StatusOK, views)
+}
+
+func UpdateSavedView(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	viewID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid view ID")
+		return
+	}
+	if !authorizeResource(w, r, "saved_view", viewID) {
+		return
+	}
+	var v SavedView
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil || strings.TrimSpace(v.Name) == "" {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if v.UserID, err = resourceOwner("saved_view", viewID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to verify view owner")
+		return
+	}
+	if !validateViewFilters(w, v) {
+		return
+	}
+	if v.Filters == nil {
+		v.Filters = map[string]string{}
+	}
+	filters, _ := json.Marshal(v.Filters)
+	_, err = db.Exec("UPDATE saved_views SET name=$1, filters=$2 WHERE id=$3", v.Name, filters, viewID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update view. The name may already be in use.")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "View updated successfully"})
+}
+
+func DeleteSavedView(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	viewID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid view ID")
+		return
+	}
+	if !authorizeResource(w, r, "saved_view", viewID) {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM saved_views WHERE id=$1", viewID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete view")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "View deleted successfully"})
+}
@@ -0,0 +1,132 @@
+// webhooks.go
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	webhookTimestampHeader = "X-Budgello-Timestamp"
+	webhookSignatureHeader = "X-Budgello-Signature"
+	maxWebhookBodyBytes    = 1 << 20
+)
+
+// seenSignatures remembers recently accepted signatures so a captured request
+// cannot be replayed inside the timestamp tolerance window.
+var seenSignatures = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+func webhookTolerance() time.Duration {
+	return time.Duration(getEnvInt("WEBHOOK_TOLERANCE_SECONDS", 300)) * time.Second
+}
+
+// signWebhook computes the expected signature: hex(HMAC-SHA256(secret, timestamp + "." + body)).
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// markSignatureSeen records the signature and reports whether it was new.
+func markSignatureSeen(signature string, window time.Duration) bool {
+	seenSignatures.Lock()
+	defer seenSignatures.Unlock()
+	now := time.Now()
+	for sig, at := range seenSignatures.m {
+		if now.Sub(at) > window {
+			delete(seenSignatures.m, sig)
+		}
+	}
+	if _, ok := seenSignatures.m[signature]; ok {
+		return false
+	}
+	seenSignatures.m[signature] = now
+	return true
+}
+
+// --- MIDDLEWARE ---
+
+// verifyWebhookSignature rejects inbound webhooks that are unsigned, signed
+// with the wrong secret, outside the replay window, or already seen.
+func verifyWebhookSignature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := []byte(os.Getenv("WEBHOOK_SECRET"))
+		if len(secret) == 0 {
+			respondWithError(w, http.StatusServiceUnavailable, "Inbound webhooks are not configured")
+			return
+		}
+
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		signature := strings.TrimPrefix(r.Header.Get(webhookSignatureHeader), "sha256=")
+		if timestamp == "" || signature == "" {
+			respondWithError(w, http.StatusUnauthorized, "Missing webhook signature")
+			return
+		}
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid webhook timestamp")
+			return
+		}
+		tolerance := webhookTolerance()
+		if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+			respondWithError(w, http.StatusUnauthorized, "Webhook timestamp outside of tolerance")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+		if err != nil {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Webhook payload too large")
+			return
+		}
+		expected := signWebhook(secret, timestamp, body)
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid webhook signature")
+			return
+		}
+		if !markSignatureSeen(expected, 2*tolerance) {
+			respondWithError(w, http.StatusConflict, "Webhook already processed")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- WEBHOOK HANDLERS ---
+
+// ReceiveInboundWebhook stores a verified payload for the integration named
+// in the path so it can be processed asynchronously.
+func ReceiveInboundWebhook(w http.ResponseWriter, r *http.Request) {
+	source := mux.Vars(r)["source"]
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	var id int
+	err = db.QueryRow("INSERT INTO inbound_webhook_events (source, payload) VALUES ($1, $2) RETURNING id", source, string(body)).Scan(&id)
+	if err != nil {
+		log.Printf("Error storing webhook from %s: %v", source, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to store webhook")
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, map[string]interface{}{"message": "Webhook received", "id": id})
+}
@@ -26,6 +26,7 @@ interface Transaction {
     amount: number;
     date: string; // ISO string
     category_id: number;
+    version: number;
 }
 
 interface Budget {
@@ -34,17 +35,27 @@ interface Budget {
     period: string; // ISO string
     frequency: 'weekly' | 'monthly' | 'yearly';
     amount: number;
+    version: number;
 }
 
 interface AuthContextType {
     user: User | null;
     isAuthenticated: boolean;
     isAdmin: boolean;
-    login: (userData: { user_id: number; role: 'admin' | 'user'; username: string }) => void;
+    login: (userData: LoginResponse & { username: string }) => void;
     logout: () => void;
     loading: boolean;
 }
 
+// The login response. `token` is only present when the server issues JWTs;
+// in session mode the server sets an HttpOnly cookie instead.
+interface LoginResponse {
+    user_id: number;
+    role: 'admin' | 'user';
+    token?: string;
+    expires_at?: string;
+}
+
 // --- AUTHENTICATION CONTEXT ---
 const AuthContext = createContext<AuthContextType | null>(null);
 
@@ -62,6 +73,7 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
             } else {
                 localStorage.removeItem('budgelloUser');
                 localStorage.removeItem('budgelloExpiry');
+                localStorage.removeItem('budgelloToken');
             }
         } catch (error) {
             console.error("Failed to parse user from localStorage", error);
@@ -70,19 +82,29 @@ export const AuthProvider = ({ children }: { children: ReactNode }) => {
         }
     }, []);
 
-    const login = (userData: { user_id: number; role: 'admin' | 'user'; username: string }) => {
+    const login = (userData: LoginResponse & { username: string }) => {
         const thirtyDays = 30 * 24 * 60 * 60 * 1000;
-        const expiry = new Date().getTime() + thirtyDays;
+        // Expire the stored login with the credential the server issued.
+        const expiry = userData.expires_at ? new Date(userData.expires_at).getTime() : new Date().getTime() + thirtyDays;
         
         const userToStore: User = { id: userData.user_id, role: userData.role, username: userData.username };
         localStorage.setItem('budgelloUser', JSON.stringify(userToStore));
         localStorage.setItem('budgelloExpiry', String(expiry));
+        if (userData.token) {
+            localStorage.setItem('budgelloToken', userData.token);
+        }
         setUser(userToStore);
     };
 
-    const logout = () => {
+    const logout = async () => {
+        try {
+            await api.logout();
+        } catch (error) {
+            console.error("Failed to log out on the server", error);
+        }
         localStorage.removeItem('budgelloUser');
         localStorage.removeItem('budgelloExpiry');
+        localStorage.removeItem('budgelloToken');
         setUser(null);
         window.location.hash = '/login';
         window.location.reload();
@@ -116,13 +138,25 @@ export const useAuth = () => {
 const api = {
     async request<T>(endpoint: string, options: RequestInit = {}): Promise<T | null> {
         const url = `${API_BASE_URL}${endpoint}`;
+        // Send the stored JWT when there is one; in session mode the cookie
+        // goes along with `credentials: 'include'`.
+        const token = localStorage.getItem('budgelloToken');
         const headers = {
             'Content-Type': 'application/json',
+            ...(token ? { Authorization: `Bearer ${token}` } : {}),
             ...options.headers,
         };
 
         try {
-            const response = await fetch(url, { ...options, headers });
+            const response = await fetch(url, { ...options, headers, credentials: 'include' });
+            if (response.status === 401 && endpoint !== '/login' && localStorage.getItem('budgelloUser')) {
+                // The stored login was revoked or has expired on the server.
+                localStorage.removeItem('budgelloUser');
+                localStorage.removeItem('budgelloExpiry');
+                localStorage.removeItem('budgelloToken');
+                window.location.hash = '/login';
+                window.location.reload();
+            }
             if (!response.ok) {
                 const errorData = await response.json().catch(() => ({ error: 'An unknown error occurred' }));
                 throw new Error(errorData.error || `HTTP error! status: ${response.status}`);
@@ -137,7 +171,8 @@ const api = {
         }
     },
     // User
-    login: (username: string, password: string) => api.request<{ user_id: number; role: 'admin' | 'user', username: string }>('/login', { method: 'POST', body: JSON.stringify({ username, password }) }),
+    login: (username: string, password: string) => api.request<LoginResponse>('/login', { method: 'POST', body: JSON.stringify({ username, password }) }),
+    logout: () => api.request<{ message: string }>('/logout', { method: 'POST' }),
     getUsers: () => api.request<User[]>('/users'),
     updateUser: (id: number, data: Partial<User>) => api.request<User>(`/users/${id}`, { method: 'PUT', body: JSON.stringify(data) }),
     deleteUser: (id: number) => api.request<null>(`/users/${id}`, { method: 'DELETE' }),
@@ -149,12 +184,12 @@ const api = {
     deleteCategory: (id: number) => api.request<null>(`/categories/${id}`, { method: 'DELETE' }),
     // Transactions
     getTransactions: (userId: number) => api.request<Transaction[]>(`/transactions/${userId}`),
-    createTransaction: (data: Omit<Transaction, 'id'>) => api.request<Transaction>('/transactions', { method: 'POST', body: JSON.stringify(data) }),
+    createTransaction: (data: Omit<Transaction, 'id' | 'version'>) => api.request<Transaction>('/transactions', { method: 'POST', body: JSON.stringify(data) }),
     updateTransaction: (id: number, data: Partial<Transaction>) => api.request<Transaction>(`/transactions/${id}`, { method: 'PUT', body: JSON.stringify(data) }),
     deleteTransaction: (id: number) => api.request<null>(`/transactions/${id}`, { method: 'DELETE' }),
     // Budgets
     getBudgets: (userId: number) => api.request<Budget[]>(`/budgets/${userId}`),
-    createBudget: (data: Omit<Budget, 'id'>) => api.request<Budget>('/budgets', { method: 'POST', body: JSON.stringify(data) }),
+    createBudget: (data: Omit<Budget, 'id' | 'version'>) => api.request<Budget>('/budgets', { method: 'POST', body: JSON.stringify(data) }),
     updateBudget: (id: number, data: Partial<Budget>) => api.request<Budget>(`/budgets/${id}`, { method: 'PUT', body: JSON.stringify(data) }),
     deleteBudget: (id: number) => api.request<null>(`/budgets/${id}`, { method: 'DELETE' }),
 };
@@ -580,7 +615,7 @@ const BudgetPage = () => {
         
         try {
             if (editingBudget) {
-                await api.updateBudget(editingBudget.id, budgetData);
+                await api.updateBudget(editingBudget.id, { ...budgetData, version: editingBudget.version });
             } else {
                 await api.createBudget(budgetData);
             }
@@ -906,7 +941,7 @@ const TransactionsPage = () => {
         setEditingTransaction(null);
     };
 
-    const handleSave = async (formData: Omit<Transaction, 'id' | 'user_id'>) => {
+    const handleSave = async (formData: Omit<Transaction, 'id' | 'user_id' | 'version'>) => {
         if (!user) return;
         const transactionData = {
             ...formData,
@@ -917,7 +952,7 @@ const TransactionsPage = () => {
         };
         try {
             if (editingTransaction) {
-                await api.updateTransaction(editingTransaction.id, transactionData);
+                await api.updateTransaction(editingTransaction.id, { ...transactionData, version: editingTransaction.version });
             } else {
                 await api.createTransaction(transactionData);
             }
@@ -1043,7 +1078,7 @@ const TransactionsPage = () => {
 interface TransactionFormProps {
     isOpen: boolean;
     onClose: () => void;
-    onSave: (data: Omit<Transaction, 'id' | 'user_id'>) => void;
+    onSave: (data: Omit<Transaction, 'id' | 'user_id' | 'version'>) => void;
     transaction: Transaction | null;
     categories: Category[];
 }